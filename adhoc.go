@@ -0,0 +1,166 @@
+package main
+
+// Ad-hoc commands, typed by the requester instead of picked from the templates. The command is kept in the request as
+// a one-shot template that never ends up in the template store, approvers see the exact text and it requires more
+// approvals than a template.
+
+import (
+	"errors"
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const MIN_ADHOC_AUTH uint = 2         // Requester and at least one approver, whatever is configured
+const ADHOC_TITLE_LENGTH int = 50     // Characters of the command shown as title
+const DEFAULT_ADHOC_TIMEOUT int = 300 // Seconds
+
+// Approvals required for an ad-hoc command, including the requester
+func (c *Conf) GetAdHocMinAuth() uint {
+	if c.AdHocMinAuth < MIN_ADHOC_AUTH {
+		return MIN_ADHOC_AUTH
+	}
+	return c.AdHocMinAuth
+}
+
+// Approvals required for an ad-hoc command: the configured number, but always more than any template requires so an
+// arbitrary command never gets through with fewer approvals than a template
+func (s *TemplateStore) AdHocMinAuth(configured uint) uint {
+	minAuth := configured
+	s.templateMux.RLock()
+	defer s.templateMux.RUnlock()
+	for _, template := range s.Templates {
+		if template.Acl != nil && template.Acl.MinAuth >= minAuth {
+			minAuth = template.Acl.MinAuth + 1
+		}
+	}
+	return minAuth
+}
+
+// Title of an ad-hoc command, its first line
+func adHocTitle(command string) string {
+	line := strings.TrimSpace(strings.SplitN(strings.TrimSpace(command), "\n", 2)[0])
+	if len(line) > ADHOC_TITLE_LENGTH {
+		line = line[:ADHOC_TITLE_LENGTH] + "..."
+	}
+	return fmt.Sprintf("Ad-hoc: %s", line)
+}
+
+// One-shot template of an ad-hoc command
+func newAdHocTemplate(command string, reason string, interpreter string, timeout int, executionStrategy *ExecutionStrategy) (*Template, error) {
+	if len(strings.TrimSpace(command)) < 1 {
+		return nil, errors.New("Fill in a command")
+	}
+	if err := validateInterpreter(interpreter); err != nil {
+		return nil, err
+	}
+	if timeout < 1 {
+		timeout = DEFAULT_ADHOC_TIMEOUT
+	}
+	template := newTemplate(adHocTitle(command), reason, command, true, make([]string, 0), make([]string, 0), server.templateStore.AdHocMinAuth(conf.GetAdHocMinAuth()), timeout, executionStrategy)
+	template.Interpreter = interpreter
+	return template, nil
+}
+
+// Request an ad-hoc command
+func PostConsensusAdHoc(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	user := getUser(r)
+
+	// Verify two factor, so that a hacked account can not request anything without getting access to the 2fa device
+	if !validSecondFactor(user, r) {
+		jr.Error("Invalid two factor token")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Reason
+	reason := strings.TrimSpace(r.PostFormValue("reason"))
+	if len(reason) < 4 {
+		jr.Error("Please provide a valid reason")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Timeout, optional
+	timeout := 0
+	if timeoutStr := strings.TrimSpace(r.PostFormValue("timeout")); len(timeoutStr) > 0 {
+		var timeoutE error
+		timeout, timeoutE = strconv.Atoi(timeoutStr)
+		if timeoutE != nil || timeout < 1 {
+			jr.Error("Timeout must be at least 1 second")
+			fmt.Fprint(w, jr.ToString(conf.Debug))
+			return
+		}
+	}
+
+	// Execution strategy, one at a time unless asked otherwise
+	strategyName := r.PostFormValue("executionStrategy")
+	if len(strategyName) < 1 {
+		strategyName = "rolling"
+	}
+	executionStrategy := parseExecutionStrategy(strategyName)
+	if executionStrategy == nil {
+		jr.Error("Execution strategy not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Interpreter
+	interpreter := strings.TrimSpace(r.PostFormValue("interpreter"))
+	if interpreter == DEFAULT_INTERPRETER {
+		interpreter = ""
+	}
+
+	// Command as typed, not trimmed
+	template, err := newAdHocTemplate(r.PostFormValue("command"), reason, interpreter, timeout, executionStrategy)
+	if err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Clients must exist and be able to run the interpreter
+	clientIds := splitFormList(r.PostFormValue("clients"))
+	if len(clientIds) < 1 {
+		jr.Error("Select at least one client")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	for _, clientId := range clientIds {
+		registeredClient := server.GetClient(clientId)
+		if registeredClient == nil {
+			jr.Error(fmt.Sprintf("Client %s not registered", clientId))
+			fmt.Fprint(w, jr.ToString(conf.Debug))
+			return
+		}
+		if !registeredClient.HasInterpreter(template.Interpreter) {
+			jr.Error(fmt.Sprintf("Client %s does not support interpreter %s", clientId, normalizeInterpreter(template.Interpreter)))
+			fmt.Fprint(w, jr.ToString(conf.Debug))
+			return
+		}
+	}
+	if !user.Can(PERM_REQUEST_CREATE, nil, registeredClients(clientIds)) {
+		jr.Error("User not allowed to request commands on these clients")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Create request, it always waits for approval
+	cr := server.consensus.AddAdHocRequest(template, clientIds, user, reason)
+	if cr == nil {
+		jr.Error("Failed to create request")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	cr.AddCallback(consensusRequestFinishedNotification)
+	server.consensus.save()
+
+	jr.Set("id", cr.Id)
+	jr.Set("min_auth", template.Acl.MinAuth)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
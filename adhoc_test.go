@@ -0,0 +1,39 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestAdHocTitle(t *testing.T) {
+	assert.Equal(t, "Ad-hoc: systemctl restart nginx", adHocTitle("  systemctl restart nginx\nsleep 5\n"))
+	assert.Equal(t, "Ad-hoc: "+strings.Repeat("a", ADHOC_TITLE_LENGTH)+"...", adHocTitle(strings.Repeat("a", ADHOC_TITLE_LENGTH+10)))
+}
+
+func TestAdHocMinAuth(t *testing.T) {
+	c := &Conf{}
+	assert.Equal(t, MIN_ADHOC_AUTH, c.GetAdHocMinAuth())
+	c.AdHocMinAuth = 1
+	assert.Equal(t, MIN_ADHOC_AUTH, c.GetAdHocMinAuth())
+	c.AdHocMinAuth = 4
+	assert.Equal(t, uint(4), c.GetAdHocMinAuth())
+}
+
+func TestTemplateStoreAdHocMinAuth(t *testing.T) {
+	s := &TemplateStore{Templates: make(map[string]*Template)}
+	assert.Equal(t, uint(3), s.AdHocMinAuth(3))
+
+	// More than the strictest template
+	s.Templates["a"] = &Template{Id: "a", Acl: &TemplateACL{MinAuth: 2}}
+	s.Templates["b"] = &Template{Id: "b", Acl: &TemplateACL{MinAuth: 4}}
+	assert.Equal(t, uint(5), s.AdHocMinAuth(3))
+	assert.Equal(t, uint(6), s.AdHocMinAuth(6))
+}
+
+func TestAdHocRequestTemplate(t *testing.T) {
+	template := &Template{Id: "adhoc", Command: "uptime", Acl: &TemplateACL{MinAuth: 3}}
+	cr := newConsensusRequest()
+	cr.AdHoc = template
+	assert.Equal(t, template, cr.Template())
+}
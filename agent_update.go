@@ -0,0 +1,551 @@
+package main
+
+// Agent updates through a signed release channel. Releases are signed offline with an RSA key, the server only hosts
+// them and clients verify the signature with the public key before they swap their binary and restart.
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const AGENT_UPDATE_CMD string = "agent_update"         // Type of the command that updates the agent
+const MAX_AGENT_RELEASE_SIZE int64 = 256 * 1024 * 1024 // In bytes
+const AGENT_UPDATE_TIMEOUT int = 600                   // In seconds to download and install a release
+
+var agentVersionRegexp = regexp.MustCompile("^[0-9A-Za-z.+_-]+$") // e.g. 2.1.0 or 2.1.0-rc1
+var agentPlatformRegexp = regexp.MustCompile("^[0-9a-z_]+$")      // e.g. linux or amd64
+
+// Released agent binary for one platform
+type AgentRelease struct {
+	Id        string // Unique id
+	Version   string // e.g. 2.1.0
+	Os        string // GOOS, e.g. linux
+	Arch      string // GOARCH, e.g. amd64
+	Size      int64  // In bytes
+	Sha256    string // Hex encoded checksum of the binary
+	Signature string // Base64 encoded RSA PKCS #1 v1.5 signature of the SHA-256 of the manifest
+	Uploaded  int64  // Unix timestamp
+}
+
+// Releases
+type AgentReleaseStore struct {
+	Releases map[string]*AgentRelease
+	ConfFile string
+	mux      sync.RWMutex
+}
+
+// Read the public key that signs releases, PKIX or PKCS #1 in PEM format
+func loadUpdatePublicKey(file string) (*rsa.PublicKey, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found in %s", file)
+	}
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Public key in %s is not an RSA key", file)
+	}
+	return rsaKey, nil
+}
+
+// What is signed: the id, version and platform of the release with the size and checksum of the binary, one per line.
+// Signing only the binary would let anyone relabel an old release as a newer version.
+func (a *AgentRelease) Manifest() string {
+	return fmt.Sprintf("id=%s\nversion=%s\nos=%s\narch=%s\nsize=%d\nsha256=%s\n", a.Id, a.Version, a.Os, a.Arch, a.Size, a.Sha256)
+}
+
+// Verify the binary against the release and the signature of its manifest
+func (a *AgentRelease) Verify(binary []byte, key *rsa.PublicKey) error {
+	if !agentVersionRegexp.MatchString(a.Id) || !agentVersionRegexp.MatchString(a.Version) || !agentPlatformRegexp.MatchString(a.Os) || !agentPlatformRegexp.MatchString(a.Arch) {
+		return fmt.Errorf("Invalid id, version or platform for release %s", a.Version)
+	}
+	if int64(len(binary)) != a.Size || sha256Hex(binary) != a.Sha256 {
+		return fmt.Errorf("Checksum mismatch for release %s", a.Version)
+	}
+	sig, err := base64.StdEncoding.DecodeString(a.Signature)
+	if err != nil {
+		return fmt.Errorf("Invalid signature encoding for release %s", a.Version)
+	}
+	sum := sha256.Sum256([]byte(a.Manifest()))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+		return fmt.Errorf("Invalid signature for release %s", a.Version)
+	}
+	return nil
+}
+
+// Compare agent versions like 2.1.0 and 2.1.0-rc1, returns -1, 0 or 1. Numeric parts are compared as numbers and a
+// pre-release is older than the release itself.
+func compareAgentVersions(a string, b string) int {
+	aRelease, aPre := splitAgentVersion(a)
+	bRelease, bPre := splitAgentVersion(b)
+	aParts := strings.Split(aRelease, ".")
+	bParts := strings.Split(bRelease, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		x, y := "0", "0"
+		if i < len(aParts) && len(aParts[i]) > 0 {
+			x = aParts[i]
+		}
+		if i < len(bParts) && len(bParts[i]) > 0 {
+			y = bParts[i]
+		}
+		if c := compareAgentVersionPart(x, y); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case aPre == bPre:
+		return 0
+	case len(aPre) < 1:
+		return 1
+	case len(bPre) < 1:
+		return -1
+	}
+	return compareAgentVersionPart(aPre, bPre)
+}
+
+// Release and pre-release of a version, build metadata after a + is ignored
+func splitAgentVersion(version string) (string, string) {
+	version = strings.SplitN(version, "+", 2)[0]
+	parts := strings.SplitN(version, "-", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// Compare numbers as numbers, anything else as text
+func compareAgentVersionPart(a string, b string) int {
+	x, xErr := strconv.Atoi(a)
+	y, yErr := strconv.Atoi(b)
+	if xErr == nil && yErr == nil {
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(a, b)
+}
+
+// Location of the binary on the server, stored by checksum
+func agentReleaseStorePath(checksum string) string {
+	return conf.HomeFile(path.Join("releases", checksum))
+}
+
+// Get item
+func (s *AgentReleaseStore) Get(id string) *AgentRelease {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.Releases[id]
+}
+
+// Find the release of a version for a platform
+func (s *AgentReleaseStore) Find(version string, goos string, goarch string) *AgentRelease {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	for _, a := range s.Releases {
+		if a.Version == version && a.Os == goos && a.Arch == goarch {
+			return a
+		}
+	}
+	return nil
+}
+
+// Add item, replaces the release of the same version and platform
+func (s *AgentReleaseStore) Add(a *AgentRelease) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for id, existing := range s.Releases {
+		if existing.Version == a.Version && existing.Os == a.Os && existing.Arch == a.Arch {
+			delete(s.Releases, id)
+		}
+	}
+	s.Releases[a.Id] = a
+}
+
+// Save to disk
+func (s *AgentReleaseStore) save() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	bytes, je := json.Marshal(s.Releases)
+	if je != nil {
+		log.Printf("Failed to write releases: %s", je)
+		return false
+	}
+	err := ioutil.WriteFile(s.ConfFile, bytes, 0644)
+	if err != nil {
+		log.Printf("Failed to write releases: %s", err)
+		return false
+	}
+	return true
+}
+
+// Load from disk
+func (s *AgentReleaseStore) load() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	bytes, err := ioutil.ReadFile(s.ConfFile)
+	if err == nil {
+		var v map[string]*AgentRelease
+		je := json.Unmarshal(bytes, &v)
+		if je != nil {
+			log.Printf("Invalid releases.json: %s", je)
+			return
+		}
+		s.Releases = v
+	}
+}
+
+// New store
+func newAgentReleaseStore() *AgentReleaseStore {
+	s := &AgentReleaseStore{
+		ConfFile: conf.HomeFile("releases.json"),
+		Releases: make(map[string]*AgentRelease),
+	}
+	s.load()
+	return s
+}
+
+// Version and platform of the agent, as reported in the ping
+func (c *RegisteredClient) SetAgent(version string, goos string, goarch string) {
+	c.mux.Lock()
+	c.Version = version
+	c.Os = goos
+	c.Arch = goarch
+	c.mux.Unlock()
+}
+
+// Replace the binary, written next to it and swapped so it is never half written
+func installAgentBinary(binary []byte, target string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(target), ".indispenso_update_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(binary); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+// Download, verify and install the release of the command on the client, returns the path of the new binary
+func (c *Cmd) updateAgent(client *Client) (string, error) {
+	if c.Release == nil {
+		return "", errors.New("Command has no release")
+	}
+	if c.Release.Os != runtime.GOOS || c.Release.Arch != runtime.GOARCH {
+		return "", fmt.Errorf("Release %s is built for %s/%s, not %s/%s", c.Release.Version, c.Release.Os, c.Release.Arch, runtime.GOOS, runtime.GOARCH)
+	}
+
+	// No downgrades, an older release may have issues that were fixed since. The version and platform are part of the
+	// signed manifest, so a relabelled release fails verification below.
+	if compareAgentVersions(c.Release.Version, VERSION) < 0 {
+		return "", fmt.Errorf("Release %s is older than the running agent %s", c.Release.Version, VERSION)
+	}
+
+	// Without our own key a compromised server could push any binary
+	key, err := loadUpdatePublicKey(conf.GetUpdatePublicKeyFile())
+	if err != nil {
+		return "", fmt.Errorf("Agent updates require the release public key: %s", err)
+	}
+
+	binary, err := client._get(fmt.Sprintf("client/%s/cmd/%s/release", url.QueryEscape(client.Id), url.QueryEscape(c.Id)))
+	if err != nil {
+		return "", fmt.Errorf("Failed to download release %s: %s", c.Release.Version, err)
+	}
+	if err := c.Release.Verify(binary, key); err != nil {
+		return "", err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return "", err
+	}
+	if err := installAgentBinary(binary, exe); err != nil {
+		return "", fmt.Errorf("Failed to install release %s: %s", c.Release.Version, err)
+	}
+	return exe, nil
+}
+
+// Execute an agent update on the client, the agent restarts with the new binary once the server knows the result
+func (c *Cmd) executeAgentUpdate(client *Client) {
+	if client == nil {
+		c.fail("Unable to update the agent without a client")
+		return
+	}
+	exe, err := c.updateAgent(client)
+	if err != nil {
+		c.fail(fmt.Sprintf("%s", err))
+		return
+	}
+
+	log.Printf("Installed agent %s, restarting", c.Release.Version)
+	c.NotifyServer("finished_execution")
+	c.LogOutput(fmt.Sprintf("Updated agent from %s to %s", VERSION, c.Release.Version))
+	c._flushLogs()
+	c.NotifyServer("flushed_logs")
+
+	// Received commands that did not start yet are lost with the restart
+	for _, queued := range client.executor.takeQueued() {
+		queued.fail("Agent restarted for an update before the command started")
+	}
+
+	// Same process id, so service managers keep tracking it
+	if err := syscall.Exec(exe, os.Args, os.Environ()); err != nil {
+		log.Printf("Failed to restart agent, the update is applied at the next start: %s", err)
+	}
+}
+
+// Upload a signed release
+func PostAgentRelease(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	user := getUser(r)
+
+	// Binary
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_AGENT_RELEASE_SIZE+1024*1024)
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		jr.Error(fmt.Sprintf("Failed to read file: %s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	defer file.Close()
+	binary, err := ioutil.ReadAll(file)
+	if err != nil {
+		jr.Error(fmt.Sprintf("Failed to read file: %s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	if int64(len(binary)) > MAX_AGENT_RELEASE_SIZE {
+		jr.Error(fmt.Sprintf("Release can not be larger than %d bytes", MAX_AGENT_RELEASE_SIZE))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Declaration, the signature of the manifest is base64 encoded, e.g. of openssl dgst -sha256 -sign
+	release := &AgentRelease{
+		Id:        strings.TrimSpace(r.PostFormValue("id")),
+		Version:   strings.TrimSpace(r.PostFormValue("version")),
+		Os:        strings.TrimSpace(r.PostFormValue("os")),
+		Arch:      strings.TrimSpace(r.PostFormValue("arch")),
+		Size:      int64(len(binary)),
+		Sha256:    sha256Hex(binary),
+		Signature: strings.Join(strings.Fields(r.PostFormValue("signature")), ""),
+		Uploaded:  time.Now().Unix(),
+	}
+	if !agentVersionRegexp.MatchString(release.Id) || !agentVersionRegexp.MatchString(release.Version) || !agentPlatformRegexp.MatchString(release.Os) || !agentPlatformRegexp.MatchString(release.Arch) {
+		jr.Error("Id, version, os and arch are required")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Refuse what clients would refuse as well
+	key, err := loadUpdatePublicKey(conf.GetUpdatePublicKeyFile())
+	if err != nil {
+		jr.Error(fmt.Sprintf("Release public key not available: %s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	if err := release.Verify(binary, key); err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Store
+	err = os.MkdirAll(conf.HomeFile("releases"), 0700)
+	if err == nil {
+		err = ioutil.WriteFile(agentReleaseStorePath(release.Sha256), binary, 0600)
+	}
+	if err != nil {
+		jr.Error("Failed to store release")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	server.agentReleaseStore.Add(release)
+	res := server.agentReleaseStore.save()
+	audit.Log(user, "Agent update", fmt.Sprintf("Uploaded release %s for %s/%s (sha256 %s)", release.Version, release.Os, release.Arch, release.Sha256))
+
+	jr.Set("release", release)
+	jr.Set("saved", res)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// List releases
+func GetAgentReleases(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+
+	server.agentReleaseStore.mux.RLock()
+	jr.Set("releases", server.agentReleaseStore.Releases)
+	server.agentReleaseStore.mux.RUnlock()
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Roll out a release to clients with an execution strategy
+func PostAgentUpdate(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	user := getUser(r)
+
+	// Replacing the agent everywhere deserves a second factor
+	if !validSecondFactor(user, r) {
+		jr.Error("Invalid two factor token")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	strategy := parseExecutionStrategy(r.PostFormValue("executionStrategy"))
+	if strategy == nil {
+		jr.Error("Strategy not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	version := strings.TrimSpace(r.PostFormValue("version"))
+
+	// Commands for the clients that are not on this version yet
+	rolloutId := uuidStr()
+	cmds := make([]*PendingClientCmd, 0)
+	skipped := make(map[string]string)
+	for _, clientId := range strings.Split(r.PostFormValue("clients"), ",") {
+		clientId = strings.TrimSpace(clientId)
+		if len(clientId) < 1 {
+			continue
+		}
+		client := server.GetClient(clientId)
+		if client == nil {
+			skipped[clientId] = "not registered"
+			continue
+		}
+		client.mux.RLock()
+		clientVersion, goos, goarch := client.Version, client.Os, client.Arch
+		client.mux.RUnlock()
+		if clientVersion == version {
+			skipped[clientId] = "already up to date"
+			continue
+		}
+		if compareAgentVersions(version, clientVersion) < 0 {
+			skipped[clientId] = fmt.Sprintf("runs newer version %s", clientVersion)
+			continue
+		}
+		release := server.agentReleaseStore.Find(version, goos, goarch)
+		if release == nil {
+			skipped[clientId] = fmt.Sprintf("no release for %s/%s", goos, goarch)
+			continue
+		}
+
+		cmd := newCmd(fmt.Sprintf("Update agent to %s", version), AGENT_UPDATE_TIMEOUT)
+		cmd.Type = AGENT_UPDATE_CMD
+		cmd.Release = release
+		cmd.ConsensusRequestId = rolloutId
+		cmd.ClientId = clientId
+		cmd.RequestUserId = user.Id
+		cmds = append(cmds, &PendingClientCmd{
+			Client: client,
+			Cmd:    cmd,
+		})
+	}
+	if len(cmds) < 1 {
+		jr.Set("skipped", skipped)
+		jr.Error("No clients to update")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	audit.Log(user, "Agent update", fmt.Sprintf("Rollout %s of version %s to %d clients", rolloutId, version, len(cmds)))
+	server.executionCoordinator.Add(rolloutId, strategy, cmds)
+	server.executionCoordinator.Get(rolloutId).Next()
+
+	jr.Set("id", rolloutId)
+	jr.Set("clients", len(cmds))
+	jr.Set("skipped", skipped)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Download of a release by the client that executes the update
+func GetClientCmdRelease(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !auth(r) {
+		jr.Error("Client not authorized for GetClientCmdRelease")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Get client
+	registeredClient := server.GetClient(ps.ByName("clientId"))
+	if registeredClient == nil {
+		jr.Error("Client not registered")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Command, must be an update dispatched to this client
+	registeredClient.mux.RLock()
+	cmd := registeredClient.DispatchedCmds[ps.ByName("cmd")]
+	registeredClient.mux.RUnlock()
+	if cmd == nil || cmd.Type != AGENT_UPDATE_CMD || cmd.Release == nil {
+		jr.Error("Command not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	binary, err := ioutil.ReadFile(agentReleaseStorePath(cmd.Release.Sha256))
+	if err != nil {
+		jr.Error("Failed to read release")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(binary)))
+	w.Write(binary)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// Release of the binary signed with the key
+func signedRelease(t *testing.T, key *rsa.PrivateKey, binary []byte) *AgentRelease {
+	release := &AgentRelease{
+		Id:      "2.1.0-linux-amd64",
+		Version: "2.1.0",
+		Os:      "linux",
+		Arch:    "amd64",
+		Size:    int64(len(binary)),
+		Sha256:  sha256Hex(binary),
+	}
+	sum := sha256.Sum256([]byte(release.Manifest()))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	assert.NoError(t, err)
+	release.Signature = base64.StdEncoding.EncodeToString(sig)
+	return release
+}
+
+func TestAgentReleaseVerify(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	binary := []byte("new agent")
+	release := signedRelease(t, key, binary)
+	assert.NoError(t, release.Verify(binary, &key.PublicKey))
+
+	// Tampered binary
+	assert.Error(t, release.Verify([]byte("evil agent"), &key.PublicKey))
+
+	// Signed by another key, with a matching checksum
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	assert.Error(t, release.Verify(binary, &otherKey.PublicKey))
+	other := signedRelease(t, otherKey, binary)
+	assert.Error(t, other.Verify(binary, &key.PublicKey))
+
+	// Relabelled as another version or platform
+	relabelled := *release
+	relabelled.Version = "9.0.0"
+	assert.Error(t, relabelled.Verify(binary, &key.PublicKey))
+	relabelled = *release
+	relabelled.Arch = "arm64"
+	assert.Error(t, relabelled.Verify(binary, &key.PublicKey))
+	relabelled = *release
+	relabelled.Id = "2.1.0"
+	assert.Error(t, relabelled.Verify(binary, &key.PublicKey))
+	relabelled = *release
+	relabelled.Version = "2.1.0\nos=linux"
+	assert.Error(t, relabelled.Verify(binary, &key.PublicKey))
+	assert.Equal(t, "id=2.1.0-linux-amd64\nversion=2.1.0\nos=linux\narch=amd64\nsize=9\nsha256="+sha256Hex(binary)+"\n", release.Manifest())
+
+	// Not base64
+	release.Signature = "!"
+	assert.Error(t, release.Verify(binary, &key.PublicKey))
+}
+
+func TestLoadUpdatePublicKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "indispenso_test_")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	// PKIX, as written by openssl rsa -pubout
+	pkix, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "pkix.pem"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix}), 0644))
+	loaded, err := loadUpdatePublicKey(path.Join(dir, "pkix.pem"))
+	assert.NoError(t, err)
+	assert.Equal(t, key.PublicKey.N, loaded.N)
+
+	// PKCS #1
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "pkcs1.pem"), pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey)}), 0644))
+	loaded, err = loadUpdatePublicKey(path.Join(dir, "pkcs1.pem"))
+	assert.NoError(t, err)
+	assert.Equal(t, key.PublicKey.N, loaded.N)
+
+	// Missing or invalid
+	_, err = loadUpdatePublicKey(path.Join(dir, "missing.pem"))
+	assert.Error(t, err)
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "invalid.pem"), []byte("invalid"), 0644))
+	_, err = loadUpdatePublicKey(path.Join(dir, "invalid.pem"))
+	assert.Error(t, err)
+}
+
+func TestInstallAgentBinary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "indispenso_test_")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	target := path.Join(dir, "indispenso")
+	assert.NoError(t, ioutil.WriteFile(target, []byte("old agent"), 0755))
+
+	assert.NoError(t, installAgentBinary([]byte("new agent"), target))
+	b, _ := ioutil.ReadFile(target)
+	assert.Equal(t, []byte("new agent"), b)
+	info, _ := os.Stat(target)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+
+	// No temporary files left behind
+	entries, _ := ioutil.ReadDir(dir)
+	assert.Len(t, entries, 1)
+}
+
+func TestAgentReleaseStoreFind(t *testing.T) {
+	s := &AgentReleaseStore{Releases: make(map[string]*AgentRelease)}
+	s.Add(&AgentRelease{Id: "a", Version: "2.1.0", Os: "linux", Arch: "amd64"})
+	s.Add(&AgentRelease{Id: "b", Version: "2.1.0", Os: "linux", Arch: "arm64"})
+	assert.Equal(t, "b", s.Find("2.1.0", "linux", "arm64").Id)
+	assert.Nil(t, s.Find("2.1.0", "darwin", "amd64"))
+
+	// Uploading the same version and platform again replaces it
+	s.Add(&AgentRelease{Id: "c", Version: "2.1.0", Os: "linux", Arch: "amd64"})
+	assert.Equal(t, "c", s.Find("2.1.0", "linux", "amd64").Id)
+	assert.Len(t, s.Releases, 2)
+}
+
+func TestCompareAgentVersions(t *testing.T) {
+	assert.Equal(t, 0, compareAgentVersions("2.1.0", "2.1.0"))
+	assert.Equal(t, 0, compareAgentVersions("2.1", "2.1.0"))
+	assert.Equal(t, 0, compareAgentVersions("2.1.0+linux", "2.1.0"))
+	assert.Equal(t, -1, compareAgentVersions("2.0.0", "2.1.0"))
+	assert.Equal(t, 1, compareAgentVersions("2.10.0", "2.9.1"))
+	assert.Equal(t, -1, compareAgentVersions("2.1.0-rc1", "2.1.0"))
+	assert.Equal(t, 1, compareAgentVersions("2.1.0-rc2", "2.1.0-rc1"))
+	assert.Equal(t, 1, compareAgentVersions("2.1.0-rc1", "2.0.9"))
+	assert.Equal(t, 1, compareAgentVersions("2.0.0", ""))
+}
+
+func TestAgentUpdateCmdSignature(t *testing.T) {
+	token := base64.URLEncoding.EncodeToString([]byte("01234567890123456789012345678901"))
+	cmd := newCmd("Update agent to 2.1.0", AGENT_UPDATE_TIMEOUT)
+	cmd.Type = AGENT_UPDATE_CMD
+	cmd.Release = &AgentRelease{Id: "a", Version: "2.1.0", Os: "linux", Arch: "amd64", Sha256: sha256Hex([]byte("new agent"))}
+	signature := cmd.ComputeHmac(token)
+
+	// Swapping the release invalidates the command
+	cmd.Release.Sha256 = sha256Hex([]byte("old agent"))
+	assert.NotEqual(t, signature, cmd.ComputeHmac(token))
+	cmd.Release.Sha256 = sha256Hex([]byte("new agent"))
+	assert.Equal(t, signature, cmd.ComputeHmac(token))
+
+	// As does turning it into a regular command
+	cmd.Type = ""
+	assert.NotEqual(t, signature, cmd.ComputeHmac(token))
+}
+
+func TestParseExecutionStrategy(t *testing.T) {
+	assert.Equal(t, RollingExecutionStrategy, parseExecutionStrategy("rolling").Strategy)
+	assert.Equal(t, ExponentialRollingExecutionStrategy, parseExecutionStrategy("exponential-rolling").Strategy)
+	assert.Nil(t, parseExecutionStrategy("unknown"))
+}
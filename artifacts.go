@@ -0,0 +1,333 @@
+package main
+
+// Artifacts are files produced by a command, uploaded by the client after execution and kept on the server with the command
+
+import (
+	"errors"
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/antonholmquist/jason"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/sys/unix"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const MAX_ARTIFACT_SIZE int64 = 64 * 1024 * 1024   // In bytes, per file
+const MAX_ARTIFACTS_SIZE int64 = 256 * 1024 * 1024 // In bytes, per command
+const MAX_ARTIFACTS = 100                          // Files per command
+
+type CmdArtifact struct {
+	Id       string // Unique id
+	Path     string // Path on the client
+	Size     int64  // In bytes
+	Sha256   string // Hex encoded checksum of the contents
+	Uploaded int64  // Unix timestamp
+}
+
+// Validate an artifact path of a template, glob patterns are allowed in the file name and directories
+func validateArtifactPath(p string) error {
+	if !path.IsAbs(p) || path.Clean(p) != p {
+		return fmt.Errorf("Artifact %s must be a clean absolute path", p)
+	}
+	if _, err := filepath.Match(p, ""); err != nil {
+		return fmt.Errorf("Artifact %s is not a valid pattern", p)
+	}
+	return nil
+}
+
+// Is this path declared as an artifact of the command?
+func (c *Cmd) IsArtifact(p string) bool {
+	if path.Clean(p) != p {
+		return false
+	}
+	for _, pattern := range c.Artifacts {
+		if match, _ := filepath.Match(pattern, p); match {
+			return true
+		}
+	}
+	return false
+}
+
+// Directory on the server with the artifacts of a command
+func artifactDir(cmdId string) string {
+	return conf.HomeFile(path.Join("artifacts", cmdId))
+}
+
+// Read the artifacts from the template form, one path per line
+func artifactsFromForm(r *http.Request) ([]string, error) {
+	list := make([]string, 0)
+	for _, line := range strings.Split(r.PostFormValue("artifacts"), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) < 1 {
+			continue
+		}
+		if err := validateArtifactPath(line); err != nil {
+			return nil, err
+		}
+		list = append(list, line)
+	}
+	return list, nil
+}
+
+// Upload the artifacts of a command from the client, problems are reported in the error output of the command
+func (c *Cmd) uploadArtifacts() {
+	var total int64
+	count := 0
+	for _, pattern := range c.Artifacts {
+		matches, err := filepath.Glob(pattern)
+		if err != nil || len(matches) < 1 {
+			c.LogError(fmt.Sprintf("Artifact %s not found", pattern))
+			continue
+		}
+		for _, p := range matches {
+			// Glob follows symlinked directories, opening the match does not
+			f, info, err := openArtifact(p)
+			if err != nil {
+				c.LogError(fmt.Sprintf("Artifact %s is not a regular file: %s", p, err))
+				continue
+			}
+			if info.Size() > MAX_ARTIFACT_SIZE {
+				f.Close()
+				c.LogError(fmt.Sprintf("Artifact %s is larger than %d bytes", p, MAX_ARTIFACT_SIZE))
+				continue
+			}
+			if total+info.Size() > MAX_ARTIFACTS_SIZE || count >= MAX_ARTIFACTS {
+				f.Close()
+				c.LogError(fmt.Sprintf("Artifact %s exceeds the limit of %d files and %d bytes per command", p, MAX_ARTIFACTS, MAX_ARTIFACTS_SIZE))
+				continue
+			}
+			b, err := ioutil.ReadAll(io.LimitReader(f, info.Size()))
+			f.Close()
+			if err != nil {
+				c.LogError(fmt.Sprintf("Failed to read artifact %s: %s", p, err))
+				continue
+			}
+			if err := c.uploadArtifact(p, b); err != nil {
+				c.LogError(fmt.Sprintf("Failed to upload artifact %s: %s", p, err))
+				continue
+			}
+			total += int64(len(b))
+			count++
+		}
+	}
+}
+
+// Open an artifact without following symlinks. The agent runs as root while the command may run as another user,
+// which could otherwise replace the artifact or one of its directories with a link to e.g. /etc and have any file
+// uploaded. The path is opened one directory at a time from the root, so a link anywhere in it fails to open.
+func openArtifact(p string) (*os.File, os.FileInfo, error) {
+	if !path.IsAbs(p) || path.Clean(p) != p {
+		return nil, nil, errors.New("Not a clean absolute path")
+	}
+	dir, err := unix.Open("/", unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	parts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	for _, part := range parts[:len(parts)-1] {
+		next, err := unix.Openat(dir, part, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		unix.Close(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		dir = next
+	}
+
+	// Non blocking, in case it is a fifo
+	fd, err := unix.Openat(dir, parts[len(parts)-1], unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	unix.Close(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	f := os.NewFile(uintptr(fd), p)
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		f.Close()
+		return nil, nil, errors.New("Not a regular file")
+	}
+	return f, info, nil
+}
+
+// Upload a single artifact
+func (c *Cmd) uploadArtifact(p string, b []byte) error {
+	resp, err := client._req("PUT", fmt.Sprintf("client/%s/cmd/%s/artifact?path=%s", url.QueryEscape(client.Id), url.QueryEscape(c.Id), url.QueryEscape(p)), b)
+	if err != nil {
+		return err
+	}
+	obj, jerr := jason.NewObjectFromBytes(resp)
+	if jerr != nil {
+		return jerr
+	}
+	status, statusE := obj.GetString("status")
+	if statusE != nil || status != "OK" {
+		return errors.New(string(resp))
+	}
+	log.Printf("Uploaded artifact %s of %s", p, c.Id)
+	return nil
+}
+
+// Remove artifacts of commands that are no longer in the history
+func cleanupArtifacts() {
+	maxAge := time.Now().Add(-14 * 24 * time.Hour)
+	entries, err := ioutil.ReadDir(conf.HomeFile("artifacts"))
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && entry.ModTime().Before(maxAge) {
+			if err := os.RemoveAll(path.Join(conf.HomeFile("artifacts"), entry.Name())); err != nil {
+				log.Printf("Failed to remove artifacts of %s: %s", entry.Name(), err)
+			}
+		}
+	}
+}
+
+// Artifact upload from the client
+func PutClientCmdArtifact(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !auth(r) {
+		jr.Error("Client not authorized for PutClientCmdArtifact")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Get client
+	registeredClient := server.GetClient(ps.ByName("clientId"))
+	if registeredClient == nil {
+		jr.Error("Client not registered")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Command
+	cmdId := ps.ByName("cmd")
+	registeredClient.mux.RLock()
+	cmd := registeredClient.DispatchedCmds[cmdId]
+	registeredClient.mux.RUnlock()
+	if cmd == nil {
+		jr.Error("Command not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Only what the template declared
+	p := r.URL.Query().Get("path")
+	if !cmd.IsArtifact(p) {
+		jr.Error("Path is not an artifact of this command")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Read body
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MAX_ARTIFACT_SIZE))
+	if err != nil {
+		jr.Error(fmt.Sprintf("Artifact can not be larger than %d bytes", MAX_ARTIFACT_SIZE))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Limits of the command
+	registeredClient.mux.Lock()
+	var total int64
+	for _, a := range cmd.ArtifactFiles {
+		total += a.Size
+	}
+	if len(cmd.ArtifactFiles) >= MAX_ARTIFACTS || total+int64(len(body)) > MAX_ARTIFACTS_SIZE {
+		registeredClient.mux.Unlock()
+		jr.Error(fmt.Sprintf("Artifacts are limited to %d files and %d bytes per command", MAX_ARTIFACTS, MAX_ARTIFACTS_SIZE))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	artifact := &CmdArtifact{
+		Id:       uuidStr(),
+		Path:     p,
+		Size:     int64(len(body)),
+		Sha256:   sha256Hex(body),
+		Uploaded: time.Now().Unix(),
+	}
+	cmd.ArtifactFiles = append(cmd.ArtifactFiles, artifact)
+	registeredClient.mux.Unlock()
+
+	// Store
+	dir := artifactDir(cmd.Id)
+	err = os.MkdirAll(dir, 0700)
+	if err == nil {
+		err = ioutil.WriteFile(path.Join(dir, artifact.Id), body, 0600)
+	}
+	if err != nil {
+		registeredClient.mux.Lock()
+		for i, a := range cmd.ArtifactFiles {
+			if a.Id == artifact.Id {
+				cmd.ArtifactFiles = append(cmd.ArtifactFiles[:i], cmd.ArtifactFiles[i+1:]...)
+				break
+			}
+		}
+		registeredClient.mux.Unlock()
+		jr.Error("Failed to store artifact")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	jr.Set("artifact", artifact)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Artifact download by a user
+func GetClientCmdArtifact(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("User not authorized for GetClientCmdArtifact")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Get client
+	registeredClient := server.GetClient(ps.ByName("clientId"))
+	if registeredClient == nil {
+		jr.Error("Client not registered")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Command
+	cmdId := ps.ByName("cmd")
+	registeredClient.mux.RLock()
+	cmd := registeredClient.DispatchedCmds[cmdId]
+	var artifact *CmdArtifact
+	if cmd != nil {
+		for _, a := range cmd.ArtifactFiles {
+			if a.Id == ps.ByName("id") {
+				artifact = a
+				break
+			}
+		}
+	}
+	registeredClient.mux.RUnlock()
+	if artifact == nil || !cmd.VisibleTo(getUser(r)) {
+		jr.Error("Artifact not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	b, err := ioutil.ReadFile(path.Join(artifactDir(cmd.Id), artifact.Id))
+	if err != nil {
+		jr.Error("Failed to read artifact")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	audit.Log(getUser(r), "Artifact", fmt.Sprintf("Downloaded %s of %s from %s", artifact.Path, cmd.Id, registeredClient.ClientId))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(artifact.Path)))
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(b)))
+	w.Write(b)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestValidateArtifactPath(t *testing.T) {
+	assert.NoError(t, validateArtifactPath("/tmp/report.tar.gz"))
+	assert.NoError(t, validateArtifactPath("/var/log/app/*.log"))
+	assert.Error(t, validateArtifactPath("report.tar.gz"))
+	assert.Error(t, validateArtifactPath("/var/log/../../etc/shadow"))
+	assert.Error(t, validateArtifactPath("/tmp/[report"))
+}
+
+func TestCmdIsArtifact(t *testing.T) {
+	c := newCmd("echo", 10)
+	c.Artifacts = []string{"/tmp/report.tar.gz", "/var/log/app/*.log"}
+	assert.True(t, c.IsArtifact("/tmp/report.tar.gz"))
+	assert.True(t, c.IsArtifact("/var/log/app/error.log"))
+	assert.False(t, c.IsArtifact("/var/log/app/sub/error.log"))
+	assert.False(t, c.IsArtifact("/var/log/app/../../../etc/shadow"))
+	assert.False(t, c.IsArtifact("/etc/shadow"))
+}
+
+func TestOpenArtifactRejectsSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "indispenso_test_")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	secret := path.Join(dir, "secret")
+	assert.NoError(t, ioutil.WriteFile(secret, []byte("root only"), 0600))
+	report := path.Join(dir, "report.txt")
+	assert.NoError(t, ioutil.WriteFile(report, []byte("report"), 0644))
+	link := path.Join(dir, "link.txt")
+	assert.NoError(t, os.Symlink(secret, link))
+
+	// Regular file
+	f, info, err := openArtifact(report)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(6), info.Size())
+	f.Close()
+
+	// Symlinks and directories are refused
+	_, _, err = openArtifact(link)
+	assert.Error(t, err)
+	_, _, err = openArtifact(dir)
+	assert.Error(t, err)
+
+	// Also in a directory of the path
+	secretDir := path.Join(dir, "secrets")
+	assert.NoError(t, os.Mkdir(secretDir, 0700))
+	assert.NoError(t, ioutil.WriteFile(path.Join(secretDir, "key"), []byte("root only"), 0600))
+	linkDir := path.Join(dir, "logs")
+	assert.NoError(t, os.Symlink(secretDir, linkDir))
+	_, _, err = openArtifact(path.Join(linkDir, "key"))
+	assert.Error(t, err)
+	_, _, err = openArtifact(dir + "/secrets/../report.txt")
+	assert.Error(t, err)
+
+	// Nothing is uploaded, the command reports it instead
+	c := newCmd("echo", 10)
+	c.Artifacts = []string{link, path.Join(linkDir, "*")}
+	c.uploadArtifacts()
+	assert.True(t, strings.Contains(strings.Join(c.BufOutputErr, "\n"), link+" is not a regular file"))
+	assert.True(t, strings.Contains(strings.Join(c.BufOutputErr, "\n"), path.Join(linkDir, "key")+" is not a regular file"))
+}
@@ -20,5 +20,13 @@ go get "github.com/oleiade/reflections"
 go get "github.com/HuKeping/rbtree"
 go get "github.com/bluele/slack"
 go get "gopkg.in/fsnotify.v1"
+go get "gopkg.in/yaml.v2"
+go get "golang.org/x/sys/unix"
+go get "github.com/go-webauthn/webauthn/webauthn"
 go fmt .
-go test && go build .
+# Version of the agent, e.g. VERSION=2.1.0 ./build.sh, defaults to the one in main.go
+LDFLAGS=""
+if [ -n "${VERSION}" ]; then
+	LDFLAGS="-X main.VERSION=${VERSION}"
+fi
+go test && go build -ldflags "${LDFLAGS}" .
@@ -5,14 +5,16 @@ import (
 	"crypto/sha256"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"github.com/antonholmquist/jason"
-	"github.com/julienschmidt/httprouter"
+	"io"
 	"io/ioutil"
 	"math"
 	"math/rand"
 	"net/http"
 	"net/url"
+	"runtime"
 	"strings"
 	"sync"
 	"time"
@@ -26,6 +28,14 @@ type Client struct {
 	AuthToken                 string
 	ConnectedServerInstanceId string // ID of the server to which it is connected
 	mux                       sync.RWMutex
+	stream                    *clientStream    // Control stream, nil if not connected
+	executor                  *Executor        // Received commands waiting for execution
+	received                  map[string]int64 // Ids of received commands with the time of receipt, to ignore redeliveries
+	running                   map[string]*Cmd  // Commands that are executing
+	history                   []*LocalCmdRecord
+	freeze                    *FreezeState // Set while frozen on the host, no commands are executed
+	localToken                string       // Token of the local API
+	lastPing                  time.Time    // Last successful ping to the server
 }
 
 // Start client
@@ -40,15 +50,10 @@ func (s *Client) Start() bool {
 
 	// Is the client enabled?
 	if conf.isClientEnabled() {
-		// Start webserver
-		go func() {
-			log.Printf("Starting client server %s", s.Id)
-			router := httprouter.New()
-			router.GET("/ping", Ping)
-
-			log.Printf("Failed to start client server %s %v", s.Id, http.ListenAndServe(fmt.Sprintf(":%d", conf.ClientPort), router))
-
-		}()
+		// Local API, only reachable from the host
+		if err := s.StartLocalApi(); err != nil {
+			log.Printf("Failed to start local API of %s: %s", s.Id, err)
+		}
 	} else {
 		if conf.Debug {
 			log.Printf("Client server of %s disabled", s.Id)
@@ -74,13 +79,20 @@ func (s *Client) Start() bool {
 		}
 	}()
 
-	// Long poll commands
+	// Report facts, less often than pings as gathering them is more expensive
 	go func() {
-		for {
-			s.PollCmds()
+		c := time.Tick(time.Duration(CLIENT_FACTS_INTERVAL) * time.Second)
+		for _ = range c {
+			s.ReportFacts()
 		}
 	}()
 
+	// Execute received commands
+	s.executor.Start(s.executeCmd)
+
+	// Receive commands over the control stream, or long poll
+	go s.RunControlChannel()
+
 	return true
 }
 
@@ -99,20 +111,20 @@ func (s *Client) PollCmds() {
 				return
 			}
 
-			// List commands
-			cmds, _ := obj.GetObjectArray("cmds")
-			for _, cmd := range cmds {
-				id, _ := cmd.GetString("Id")
-				command, _ := cmd.GetString("Command")
-				signature, _ := cmd.GetString("Signature")
-				templateId, _ := cmd.GetString("TemplateId")
-				timeout, _ := cmd.GetInt64("Timeout")
-				cmd := newCmd(command, int(timeout))
-				cmd.ClientId = client.Id
-				cmd.TemplateId = templateId
-				cmd.Id = id
-				cmd.Signature = signature
-				cmd.Execute(s)
+			// List commands, decoded as a whole as they contain nested structures
+			var payload struct {
+				Cmds   []*Cmd      `json:"cmds"`
+				Inputs []*CmdInput `json:"inputs"`
+			}
+			if je := json.Unmarshal(bytes, &payload); je != nil {
+				log.Printf("Failed to parse commands: %s", je)
+				return
+			}
+			for _, received := range payload.Cmds {
+				s.receiveCmd(received)
+			}
+			for _, in := range payload.Inputs {
+				s.receiveInput(in)
 			}
 		}
 	} else {
@@ -121,6 +133,39 @@ func (s *Client) PollCmds() {
 	}
 }
 
+// Execute a command received from the server
+func (s *Client) executeCmd(received *Cmd) {
+	cmd := newCmd(received.Command, received.Timeout)
+	cmd.ClientId = s.Id
+	cmd.TemplateId = received.TemplateId
+	cmd.Id = received.Id
+	cmd.Signature = received.Signature
+	cmd.Environment = received.Environment
+	cmd.Interpreter = received.Interpreter
+	cmd.Files = received.Files
+	cmd.Artifacts = received.Artifacts
+	cmd.DeliveryDeadline = received.DeliveryDeadline
+	cmd.Type = received.Type
+	cmd.Release = received.Release
+	cmd.Interactive = received.Interactive
+	cmd.KillGracePeriod = received.KillGracePeriod
+
+	// Frozen on the host
+	if f := s.Frozen(); f != nil {
+		s.refuseCmd(cmd, f)
+		return
+	}
+
+	// Can be stopped from the local API, interactive commands receive answers while running
+	cmd.stop = make(chan string, 1)
+	if cmd.Interactive {
+		cmd.input = make(chan *CmdInput, 1)
+	}
+	record := s.trackRunning(cmd)
+	defer s.finishRunning(cmd, record)
+	cmd.Execute(s)
+}
+
 // Auth server, token is used for verifying commands
 // @todo This function needs more logging in failure scenarios
 func (s *Client) AuthServer() {
@@ -163,7 +208,8 @@ func (s *Client) AuthServer() {
 
 // Ping server
 func (s *Client) PingServer() {
-	bytes, e := s._get(fmt.Sprintf("client/%s/ping?tags=%s&hostname=%s", url.QueryEscape(s.Id), url.QueryEscape(strings.Join(conf.GetTags(), ",")), url.QueryEscape(s.Hostname)))
+	queue := s.executor.Status()
+	bytes, e := s._get(fmt.Sprintf("client/%s/ping?tags=%s&hostname=%s&interpreters=%s&version=%s&os=%s&arch=%s&workers=%d&running=%d&queued=%d", url.QueryEscape(s.Id), url.QueryEscape(strings.Join(conf.GetTags(), ",")), url.QueryEscape(s.Hostname), url.QueryEscape(strings.Join(availableInterpreters(), ",")), url.QueryEscape(VERSION), url.QueryEscape(runtime.GOOS), url.QueryEscape(runtime.GOARCH), queue.Workers, queue.Running, queue.Queued))
 	if e == nil {
 		obj, jerr := jason.NewObjectFromBytes(bytes)
 		if jerr == nil {
@@ -176,10 +222,17 @@ func (s *Client) PingServer() {
 				log.Println("Re-authenticate with server")
 				s.AuthServer()
 			} else {
+				s.mux.Lock()
+				s.lastPing = time.Now()
+				s.mux.Unlock()
+
 				// Only log a connect if the instance ID changed
 				if len(s.ConnectedServerInstanceId) == 0 || s.ConnectedServerInstanceId != serverInstanceId {
 					s.ConnectedServerInstanceId = serverInstanceId
 					log.Println(fmt.Sprintf("Client registered with server %s", s.ConnectedServerInstanceId))
+
+					// A new server does not know our facts yet
+					go s.ReportFacts()
 				}
 			}
 		}
@@ -214,11 +267,7 @@ func (s *Client) _req(method string, uri string, data []byte) ([]byte, error) {
 // Generic request method
 func (s *Client) _reqUnsafe(method string, uri string, data []byte) ([]byte, error) {
 	// Transport
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-		}, // Ignore certificate as this is self generated and invalid
-	}
+	tr := newClientTransport()
 	// For some reasons connections were not closed, this helps
 	defer tr.CloseIdleConnections()
 
@@ -227,6 +276,40 @@ func (s *Client) _reqUnsafe(method string, uri string, data []byte) ([]byte, err
 		Transport: tr,
 	}
 
+	// Req
+	var buf *bytes.Buffer
+	if data != nil && len(data) > 0 {
+		buf = bytes.NewBuffer(data)
+	} else {
+		buf = bytes.NewBuffer(make([]byte, 0))
+	}
+	req, reqErr := s._newRequest(method, uri, buf)
+	if reqErr != nil {
+		return nil, reqErr
+	}
+
+	// Log
+	if conf.Debug {
+		log.Printf("%s %s (req bytes %d)", method, req.URL, len(data))
+	}
+
+	// Execute
+	resp, respErr := client.Do(req)
+	if respErr != nil {
+		return nil, respErr
+	}
+
+	// Read body
+	defer resp.Body.Close()
+	body, bodyErr := ioutil.ReadAll(resp.Body)
+	if bodyErr != nil {
+		return nil, bodyErr
+	}
+	return body, nil
+}
+
+// Signed request to the server
+func (s *Client) _newRequest(method string, uri string, body io.Reader) (*http.Request, error) {
 	// Sanitize urls
 	uri = fmt.Sprintf("/%s", strings.TrimLeft(uri, "/"))
 
@@ -238,20 +321,7 @@ func (s *Client) _reqUnsafe(method string, uri string, data []byte) ([]byte, err
 		uri = fmt.Sprintf("%s&_rand=%s", uri, randStr)
 	}
 	url := conf.ServerRequest(uri)
-
-	// Log
-	if conf.Debug {
-		log.Printf("%s %s (req bytes %d)", method, url, len(data))
-	}
-
-	// Req
-	var buf *bytes.Buffer
-	if data != nil && len(data) > 0 {
-		buf = bytes.NewBuffer(data)
-	} else {
-		buf = bytes.NewBuffer(make([]byte, 0))
-	}
-	req, reqErr := http.NewRequest(method, url, buf)
+	req, reqErr := http.NewRequest(method, url, body)
 	if reqErr != nil {
 		return nil, reqErr
 	}
@@ -268,20 +338,17 @@ func (s *Client) _reqUnsafe(method string, uri string, data []byte) ([]byte, err
 	if conf.Debug {
 		log.Println("Sending X-Auth: " + signedToken)
 	}
+	return req, nil
+}
 
-	// Execute
-	resp, respErr := client.Do(req)
-	if respErr != nil {
-		return nil, respErr
-	}
-
-	// Read body
-	defer resp.Body.Close()
-	body, bodyErr := ioutil.ReadAll(resp.Body)
-	if bodyErr != nil {
-		return nil, bodyErr
+// Transport to the server
+func newClientTransport() *http.Transport {
+	return &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		}, // Ignore certificate as this is self generated and invalid
+		ForceAttemptHTTP2: true, // Required for the control stream, a custom TLS config disables it otherwise
 	}
-	return body, nil
 }
 
 // Create new client
@@ -289,5 +356,10 @@ func newClient() *Client {
 	return &Client{
 		Id:       conf.Hostname,
 		Hostname: conf.Hostname,
+		executor: newExecutor(conf.ClientWorkers),
+		received: make(map[string]int64),
+		running:  make(map[string]*Cmd),
+		history:  make([]*LocalCmdRecord, 0),
+		freeze:   loadFreezeState(conf.HomeFile("frozen.json")),
 	}
 }
@@ -11,28 +11,52 @@ import (
 	"io/ioutil"
 	"net/url"
 	"os"
-	"os/exec"
+	"path"
 	"strings"
+	"sync"
 	"time"
 )
 
 // @author Robin Verlangen
 
 type Cmd struct {
-	Command              string   // Commands to execute
-	Pending              bool     // Did we dispatch it to the client?
-	Id                   string   // Unique ID for this command
-	ClientId             string   // Client ID on which the command is executed
-	TemplateId           string   // Reference to the template id
-	ConsensusRequestId   string   // Reference to the request id
-	Signature            string   // makes this only valid from the server to the client based on the preshared token and this is a signature with the command and id
-	Timeout              int      // in seconds
-	State                string   // Textual representation of the current state, e.g. finished, failed, etc.
-	RequestUserId        string   // User ID of the user that initiated this command
-	Created              int64    // Unix timestamp created
-	ExecutionIterationId int      // In which iteration the command was started
-	BufOutput            []string // Standard output
-	BufOutputErr         []string // Error output
+	Command              string                // Commands to execute
+	Pending              bool                  // Did we dispatch it to the client?
+	Id                   string                // Unique ID for this command
+	ClientId             string                // Client ID on which the command is executed
+	TemplateId           string                // Reference to the template id
+	TemplateVersion      int                   // Version of the template that was executed
+	AdHoc                bool                  // Typed by the requester instead of a template, see adhoc.go
+	ConsensusRequestId   string                // Reference to the request id
+	Signature            string                // makes this only valid from the server to the client based on the preshared token and this is a signature with the command and id
+	Timeout              int                   // in seconds
+	State                string                // Textual representation of the current state, e.g. finished, failed, etc.
+	RequestUserId        string                // User ID of the user that initiated this command
+	Created              int64                 // Unix timestamp created
+	ExecutionIterationId int                   // In which iteration the command was started
+	BufOutput            []string              // Standard output
+	BufOutputErr         []string              // Error output
+	Environment          *ExecutionEnvironment // User, group, working directory, environment and limits of the process
+	Interpreter          string                // Interpreter of the command, empty for bash
+	KillGracePeriod      int                   // Seconds between SIGTERM and SIGKILL on timeout
+	ExitCode             int                   // Exit code of the process, -1 if killed by a signal
+	ExitSignal           string                // Signal that ended the process, e.g. SIGKILL
+	TimedOut             bool                  // Was the process terminated because of the timeout?
+	Files                []*TemplateFile       // Files to install before execution
+	Artifacts            []string              // Paths or patterns of files to upload after execution
+	ArtifactFiles        []*CmdArtifact        // Artifacts received by the server
+	DeliveryTimeout      int                   // Seconds the command may wait for an offline client, 0 for the default
+	DeliveryDeadline     int64                 // Unix timestamp after which the command is undeliverable
+	LastSent             int64                 // Unix timestamp of the last delivery attempt
+	Delivered            int64                 // Unix timestamp of the acknowledgement by the client
+	Type                 string                // Empty for a command, agent_update to update the agent, check for check mode
+	Release              *AgentRelease         // Release to install for an agent update
+	Interactive          bool                  // Can ask for input with a prompt line, see prompt.go
+	Prompt               *CmdPrompt            // Question while awaiting input
+	Answers              []*CmdAnswer          // Answers given by users, only on the server
+	stop                 chan string           // Reason to stop the process, from the local API of the client
+	input                chan *CmdInput        // Answers received for an interactive command on the client
+	stateMux             sync.RWMutex          // State and prompt change while other routines read them
 }
 
 // Sign the command on the server
@@ -43,24 +67,36 @@ func (c *Cmd) Sign(client *RegisteredClient) {
 // Set local state
 func (c *Cmd) SetState(state string) {
 	// Old state for change detection
+	c.stateMux.Lock()
 	oldState := c.State
 
 	// Update
 	c.State = state
+	if oldState == "failed_execution" && state == "flushed_logs" {
+		c.State = "failed"
+	}
+	c.stateMux.Unlock()
 
 	// Debug logging
 	if conf.Debug {
-		log.Printf("Cmd %s went from state %s to %s", c.Id, oldState, c.State)
+		log.Printf("Cmd %s went from state %s to %s", c.Id, oldState, state)
 	}
 
 	// Run validation
-	if oldState == "finished_execution" && c.State == "flushed_logs" {
+	if oldState == "finished_execution" && state == "flushed_logs" {
 		c._validate()
-	} else if oldState == "failed_execution" && c.State == "flushed_logs" {
-		c.State = "failed"
+	} else if oldState != state && (state == "undeliverable" || state == "refused") {
+		c._abortRollout()
 	}
 }
 
+// Current state, also while the command is executing
+func (c *Cmd) GetState() string {
+	c.stateMux.RLock()
+	defer c.stateMux.RUnlock()
+	return c.State
+}
+
 // Validate the execution of a command, only on the server
 func (c *Cmd) _validate() {
 	// Only on the server
@@ -68,16 +104,27 @@ func (c *Cmd) _validate() {
 		return
 	}
 
-	// Get template
-	template := server.templateStore.Get(c.TemplateId)
-	if template == nil {
-		log.Printf("Unable to find template %s for validation of cmd %s", c.TemplateId, c.Id)
+	// Get template, commands without one (e.g. agent updates) have no validation rules
+	var rules []*ExecutionValidation
+	if len(c.TemplateId) > 0 {
+		template := server.templateStore.Get(c.TemplateId)
+		if template == nil {
+			log.Printf("Unable to find template %s for validation of cmd %s", c.TemplateId, c.Id)
+			return
+		}
+		rules = template.ValidationRules
+	}
+
+	// Checks only have to finish, the validation rules are about real runs
+	if c.Type == CHECK_CMD {
+		c.SetState("finished")
+		go server.consensus.checkFinished(c.ConsensusRequestId)
 		return
 	}
 
 	// Iterate and run on templates
 	var failedValidation = false
-	for _, v := range template.ValidationRules {
+	for _, v := range rules {
 		// Select stream
 		var stream []string
 		if v.OutputStream == 1 {
@@ -131,10 +178,66 @@ func (c *Cmd) NotifyServer(state string) {
 
 	// Update server state, only if this has a signature, else it is local
 	if len(c.Signature) > 0 {
-		client._req("PUT", fmt.Sprintf("client/%s/cmd/%s/state?state=%s", url.QueryEscape(client.Id), url.QueryEscape(c.Id), url.QueryEscape(state)), nil)
+		// Control stream if connected, request otherwise
+		frame := &StreamFrame{
+			Type:       "state",
+			CmdId:      c.Id,
+			State:      state,
+			ExitCode:   c.ExitCode,
+			ExitSignal: c.ExitSignal,
+			TimedOut:   c.TimedOut,
+		}
+		if state == "awaiting_input" {
+			frame.Prompt = c.awaitingInput()
+		}
+		if client.SendFrame(frame) == nil {
+			return
+		}
+		uri := fmt.Sprintf("client/%s/cmd/%s/state?state=%s&exit_code=%d&exit_signal=%s&timed_out=%t", url.QueryEscape(client.Id), url.QueryEscape(c.Id), url.QueryEscape(state), c.ExitCode, url.QueryEscape(c.ExitSignal), c.TimedOut)
+		if frame.Prompt != nil {
+			promptBytes, _ := json.Marshal(frame.Prompt)
+			uri += "&prompt=" + url.QueryEscape(string(promptBytes))
+		}
+		client._req("PUT", uri, nil)
 	}
 }
 
+// State reported by the client on the server, including the exit details and the prompt while awaiting input
+func (c *Cmd) ReportState(state string, exitCode int, exitSignal string, timedOut bool, prompt *CmdPrompt) {
+	c.ExitCode = exitCode
+	c.ExitSignal = exitSignal
+	c.TimedOut = timedOut
+	if state == "awaiting_input" {
+		c.setPrompt(prompt)
+	} else {
+		c.setPrompt(nil)
+	}
+	c.SetState(state)
+}
+
+// Question the command asks, nil once answered
+func (c *Cmd) setPrompt(prompt *CmdPrompt) {
+	c.stateMux.Lock()
+	c.Prompt = prompt
+	c.stateMux.Unlock()
+}
+
+// Prompt the command is waiting for, nil if it is not awaiting input
+func (c *Cmd) awaitingInput() *CmdPrompt {
+	c.stateMux.RLock()
+	defer c.stateMux.RUnlock()
+	if c.State != "awaiting_input" {
+		return nil
+	}
+	return c.Prompt
+}
+
+// Logs received from the client on the server
+func (c *Cmd) AppendLogs(output []string, errorOutput []string) {
+	c.BufOutput = append(c.BufOutput, output...)
+	c.BufOutputErr = append(c.BufOutputErr, errorOutput...)
+}
+
 // Should we flush the local buffer? After X milliseconds or Y lines
 func (c *Cmd) _checkFlushLogs() {
 	// At least 10 lines
@@ -150,6 +253,19 @@ func (c *Cmd) _flushLogs() {
 		return
 	}
 
+	// Control stream if connected
+	frame := &StreamFrame{
+		Type:   "logs",
+		CmdId:  c.Id,
+		Output: c.BufOutput,
+		Error:  c.BufOutputErr,
+	}
+	if client.SendFrame(frame) == nil {
+		c.BufOutput = make([]string, 0)
+		c.BufOutputErr = make([]string, 0)
+		return
+	}
+
 	// To JSON
 	m := make(map[string][]string)
 	m["output"] = c.BufOutput
@@ -194,15 +310,79 @@ func (c *Cmd) LogError(line string) {
 	c._checkFlushLogs()
 }
 
+// Abort before the process is started, the error is reported in the logs
+func (c *Cmd) fail(msg string) {
+	log.Printf("Failed to execute %s: %s", c.Id, msg)
+	c.NotifyServer("failed_execution")
+	c.LogError(msg)
+	c._flushLogs()
+	c.NotifyServer("flushed_logs")
+}
+
+// Fields covered by the signature of a command. They are signed as one JSON document, so bytes can not be moved from
+// one field into the next without changing the signature.
+type cmdSignedFields struct {
+	Command          string
+	Id               string
+	Timeout          int
+	Environment      *ExecutionEnvironment // Determines who runs the command
+	Interpreter      string
+	KillGracePeriod  int
+	Files            []cmdSignedFile // The client only installs what the server declared
+	Artifacts        []string        // Otherwise the client could be made to upload any file
+	DeliveryDeadline int64
+	Type             string // A check runs with INDISPENSO_DRY_RUN=1
+	Release          *cmdSignedRelease
+	Interactive      bool // Otherwise a command could be made to read from the standard input
+}
+
+type cmdSignedFile struct {
+	Id     string
+	Path   string
+	Mode   uint32
+	Sha256 string
+}
+
+// The release is signed on its own, this binds it to the command
+type cmdSignedRelease struct {
+	Id      string
+	Version string
+	Os      string
+	Arch    string
+	Sha256  string
+}
+
 // Sign the command
 func (c *Cmd) ComputeHmac(token string) string {
 	bytes, be := base64.URLEncoding.DecodeString(token)
 	if be != nil {
 		return ""
 	}
+	fields := &cmdSignedFields{
+		Command:          c.Command,
+		Id:               c.Id,
+		Timeout:          c.Timeout,
+		Environment:      c.Environment,
+		Interpreter:      c.Interpreter,
+		KillGracePeriod:  c.KillGracePeriod,
+		Files:            make([]cmdSignedFile, 0, len(c.Files)),
+		Artifacts:        c.Artifacts,
+		DeliveryDeadline: c.DeliveryDeadline,
+		Type:             c.Type,
+		Interactive:      c.Interactive,
+	}
+	for _, f := range c.Files {
+		fields.Files = append(fields.Files, cmdSignedFile{Id: f.Id, Path: f.Path, Mode: f.Mode, Sha256: f.Sha256})
+	}
+	if c.Release != nil {
+		fields.Release = &cmdSignedRelease{Id: c.Release.Id, Version: c.Release.Version, Os: c.Release.Os, Arch: c.Release.Arch, Sha256: c.Release.Sha256}
+	}
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return ""
+	}
 	mac := hmac.New(sha256.New, bytes)
-	mac.Write([]byte(c.Command))
-	mac.Write([]byte(c.Id))
+	mac.Write(b)
 	sum := mac.Sum(nil)
 	return base64.URLEncoding.EncodeToString(sum)
 }
@@ -237,90 +417,137 @@ func (c *Cmd) Execute(client *Client) {
 		log.Printf("Executing insecure command, unable to validate HMAC of %s", c.Id)
 	}
 
+	// Too late, the server gave up on it
+	if c.DeliveryDeadline > 0 && time.Now().Unix() > c.DeliveryDeadline {
+		log.Printf("Not executing %s, the delivery deadline passed", c.Id)
+		c.NotifyServer("undeliverable")
+		return
+	}
+
 	// Start
 	c.NotifyServer("starting")
 
+	// Agent update instead of a command
+	if c.Type == AGENT_UPDATE_CMD {
+		c.executeAgentUpdate(client)
+		return
+	}
+
+	// Files of the template
+	if len(c.Files) > 0 {
+		if client == nil {
+			c.fail("Unable to download files without a client")
+			return
+		}
+		if err := c.installFiles(client); err != nil {
+			c.fail(fmt.Sprintf("Failed to install files: %s", err))
+			return
+		}
+	}
+
 	// File contents
 	var fileBytes bytes.Buffer
-	fileBytes.WriteString("#!/bin/bash\n")
+	fileBytes.WriteString(interpreterShebang(c.Interpreter) + "\n")
 	fileBytes.WriteString(c.Command)
 
-	// Write tmp file
-	tmpFileName := fmt.Sprintf("/tmp/indispenso_%s", c.Id)
-	ioutil.WriteFile(tmpFileName, fileBytes.Bytes(), 0644)
+	// Private directory (0700) so other local users can not read or replace the script
+	tmpDir, err := ioutil.TempDir("", "indispenso_")
+	if err != nil {
+		c.NotifyServer("failed_execution")
+		log.Printf("Failed to create directory for %s: %s", c.Id, err)
+		return
+	}
+
+	// Remove directory once done
+	defer os.RemoveAll(tmpDir)
 
-	// Remove file once done
-	defer os.Remove(tmpFileName)
+	// Write script
+	tmpFileName := path.Join(tmpDir, fmt.Sprintf("indispenso_%s", c.Id))
+	if err := ioutil.WriteFile(tmpFileName, fileBytes.Bytes(), 0700); err != nil {
+		c.NotifyServer("failed_execution")
+		log.Printf("Failed to write script for %s: %s", c.Id, err)
+		return
+	}
 
 	// Run file
-	cmd := exec.Command("bash", tmpFileName)
+	cmd := interpreterCommand(c.Interpreter, tmpFileName)
+
+	// Own process group, so a timeout can take down all children as well
+	setProcessGroup(cmd)
+
+	// Run as user, working directory, environment and limits
+	if c.Environment != nil {
+		if err := c.Environment.Apply(cmd, tmpDir, tmpFileName); err != nil {
+			c.fail(fmt.Sprintf("Failed to prepare environment: %s", err))
+			return
+		}
+	}
+
+	// Check mode, the command must not change anything
+	if c.Type == CHECK_CMD {
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = append(cmd.Env, DRY_RUN_ENV+"=1")
+	}
+
 	var out bytes.Buffer
 	var outerr bytes.Buffer
 	cmd.Stdout = &out
 	cmd.Stderr = &outerr
 
-	// Consume streams
-	// go func() {
-	// 	p, pe := cmd.StdoutPipe()
-	// 	if pe != nil {
-	// 		log.Printf("Pipe error: %s", pe)
-	// 		return
-	// 	}
-	// 	scanner := bufio.NewScanner(p)
-	// 	for scanner.Scan() {
-	// 		txt := scanner.Text()
-	// 		c.LogOutput(txt)
-	// 		if conf.Debug {
-	// 			log.Println(scanner.Text())
-	// 		}
-	// 	}
-	// 	if err := scanner.Err(); err != nil {
-	// 		fmt.Fprintln(os.Stderr, "reading standard input:", err)
-	// 	}
-	// }()
-	// go func() {
-	// 	p, pe := cmd.StderrPipe()
-	// 	if pe != nil {
-	// 		log.Printf("Pipe error: %s", pe)
-	// 		return
-	// 	}
-	// 	scanner := bufio.NewScanner(p)
-	// 	for scanner.Scan() {
-	// 		txt := scanner.Text()
-	// 		c.LogError(txt)
-	// 		if conf.Debug {
-	// 			log.Println(scanner.Text())
-	// 		}
-	// 	}
-	// 	if err := scanner.Err(); err != nil {
-	// 		fmt.Fprintln(os.Stderr, "reading standard input:", err)
-	// 	}
-	// }()
+	// Answers to prompts go to the standard input, other commands have none. Standard output of interactive commands
+	// is read line by line so prompts are seen while the process runs.
+	var answerer *promptAnswerer
+	var stdout *lineWriter
+	if c.Interactive {
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			c.fail(fmt.Sprintf("Failed to open standard input: %s", err))
+			return
+		}
+		answerer = newPromptAnswerer(c, stdin)
+		stdout = &lineWriter{line: answerer.outputLine}
+		cmd.Stdout = stdout
+	}
 
 	// Start
-	err := cmd.Start()
+	err = cmd.Start()
 	if err != nil {
 		c.NotifyServer("failed_execution")
 		log.Printf("Failed to start command: %s", err)
 		return
 	}
 	c.NotifyServer("started_execution")
+	if answerer != nil {
+		go answerer.run()
+	}
 
-	// Timeout mechanism
+	// Timeout mechanism, the time spent waiting for input counts as well
 	done := make(chan error, 1)
 	go func() {
 		done <- cmd.Wait()
 	}()
 	select {
 	case <-time.After(time.Duration(c.Timeout) * time.Second):
-		if err := cmd.Process.Kill(); err != nil {
-			log.Printf("Failed to kill %s: %s", c.Id, err)
-			return
-		}
-		<-done // allow goroutine to exit
+		// Terminate gracefully, then force
+		answerer.stop()
+		c.TimedOut = true
+		terminateProcessGroup(cmd.Process, time.Duration(c.KillGracePeriod)*time.Second, done)
+		c.ExitCode, c.ExitSignal = processExitStatus(cmd.ProcessState)
+		c.NotifyServer("killed_execution")
+		log.Printf("Process %s killed after timeout (%s)", c.Id, c.ExitSignal)
+	case reason := <-c.stop:
+		// Stopped on the host
+		answerer.stop()
+		terminateProcessGroup(cmd.Process, time.Duration(c.KillGracePeriod)*time.Second, done)
+		c.ExitCode, c.ExitSignal = processExitStatus(cmd.ProcessState)
 		c.NotifyServer("killed_execution")
-		log.Printf("Process %s killed", c.Id)
+		c.LogError(fmt.Sprintf("Stopped on the host: %s", reason))
+		log.Printf("Process %s stopped on the host (%s): %s", c.Id, c.ExitSignal, reason)
 	case err := <-done:
+		answerer.stop()
+		c.ExitCode, c.ExitSignal = processExitStatus(cmd.ProcessState)
 		if err != nil {
 			c.NotifyServer("failed_execution")
 			c.LogError(fmt.Sprintf("%v", err))
@@ -331,13 +558,23 @@ func (c *Cmd) Execute(client *Client) {
 		}
 	}
 
-	// Logs
-	for _, line := range strings.Split(out.String(), "\n") {
-		c.LogOutput(line)
+	// Logs, standard output of interactive commands was logged while running except for the last line without a newline
+	if stdout != nil {
+		stdout.Flush()
+	} else {
+		for _, line := range strings.Split(out.String(), "\n") {
+			c.LogOutput(line)
+		}
 	}
 	for _, line := range strings.Split(outerr.String(), "\n") {
 		c.LogError(line)
 	}
+
+	// Artifacts, also of failed commands as they often help to find out why
+	if len(c.Artifacts) > 0 && len(c.Signature) > 0 {
+		c.uploadArtifacts()
+	}
+
 	// Final flush
 	c._flushLogs()
 	c.NotifyServer("flushed_logs")
@@ -351,13 +588,14 @@ func newCmd(command string, timeout int) *Cmd {
 
 	// Create instance
 	return &Cmd{
-		Id:           uuidStr(),
-		Command:      command,
-		Pending:      true,
-		Timeout:      timeout,
-		State:        "pending",
-		Created:      time.Now().Unix(),
-		BufOutput:    make([]string, 0),
-		BufOutputErr: make([]string, 0),
+		Id:              uuidStr(),
+		Command:         command,
+		Pending:         true,
+		Timeout:         timeout,
+		KillGracePeriod: DEFAULT_KILL_GRACE_PERIOD,
+		State:           "pending",
+		Created:         time.Now().Unix(),
+		BufOutput:       make([]string, 0),
+		BufOutputErr:    make([]string, 0),
 	}
 }
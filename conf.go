@@ -1,38 +1,58 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/cast"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
-	"github.com/fsnotify/fsnotify"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"regexp"
 	"strings"
+	"time"
 )
 
 type Conf struct {
-	Token             string // Pre-shared token in configuration, never via the wire
-	Hostname          string
-	TagsList          []string
-	UseAutoTag        bool
-	ServerEnabled     bool
-	EndpointURI       string
-	ServerPort        int
-	SslCertFile       string // TLS certificate file
-	SslPrivateKeyFile string // Private key file
-	AutoGenerateCert  bool
-	ClientPort        int
-	Debug             bool
-	Home              string //home directory
-	LdapConfigFile    string
-	EnableLdap        bool
+	Token                 string // Pre-shared token in configuration, never via the wire
+	Hostname              string
+	TagsList              []string
+	TagProviders          []string // Executables that print tags, run on each ping
+	TagFiles              []string // Files with tags, read on each ping
+	UseAutoTag            bool
+	ServerEnabled         bool
+	EndpointURI           string
+	ServerPort            int
+	SslCertFile           string // TLS certificate file
+	SslPrivateKeyFile     string // Private key file
+	AutoGenerateCert      bool
+	ClientPort            int
+	ClientSocket          string // Unix socket of the local API, localhost on the client port if empty
+	ClientWorkers         int    // Commands the client runs at the same time
+	Debug                 bool
+	Home                  string //home directory
+	LdapConfigFile        string
+	EnableLdap            bool
+	OidcConfigFile        string              // OpenID Connect configuration, oidc.yaml in the home if empty
+	EnableOidc            bool                // Single sign-on with OpenID Connect
+	WebauthnOrigin        string              // Origin of the console for security keys, scheme, host and port of the EndpointURI if empty
+	UpdatePublicKey       string              // Public key that signs agent releases
+	AdHocMinAuth          uint                // Approvals required for ad-hoc commands, including the requester
+	TemplateChangeMinAuth uint                // Admins that agree on a change of what a template runs, including the one that made it
+	TemplateSyncDir       string              // Directory in the home with template bundles the server keeps the templates in sync with, disabled if empty
+	Roles                 map[string][]string // Roles with their permissions next to the built-in ones, see rbac.go
 
 	//Ldap
 	ldapConfig *LdapConfig
 	ldapViper  *viper.Viper
 
+	//OpenID Connect
+	oidcConfig *OidcConfig
+	oidcViper  *viper.Viper
+
 	//Notifications
 	notificationConfigs []NotificationServiceConfig
 
@@ -45,6 +65,8 @@ func newConfig() *Conf {
 	c := new(Conf)
 	c.ldapViper = viper.New()
 	c.ldapConfig = &LdapConfig{}
+	c.oidcViper = viper.New()
+	c.oidcConfig = &OidcConfig{}
 	c.notificationConfigs = []NotificationServiceConfig{}
 
 	viper.SetConfigName("indispenso")
@@ -54,6 +76,8 @@ func newConfig() *Conf {
 	viper.SetDefault("Token", "")
 	viper.SetDefault("Hostname", getDefaultHostName())
 	viper.SetDefault("UseAutoTag", true)
+	viper.SetDefault("TagProviders", []string{})
+	viper.SetDefault("TagFiles", []string{})
 	viper.SetDefault("ServerEnabled", false)
 	viper.SetDefault("Home", defaultHomePath)
 	viper.SetDefault("Debug", false)
@@ -63,8 +87,18 @@ func newConfig() *Conf {
 	viper.SetDefault("SslPrivateKeyFile", "key.pem")
 	viper.SetDefault("AutoGenerateCert", true)
 	viper.SetDefault("ClientPort", 898)
+	viper.SetDefault("ClientSocket", "")
+	viper.SetDefault("ClientWorkers", 4)
 	viper.SetDefault("EnableLdap", false)
 	viper.SetDefault("LdapConfigFile", "")
+	viper.SetDefault("EnableOidc", false)
+	viper.SetDefault("OidcConfigFile", "")
+	viper.SetDefault("WebauthnOrigin", "")
+	viper.SetDefault("UpdatePublicKey", "update.pem")
+	viper.SetDefault("AdHocMinAuth", 3)
+	viper.SetDefault("TemplateChangeMinAuth", 1)
+	viper.SetDefault("TemplateSyncDir", "")
+	viper.SetDefault("Roles", map[string][]string{})
 
 	//Flags
 	c.confFlags = pflag.NewFlagSet(os.Args[0], pflag.ExitOnError)
@@ -78,6 +112,11 @@ func newConfig() *Conf {
 	c.confFlags.StringP("hostname", "i", getDefaultHostName(), "Hostname that is use to identify itself")
 	c.confFlags.BoolP("enableLdap", "l", false, "Enable LDAP authentication")
 	c.confFlags.BoolP("help", "h", false, "Print help message")
+	c.confFlags.String("exportTemplates", "", "Export the templates to this .yaml or .json file and exit")
+	c.confFlags.String("importTemplates", "", "Import the templates from this .yaml or .json file and exit, the server must not be running")
+	c.confFlags.String("importMatch", "id", "Match imported templates to existing ones by id or title")
+	c.confFlags.String("importOnConflict", "overwrite", "When an imported template differs from the existing one: overwrite, skip or fail")
+	c.confFlags.Bool("importDryRun", false, "Only show what the import would change")
 
 	c.confFlags.Parse(os.Args[1:])
 	if len(*configFile) > 2 {
@@ -96,6 +135,7 @@ func newConfig() *Conf {
 
 	c.setupHome(nil, viper.GetString("Home"))
 	c.setupHome(c.ldapViper, viper.GetString("Home"))
+	c.setupHome(c.oidcViper, viper.GetString("Home"))
 
 	c.SetupNotificationConfig("slack", &SlackNotifyConfig{})
 	c.Update()
@@ -157,6 +197,11 @@ func (c *Conf) Update() {
 		c.ldapViper.ReadInConfig()
 		c.ldapViper.Unmarshal(c.ldapConfig)
 	}
+	if c.EnableOidc {
+		c.setupOidcViper()
+		c.oidcViper.ReadInConfig()
+		c.oidcViper.Unmarshal(c.oidcConfig)
+	}
 
 	c.AutoRepair()
 	if c.Debug {
@@ -170,6 +215,12 @@ func (c *Conf) setupLdapViper() {
 	c.setupHome(c.ldapViper, c.Home)
 }
 
+func (c *Conf) setupOidcViper() {
+	c.oidcViper.SetConfigFile(c.OidcConfigFile)
+	c.oidcViper.SetConfigName("oidc")
+	c.setupHome(c.oidcViper, c.Home)
+}
+
 func UpdateLegacyString(from string, to string) {
 	val := viper.GetString(from)
 	if val == "" {
@@ -237,6 +288,10 @@ func (c *Conf) GetSslCertFile() string {
 	return c.HomeFile(c.SslCertFile)
 }
 
+func (c *Conf) GetUpdatePublicKeyFile() string {
+	return c.HomeFile(c.UpdatePublicKey)
+}
+
 func (c *Conf) ConfFile() string {
 	return viper.ConfigFileUsed()
 }
@@ -259,6 +314,14 @@ func (c *Conf) HomeFile(fileName string) string {
 	return fmt.Sprintf("%s/%s", c.GetHome(), fileName)
 }
 
+// Origin the console is served from, security keys are bound to its host
+func (c *Conf) GetWebauthnOrigin() string {
+	if len(strings.TrimSpace(c.WebauthnOrigin)) > 0 {
+		return c.WebauthnOrigin
+	}
+	return c.EndpointURI
+}
+
 func (c *Conf) ServerRequest(path string) string {
 	return fmt.Sprintf("%s/%s", strings.TrimRight(c.EndpointURI, "/"), strings.TrimLeft(path, "/"))
 }
@@ -274,6 +337,10 @@ func (c *Conf) Validate() error {
 		return errors.New(fmt.Sprintf("Home directory doesn't exists: %s", c.GetHome()))
 	}
 
+	if err := validateRoles(c.Roles); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -289,7 +356,76 @@ func (c *Conf) GetTags() []string {
 		tagsList = append(tagsList, autoTags...)
 	}
 
-	return tagsList
+	tagsList = append(tagsList, c.tagFileDiscovery()...)
+	tagsList = append(tagsList, c.tagProviderDiscovery()...)
+
+	return uniqueTags(tagsList)
+}
+
+// Tags from files, e.g. /etc/role
+func (c *Conf) tagFileDiscovery() []string {
+	ret := make([]string, 0)
+	for _, file := range c.TagFiles {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Printf("Failed to read tags from %s: %s", file, err)
+			continue
+		}
+		ret = append(ret, parseTags(string(b), file)...)
+	}
+	return ret
+}
+
+// Tags printed by executables, e.g. a CMDB lookup
+func (c *Conf) tagProviderDiscovery() []string {
+	ret := make([]string, 0)
+	for _, provider := range c.TagProviders {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(TAG_PROVIDER_TIMEOUT)*time.Second)
+		out, err := exec.CommandContext(ctx, provider).Output()
+		cancel()
+		if err != nil {
+			log.Printf("Failed to get tags from %s: %s", provider, err)
+			continue
+		}
+		ret = append(ret, parseTags(string(out), provider)...)
+	}
+	return ret
+}
+
+// Parse tags separated by whitespace or commas, lines starting with # are comments
+func parseTags(s string, source string) []string {
+	ret := make([]string, 0)
+	for _, line := range strings.Split(s, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		tokens := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t' || r == '\r'
+		})
+		for _, token := range tokens {
+			tag := cleanTag(token)
+			if len(tag) < 1 {
+				log.Printf("Ignoring invalid tag %s from %s", token, source)
+				continue
+			}
+			ret = append(ret, tag)
+		}
+	}
+	return ret
+}
+
+// Remove duplicate tags, keeps the order
+func uniqueTags(in []string) []string {
+	seen := make(map[string]bool)
+	ret := make([]string, 0, len(in))
+	for _, tag := range in {
+		if seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		ret = append(ret, tag)
+	}
+	return ret
 }
 
 // Auto tag
@@ -319,12 +455,18 @@ func (c *Conf) hostTagDiscovery() []string {
 	return ret
 }
 
-// Clean tag
+// Clean tag, either a label or a key=value pair
 func cleanTag(in string) string {
 	tagRegexp, _ := regexp.Compile("^[[:alnum:]-]+$")
+	valueRegexp, _ := regexp.Compile("^[[:alnum:]._-]+$")
 	cleanTag := strings.ToLower(strings.TrimSpace(in))
-	// Must be alphanumeric
-	if !tagRegexp.MatchString(cleanTag) {
+	parts := strings.SplitN(cleanTag, "=", 2)
+	// Key must be alphanumeric
+	if !tagRegexp.MatchString(parts[0]) {
+		return ""
+	}
+	// Value may also contain dots and underscores, e.g. version=1.2
+	if len(parts) == 2 && !valueRegexp.MatchString(parts[1]) {
 		return ""
 	}
 	return cleanTag
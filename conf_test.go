@@ -5,7 +5,9 @@ import (
 	"github.com/spf13/cast"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
 	"os"
+	"path"
 	"testing"
 )
 
@@ -124,6 +126,38 @@ func TestInvalidTagClean(t *testing.T) {
 	assert.Empty(t, cleanTag("!@test^&"))
 }
 
+func TestKeyValueTagClean(t *testing.T) {
+	assert.Equal(t, "dc=ams", cleanTag(" DC=ams "))
+	assert.Equal(t, "version=1.2_3", cleanTag("version=1.2_3"))
+	assert.Empty(t, cleanTag("role="))
+	assert.Empty(t, cleanTag("=ams"))
+	assert.Empty(t, cleanTag("dc=ams=1"))
+	assert.Empty(t, cleanTag("dc=a,b"))
+}
+
+func TestParseTags(t *testing.T) {
+	tags := parseTags("# Comment\nweb, dc=ams\tdb\n\n!invalid\n", "test")
+	assert.Equal(t, []string{"web", "dc=ams", "db"}, tags)
+}
+
+func TestTagsFromFilesAndProviders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "indispenso_test_")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "role"), []byte("web\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "cmdb.sh"), []byte("#!/bin/sh\necho dc=ams web\n"), 0755))
+
+	c := newConfig()
+	c.Hostname = "localtest"
+	c.TagsList = []string{"test1"}
+	c.TagFiles = []string{path.Join(dir, "role"), path.Join(dir, "missing")}
+	c.TagProviders = []string{path.Join(dir, "cmdb.sh")}
+
+	tags := c.GetTags()
+	assert.Equal(t, []string{"test1", "localtest", "web", "dc=ams"}, tags)
+}
+
 func TestServerRequest(t *testing.T) {
 	c := &Conf{EndpointURI: "localhost:1000"}
 
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/nu7hatch/gouuid"
 	"io/ioutil"
+	"strings"
 	"sync"
 	"time"
 )
@@ -19,19 +20,24 @@ type Consensus struct {
 }
 
 type ConsensusRequest struct {
-	Id             string
-	TemplateId     string
-	ClientIds      []string
-	RequestUserId  string
-	Reason         string
-	ApproveUserIds map[string]bool
-	executeMux     sync.RWMutex
-	Executed       bool
-	CreateTime     int64                     // Unix TS for creation of consensus request
-	StartTime      int64                     // Unix TS for start of command execution
-	CompleteTime   int64                     // Unix TS for completion of command exectuion
-	Callbacks      []func(*ConsensusRequest) `json:"-"` // Will be called on completions
-	callbacksMux   sync.RWMutex
+	Id              string
+	TemplateId      string
+	AdHoc           *Template // One-shot template of an ad-hoc command, instead of the template id
+	TemplateVersion int       // Version of the template that was requested and approved
+	ClientIds       []string
+	Plan            *ConsensusPlan  // What will run where, approvers vote on this
+	Check           *ConsensusCheck // Last run of the template in check mode, see consensus_check.go
+	checkMux        sync.RWMutex
+	RequestUserId   string
+	Reason          string
+	ApproveUserIds  map[string]bool
+	executeMux      sync.RWMutex
+	Executed        bool
+	CreateTime      int64                     // Unix TS for creation of consensus request
+	StartTime       int64                     // Unix TS for start of command execution
+	CompleteTime    int64                     // Unix TS for completion of command exectuion
+	Callbacks       []func(*ConsensusRequest) `json:"-"` // Will be called on completions
+	callbacksMux    sync.RWMutex
 }
 
 func (c *Consensus) Get(id string) *ConsensusRequest {
@@ -69,6 +75,9 @@ func (c *ConsensusRequest) Cancel(user *User) bool {
 	return c.Delete()
 }
 func (c *ConsensusRequest) Template() *Template {
+	if c.AdHoc != nil {
+		return c.AdHoc
+	}
 	server.templateStore.templateMux.RLock()
 	template := server.templateStore.Templates[c.TemplateId]
 	server.templateStore.templateMux.RUnlock()
@@ -127,6 +136,18 @@ func (c *ConsensusRequest) check() bool {
 		return false
 	}
 
+	// Approvals are for the version that was requested
+	if c.AdHoc == nil && c.TemplateVersion > 0 && template.Version != c.TemplateVersion {
+		log.Printf("Template %s changed from version %d to %d since request %s, not executing", c.TemplateId, c.TemplateVersion, template.Version, c.Id)
+		return false
+	}
+
+	// Templates can require a passed check first
+	if c.awaitsCheck() {
+		log.Printf("Check of request %s has not passed, not executing", c.Id)
+		return false
+	}
+
 	// Did we meet the auth?
 	minAuth := template.Acl.MinAuth
 	voteCount := 1 // Initial vote by the requester
@@ -153,6 +174,9 @@ func (c *ConsensusRequest) Approve(user *User) bool {
 	if c.ApproveUserIds[user.Id] {
 		return false
 	}
+	if c.awaitsCheck() {
+		return false
+	}
 	c.ApproveUserIds[user.Id] = true
 
 	audit.Log(user, "Consensus", fmt.Sprintf("Approve %s", c.Id))
@@ -214,8 +238,8 @@ func (c *Consensus) load() {
 
 func (c *Consensus) AddRequest(templateId string, clientIds []string, user *User, reason string) *ConsensusRequest {
 	// Double check permissions
-	if !user.HasRole("requester") {
-		log.Printf("User %s (%s) does not have requester permissions", user.Username, user.Id)
+	if !user.HasPermission(PERM_REQUEST_CREATE) {
+		log.Printf("User %s (%s) does not have permission to request", user.Username, user.Id)
 		return nil
 	}
 
@@ -223,19 +247,59 @@ func (c *Consensus) AddRequest(templateId string, clientIds []string, user *User
 	cr := newConsensusRequest()
 	cr.TemplateId = templateId
 	cr.ClientIds = clientIds
+	if template := server.templateStore.Get(templateId); template != nil {
+		cr.TemplateVersion = template.Version
+		cr.Plan = newConsensusPlan(template, clientIds, server.GetClient)
+	}
 	cr.RequestUserId = user.Id
 	cr.Reason = reason
 
 	message := fmt.Sprintf("Request %s, reason: %s", cr.Id, cr.Reason)
+	if cr.Plan != nil {
+		message = fmt.Sprintf("%s, plan: %s", message, cr.Plan)
+	}
 	audit.Log(user, "Consensus", message)
+	c.add(cr, message)
+
+	// Required checks start right away
+	if template := cr.Template(); template != nil && template.RequireCheck {
+		if err := cr.runCheck(user); err != nil {
+			log.Printf("Failed to start the check of request %s: %s", cr.Id, err)
+		}
+	}
+	return cr
+}
+
+// Request to execute a command that is not a template
+func (c *Consensus) AddAdHocRequest(template *Template, clientIds []string, user *User, reason string) *ConsensusRequest {
+	// Double check permissions
+	if !user.HasPermission(PERM_REQUEST_CREATE) {
+		log.Printf("User %s (%s) does not have permission to request", user.Username, user.Id)
+		return nil
+	}
+
+	// Create request
+	cr := newConsensusRequest()
+	cr.AdHoc = template
+	cr.ClientIds = clientIds
+	cr.Plan = newConsensusPlan(template, clientIds, server.GetClient)
+	cr.RequestUserId = user.Id
+	cr.Reason = reason
+
+	// The exact command, as it is not in any template
+	audit.Log(user, "Consensus", fmt.Sprintf("Ad-hoc request %s on %s, reason: %s, command: %s", cr.Id, strings.Join(clientIds, ", "), cr.Reason, template.Command))
+	c.add(cr, fmt.Sprintf("Ad-hoc request %s needs %d approvals, reason: %s, plan: %s", cr.Id, template.Acl.MinAuth-1, cr.Reason, cr.Plan))
+	return cr
+}
+
+// Add a pending request and notify the approvers
+func (c *Consensus) add(cr *ConsensusRequest, message string) {
 
 	c.pendingMux.Lock()
 	c.Pending[cr.Id] = cr
 	c.pendingMux.Unlock()
 
 	server.notifications.Notify(&Message{Type: NEW_CONSENSUS, Content: message, Url: conf.ServerRequest("/console/#!pending")})
-
-	return cr
 }
 
 func newConsensus() *Consensus {
@@ -0,0 +1,211 @@
+package main
+
+// Check mode of templates. Before a request is approved its template can run in check mode on the planned clients:
+// the check command of the template, or the command itself with INDISPENSO_DRY_RUN=1 when it supports that. Checks
+// must not change anything, they show in the history as checks and do not count as a run of the request. Templates
+// can require a passed check before requests are approved and executed.
+
+import (
+	"errors"
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const CHECK_CMD string = "check"                // Type of a command that runs a template in check mode
+const DRY_RUN_ENV string = "INDISPENSO_DRY_RUN" // Set to 1 for commands in check mode
+
+const CHECK_NOT_RUN string = ""        // No check, or one of an older version of the template
+const CHECK_RUNNING string = "running" // Not finished on all clients yet
+const CHECK_PASSED string = "passed"   // Finished on all clients
+const CHECK_FAILED string = "failed"   // Failed, not delivered or missing on at least one client
+
+type ConsensusCheck struct {
+	ClientIds       []string          // Clients the check runs on
+	CmdIds          map[string]string // Command per client
+	TemplateVersion int               // Version of the template that was checked
+	UserId          string            // User that started the check
+	Started         int64             // Unix TS
+}
+
+// Does the template have a check mode?
+func (t *Template) HasCheck() bool {
+	return len(t.CheckCommand) > 0 || t.DryRun
+}
+
+// Command that runs in check mode
+func (t *Template) checkCommand() string {
+	if len(t.CheckCommand) > 0 {
+		return t.CheckCommand
+	}
+	return t.Command
+}
+
+// Run the template of the request in check mode on the planned clients, replaces the previous check
+func (c *ConsensusRequest) runCheck(user *User) error {
+	if c.AdHoc != nil {
+		return errors.New("Ad-hoc commands have no check mode")
+	}
+	template := c.Template()
+	if template == nil {
+		return errors.New("Template not found")
+	}
+	if !template.HasCheck() {
+		return errors.New("Template has no check mode")
+	}
+	if c.Executed {
+		return errors.New("Request has been executed already")
+	}
+	if c.TemplateVersion > 0 && template.Version != c.TemplateVersion {
+		return fmt.Errorf("Template changed from version %d to %d since the request", c.TemplateVersion, template.Version)
+	}
+
+	// Same clients as the request
+	clientIds := c.ClientIds
+	if c.Plan != nil {
+		clientIds = c.Plan.Clients
+	}
+	check := &ConsensusCheck{
+		ClientIds:       clientIds,
+		CmdIds:          make(map[string]string),
+		TemplateVersion: template.Version,
+		UserId:          user.Id,
+		Started:         time.Now().Unix(),
+	}
+	clientCmds := make([]*PendingClientCmd, 0)
+	for _, clientId := range clientIds {
+		// Clients that are gone fail the check as they have no command
+		client := server.GetClient(clientId)
+		if client == nil {
+			continue
+		}
+		cmd := c.newClientCmd(template, client)
+		cmd.Type = CHECK_CMD
+		cmd.Command = template.checkCommand()
+		cmd.RequestUserId = user.Id
+		cmd.Interactive = false
+		cmd.Artifacts = make([]string, 0)
+		check.CmdIds[clientId] = cmd.Id
+		clientCmds = append(clientCmds, &PendingClientCmd{Client: client, Cmd: cmd})
+	}
+
+	// Known before the first command finishes
+	c.checkMux.Lock()
+	c.Check = check
+	c.checkMux.Unlock()
+
+	// All at once, nothing changes
+	audit.Log(user, "Consensus", fmt.Sprintf("Check %s on %s", c.Id, strings.Join(clientIds, ", ")))
+	for _, clientCmd := range clientCmds {
+		clientCmd.Client.Submit(clientCmd.Cmd)
+	}
+	return nil
+}
+
+// State of the last check, see checkState
+func (c *ConsensusRequest) checkStatus() string {
+	c.checkMux.RLock()
+	check := c.Check
+	c.checkMux.RUnlock()
+	if check == nil {
+		return CHECK_NOT_RUN
+	}
+
+	// Only valid for the version it checked
+	if template := c.Template(); template == nil || template.Version != check.TemplateVersion {
+		return CHECK_NOT_RUN
+	}
+
+	cmdStates := make(map[string]string)
+	for clientId, cmdId := range check.CmdIds {
+		client := server.GetClient(clientId)
+		if client == nil {
+			continue
+		}
+		client.mux.RLock()
+		if cmd := client.DispatchedCmds[cmdId]; cmd != nil {
+			cmdStates[clientId] = cmd.State
+		}
+		client.mux.RUnlock()
+	}
+	return checkState(check.ClientIds, cmdStates)
+}
+
+// Does the request wait for a check to pass before it can be approved and executed?
+func (c *ConsensusRequest) awaitsCheck() bool {
+	template := c.Template()
+	return template != nil && c.AdHoc == nil && template.RequireCheck && c.checkStatus() != CHECK_PASSED
+}
+
+// State of a check from the states of its commands per client
+func checkState(clientIds []string, cmdStates map[string]string) string {
+	state := CHECK_PASSED
+	for _, clientId := range clientIds {
+		cmdState, found := cmdStates[clientId]
+		if !found {
+			return CHECK_FAILED
+		}
+		switch cmdState {
+		case "finished":
+		case "pending", "queued", "validating", "starting", "started_execution", "awaiting_input", "finished_execution":
+			state = CHECK_RUNNING
+		default:
+			return CHECK_FAILED
+		}
+	}
+	return state
+}
+
+// A check command finished, requests that waited for the check can run now
+func (c *Consensus) checkFinished(requestId string) {
+	cr := c.Get(requestId)
+	if cr == nil || cr.checkStatus() != CHECK_PASSED {
+		return
+	}
+	message := fmt.Sprintf("Check of request %s passed", cr.Id)
+	audit.Log(nil, "Consensus", message)
+	server.notifications.Notify(&Message{Type: NEW_CONSENSUS, Content: message, Url: conf.ServerRequest("/console/#!pending")})
+	if cr.check() {
+		c.save()
+	}
+}
+
+// State of the checks of the requests, by request id
+func checkStates(requests []*ConsensusRequest) map[string]string {
+	states := make(map[string]string)
+	for _, req := range requests {
+		states[req.Id] = req.checkStatus()
+	}
+	return states
+}
+
+// (Re)run the check of a request
+func PostConsensusCheck(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	user := getUser(r)
+
+	req := server.consensus.Get(strings.TrimSpace(r.PostFormValue("id")))
+	if req == nil || !req.VisibleTo(user) {
+		jr.Error("Request not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	clients := req.clients()
+	if req.RequestUserId != user.Id && !user.Can(PERM_REQUEST_APPROVE, req.Template(), clients) && !user.Can(PERM_REQUEST_MANAGE, req.Template(), clients) {
+		jr.Error("User not allowed to check this request")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	if err := req.runCheck(user); err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	server.consensus.save()
+
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCheckState(t *testing.T) {
+	clientIds := []string{"web01", "web02"}
+	assert.Equal(t, CHECK_PASSED, checkState(clientIds, map[string]string{"web01": "finished", "web02": "finished"}))
+	assert.Equal(t, CHECK_RUNNING, checkState(clientIds, map[string]string{"web01": "finished", "web02": "started_execution"}))
+	assert.Equal(t, CHECK_FAILED, checkState(clientIds, map[string]string{"web01": "failed", "web02": "started_execution"}))
+	assert.Equal(t, CHECK_FAILED, checkState(clientIds, map[string]string{"web01": "finished", "web02": "undeliverable"}))
+
+	// Clients without a command fail the check
+	assert.Equal(t, CHECK_FAILED, checkState(clientIds, map[string]string{"web01": "finished"}))
+}
+
+func TestTemplateCheckMode(t *testing.T) {
+	template := &Template{Command: "apt-get upgrade -y"}
+	assert.False(t, template.HasCheck())
+
+	template.DryRun = true
+	assert.True(t, template.HasCheck())
+	assert.Equal(t, "apt-get upgrade -y", template.checkCommand())
+
+	template.CheckCommand = "apt-get upgrade --simulate"
+	assert.Equal(t, "apt-get upgrade --simulate", template.checkCommand())
+
+	// A new check command needs approval like the command itself
+	previous := &TemplateVersion{Command: "apt-get upgrade -y"}
+	assert.True(t, (&TemplateVersion{Command: "apt-get upgrade -y", CheckCommand: "apt-get upgrade --simulate"}).changesExecution(previous))
+	assert.True(t, (&TemplateVersion{Command: "apt-get upgrade -y", DryRun: true}).changesExecution(previous))
+	assert.False(t, (&TemplateVersion{Command: "apt-get upgrade -y", RequireCheck: true}).changesExecution(previous))
+}
+
+func TestCheckCmdSignature(t *testing.T) {
+	token := "c2VjcmV0"
+	check := newCmd("apt-get upgrade -y", 60)
+	check.Id = "1a2b"
+	check.DeliveryDeadline = 1700000000
+	check.Type = CHECK_CMD
+	signature := check.ComputeHmac(token)
+
+	// The type can not be moved into the id or the deadline to run the command for real
+	for _, moved := range []*Cmd{
+		{Command: check.Command, Timeout: 60, Id: check.Id + CHECK_CMD, DeliveryDeadline: check.DeliveryDeadline, KillGracePeriod: check.KillGracePeriod},
+		{Command: check.Command, Timeout: 60, Id: check.Id, DeliveryDeadline: 17000000, Type: "00" + CHECK_CMD, KillGracePeriod: check.KillGracePeriod},
+		{Command: check.Command + check.Id, Timeout: 60, DeliveryDeadline: check.DeliveryDeadline, Type: CHECK_CMD, KillGracePeriod: check.KillGracePeriod},
+	} {
+		assert.NotEqual(t, signature, moved.ComputeHmac(token))
+	}
+	copied := newCmd(check.Command, 60)
+	copied.Id = check.Id
+	copied.DeliveryDeadline = check.DeliveryDeadline
+	copied.Type = CHECK_CMD
+	assert.Equal(t, signature, copied.ComputeHmac(token))
+}
@@ -0,0 +1,124 @@
+package main
+
+// Plan of a consensus request. Before voting approvers see which clients will run the command, which were rejected
+// and why, the batches of the execution strategy and the exact command. The plan is attached to the request and the
+// execution follows it, so approvers vote on the plan.
+
+import (
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type ConsensusPlan struct {
+	Command           string
+	Interpreter       string
+	ExecutionStrategy string
+	Clients           []string         // Clients that will run the command, in order of execution
+	Rejected          []*PlanRejection // Requested clients that will not run the command
+	Batches           [][]string       // Clients per batch, a batch starts once the previous one has finished
+	Created           int64            // Unix TS of the plan
+}
+
+type PlanRejection struct {
+	ClientId string
+	Reason   string
+}
+
+// Plan the execution of the template on the clients, clients are looked up with the function
+func newConsensusPlan(template *Template, clientIds []string, getClient func(string) *RegisteredClient) *ConsensusPlan {
+	strategy := template.GetExecutionStrategy()
+	template.mux.RLock()
+	acl := template.Acl
+	p := &ConsensusPlan{
+		Command:           template.Command,
+		Interpreter:       normalizeInterpreter(template.Interpreter),
+		ExecutionStrategy: strategy.Strategy.name(),
+		Clients:           make([]string, 0),
+		Rejected:          make([]*PlanRejection, 0),
+		Created:           time.Now().Unix(),
+	}
+	interpreter := template.Interpreter
+	template.mux.RUnlock()
+
+	seen := make(map[string]bool)
+	for _, clientId := range clientIds {
+		clientId = strings.TrimSpace(clientId)
+		if len(clientId) < 1 || seen[clientId] {
+			continue
+		}
+		seen[clientId] = true
+
+		client := getClient(clientId)
+		if client == nil {
+			p.reject(clientId, "Client not registered")
+			continue
+		}
+		if !client.HasInterpreter(interpreter) {
+			p.reject(clientId, fmt.Sprintf("Interpreter %s not supported", p.Interpreter))
+			continue
+		}
+		if reason := aclRejection(acl, client); len(reason) > 0 {
+			p.reject(clientId, reason)
+			continue
+		}
+		p.Clients = append(p.Clients, clientId)
+	}
+	p.Batches = strategy.batches(p.Clients)
+	return p
+}
+
+func (p *ConsensusPlan) reject(clientId string, reason string) {
+	p.Rejected = append(p.Rejected, &PlanRejection{ClientId: clientId, Reason: reason})
+}
+
+// Reason why the tags of the client do not match the ACL of the template, empty if they match
+func aclRejection(acl *TemplateACL, client *RegisteredClient) string {
+	if acl == nil {
+		return ""
+	}
+	for _, tag := range acl.ExcludedTags {
+		if client.HasTag(tag) {
+			return fmt.Sprintf("Excluded by tag %s", tag)
+		}
+	}
+	for _, tag := range acl.IncludedTags {
+		if !client.HasTag(tag) {
+			return fmt.Sprintf("Missing included tag %s", tag)
+		}
+	}
+	return ""
+}
+
+// Summary of the plan for audit logs and notifications
+func (p *ConsensusPlan) String() string {
+	return fmt.Sprintf("%d clients in %d batches (%s), %d rejected", len(p.Clients), len(p.Batches), p.ExecutionStrategy, len(p.Rejected))
+}
+
+// Plan a request without creating it, takes the same input as PostConsensusRequest
+func PostConsensusPlan(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	user := getUser(r)
+
+	// Template
+	template := server.templateStore.Get(strings.TrimSpace(r.PostFormValue("template")))
+	if template == nil || !template.VisibleTo(user) {
+		jr.Error("Template not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Plan
+	clientIds := strings.Split(strings.TrimSpace(r.PostFormValue("clients")), ",")
+	if !user.Can(PERM_REQUEST_CREATE, template, registeredClients(clientIds)) {
+		jr.Error("User not allowed to request this template on these clients")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	jr.Set("plan", newConsensusPlan(template, clientIds, server.GetClient))
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestExecutionStrategyBatches(t *testing.T) {
+	clientIds := []string{"a", "b", "c", "d", "e", "f"}
+	assert.Equal(t, [][]string{{"a", "b", "c", "d", "e", "f"}}, newExecutionStrategy(SimpleExecutionStrategy).batches(clientIds))
+	assert.Equal(t, [][]string{{"a"}, {"b", "c", "d", "e", "f"}}, newExecutionStrategy(OneTestExecutionStrategy).batches(clientIds))
+	assert.Equal(t, [][]string{{"a"}, {"b"}, {"c"}}, newExecutionStrategy(RollingExecutionStrategy).batches(clientIds[:3]))
+	assert.Equal(t, [][]string{{"a"}, {"b", "c"}, {"d", "e", "f"}}, newExecutionStrategy(ExponentialRollingExecutionStrategy).batches(clientIds))
+	assert.Empty(t, newExecutionStrategy(SimpleExecutionStrategy).batches([]string{}))
+}
+
+func TestConsensusPlan(t *testing.T) {
+	clients := make(map[string]*RegisteredClient)
+	for _, id := range []string{"web01", "web02", "web03", "db01", "py01"} {
+		clients[id] = newRegisteredClient(id)
+		clients[id].Tags = []string{"app"}
+	}
+	clients["db01"].Tags = []string{"app", "db"}
+	clients["py01"].Interpreters = []string{"python3"}
+	getClient := func(id string) *RegisteredClient {
+		return clients[id]
+	}
+
+	template := &Template{Title: "Restart", Command: "service app restart", Acl: newTemplateAcl(), ExecutionStrategy: newExecutionStrategy(OneTestExecutionStrategy)}
+	template.Acl.IncludedTags = []string{"app"}
+	template.Acl.ExcludedTags = []string{"db"}
+	p := newConsensusPlan(template, []string{"web01", "db01", "web02", "gone", "py01", "web03", "web01", ""}, getClient)
+	assert.Equal(t, "service app restart", p.Command)
+	assert.Equal(t, "one-test", p.ExecutionStrategy)
+	assert.Equal(t, []string{"web01", "web02", "web03"}, p.Clients)
+	assert.Equal(t, [][]string{{"web01"}, {"web02", "web03"}}, p.Batches)
+	assert.Equal(t, []*PlanRejection{
+		&PlanRejection{ClientId: "db01", Reason: "Excluded by tag db"},
+		&PlanRejection{ClientId: "gone", Reason: "Client not registered"},
+		&PlanRejection{ClientId: "py01", Reason: "Interpreter bash not supported"},
+	}, p.Rejected)
+	assert.Equal(t, "3 clients in 2 batches (one-test), 3 rejected", p.String())
+
+	// Missing included tags
+	clients["web02"].Tags = []string{}
+	p = newConsensusPlan(template, []string{"web02"}, getClient)
+	assert.Empty(t, p.Clients)
+	assert.Equal(t, "Missing included tag app", p.Rejected[0].Reason)
+}
@@ -27,6 +27,15 @@ var app = {
 		return l.split(',');
 	},
 
+	// Permissions of the user in any scope, see userRoles
+	userPermissions : function() {
+		var l = localStorage['user_permissions'];
+		if (typeof l === 'undefined' || l === null || l === '') {
+			return [];
+		}
+		return l.split(',');
+	},
+
 	alert : function(type, title, message) {
 		$('#alert').html('<div class="alert alert-' + type + '" role="alert"><strong>' + title + '</strong> ' + message + '</div>');
 		setTimeout(function() {
@@ -97,7 +106,7 @@ var app = {
 			app.pages[name]['load']();
 		}
 
-		// Hide elements that are not visible to your role
+		// Hide elements that are not visible with your permissions
 		app.updateRolesDom();
 	},
 
@@ -114,14 +123,14 @@ var app = {
 	},
 
 	updateRolesDom : function() {
-		if (app.userRoles().length === 0) {
+		if (typeof localStorage['user_permissions'] === 'undefined') {
 			return;
 		}
-		$('[data-roles]').each(function(i, elm) {
-			var roles = $(elm).attr('data-roles').split(',');
+		$('[data-permissions]').each(function(i, elm) {
+			var permissions = $(elm).attr('data-permissions').split(',');
 			var hasAll = true;
-			$(roles).each(function(i, role) {
-				if (app.userRoles().indexOf(role) === -1) {
+			$(permissions).each(function(i, permission) {
+				if (app.userPermissions().indexOf(permission) === -1) {
 					hasAll = false;
 				}
 			});
@@ -254,6 +263,154 @@ var app = {
 		return x;
 	},
 
+	download : function(url, name) {
+		var xhr = new XMLHttpRequest();
+		xhr.open('GET', url);
+		xhr.setRequestHeader('X-Auth-User', app.username());
+		xhr.setRequestHeader('X-Auth-Session', app.token());
+		xhr.responseType = 'blob';
+		xhr.onload = function() {
+			if (xhr.response.type !== 'application/octet-stream') {
+				// Errors are returned as json
+				var reader = new FileReader();
+				reader.onload = function() {
+					app.handleResponse(JSON.parse(reader.result));
+				};
+				reader.readAsText(xhr.response);
+				return;
+			}
+			var a = document.createElement('a');
+			a.href = window.URL.createObjectURL(xhr.response);
+			a.download = name;
+			document.body.appendChild(a);
+			a.click();
+			document.body.removeChild(a);
+			window.URL.revokeObjectURL(a.href);
+		};
+		xhr.send();
+	},
+
+	// Binary values of security keys travel base64 URL encoded without padding
+	b64urlDecode : function(str) {
+		str = str.replace(/-/g, '+').replace(/_/g, '/');
+		while (str.length % 4 !== 0) {
+			str += '=';
+		}
+		var bin = atob(str);
+		var bytes = new Uint8Array(bin.length);
+		for (var i = 0; i < bin.length; i++) {
+			bytes[i] = bin.charCodeAt(i);
+		}
+		return bytes.buffer;
+	},
+
+	b64urlEncode : function(buf) {
+		var bytes = new Uint8Array(buf);
+		var bin = '';
+		for (var i = 0; i < bytes.length; i++) {
+			bin += String.fromCharCode(bytes[i]);
+		}
+		return btoa(bin).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+	},
+
+	webauthnSupported : function() {
+		return typeof window.PublicKeyCredential !== 'undefined' && typeof navigator.credentials !== 'undefined';
+	},
+
+	// Touch a security key for the assertion options of the server, done gets the assertion as JSON
+	webauthnGet : function(options, done) {
+		options.challenge = app.b64urlDecode(options.challenge);
+		$(options.allowCredentials).each(function(i, c) {
+			c.id = app.b64urlDecode(c.id);
+		});
+		navigator.credentials.get({ publicKey : options }).then(function(cred) {
+			done(app.webauthnCredential(cred, {
+				clientDataJSON : app.b64urlEncode(cred.response.clientDataJSON),
+				authenticatorData : app.b64urlEncode(cred.response.authenticatorData),
+				signature : app.b64urlEncode(cred.response.signature),
+				userHandle : cred.response.userHandle ? app.b64urlEncode(cred.response.userHandle) : null
+			}));
+		}, function(err) {
+			app.alert('warning', 'Security key', $('<div>').text(err.message).html());
+		});
+	},
+
+	// Register a security key for the registration options of the server
+	webauthnCreate : function(options, done) {
+		options.challenge = app.b64urlDecode(options.challenge);
+		options.user.id = app.b64urlDecode(options.user.id);
+		$(options.excludeCredentials).each(function(i, c) {
+			c.id = app.b64urlDecode(c.id);
+		});
+		navigator.credentials.create({ publicKey : options }).then(function(cred) {
+			done({
+				credential : app.webauthnCredential(cred, {
+					clientDataJSON : app.b64urlEncode(cred.response.clientDataJSON),
+					attestationObject : app.b64urlEncode(cred.response.attestationObject)
+				})
+			});
+		}, function(err) {
+			app.alert('warning', 'Security key', $('<div>').text(err.message).html());
+		});
+	},
+
+	// Credential of a security key as JSON, the way the server reads it
+	webauthnCredential : function(cred, response) {
+		return JSON.stringify({
+			id : cred.id,
+			rawId : app.b64urlEncode(cred.rawId),
+			type : cred.type,
+			response : response
+		});
+	},
+
+	hasSecondFactor : function() {
+		return localStorage['two_factor_enabled'] === 'true' || localStorage['webauthn_enabled'] === 'true';
+	},
+
+	// Step-up confirmation with a security key, or the two factor token if the user has none. Done gets the fields to
+	// post along.
+	secondFactor : function(message, done) {
+		if (localStorage['webauthn_enabled'] === 'true' && app.webauthnSupported()) {
+			app.ajax('/user/webauthn').done(function(resp) {
+				var resp = app.handleResponse(resp);
+				if (resp.status === 'OK') {
+					app.webauthnGet(resp.options, function(assertion) {
+						done({ webauthn : assertion });
+					});
+				}
+			});
+			return;
+		}
+		var totp = prompt(message, "");
+		if (totp === null) {
+			return;
+		}
+		done({ totp : totp });
+	},
+
+	// Batches and rejected clients of a request plan
+	planHtml : function(plan) {
+		var esc = function(s) {
+			return $('<div>').text(s).html();
+		};
+		var lines = [];
+		lines.push('<small>' + esc(plan.ExecutionStrategy) + ', ' + esc(plan.Interpreter) + '</small>');
+		lines.push('<ol class="plan-batches">');
+		$(plan.Batches).each(function(i, batch) {
+			lines.push('<li>' + esc(batch.join(', ')) + '</li>');
+		});
+		lines.push('</ol>');
+		if (plan.Rejected.length > 0) {
+			lines.push('<div class="text-danger"><b>Rejected</b><ul>');
+			$(plan.Rejected).each(function(i, rejection) {
+				lines.push('<li>' + esc(rejection.ClientId) + ': ' + esc(rejection.Reason) + '</li>');
+			});
+			lines.push('</ul></div>');
+		}
+		return lines.join('');
+	},
+
 	AuthMethods : function(type, authMethods ){
 		var res = [];
 		$.each(authMethods, function(key, value) {
@@ -293,6 +450,9 @@ var app = {
 		delete localStorage['username'];
 		delete localStorage['user_id'];
 		delete localStorage['user_roles'];
+		delete localStorage['user_permissions'];
+		delete localStorage['two_factor_enabled'];
+		delete localStorage['webauthn_enabled'];
 		app.showPage('login');
 	},
 
@@ -359,9 +519,79 @@ var app = {
 					}, 'json');
 					return false;
 				});
+
+				// Security keys
+				var loadKeys = function() {
+					app.ajax('/user/webauthn').done(function(resp) {
+						var resp = app.handleResponse(resp);
+						if (resp.status !== 'OK') {
+							return;
+						}
+						var date = function(ts) {
+							return ts > 0 ? new Date(ts * 1000).toLocaleString() : '-';
+						};
+						var rows = [];
+						$(resp.keys).each(function(i, key) {
+							rows.push('<tr><td>' + $('<div>').text(key.Name).html() + '</td><td>' + date(key.Created) + '</td><td>' + date(key.LastUsed) + '</td><td><span class="btn btn-default btn-xs pull-right delete-webauthn" data-id="' + key.Id + '"><i class="fa fa-trash-o" title="Remove"></i></span></td></tr>');
+						});
+						app.bindData('webauthn-keys', rows.join("\n"));
+						localStorage['webauthn_enabled'] = resp.keys.length > 0 ? 'true' : 'false';
+
+						$('.delete-webauthn', app.pageInstance()).click(function() {
+							var id = $(this).attr('data-id');
+							if (!confirm('Are you sure you want to remove this security key?')) {
+								return;
+							}
+							app.secondFactor("Please enter your two factor token to remove the security key", function(factor) {
+								app.ajax('/user/webauthn/' + id + '?' + $.param(factor), { method: 'DELETE' }).done(function(resp) {
+									var resp = app.handleResponse(resp);
+									if (resp.status === 'OK') {
+										loadKeys();
+									}
+								});
+							});
+						});
+					});
+				};
+				loadKeys();
+
+				$('form#add-webauthn').submit(function() {
+					if (!app.webauthnSupported()) {
+						app.alert('warning', 'Security key', 'This browser does not support security keys');
+						return false;
+					}
+					var name = $('input[name="name"]', this).val();
+					var register = function(factor) {
+						app.ajax('/user/webauthn/register').done(function(resp) {
+							var resp = app.handleResponse(resp);
+							if (resp.status !== 'OK') {
+								return;
+							}
+							app.webauthnCreate(resp.options, function(cred) {
+								app.ajax('/user/webauthn/register', { method: 'POST', data : $.extend({ name : name }, cred, factor) }).done(function(resp) {
+									var resp = app.handleResponse(resp);
+									if (resp.status === 'OK') {
+										app.alert('info', 'Security key', 'Added, next time you can log in with it.');
+										$('form#add-webauthn')[0].reset();
+										loadKeys();
+									}
+								});
+							});
+						});
+					};
+
+					// Users with a second factor confirm the new key with it
+					if (app.hasSecondFactor()) {
+						app.secondFactor("Please enter your two factor token to add a security key", register);
+					} else {
+						register({});
+					}
+					return false;
+				});
 			},
 			unload : function() {
 				$('form#change-password').unbind('submit');
+				$('form#add-webauthn').unbind('submit');
 			}
 		},
 
@@ -458,14 +688,37 @@ var app = {
 							userMap[user.Id] = user;
 						});
 
+						// Ad-hoc commands are shown as typed
+						var requestTitle = function(request) {
+							if (request.AdHoc) {
+								return $('<div>').text(request.AdHoc.Title).html() + '<pre>' + $('<div>').text(request.AdHoc.Command).html() + '</pre>';
+							}
+							var template = templates[request.TemplateId];
+							return '<a href="#" data-nav="request-execution?id=' + template.Id + '">' + template.Title + '</a>';
+						};
+
 						app.ajax('/consensus/pending').done(function(resp) {
 							var resp = app.handleResponse(resp);
 							if (resp.status === 'OK') {
+								// State of the check mode of the template
+								var checkHtml = function(request) {
+									var template = templates[request.TemplateId];
+									if (request.AdHoc || typeof template === 'undefined' || !(template.CheckCommand || template.DryRun)) {
+										return '';
+									}
+									var state = resp.checks[request.Id];
+									var labels = { passed : 'success', failed : 'danger', running : 'info' };
+									var html = '<br /><span class="label label-' + (labels[state] || 'default') + '">Check ' + (state || 'not run') + (template.RequireCheck ? ', required' : '') + '</span>';
+									if (state !== 'running') {
+										html += ' <a href="#" class="run-check" data-id="' + request.Id + '">Run check</a>';
+									}
+									return html;
+								};
+
 								var workKeys = Object.keys(resp.work);
 								var workHtml = [];
 								$(workKeys).each(function(i, workKey) {
 									var work = resp.work[workKey];
-									var template = templates[work.TemplateId];
 									var user = userMap[work.RequestUserId];
 									if (typeof user === 'undefined') {
 										user = {
@@ -476,39 +729,47 @@ var app = {
 
 									var lines = [];
 									lines.push('<tr>');
-									lines.push('<td><a href="#" data-nav="request-execution?id=' + template.Id + '">' + template.Title + '</a></td>');
+									lines.push('<td>' + requestTitle(work) + checkHtml(work) + '</td>');
 									lines.push('<td>' + user.Username + '</td>');
-									lines.push('<td>' + work.ClientIds.join(', ') + '</td>');
+									lines.push('<td>' + (work.Plan ? app.planHtml(work.Plan) : work.ClientIds.join(', ')) + '</td>');
 									lines.push('<td>' + work.Reason + '</td>');
-									lines.push('<td><div class="btn-group btn-group-xs pull-right"><span class="btn btn-success approve-request" data-roles="approver" data-id="' + work.Id + '">Approve</span> <span class="btn btn-default cancel-request" data-id="' + work.Id + '">Cancel</span></div></td>');
+									lines.push('<td><div class="btn-group btn-group-xs pull-right"><span class="btn btn-success approve-request" data-permissions="request.approve" data-id="' + work.Id + '">Approve</span> <span class="btn btn-default cancel-request" data-id="' + work.Id + '">Cancel</span></div></td>');
 									lines.push('</tr>');
 									workHtml.push(lines.join(''));
 								});
 								app.bindData('work', workHtml.join("\n"));
 								$('.approve-request', app.pageInstance()).click(function() {
 									var id = $(this).attr('data-id');
-									app.ajax('/consensus/approve', { method: 'POST', data : { id : id } }).done(function(resp) {
-										var resp = app.handleResponse(resp);
-										if (resp.status === 'OK') {
-											// Cancel notification?
-											try {
-												var notificationId = 'work_' + id;
-												if (typeof app.shownNotifications[notificationId] === 'object') {
-													app.shownNotifications[notificationId].close();
+									var approve = function(factor) {
+										app.ajax('/consensus/approve', { method: 'POST', data : $.extend({ id : id }, factor) }).done(function(resp) {
+											var resp = app.handleResponse(resp);
+											if (resp.status === 'OK') {
+												// Cancel notification?
+												try {
+													var notificationId = 'work_' + id;
+													if (typeof app.shownNotifications[notificationId] === 'object') {
+														app.shownNotifications[notificationId].close();
+													}
+												} catch (e) {
+													console.error(e);
 												}
-											} catch (e) {
-												console.error(e);
+												app.showPage('pending');
 											}
-											app.showPage('pending');
-										}
-									});
+										});
+									};
+
+									// Users with a second factor confirm their vote with it
+									if (app.hasSecondFactor()) {
+										app.secondFactor("Please enter your two factor token to approve this request", approve);
+									} else {
+										approve({});
+									}
 								});
 
 								var workHtml = [];
 								var requestKeys = Object.keys(resp.requests);
 								$(requestKeys).each(function(i, requestKey) {
 									var request = resp.requests[requestKey];
-									var template = templates[request.TemplateId];
 									var user = userMap[request.RequestUserId];
 									if (typeof user === 'undefined') {
 										user = {
@@ -519,12 +780,12 @@ var app = {
 
 									var lines = [];
 									lines.push('<tr>');
-									lines.push('<td><a href="#" data-nav="request-execution?id=' + template.Id + '">' + template.Title + '</a></td>');
+									lines.push('<td>' + requestTitle(request) + checkHtml(request) + '</td>');
 									lines.push('<td>' + user.Username + '</td>');
-									lines.push('<td>' + request.ClientIds.join(', ') + '</td>');
+									lines.push('<td>' + (request.Plan ? app.planHtml(request.Plan) : request.ClientIds.join(', ')) + '</td>');
 									lines.push('<td>' + request.Reason + '</td>');
 									lines.push('<td>');
-									if (user.Id === app.userId() || app.userRoles().indexOf('admin') !== -1) {
+									if (user.Id === app.userId() || app.userPermissions().indexOf('request.manage') !== -1) {
 										lines.push('<div class="btn-group btn-group-xs pull-right"><span class="btn btn-default cancel-request" data-id="' + request.Id + '">Cancel</span></div>');
 									}
 									lines.push('</td>');
@@ -545,6 +806,17 @@ var app = {
 										}
 									});
 								});
+
+								$('.run-check', app.pageInstance()).click(function() {
+									var id = $(this).attr('data-id');
+									app.ajax('/consensus/check', { method: 'POST', data : { id : id } }).done(function(resp) {
+										var resp = app.handleResponse(resp);
+										if (resp.status === 'OK') {
+											app.showPage('pending');
+										}
+									});
+									return false;
+								});
 							}
 						});
 					});
@@ -565,7 +837,9 @@ var app = {
 						var lines = [];
 						lines.push('<tr class="user-row" data-username="'+obj.Username+'">');
 						lines.push('<td>' + obj.Username + '</td>');
-						lines.push('<td>' + Object.keys(obj.Roles).join(', ') + '</td>');
+						var roles = Object.keys(obj.Roles).filter(function(role) { return obj.Roles[role]; });
+						lines.push('<td>' + $('<div>').text(roles.join(', ')).html() + ' <span class="btn btn-default btn-xs edit-roles" data-roles-list="' + $('<div>').text(roles.join(',')).html() + '"><i class="fa fa-pencil" title="Edit roles"></i></span></td>');
+						lines.push('<td>' + $('<div>').text((obj.Teams || []).join(', ')).html() + ' <span class="btn btn-default btn-xs edit-teams" data-teams="' + $('<div>').text((obj.Teams || []).join(',')).html() + '"><i class="fa fa-pencil" title="Edit teams"></i></span></td>');
 						lines.push('<td>' + app.AuthMethods( obj.AuthType,resp.authTypes ) + '</td>');
 						lines.push('<td><input type="checkbox" class="enable-user" '+ (obj.Enabled == true ? 'checked="checked"' : '')+' /></td>');
 						lines.push('<td><div class="btn-group btn-group-xs pull-right"><span class="btn btn-default delete-user"><i class="fa fa-trash-o" title="Delete"></i></span></div></td>');
@@ -593,6 +867,42 @@ var app = {
 						});
 					});
 
+					$('.edit-teams').click(function() {
+						var username = $(this).closest("tr").attr('data-username');
+						var teams = prompt('Comma separated teams of "' + username + '"', $(this).attr('data-teams'));
+						if (teams === null) {
+							return;
+						}
+
+						// Admin totp challenge
+						var adminTotp = prompt("Please enter your own two factor token to authorize the change of a user", "");
+						if(adminTotp == null || adminTotp.length < 2) {
+							app.alert("danger","Invalid token", "Token is too short");
+							return;
+						}
+						app.changeUser({teams:teams},username, adminTotp);
+					});
+
+					$('.edit-roles').click(function() {
+						var username = $(this).closest("tr").attr('data-username');
+						var current = $(this).attr('data-roles-list');
+						app.ajax('/roles').done(function(resp) {
+							var resp = app.handleResponse(resp);
+							var roles = prompt('Comma separated roles of "' + username + '" (' + Object.keys(resp.roles).join(', ') + ')', current);
+							if (roles === null) {
+								return;
+							}
+
+							// Admin totp challenge
+							var adminTotp = prompt("Please enter your own two factor token to authorize the change of a user", "");
+							if(adminTotp == null || adminTotp.length < 2) {
+								app.alert("danger","Invalid token", "Token is too short");
+								return;
+							}
+							app.changeUser({roles:roles},username, adminTotp);
+						});
+					});
+
 					$('.enable-user').change(function(e) {
 						e.preventDefault();
 						var username = $(this).closest("tr").attr('data-username');
@@ -615,12 +925,25 @@ var app = {
 			},
 			unload : function() {
 				$('.delete-user').unbind('click');
+				$('.edit-teams').unbind('click');
+				$('.edit-roles').unbind('click');
 				$('.enable-user').unbind('click');
 			}
 		},
 
 		'create-user' : {
 			load : function() {
+				// Configured roles next to the built-in ones
+				app.ajax('/roles').done(function(resp) {
+					var resp = app.handleResponse(resp);
+					var select = $('select[name="roles"]', app.pageInstance());
+					$('option.configured-role', select).remove();
+					Object.keys(resp.roles).forEach(function(role) {
+						if (['admin', 'requester', 'approver'].indexOf(role) === -1) {
+							select.append($('<option class="configured-role">').val(role).text(role + ' (' + resp.roles[role].join(', ') + ')'));
+						}
+					});
+				});
 				$('.select2', app.pageInstance()).select2();
 				$('form#create-user').submit(function() {
 					var data = $(this).serializeArray();
@@ -675,7 +998,7 @@ var app = {
 							lines.push('<tr>');
 							lines.push('<td>' + template.Title + '</td>');
 							lines.push('<td>' + check.ClientIds.join(', ') + '</td>');
-							lines.push('<td><div class="btn-group btn-group-xs pull-right"><a class="btn btn-default" href="' + uri + '" target="_blank" data-roles="requester" href="#">Execute</a> <span class="btn btn-default delete-http-check" data-roles="admin" data-id="' + check.Id + '"><i class="fa fa-trash-o" title="Delete"></i></span></div></td>');
+							lines.push('<td><div class="btn-group btn-group-xs pull-right"><a class="btn btn-default" href="' + uri + '" target="_blank" data-permissions="request.create" href="#">Execute</a> <span class="btn btn-default delete-http-check" data-permissions="httpcheck.manage" data-id="' + check.Id + '"><i class="fa fa-trash-o" title="Delete"></i></span></div></td>');
 							lines.push('</tr>');
 							trs.push(lines.join(''));
 								
@@ -701,6 +1024,86 @@ var app = {
 			}
 		},
 
+		adhoc : {
+			load : function() {
+				$('form#adhoc-command').submit(function() {
+					var form = $(this);
+					app.secondFactor("Please enter your two factor token to request execution of this command", function(factor) {
+						app.ajax('/consensus/adhoc', { method: 'POST', data : form.serialize() + '&' + $.param(factor) }).done(function(resp) {
+							var resp = app.handleResponse(resp);
+							if (resp.status === 'OK') {
+								form[0].reset();
+								app.showPage('pending');
+							}
+						});
+					});
+					return false;
+				});
+			},
+			unload : function() {
+				$('form#adhoc-command').unbind('submit');
+			}
+		},
+
+		hostgroups : {
+			load : function() {
+				app.ajax('/hostgroups').done(function(resp) {
+					var resp = app.handleResponse(resp);
+					var groups = resp.hostgroups;
+					var trs = [];
+					for (var k in groups) {
+						var group = groups[k];
+						var lines = [];
+						lines.push('<tr>');
+						lines.push('<td>' + $('<div>').text(group.Name).html() + '</td>');
+						lines.push('<td>' + $('<div>').text(group.Tags.join(', ')).html() + '</td>');
+						lines.push('<td>' + $('<div>').text(group.ClientIds.join(', ')).html() + '</td>');
+						lines.push('<td><div class="btn-group btn-group-xs pull-right"><span class="btn btn-default edit-hostgroup" data-id="' + group.Id + '"><i class="fa fa-pencil" title="Edit"></i></span> <span class="btn btn-default delete-hostgroup" data-id="' + group.Id + '"><i class="fa fa-trash-o" title="Delete"></i></span></div></td>');
+						lines.push('</tr>');
+						trs.push(lines.join(''));
+					}
+					app.bindData('hostgroups', trs.join("\n"));
+
+					$('.edit-hostgroup').click(function() {
+						var group = groups[$(this).attr('data-id')];
+						$('#hostgroup-id', app.pageInstance()).val(group.Id);
+						$('#hostgroup-name', app.pageInstance()).val(group.Name);
+						$('#hostgroup-tags', app.pageInstance()).val(group.Tags.join(','));
+						$('#hostgroup-clients', app.pageInstance()).val(group.ClientIds.join(','));
+					});
+					$('.delete-hostgroup').click(function() {
+						var id = $(this).attr('data-id');
+						if (!confirm('Are you sure you want to delete this host group?')) {
+							return;
+						}
+						app.ajax('/hostgroup/' + id, { method: 'DELETE' }).done(function(resp) {
+							var resp = app.handleResponse(resp);
+							if (resp.status === 'OK') {
+								app.showPage('hostgroups');
+							}
+						});
+					});
+				});
+
+				$('form#save-hostgroup').submit(function() {
+					app.ajax('/hostgroup', { method: 'POST', data : $(this).serialize() }).done(function(resp) {
+						var resp = app.handleResponse(resp);
+						if (resp.status === 'OK') {
+							$('form#save-hostgroup')[0].reset();
+							$('#hostgroup-id', app.pageInstance()).val('');
+							app.showPage('hostgroups');
+						}
+					});
+					return false;
+				});
+			},
+			unload : function() {
+				$('.edit-hostgroup').unbind('click');
+				$('.delete-hostgroup').unbind('click');
+				$('form#save-hostgroup').unbind('submit');
+			}
+		},
+
 		templates : {
 			load : function() {
 				app.ajax('/templates').done(function(resp) {
@@ -713,7 +1116,12 @@ var app = {
 						var template = resp.templates[k];
 						var lines = [];
 						lines.push('<tr>');
-						lines.push('<td>' + template.Title + '</td>');
+						var versionHtml = ' <span class="label label-default">v' + template.Version + '</span>';
+						if (template.PendingVersion !== null) {
+							versionHtml += ' <span class="label label-warning" title="' + $('<div>').text(template.PendingVersion.Changes.join("\n")).html() + '">v' + template.PendingVersion.Version + ' waiting for approval</span>';
+						}
+						lines.push('<td>' + $('<div>').text(template.Category || '').html() + '</td>');
+						lines.push('<td>' + template.Title + versionHtml + '</td>');
 						var tags = [];
 						$(template.Acl.IncludedTags).each(function(i, tag) {
 							tags.push('<span class="label label-primary">' + tag + '</span>');
@@ -725,13 +1133,14 @@ var app = {
 							tags.push('<span class="label label-success">ANY</span>');
 						}
 						lines.push('<td>' + tags.join(" ") + '</td>');
-						lines.push('<td><div class="btn-group btn-group-xs pull-right"><a class="btn btn-default" data-nav="request-execution?id=' + template.Id + '" data-roles="requester" href="#">Execute</a> <span class="btn btn-default delete-template" data-roles="admin" data-id="' + template.Id + '"><i class="fa fa-trash-o" title="Delete"></i></span></div></td>');
+						lines.push('<td><div class="btn-group btn-group-xs pull-right"><a class="btn btn-default" data-nav="request-execution?id=' + template.Id + '" data-permissions="request.create" href="#">Execute</a> ' + (template.PendingVersion !== null ? '<span class="btn btn-success approve-template-change" data-permissions="template.approve" data-id="' + template.Id + '">Approve change</span> <span class="btn btn-danger reject-template-change" data-permissions="template.approve" data-id="' + template.Id + '">Reject change</span> ' : '') + (resp.editable[template.Id] ? '<a class="btn btn-default" data-nav="create-template?id=' + template.Id + '" href="#">Edit</a> <span class="btn btn-default delete-template" data-id="' + template.Id + '"><i class="fa fa-trash-o" title="Delete"></i></span>' : '') + '</div></td>');
 						lines.push('</tr>');
 						templatesHtml.push(lines.join("\n"));
 					}
 					app.bindData('templates', templatesHtml.join("\n"));
 
-					app.initTables();
+					// Grouped by category
+					app.initTables({ order: [[ 0, "asc" ], [ 1, "asc" ]] });
 					
 					app.initNav();
 					app.updateRolesDom();
@@ -747,6 +1156,31 @@ var app = {
 							}
 						});
 					});
+					$('.export-templates').unbind('click');
+					$('.export-templates').click(function() {
+						app.download('/templates/export?format=yaml', 'templates.yaml');
+					});
+					$('.approve-template-change').click(function() {
+						var id = $(this).attr('data-id');
+						app.ajax('/template/' + id + '/change/approve', { method: 'POST' }).done(function(resp) {
+							var resp = app.handleResponse(resp);
+							if (resp.status === 'OK') {
+								app.showPage('templates');
+							}
+						});
+					});
+					$('.reject-template-change').click(function() {
+						var id = $(this).attr('data-id');
+						if (!confirm('Are you sure you want to reject this change?')) {
+							return;
+						}
+						app.ajax('/template/' + id + '/change', { method: 'DELETE' }).done(function(resp) {
+							var resp = app.handleResponse(resp);
+							if (resp.status === 'OK') {
+								app.showPage('templates');
+							}
+						});
+					});
 				});
 			}
 		},
@@ -805,19 +1239,43 @@ var app = {
 					app.bindData('template-execution-strategy', strategyName);
 
 					// Get eligible clients
-					app.ajax('/clients?filter_tags_include=' + encodeURIComponent(template.Acl.IncludedTags.join(',')) + '&filter_tags_exclude=' + encodeURIComponent(template.Acl.ExcludedTags.join(','))).done(function(resp) {
-						var resp = app.handleResponse(resp);
+					var clientsUrl = function() {
+						var facts = $('input[name="filter-facts"]', app.pageInstance()).val() || '';
+						return '/clients?filter_tags_include=' + encodeURIComponent(template.Acl.IncludedTags.join(',')) + '&filter_tags_exclude=' + encodeURIComponent(template.Acl.ExcludedTags.join(',')) + '&filter_interpreter=' + encodeURIComponent(template.Interpreter || '') + '&filter_facts=' + encodeURIComponent(facts);
+					};
+					var renderClients = function(resp) {
 						var rows = [];
 						$(resp.clients).each(function(i, client) {
 							var tags = [];
 							$(client.Tags).each(function(j, tag) {
 								tags.push('<span class="label label-primary">' + tag + '</span>');
 							});
-							rows.push('<tr class="client"><td><input type="checkbox" class="select-client" data-id="' + client.ClientId + '" value="1"></td><td>' + client.ClientId + '</td><td>' + tags.join("\n") + '</td><td>' + client.LastPing + '</td></tr>');
+							var facts = [];
+							$.each(client.Facts || {}, function(key, value) {
+								facts.push(key + '=' + value);
+							});
+							facts.sort();
+							rows.push('<tr class="client"><td><input type="checkbox" class="select-client" data-id="' + client.ClientId + '" value="1"></td><td title="' + $('<div>').text(facts.join("\n")).html() + '">' + client.ClientId + '</td><td>' + tags.join("\n") + '</td><td>' + client.LastPing + '</td></tr>');
 						});
 						app.bindData('clients', rows.join("\n"));
 
 						app.initTables();
+					};
+					$('input[name="filter-facts"]', app.pageInstance()).val('');
+					app.ajax(clientsUrl()).done(function(resp) {
+						var resp = app.handleResponse(resp);
+						renderClients(resp);
+
+						// Narrow down by facts, e.g. os_id=debian,memory_total>8589934592
+						$('input[name="filter-facts"]', app.pageInstance()).unbind('change');
+						$('input[name="filter-facts"]', app.pageInstance()).change(function() {
+							app.ajax(clientsUrl()).done(function(resp) {
+								var resp = app.handleResponse(resp);
+								if (resp.status === 'OK') {
+									renderClients(resp);
+								}
+							});
+						});
 						
 						// Select helpers
 						$('.select-client-helper', app.pageInstance()).unbind('click');
@@ -892,6 +1350,18 @@ var app = {
 							return clientIds;
 						}
 
+						// Preview what will run where
+						$('.plan-request', app.pageInstance()).unbind('click');
+						$('.plan-request', app.pageInstance()).click(function() {
+							app.ajax('/consensus/plan', { method: 'POST', data : { template : template.Id, clients : getClientIds().join(',') } }).done(function(resp) {
+								var resp = app.handleResponse(resp);
+								if (resp.status === 'OK') {
+									$('.request-plan', app.pageInstance()).html(app.planHtml(resp.plan)).show();
+								}
+							});
+							return false;
+						});
+
 						// Execute
 						$('.do-request', app.pageInstance()).unbind('click');
 						$('.do-request', app.pageInstance()).click(function() {
@@ -905,21 +1375,21 @@ var app = {
 								return;
 							}
 
-							// Totp challenge
-							var totp = prompt("Please enter your two factor token to authorize the request for execution of this command", "");
-
-							// Request
-							app.ajax('/consensus/request', { method: 'POST', data : { template : template.Id, clients : clientIds.join(','), reason : reason, totp : totp } }).done(function(resp) {
-								var resp = app.handleResponse(resp);
-								if (resp.status === 'OK') {
-									if (template.Acl.MinAuth > 1) {
-										// Other people have to sign, go to pending page
-										app.showPage('pending');
-									} else {
-										// Will start right now, go to history
-										app.showPage('history');
+							// Second factor challenge
+							app.secondFactor("Please enter your two factor token to authorize the request for execution of this command", function(factor) {
+								// Request
+								app.ajax('/consensus/request', { method: 'POST', data : $.extend({ template : template.Id, clients : clientIds.join(','), reason : reason }, factor) }).done(function(resp) {
+									var resp = app.handleResponse(resp);
+									if (resp.status === 'OK') {
+										if (template.Acl.MinAuth > 1) {
+											// Other people have to sign, go to pending page
+											app.showPage('pending');
+										} else {
+											// Will start right now, go to history
+											app.showPage('history');
+										}
 									}
-								}
+								});
 							});
 
 							return false;
@@ -942,15 +1412,15 @@ var app = {
 								}
 							}
 
-							// Totp challenge
-							var totp = prompt("Please enter your two factor token to create a new http check", "");
-
-							// Request
-							app.ajax('/http-check', { method: 'POST', data : { template : template.Id, clients : clientIds.join(','), totp : totp } }).done(function(resp) {
-								var resp = app.handleResponse(resp);
-								if (resp.status === 'OK') {
-									app.showPage('http-checks');
-								}
+							// Second factor challenge
+							app.secondFactor("Please enter your two factor token to create a new http check", function(factor) {
+								// Request
+								app.ajax('/http-check', { method: 'POST', data : $.extend({ template : template.Id, clients : clientIds.join(',') }, factor) }).done(function(resp) {
+									var resp = app.handleResponse(resp);
+									if (resp.status === 'OK') {
+										app.showPage('http-checks');
+									}
+								});
 							});
 
 							return false;
@@ -962,6 +1432,15 @@ var app = {
 
 		'create-template' : {
 			load : function() {
+				// Edit an existing template?
+				var id = app.getParam('id');
+				var editing = id !== null && id.length > 0;
+				$('h2', app.pageInstance()).text(editing ? 'Edit Template' : 'Create Template');
+				$('button[type="submit"]', app.pageInstance()).text(editing ? 'Save' : 'Create');
+				$('.template-check-output', app.pageInstance()).toggle(!editing);
+				$('.template-versions', app.pageInstance()).toggle(editing);
+				app.bindData('template-versions', '');
+
 				app.ajax('/tags').done(function(resp) {
 					var resp = app.handleResponse(resp);
 					var tagOptions = [];
@@ -970,6 +1449,9 @@ var app = {
 					});
 					app.bindData('tags', tagOptions.join("\n"));
 					$('.select2', app.pageInstance()).select2();
+					if (editing) {
+						app.pages['create-template'].fill(id);
+					}
 				});
 
 				$('form#create-template').submit(function() {
@@ -981,6 +1463,18 @@ var app = {
 					}
 					try { d['includedTags'] = $('#includedTags', app.pageInstance()).val().join(','); } catch (e) {}
 					try { d['excludedTags'] = $('#excludedTags', app.pageInstance()).val().join(','); } catch (e) {}
+					if (editing) {
+						app.ajax('/template/' + id, { method: 'PUT', data : d }).done(function(resp) {
+							var resp = app.handleResponse(resp);
+							if (resp.status === 'OK') {
+								if (resp.pending) {
+									app.alert('info', 'Waiting for approval', 'The change takes effect once other admins approve it.');
+								}
+								app.showPage('templates');
+							}
+						}, 'json');
+						return false;
+					}
 					app.ajax('/template', { method: 'POST', data : d }).done(function(resp) {
 						var resp = app.handleResponse(resp);
 						if (resp.status === 'OK') {
@@ -995,6 +1489,89 @@ var app = {
 					return false;
 				});
 			},
+			fill : function(id) {
+				app.ajax('/templates').done(function(resp) {
+					var resp = app.handleResponse(resp);
+					var template = resp.templates[id];
+					if (typeof template === 'undefined' || template === null) {
+						console.log('Template not found');
+						return app.showPage('templates');
+					}
+					var form = $('form#create-template');
+					var field = function(name, value) {
+						$('[name="' + name + '"]', form).val(value);
+					};
+					var optional = function(value) {
+						return value > 0 ? value : '';
+					};
+					field('title', template.Title);
+					field('description', template.Description);
+					field('category', template.Category || '');
+					field('ownerTeam', template.OwnerTeam || '');
+					field('teams', (template.Teams || []).join(','));
+					field('command', template.Command);
+					field('interpreter', template.Interpreter || 'bash');
+					field('minAuth', template.Acl.MinAuth);
+					field('timeout', template.Timeout);
+					field('killGracePeriod', template.KillGracePeriod === null || template.KillGracePeriod === undefined ? '' : template.KillGracePeriod);
+					field('deliveryTimeout', optional(template.DeliveryTimeout));
+					var env = template.Environment || {};
+					var limits = env.Limits || {};
+					field('runAsUser', env.User || '');
+					field('runAsGroup', env.Group || '');
+					field('workingDir', env.WorkingDir || '');
+					field('env', (env.Env || []).join("\n"));
+					field('limitCpu', optional(limits.CpuSeconds));
+					field('limitMemory', optional(Math.floor((limits.MemoryBytes || 0) / 1024 / 1024)));
+					field('limitOpenFiles', optional(limits.OpenFiles));
+					field('artifacts', (template.Artifacts || []).join("\n"));
+					$('input[name="interactive"]', form).prop('checked', template.Interactive);
+					field('checkCommand', template.CheckCommand || '');
+					$('input[name="dryRun"]', form).prop('checked', template.DryRun);
+					$('input[name="requireCheck"]', form).prop('checked', template.RequireCheck);
+					$('#includedTags', form).val(template.Acl.IncludedTags).trigger('change');
+					$('#excludedTags', form).val(template.Acl.ExcludedTags).trigger('change');
+					var strategies = ['simple', 'test-one', 'rolling', 'exponential-rolling'];
+					if (template.ExecutionStrategy !== null) {
+						$('#executionStrategy', form).val(strategies[template.ExecutionStrategy.Strategy]).trigger('change');
+					}
+				});
+
+				// Who changed what
+				app.ajax('/template/' + id + '/versions').done(function(resp) {
+					var resp = app.handleResponse(resp);
+					if (resp.status !== 'OK') {
+						return;
+					}
+					var versions = resp.versions;
+					if (resp.pending !== null) {
+						versions = [resp.pending].concat(versions);
+					}
+					var rows = [];
+					$(versions).each(function(i, v) {
+						var title = 'Version ' + v.Version;
+						if (v === resp.pending) {
+							title += ' <span class="label label-warning">waiting for approval</span>';
+						}
+						var lines = [];
+						lines.push('<div class="panel panel-default"><div class="panel-heading">' + title + ' by ' + $('<div>').text(v.UserId || '-').html() + ' at ' + new Date(v.Created * 1000).toLocaleString() + '</div><div class="panel-body">');
+						if (v.Changes.length > 0) {
+							lines.push('<p>' + $('<div>').text(v.Changes.join(', ')).html() + '</p>');
+						}
+						if (v.Diff.length > 0) {
+							var diff = [];
+							$(v.Diff).each(function(j, line) {
+								var cls = line.indexOf('+ ') === 0 ? 'text-success' : (line.indexOf('- ') === 0 ? 'text-danger' : '');
+								diff.push('<span class="' + cls + '">' + $('<div>').text(line).html() + '</span>');
+							});
+							lines.push('<pre>' + diff.join("\n") + '</pre>');
+						}
+						lines.push('</div></div>');
+						rows.push(lines.join(''));
+					});
+					app.bindData('template-versions', rows.join("\n"));
+				});
+			},
 			unload : function() {
 				$('form#create-template').unbind('submit');
 			}
@@ -1022,6 +1599,60 @@ var app = {
 						lis.push(line);
 					});
 					app.bindBashDataLines('err', lis);
+
+					// Waiting for an answer
+					var box = $('div#prompt');
+					box.empty();
+					if (resp.state === 'awaiting_input' && resp.prompt) {
+						var question = resp.prompt;
+						var answer = function(value) {
+							app.secondFactor("Please enter your two factor token to answer '" + question.question + "'", function(factor) {
+								app.ajax('/client/' + client + '/cmd/' + id + '/input', { method: 'POST', data : $.extend({ prompt : question.Id, answer : value }, factor) }).done(function(resp) {
+									var resp = app.handleResponse(resp);
+									if (resp.status === 'OK') {
+										app.pages.logs.load();
+									}
+								});
+							});
+						};
+						var panel = $('<div class="alert alert-warning"></div>');
+						panel.append($('<p></p>').append($('<strong></strong>').text(question.question)));
+						if (question.options && question.options.length > 0) {
+							$(question.options).each(function(i, option) {
+								var btn = $('<button class="btn btn-default"></button>').text(option);
+								btn.click(function() {
+									answer(option);
+									return false;
+								});
+								panel.append(btn).append(' ');
+							});
+						} else {
+							var form = $('<form class="form-inline"><input type="text" class="form-control" name="answer"> <button type="submit" class="btn btn-primary">Answer</button></form>');
+							form.submit(function() {
+								answer($('input[name=answer]', form).val());
+								return false;
+							});
+							panel.append(form);
+						}
+						box.append(panel);
+					}
+					$(resp.answers).each(function(i, a) {
+						box.append($('<p class="text-muted"></p>').text(a.Question + ' Answered: ' + a.Answer + ' (' + new Date(a.Answered * 1000).toLocaleString() + ')'));
+					});
+
+					var list = $('ul#artifacts');
+					list.empty();
+					$(resp.artifacts).each(function(i, artifact) {
+						var link = $('<a href="#"></a>').text(artifact.Path + ' (' + artifact.Size + ' bytes)');
+						link.click(function() {
+							app.download('/client/' + client + '/cmd/' + id + '/artifact/' + artifact.Id, artifact.Path.split('/').pop());
+							return false;
+						});
+						list.append($('<li></li>').append(link));
+					});
+					if (list.children().length === 0) {
+						list.append($('<li></li>').text('None'));
+					}
 				});
 			}
 		},
@@ -1035,7 +1666,11 @@ var app = {
 								   bPaginate: true,
 								   ajax: {
 									   url: "/dispatched",
-									   type: "POST"
+									   type: "POST",
+									   headers: {
+										   "X-Auth-User": app.username(),
+										   "X-Auth-Session": app.token()
+									   }
 								   },
 								   "drawCallback": function( settings ) {
 									   app.initNav(); // Bind logs button
@@ -1073,6 +1708,7 @@ var app = {
 							app.ajax('/user/2fa', {method : 'PUT', data : d }).done(function(resp) { 
 								var resp = app.handleResponse(resp);
 								if (resp.status === 'OK' && resp.enabled === true) {
+									localStorage['two_factor_enabled'] = 'true';
 									app.alert('info', 'Two Factor', 'Setup completed, next time you will be asked your two factor token on login.');
 									app.showPage('home');
 								}
@@ -1097,29 +1733,83 @@ var app = {
 				$('.navbar-nav').hide();
 				$('form#login').unbind('submit');
 				$('form#login').submit(function() {
-					$.post('/auth', $(this).serialize(), function(resp) {
-						if (resp.status === 'OK') {
-							localStorage['token'] = resp.session_token;
-							localStorage['user_id'] = resp.user_id;
-							localStorage['username'] = $('form#login input[name="username"]').val();
-							localStorage['user_roles'] = resp.user_roles.join(',');
-							app.alert('info', 'Login successful', 'Welcome back ' + localStorage['username']);
-							$('.navbar-nav').show();
-							app.showPage('home');
-
-							// Setup 2fa
-							if (resp.two_factor_enabled === false) {
-								app.showPage('setup-2fa');
+					var form = $(this);
+					var login = function(factor) {
+						$.post('/auth', form.serialize() + '&' + $.param(factor), function(resp) {
+							if (resp.status === 'OK') {
+								localStorage['token'] = resp.session_token;
+								localStorage['user_id'] = resp.user_id;
+								localStorage['username'] = $('form#login input[name="username"]').val();
+								localStorage['user_roles'] = resp.user_roles.join(',');
+								localStorage['user_permissions'] = resp.user_permissions.join(',');
+								localStorage['two_factor_enabled'] = resp.two_factor_enabled === true ? 'true' : 'false';
+								localStorage['webauthn_enabled'] = resp.webauthn_enabled === true ? 'true' : 'false';
+								app.alert('info', 'Login successful', 'Welcome back ' + localStorage['username']);
+								$('.navbar-nav').show();
+								app.showPage('home');
+
+								// Setup 2fa, unless the user has security keys
+								if (resp.two_factor_enabled === false && resp.webauthn_enabled !== true) {
+									app.showPage('setup-2fa');
+								}
+							} else {
+								app.apiErr(resp);
 							}
+						}, 'json');
+					};
+
+					// Security key when no two factor token is given
+					if ($('input[name="2fa"]', form).val().length > 0 || !app.webauthnSupported()) {
+						login({});
+						return false;
+					}
+					$.getJSON('/auth/webauthn', { username : $('input[name="username"]', form).val() }, function(resp) {
+						if (resp.status === 'OK' && resp.options.allowCredentials.length > 0) {
+							app.webauthnGet(resp.options, function(assertion) {
+								login({ webauthn : assertion });
+							});
 						} else {
-							app.apiErr(resp);
+							login({});
 						}
-					}, 'json');
+					}).fail(function() {
+						login({});
+					});
 					return false;
 				});
+
+				// Single sign-on
+				$.getJSON('/auth/oidc/info', function(resp) {
+					if (resp.status === 'OK' && resp.enabled === true) {
+						$('[data-bind="oidc-name"]', app.pageInstance()).text(resp.name);
+						$('.oidc-login', app.pageInstance()).show();
+					}
+				});
+				var oidcError = app.getParam('oidc_error');
+				var ticket = app.getParam('oidc');
+				delete app._params['oidc_error'];
+				delete app._params['oidc'];
+				if (oidcError !== null || ticket !== null) {
+					// Keep the ticket out of the history
+					history.replaceState(null, null, '#!login');
+				}
+				if (oidcError !== null) {
+					app.alert('warning', 'Single sign-on', $('<div>').text(oidcError).html());
+				}
+				if (ticket !== null) {
+					// The ticket is the password, the two factor token is still asked if the user set it up
+					$('form#login input[name="username"]').val(app.getParam('username'));
+					$('form#login input[name="password"]').val(ticket);
+					if (app.getParam('totp') === '1') {
+						$('form#login input[name="2fa"]').focus();
+						app.alert('info', 'Single sign-on', 'Please enter your two factor token to finish the login');
+					} else {
+						$('form#login').submit();
+					}
+				}
 			},
 			unload : function() {
 				$('.navbar-nav').show();
+				$('.oidc-login').hide();
 				$('form#login').unbind('submit');
 			}
 		}
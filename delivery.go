@@ -0,0 +1,153 @@
+package main
+
+// Delivery of commands to clients: commands stay queued on the server until the client acknowledges them,
+// are sent again after a reconnect and become undeliverable once their deadline passed
+
+import (
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Pending commands signed with the current token of the client, which is rotated when the agent restarts
+func (c *RegisteredClient) signedCmds() []*Cmd {
+	cmds := c.pendingCmds()
+	c.mux.Lock()
+	for _, cmd := range cmds {
+		cmd.Sign(c)
+	}
+	c.mux.Unlock()
+	return cmds
+}
+
+// Mark a command as sent to the client, it is sent again if not acknowledged in time
+func (c *RegisteredClient) sent(cmd *Cmd) {
+	c.mux.Lock()
+	cmd.LastSent = time.Now().Unix()
+	c.mux.Unlock()
+}
+
+// Send all unacknowledged commands again, used when the client reconnects
+func (c *RegisteredClient) resetSent() {
+	c.mux.Lock()
+	for _, cmd := range c.Cmds {
+		cmd.LastSent = 0
+	}
+	c.mux.Unlock()
+}
+
+// Client received the command, remove it from the queue
+func (c *RegisteredClient) acknowledge(cmdId string) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	cmd := c.Cmds[cmdId]
+	if cmd == nil {
+		return false
+	}
+	cmd.Pending = false
+	cmd.Delivered = time.Now().Unix()
+	delete(c.Cmds, cmdId)
+	return true
+}
+
+// Does the client still have commands waiting for delivery?
+func (c *RegisteredClient) hasQueuedCmds() bool {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return len(c.Cmds) > 0
+}
+
+// Give up on commands that were not acknowledged before their deadline
+func (s *Server) ExpireCmds() {
+	// Some slack for an acknowledgement that is on its way
+	now := time.Now().Unix() - int64(CMD_ACK_TIMEOUT)
+
+	expired := make([]*Cmd, 0)
+	s.clientsMux.RLock()
+	for _, client := range s.clients {
+		client.mux.Lock()
+		for id, cmd := range client.Cmds {
+			if cmd.Pending && cmd.DeliveryDeadline > 0 && cmd.DeliveryDeadline < now {
+				cmd.Pending = false
+				delete(client.Cmds, id)
+				expired = append(expired, cmd)
+			}
+		}
+		client.mux.Unlock()
+	}
+	s.clientsMux.RUnlock()
+
+	for _, cmd := range expired {
+		log.Printf("Command %s could not be delivered to client %s before %s", cmd.Id, cmd.ClientId, time.Unix(cmd.DeliveryDeadline, 0).Format(time.RFC3339))
+		audit.Log(nil, "Execute", fmt.Sprintf("Command %s on client %s undeliverable", cmd.Id, cmd.ClientId))
+		cmd.SetState("undeliverable")
+	}
+}
+
+// Stop the rollout the command is part of, only on the server
+func (c *Cmd) _abortRollout() {
+	if !conf.ServerEnabled || c.Type == CHECK_CMD {
+		return
+	}
+	ece := server.executionCoordinator.Get(c.ConsensusRequestId)
+	if ece != nil {
+		go ece.Abort(fmt.Sprintf("command %s on client %s is %s", c.Id, c.ClientId, c.State))
+	}
+}
+
+// Acknowledge receipt of a command
+func PutClientCmdAck(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !auth(r) {
+		jr.Error("Client not authorized for PutClientCmdAck")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Get client
+	registeredClient := server.GetClient(ps.ByName("clientId"))
+	if registeredClient == nil {
+		jr.Error("Client not registered")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Already acknowledged or expired commands are fine, the client deduplicates
+	jr.Set("acknowledged", registeredClient.acknowledge(ps.ByName("cmd")))
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Command received by the client, acknowledged and queued for execution unless it was received before
+func (s *Client) receiveCmd(received *Cmd) {
+	// Acknowledge first, also for a duplicate as the previous acknowledgement might have been lost
+	if s.SendFrame(&StreamFrame{Type: "ack", CmdId: received.Id}) != nil {
+		s._req("PUT", fmt.Sprintf("client/%s/cmd/%s/ack", url.QueryEscape(s.Id), url.QueryEscape(received.Id)), nil)
+	}
+
+	// Deduplicate, commands are sent again when an acknowledgement did not arrive
+	now := time.Now().Unix()
+	s.mux.Lock()
+	for id, ts := range s.received {
+		if now-ts > 86400 {
+			delete(s.received, id)
+		}
+	}
+	_, duplicate := s.received[received.Id]
+	if !duplicate {
+		s.received[received.Id] = now
+	}
+	s.mux.Unlock()
+	if duplicate {
+		log.Printf("Ignoring command %s, it was received before", received.Id)
+		return
+	}
+
+	// Let the server know when it can not start right away, reported before a worker can start it
+	s.executor.Enqueue(received, func(c *Cmd) {
+		c.NotifyServer("queued")
+	})
+}
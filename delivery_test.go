@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRegisteredClientAcknowledge(t *testing.T) {
+	c := newRegisteredClient("test")
+	cmd := newCmd("echo", 10)
+	c.Cmds[cmd.Id] = cmd
+	assert.True(t, c.hasQueuedCmds())
+
+	// Removed from the queue
+	assert.True(t, c.acknowledge(cmd.Id))
+	assert.False(t, cmd.Pending)
+	assert.True(t, cmd.Delivered > 0)
+	assert.False(t, c.hasQueuedCmds())
+	assert.Len(t, c.pendingCmds(), 0)
+
+	// Duplicate acknowledgement
+	assert.False(t, c.acknowledge(cmd.Id))
+}
+
+func TestRegisteredClientSignedCmds(t *testing.T) {
+	c := newRegisteredClient("test")
+	first := base64.URLEncoding.EncodeToString([]byte("01234567890123456789012345678901"))
+	second := base64.URLEncoding.EncodeToString([]byte("abcdefghijabcdefghijabcdefghijab"))
+	c.AuthToken = first
+	cmd := newCmd("echo", 10)
+	c.Cmds[cmd.Id] = cmd
+	cmds := c.signedCmds()
+	assert.Len(t, cmds, 1)
+	assert.NotEmpty(t, cmds[0].Signature)
+	assert.Equal(t, cmd.ComputeHmac(first), cmds[0].Signature)
+
+	// Agent restarted with a new token before the command was acknowledged
+	c.AuthToken = second
+	c.resetSent()
+	cmds = c.signedCmds()
+	assert.Len(t, cmds, 1)
+	assert.Equal(t, cmd.ComputeHmac(second), cmds[0].Signature)
+}
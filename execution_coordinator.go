@@ -1,7 +1,7 @@
 package main
 
 import (
-	"math"
+	"fmt"
 	"sync"
 )
 
@@ -17,7 +17,8 @@ type ExecutionCoordinatorEntry struct {
 	Id        string // Consensus request id
 	cmds      []*PendingClientCmd
 	strategy  *ExecutionStrategy
-	iteration int // starts at 0, first started iteration will update this to 1
+	iteration int  // starts at 0, first started iteration will update this to 1
+	aborted   bool // rollout stopped, nothing new is started
 	mux       sync.RWMutex
 }
 
@@ -29,6 +30,10 @@ type PendingClientCmd struct {
 // Execute the callbacks if the entire list of commands is
 func (ece *ExecutionCoordinatorEntry) ExecuteCallbacks() {
 	cr := server.consensus.Get(ece.Id)
+	if cr == nil {
+		log.Printf("Unable to find consensus request %s for callbacks", ece.Id)
+		return
+	}
 	for _, cb := range cr.Callbacks {
 		go cb(cr)
 	}
@@ -44,6 +49,11 @@ func (ece *ExecutionCoordinatorEntry) Next() {
 	ece.mux.Lock()
 	defer ece.mux.Unlock()
 
+	// Stopped
+	if ece.aborted {
+		return
+	}
+
 	// Is all work from this batch done?
 	var allFinished bool = true
 	if conf.Debug {
@@ -57,7 +67,7 @@ outer:
 		client.mux.RLock()
 		defer client.mux.RUnlock()
 		for _, cmd := range client.DispatchedCmds {
-			if cmd.ConsensusRequestId == ece.Id && cmd.ExecutionIterationId == ece.iteration {
+			if cmd.ConsensusRequestId == ece.Id && cmd.ExecutionIterationId == ece.iteration && cmd.Type != CHECK_CMD {
 				if conf.Debug {
 					log.Printf("%s was started in the previous iteration %v", cmd.Id, cmd)
 				}
@@ -91,40 +101,7 @@ outer:
 	}
 
 	// How many will we start?
-	var cmdsToStart = 0
-	switch ece.strategy.Strategy {
-	case SimpleExecutionStrategy:
-		// All at once
-		cmdsToStart = len(ece.cmds)
-		break
-
-	case OneTestExecutionStrategy:
-		// One then the rest
-		if ece.iteration == 0 {
-			// One to start
-			cmdsToStart = 1
-		} else {
-			// The rest
-			cmdsToStart = len(ece.cmds)
-		}
-		break
-
-	case RollingExecutionStrategy:
-		// One by one
-		cmdsToStart = 1
-		break
-
-	case ExponentialRollingExecutionStrategy:
-		// 1, 2, 4, 8, 16, 32 etc
-		cmdsToStart = int(math.Pow(2, float64(ece.iteration)))
-		if cmdsToStart > len(ece.cmds) {
-			cmdsToStart = len(ece.cmds)
-		}
-		break
-
-	default:
-		panic("Not yet supported")
-	}
+	cmdsToStart := ece.strategy.batchSize(ece.iteration, len(ece.cmds))
 
 	// Start command(s)
 	if conf.Debug {
@@ -138,9 +115,8 @@ outer:
 			// Submit to client
 			log.Printf("Starting cmd %s for consensus request %s", cmd.Cmd.Id, ece.Id)
 
-			c := *cmd.Cmd
-			c.ExecutionIterationId = ece.iteration
-			cmd.Client.Submit(&c)
+			cmd.Cmd.ExecutionIterationId = ece.iteration
+			cmd.Client.Submit(cmd.Cmd)
 		}(cmd)
 
 		// Remove element
@@ -151,6 +127,23 @@ outer:
 	ece.iteration++
 }
 
+// Stop the rollout, commands that were not started yet are dropped and the callbacks are executed
+func (ece *ExecutionCoordinatorEntry) Abort(reason string) {
+	ece.mux.Lock()
+	if ece.aborted {
+		ece.mux.Unlock()
+		return
+	}
+	ece.aborted = true
+	skipped := len(ece.cmds)
+	ece.cmds = make([]*PendingClientCmd, 0)
+	ece.mux.Unlock()
+
+	log.Printf("Stopped consensus request %s with %d commands not started: %s", ece.Id, skipped, reason)
+	audit.Log(nil, "Execute", fmt.Sprintf("Stopped consensus request %s with %d commands not started: %s", ece.Id, skipped, reason))
+	ece.ExecuteCallbacks()
+}
+
 func (e *ExecutionCoordinator) Get(consensusRequestId string) *ExecutionCoordinatorEntry {
 	e.mux.RLock()
 	defer e.mux.RUnlock()
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Process environment of a command on the client: user, group, working directory, environment variables and resource limits
+
+type ExecutionEnvironment struct {
+	User       string           // Run as this user, empty runs as the user of the agent
+	Group      string           // Run as this group, empty uses the primary group of the user
+	WorkingDir string           // Absolute working directory, empty inherits the one of the agent
+	Env        []string         // Additional environment variables in KEY=value form
+	Limits     *ExecutionLimits // Resource limits, nil for none
+}
+
+type ExecutionLimits struct {
+	CpuSeconds  uint64 // Maximum CPU time in seconds (RLIMIT_CPU)
+	MemoryBytes uint64 // Maximum virtual memory in bytes (RLIMIT_AS)
+	OpenFiles   uint64 // Maximum number of open file descriptors (RLIMIT_NOFILE)
+}
+
+// Largest limit, setrlimit takes a signed 64 bit value and everything from RLIM_INFINITY up wraps around
+const EXECUTION_LIMIT_MAX uint64 = math.MaxInt64
+
+var envKeyRegexp = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+var accountNameRegexp = regexp.MustCompile("^[a-z_][a-z0-9_.-]*\\$?$")
+
+// Validate the environment, used on the server before storing a template
+func (e *ExecutionEnvironment) IsValid() error {
+	if len(e.User) > 0 && !accountNameRegexp.MatchString(e.User) {
+		return errors.New("Invalid run as user")
+	}
+	if len(e.Group) > 0 && !accountNameRegexp.MatchString(e.Group) {
+		return errors.New("Invalid run as group")
+	}
+	if len(e.WorkingDir) > 0 && !path.IsAbs(e.WorkingDir) {
+		return errors.New("Working directory must be an absolute path")
+	}
+	for _, kv := range e.Env {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || !envKeyRegexp.MatchString(parts[0]) {
+			return fmt.Errorf("Invalid environment variable %s, use KEY=value", kv)
+		}
+	}
+	if e.Limits != nil {
+		return e.Limits.IsValid()
+	}
+	return nil
+}
+
+// Is there anything to apply?
+func (e *ExecutionEnvironment) IsEmpty() bool {
+	return len(e.User) == 0 && len(e.Group) == 0 && len(e.WorkingDir) == 0 && len(e.Env) == 0 && (e.Limits == nil || e.Limits.IsEmpty())
+}
+
+// Resolve the user and group into a credential, nil if the process runs as the agent user
+func (e *ExecutionEnvironment) credential() (*syscall.Credential, *user.User, error) {
+	if len(e.User) == 0 && len(e.Group) == 0 {
+		return nil, nil, nil
+	}
+
+	// User, defaults to the current one when only a group is set
+	var u *user.User
+	var err error
+	if len(e.User) > 0 {
+		u, err = user.Lookup(e.User)
+	} else {
+		u, err = user.Current()
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to find user %s: %s", e.User, err)
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Group, defaults to the primary group of the user
+	gidStr := u.Gid
+	if len(e.Group) > 0 {
+		g, ge := user.LookupGroup(e.Group)
+		if ge != nil {
+			return nil, nil, fmt.Errorf("Unable to find group %s: %s", e.Group, ge)
+		}
+		gidStr = g.Gid
+	}
+	gid, err := strconv.ParseUint(gidStr, 10, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}, u, nil
+}
+
+// Environment variables of the process
+func (e *ExecutionEnvironment) environ(u *user.User) []string {
+	var env []string
+	if u == nil {
+		// Same user as the agent, inherit
+		env = os.Environ()
+	} else {
+		// Different user, do not leak the environment of the agent
+		env = []string{
+			"HOME=" + u.HomeDir,
+			"USER=" + u.Username,
+			"LOGNAME=" + u.Username,
+			"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+		}
+	}
+	return append(env, e.Env...)
+}
+
+// Apply the environment to a process that is about to be started, the script directory and file are handed over to the run as user
+func (e *ExecutionEnvironment) Apply(cmd *exec.Cmd, scriptDir string, scriptFile string) error {
+	cred, u, err := e.credential()
+	if err != nil {
+		return err
+	}
+	if cred != nil {
+		// Hand over the private directory so only the run as user can read the script
+		if err := os.Chown(scriptDir, int(cred.Uid), int(cred.Gid)); err != nil {
+			return err
+		}
+		if err := os.Chown(scriptFile, int(cred.Uid), int(cred.Gid)); err != nil {
+			return err
+		}
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.Credential = cred
+	}
+
+	cmd.Dir = e.WorkingDir
+	cmd.Env = e.environ(u)
+
+	// Limits are set by a shell wrapper that replaces itself with the actual process
+	if e.Limits != nil && !e.Limits.IsEmpty() {
+		cmd.Args = append([]string{"/bin/sh", "-c", e.Limits.ulimitScript(), "indispenso", cmd.Path}, cmd.Args[1:]...)
+		cmd.Path = "/bin/sh"
+	}
+	return nil
+}
+
+// Validate the limits, larger values would wrap around into a tiny limit
+func (l *ExecutionLimits) IsValid() error {
+	if l.CpuSeconds > EXECUTION_LIMIT_MAX {
+		return errors.New("CPU time limit too large")
+	}
+	if l.MemoryBytes > EXECUTION_LIMIT_MAX {
+		return errors.New("Memory limit too large")
+	}
+	if l.OpenFiles > EXECUTION_LIMIT_MAX {
+		return errors.New("Open files limit too large")
+	}
+	return nil
+}
+
+// Nothing to limit?
+func (l *ExecutionLimits) IsEmpty() bool {
+	return l.CpuSeconds == 0 && l.MemoryBytes == 0 && l.OpenFiles == 0
+}
+
+// Shell snippet that sets the limits and executes its arguments
+func (l *ExecutionLimits) ulimitScript() string {
+	var lines []string
+	if l.CpuSeconds > 0 {
+		lines = append(lines, fmt.Sprintf("ulimit -t %d", l.CpuSeconds))
+	}
+	if l.MemoryBytes > 0 {
+		// Kilobytes, rounded up
+		lines = append(lines, fmt.Sprintf("ulimit -v %d", (l.MemoryBytes+1023)/1024))
+	}
+	if l.OpenFiles > 0 {
+		lines = append(lines, fmt.Sprintf("ulimit -n %d", l.OpenFiles))
+	}
+	lines = append(lines, "exec \"$@\"")
+	return strings.Join(lines, " && ")
+}
+
+// Read the environment from the template form, nil if nothing is configured
+func executionEnvironmentFromForm(r *http.Request) (*ExecutionEnvironment, error) {
+	e := newExecutionEnvironment()
+	e.User = strings.TrimSpace(r.PostFormValue("runAsUser"))
+	e.Group = strings.TrimSpace(r.PostFormValue("runAsGroup"))
+	e.WorkingDir = strings.TrimSpace(r.PostFormValue("workingDir"))
+
+	// One variable per line
+	for _, line := range strings.Split(r.PostFormValue("env"), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) > 0 {
+			e.Env = append(e.Env, line)
+		}
+	}
+
+	// Limits, empty means unlimited
+	limits := &ExecutionLimits{}
+	var err error
+	if limits.CpuSeconds, err = formUint(r, "limitCpu"); err != nil {
+		return nil, err
+	}
+	if limits.MemoryBytes, err = formUint(r, "limitMemory"); err != nil {
+		return nil, err
+	}
+	if limits.MemoryBytes > EXECUTION_LIMIT_MAX/(1024*1024) {
+		return nil, errors.New("Memory limit too large")
+	}
+	limits.MemoryBytes *= 1024 * 1024 // Form is in megabytes
+	if limits.OpenFiles, err = formUint(r, "limitOpenFiles"); err != nil {
+		return nil, err
+	}
+	if !limits.IsEmpty() {
+		e.Limits = limits
+	}
+
+	if e.IsEmpty() {
+		return nil, nil
+	}
+	return e, e.IsValid()
+}
+
+// Optional unsigned number from a form, zero if empty
+func formUint(r *http.Request, name string) (uint64, error) {
+	str := strings.TrimSpace(r.PostFormValue(name))
+	if len(str) < 1 {
+		return 0, nil
+	}
+	val, err := strconv.ParseUint(str, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid value for %s: %s", name, err)
+	}
+	return val, nil
+}
+
+func newExecutionEnvironment() *ExecutionEnvironment {
+	return &ExecutionEnvironment{
+		Env: make([]string, 0),
+	}
+}
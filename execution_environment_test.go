@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"testing"
+)
+
+func TestExecutionEnvironmentValidation(t *testing.T) {
+	e := &ExecutionEnvironment{User: "deploy", Group: "www-data", WorkingDir: "/srv/app", Env: []string{"FOO=bar", "EMPTY="}}
+	assert.NoError(t, e.IsValid())
+
+	e = &ExecutionEnvironment{User: "de ploy"}
+	assert.Error(t, e.IsValid())
+
+	e = &ExecutionEnvironment{WorkingDir: "relative/dir"}
+	assert.Error(t, e.IsValid())
+
+	e = &ExecutionEnvironment{Env: []string{"NOVALUE"}}
+	assert.Error(t, e.IsValid())
+
+	e = &ExecutionEnvironment{Env: []string{"1KEY=value"}}
+	assert.Error(t, e.IsValid())
+
+	// Limits that would wrap around
+	e = &ExecutionEnvironment{Limits: &ExecutionLimits{MemoryBytes: EXECUTION_LIMIT_MAX}}
+	assert.NoError(t, e.IsValid())
+	e.Limits.MemoryBytes = math.MaxUint64
+	assert.Error(t, e.IsValid())
+	e = &ExecutionEnvironment{Limits: &ExecutionLimits{OpenFiles: EXECUTION_LIMIT_MAX + 1}}
+	assert.Error(t, e.IsValid())
+	e = &ExecutionEnvironment{Limits: &ExecutionLimits{CpuSeconds: EXECUTION_LIMIT_MAX + 1}}
+	assert.Error(t, e.IsValid())
+}
+
+func TestExecutionEnvironmentFromForm(t *testing.T) {
+	r := &http.Request{PostForm: url.Values{"limitMemory": {"512"}}}
+	e, err := executionEnvironmentFromForm(r)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(512*1024*1024), e.Limits.MemoryBytes)
+
+	// Megabytes that overflow as bytes
+	r.PostForm.Set("limitMemory", "17592186044416")
+	_, err = executionEnvironmentFromForm(r)
+	assert.Error(t, err)
+}
+
+func TestExecutionEnvironmentEmpty(t *testing.T) {
+	assert.True(t, newExecutionEnvironment().IsEmpty())
+	assert.True(t, (&ExecutionEnvironment{Limits: &ExecutionLimits{}}).IsEmpty())
+	assert.False(t, (&ExecutionEnvironment{Limits: &ExecutionLimits{OpenFiles: 10}}).IsEmpty())
+}
+
+func TestUlimitScript(t *testing.T) {
+	l := &ExecutionLimits{CpuSeconds: 60, MemoryBytes: 1024*1024 + 1, OpenFiles: 128}
+	assert.Equal(t, "ulimit -t 60 && ulimit -v 1025 && ulimit -n 128 && exec \"$@\"", l.ulimitScript())
+}
+
+func TestApplyLimitsWrapsCommand(t *testing.T) {
+	e := &ExecutionEnvironment{Env: []string{"FOO=bar"}, Limits: &ExecutionLimits{OpenFiles: 64}}
+	cmd := exec.Command("/bin/bash", "/tmp/script")
+	assert.NoError(t, e.Apply(cmd, "/tmp", "/tmp/script"))
+
+	assert.Equal(t, "/bin/sh", cmd.Path)
+	assert.Equal(t, []string{"/bin/sh", "-c", "ulimit -n 64 && exec \"$@\"", "indispenso", "/bin/bash", "/tmp/script"}, cmd.Args)
+	assert.Contains(t, cmd.Env, "FOO=bar")
+	assert.Nil(t, cmd.SysProcAttr)
+}
@@ -1,5 +1,9 @@
 package main
 
+import (
+	"math"
+)
+
 // @author Robin Verlangen
 // The execution stratey of a command
 
@@ -17,8 +21,17 @@ func (e *ExecutionStrategy) Execute(c *ConsensusRequest) bool {
 	// Create list of commands for clients
 	var clientCmds []*PendingClientCmd = make([]*PendingClientCmd, 0)
 
-	// Assemble commands
-	for _, clientId := range c.ClientIds {
+	// Clients as planned when the request was made, requests from before plans existed have none
+	clientIds := c.ClientIds
+	if c.Plan != nil {
+		clientIds = c.Plan.Clients
+	}
+
+	// Assemble commands, the coordinator starts them from the end of the list so add them in reverse to keep the
+	// order of the plan
+	for i := len(clientIds) - 1; i >= 0; i-- {
+		clientId := clientIds[i]
+
 		// Get client
 		client := server.GetClient(clientId)
 		if client == nil {
@@ -26,13 +39,14 @@ func (e *ExecutionStrategy) Execute(c *ConsensusRequest) bool {
 			continue
 		}
 
+		// Must be able to run the interpreter
+		if !client.HasInterpreter(template.Interpreter) {
+			log.Printf("Client %s does not support interpreter %s for request %s", clientId, normalizeInterpreter(template.Interpreter), c.Id)
+			continue
+		}
+
 		// Create command instance
-		cmd := newCmd(template.Command, template.Timeout)
-		cmd.ConsensusRequestId = c.Id
-		cmd.TemplateId = c.Template().Id
-		cmd.ClientId = client.ClientId
-		cmd.RequestUserId = c.RequestUserId
-		cmd.Sign(client)
+		cmd := c.newClientCmd(template, client)
 		clientCmd := &PendingClientCmd{
 			Client: client,
 			Cmd:    cmd,
@@ -51,6 +65,74 @@ func (e *ExecutionStrategy) Execute(c *ConsensusRequest) bool {
 	return true
 }
 
+// Command of the request for a client, the caller signs it
+func (c *ConsensusRequest) newClientCmd(template *Template, client *RegisteredClient) *Cmd {
+	cmd := newCmd(template.Command, template.Timeout)
+	cmd.ConsensusRequestId = c.Id
+	if c.AdHoc != nil {
+		// One-shot, there is no template to refer to
+		cmd.AdHoc = true
+	} else {
+		cmd.TemplateId = template.Id
+		cmd.TemplateVersion = template.Version
+	}
+	cmd.ClientId = client.ClientId
+	cmd.RequestUserId = c.RequestUserId
+	cmd.Environment = template.Environment
+	cmd.Interpreter = template.Interpreter
+	cmd.Files = template.Files
+	cmd.Artifacts = template.Artifacts
+	cmd.DeliveryTimeout = template.DeliveryTimeout
+	cmd.Interactive = template.Interactive
+	if template.KillGracePeriod != nil {
+		cmd.KillGracePeriod = *template.KillGracePeriod
+	}
+	return cmd
+}
+
+// Number of commands to start in the iteration (starting at 0), out of the ones that remain
+func (e *ExecutionStrategy) batchSize(iteration int, remaining int) int {
+	switch e.Strategy {
+	case SimpleExecutionStrategy:
+		// All at once
+		return remaining
+
+	case OneTestExecutionStrategy:
+		// One then the rest
+		if iteration == 0 {
+			return 1
+		}
+		return remaining
+
+	case RollingExecutionStrategy:
+		// One by one
+		return 1
+
+	case ExponentialRollingExecutionStrategy:
+		// 1, 2, 4, 8, 16, 32 etc
+		size := int(math.Pow(2, float64(iteration)))
+		if size > remaining {
+			size = remaining
+		}
+		return size
+	}
+	panic("Not yet supported")
+}
+
+// Clients per batch in the order they will be started
+func (e *ExecutionStrategy) batches(clientIds []string) [][]string {
+	batches := make([][]string, 0)
+	for iteration := 0; len(clientIds) > 0; iteration++ {
+		size := e.batchSize(iteration, len(clientIds))
+		if size > len(clientIds) {
+			size = len(clientIds)
+		}
+		batches = append(batches, clientIds[:size])
+		clientIds = clientIds[size:]
+	}
+	return batches
+}
+
 const (
 	SimpleExecutionStrategy             ExecutionStrategyType = iota // 0
 	OneTestExecutionStrategy                                         // 1
@@ -58,6 +140,34 @@ const (
 	ExponentialRollingExecutionStrategy                              // 3
 )
 
+// Strategy by its name in forms, nil if unknown
+func parseExecutionStrategy(name string) *ExecutionStrategy {
+	switch name {
+	case "simple":
+		return newExecutionStrategy(SimpleExecutionStrategy)
+	case "one-test":
+		return newExecutionStrategy(OneTestExecutionStrategy)
+	case "rolling":
+		return newExecutionStrategy(RollingExecutionStrategy)
+	case "exponential-rolling":
+		return newExecutionStrategy(ExponentialRollingExecutionStrategy)
+	}
+	return nil
+}
+
+// Name of the strategy in forms, see parseExecutionStrategy
+func (t ExecutionStrategyType) name() string {
+	switch t {
+	case OneTestExecutionStrategy:
+		return "one-test"
+	case RollingExecutionStrategy:
+		return "rolling"
+	case ExponentialRollingExecutionStrategy:
+		return "exponential-rolling"
+	}
+	return "simple"
+}
+
 func newExecutionStrategy(strategy ExecutionStrategyType) *ExecutionStrategy {
 	return &ExecutionStrategy{
 		Strategy: strategy,
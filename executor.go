@@ -0,0 +1,223 @@
+package main
+
+// Executes received commands on the client with a pool of workers. Commands of the same template never run at the
+// same time, they wait in the local queue until the previous one is done. An agent update runs alone: once it is next
+// no new work starts, it waits for the running commands and nothing starts while it replaces the agent.
+
+import (
+	"sync"
+)
+
+const LOCAL_QUEUE_SIZE int = 100 // Commands that can wait before the control channel stops receiving
+
+type Executor struct {
+	workers int
+	queue   []*Cmd          // Waiting commands in order of receipt
+	busy    map[string]bool // Exclusion keys of running commands
+	running int
+	alone   bool          // An exclusive command is running
+	held    map[*Cmd]bool // Queued commands that are being reported, nothing from there on starts yet
+	cond    *sync.Cond
+	mux     sync.Mutex
+}
+
+// Status of the queue, reported to the server
+type ExecutorStatus struct {
+	Workers int      // Commands that can run at the same time
+	Running int      // Commands that are executing
+	Queued  int      // Commands waiting for a worker or for the same template to finish
+	Waiting []string // Ids of the waiting commands
+}
+
+// Commands with the same key run one at a time, commands without a template do not exclude each other
+func exclusionKey(c *Cmd) string {
+	return c.TemplateId
+}
+
+// Does the command have to run alone? An agent update restarts the agent, which would kill other commands
+func isExclusive(c *Cmd) bool {
+	return c.Type == AGENT_UPDATE_CMD
+}
+
+// Queue a command, waits while the queue is full. Returns whether it has to wait for another command, in that case
+// queued is called before any worker can take it so its report does not overtake the start of the command. The report
+// goes to the server, so it is made without holding the lock.
+func (e *Executor) Enqueue(c *Cmd, queued func(*Cmd)) bool {
+	e.mux.Lock()
+	for len(e.queue) >= LOCAL_QUEUE_SIZE {
+		e.cond.Wait()
+	}
+	e.queue = append(e.queue, c)
+	wait := e._mustWait(c)
+	if !wait || queued == nil {
+		e.cond.Broadcast()
+		e.mux.Unlock()
+		return wait
+	}
+	e.held[c] = true
+	e.mux.Unlock()
+
+	queued(c)
+
+	e.mux.Lock()
+	delete(e.held, c)
+	e.cond.Broadcast()
+	e.mux.Unlock()
+	return wait
+}
+
+// Will the queued command have to wait? Either its template is running, no worker is free for it or an exclusive
+// command is running or next
+func (e *Executor) _mustWait(c *Cmd) bool {
+	if e.alone {
+		return true
+	}
+	free := e.workers - e.running
+	ahead := make(map[string]bool)
+	for _, q := range e.queue {
+		if isExclusive(q) {
+			if q == c {
+				return free < e.workers
+			}
+			return true
+		}
+		key := exclusionKey(q)
+		if len(key) > 0 && (e.busy[key] || ahead[key]) {
+			if q == c {
+				return true
+			}
+			continue
+		}
+		if q == c {
+			return free < 1
+		}
+		if len(key) > 0 {
+			ahead[key] = true
+		}
+		free--
+	}
+	return false
+}
+
+// Take the first command that can start from the queue
+func (e *Executor) _next() *Cmd {
+	if e.alone {
+		return nil
+	}
+	for i, c := range e.queue {
+		if e.held[c] {
+			// Keeps the order, the ones behind it wait for the report as well
+			return nil
+		}
+		if isExclusive(c) {
+			// Nothing new starts, it waits for the running commands to finish
+			if e.running > 0 {
+				return nil
+			}
+			e.queue = append(e.queue[:i], e.queue[i+1:]...)
+			e.alone = true
+			e.running++
+			return c
+		}
+		key := exclusionKey(c)
+		if len(key) > 0 && e.busy[key] {
+			continue
+		}
+		e.queue = append(e.queue[:i], e.queue[i+1:]...)
+		if len(key) > 0 {
+			e.busy[key] = true
+		}
+		e.running++
+		return c
+	}
+	return nil
+}
+
+// Wait for a command that can start
+func (e *Executor) take() *Cmd {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	for {
+		if c := e._next(); c != nil {
+			e.cond.Broadcast()
+			return c
+		}
+		e.cond.Wait()
+	}
+}
+
+// Command done, the next one of its template can start
+func (e *Executor) done(c *Cmd) {
+	e.mux.Lock()
+	if key := exclusionKey(c); len(key) > 0 {
+		delete(e.busy, key)
+	}
+	if isExclusive(c) {
+		e.alone = false
+	}
+	e.running--
+	e.cond.Broadcast()
+	e.mux.Unlock()
+}
+
+// Remove the commands that did not start yet, e.g. before the agent restarts
+func (e *Executor) takeQueued() []*Cmd {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	queued := e.queue
+	e.queue = make([]*Cmd, 0)
+	e.cond.Broadcast()
+	return queued
+}
+
+// Start the workers
+func (e *Executor) Start(execute func(*Cmd)) {
+	for i := 0; i < e.workers; i++ {
+		go func() {
+			for {
+				c := e.take()
+				execute(c)
+				e.done(c)
+			}
+		}()
+	}
+}
+
+// Current status
+func (e *Executor) Status() *ExecutorStatus {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	waiting := make([]string, 0, len(e.queue))
+	for _, c := range e.queue {
+		waiting = append(waiting, c.Id)
+	}
+	return &ExecutorStatus{
+		Workers: e.workers,
+		Running: e.running,
+		Queued:  len(e.queue),
+		Waiting: waiting,
+	}
+}
+
+// Queue status of the client, as reported in the ping
+func (c *RegisteredClient) SetQueue(workers int, running int, queued int) {
+	c.mux.Lock()
+	c.Workers = workers
+	c.RunningCmds = running
+	c.QueuedCmds = queued
+	c.mux.Unlock()
+}
+
+func newExecutor(workers int) *Executor {
+	if workers < 1 {
+		workers = 1
+	}
+	e := &Executor{
+		workers: workers,
+		queue:   make([]*Cmd, 0),
+		busy:    make(map[string]bool),
+		held:    make(map[*Cmd]bool),
+	}
+	e.cond = sync.NewCond(&e.mux)
+	return e
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Command of a template
+func templateCmd(templateId string) *Cmd {
+	c := newCmd("echo", 10)
+	c.TemplateId = templateId
+	return c
+}
+
+func TestExecutorTemplateExclusion(t *testing.T) {
+	e := newExecutor(2)
+	a1 := templateCmd("a")
+	a2 := templateCmd("a")
+	b := templateCmd("b")
+	assert.False(t, e.Enqueue(a1, nil))
+	assert.True(t, e.Enqueue(a2, nil))
+	assert.False(t, e.Enqueue(b, nil))
+
+	// Second command of template a is skipped while the first runs
+	assert.Equal(t, a1, e.take())
+	assert.Equal(t, b, e.take())
+	status := e.Status()
+	assert.Equal(t, 2, status.Running)
+	assert.Equal(t, []string{a2.Id}, status.Waiting)
+
+	// Next of template a after the first is done
+	e.done(a1)
+	assert.Equal(t, a2, e.take())
+}
+
+func TestExecutorWorkerLimit(t *testing.T) {
+	e := newExecutor(1)
+	assert.False(t, e.Enqueue(templateCmd("a"), nil))
+	assert.True(t, e.Enqueue(templateCmd("b"), nil))
+
+	// Commands without a template do not exclude each other
+	e = newExecutor(2)
+	assert.False(t, e.Enqueue(templateCmd(""), nil))
+	assert.False(t, e.Enqueue(templateCmd(""), nil))
+	assert.True(t, e.Enqueue(templateCmd(""), nil))
+}
+
+func TestExecutorAgentUpdateRunsAlone(t *testing.T) {
+	e := newExecutor(2)
+	a := templateCmd("a")
+	update := newCmd("Update agent to 2.1.0", AGENT_UPDATE_TIMEOUT)
+	update.Type = AGENT_UPDATE_CMD
+	b := templateCmd("b")
+	assert.False(t, e.Enqueue(a, nil))
+	assert.Equal(t, a, e.take())
+
+	// No new work once the update is next, it waits for the running command
+	assert.True(t, e.Enqueue(update, nil))
+	assert.True(t, e.Enqueue(b, nil))
+	e.mux.Lock()
+	assert.Nil(t, e._next())
+	e.mux.Unlock()
+
+	// Starts once the running command is done, nothing else starts while it runs
+	e.done(a)
+	assert.Equal(t, update, e.take())
+	e.mux.Lock()
+	assert.Nil(t, e._next())
+	e.mux.Unlock()
+	assert.True(t, e.Enqueue(templateCmd("c"), nil))
+
+	// Commands that did not start are taken before the restart
+	assert.Len(t, e.takeQueued(), 2)
+	assert.Equal(t, 0, e.Status().Queued)
+}
+
+func TestExecutorReportsQueuedBeforeStart(t *testing.T) {
+	e := newExecutor(1)
+	a := templateCmd("a")
+	b := templateCmd("b")
+	queued := make([]*Cmd, 0)
+	report := func(c *Cmd) {
+		// Made without the lock, a worker that becomes free does not start the command before it is reported
+		assert.Equal(t, []string{c.Id}, e.Status().Waiting)
+		e.done(a)
+		e.mux.Lock()
+		assert.Nil(t, e._next())
+		e.mux.Unlock()
+		queued = append(queued, c)
+	}
+	assert.False(t, e.Enqueue(a, report))
+	assert.Equal(t, a, e.take())
+	assert.True(t, e.Enqueue(b, report))
+	assert.Equal(t, []*Cmd{b}, queued)
+	assert.Equal(t, b, e.take())
+}
+
+func TestExecutorRunsConcurrently(t *testing.T) {
+	e := newExecutor(3)
+	var mux sync.Mutex
+	concurrent := 0
+	maxConcurrent := 0
+	perTemplate := make(map[string]int)
+	var wg sync.WaitGroup
+	e.Start(func(c *Cmd) {
+		mux.Lock()
+		concurrent++
+		if concurrent > maxConcurrent {
+			maxConcurrent = concurrent
+		}
+		perTemplate[c.TemplateId]++
+		assert.Equal(t, 1, perTemplate[c.TemplateId], "template %s runs twice", c.TemplateId)
+		mux.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mux.Lock()
+		concurrent--
+		perTemplate[c.TemplateId]--
+		mux.Unlock()
+		wg.Done()
+	})
+
+	for _, id := range []string{"a", "a", "b", "c", "a", "d"} {
+		wg.Add(1)
+		e.Enqueue(templateCmd(id), nil)
+	}
+	wg.Wait()
+	assert.Equal(t, 3, maxConcurrent)
+	assert.Equal(t, 0, e.Status().Queued)
+}
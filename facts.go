@@ -0,0 +1,315 @@
+package main
+
+// Facts about the host of a client, reported to the server to target clients by more than their tags
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const FACTS_SCRIPT_TIMEOUT int = 10 // In seconds
+
+var factKeyRegexp = regexp.MustCompile("^[a-z0-9_.]+$")
+
+// Gather all facts of this host
+func gatherFacts() map[string]string {
+	facts := make(map[string]string)
+
+	// Custom facts first, so they can not override the built in ones
+	for k, v := range customFacts(conf.HomeFile("facts.d")) {
+		facts[k] = v
+	}
+
+	facts["agent_version"] = VERSION
+	facts["go_version"] = runtime.Version()
+	facts["os"] = runtime.GOOS
+	facts["arch"] = runtime.GOARCH
+	facts["cpu_count"] = strconv.Itoa(runtime.NumCPU())
+	if hostname, err := os.Hostname(); err == nil {
+		facts["hostname"] = hostname
+	}
+
+	// Distribution
+	if release, err := ioutil.ReadFile("/etc/os-release"); err == nil {
+		osRelease := parseKeyValues(string(release))
+		facts["os_name"] = osRelease["NAME"]
+		facts["os_id"] = osRelease["ID"]
+		facts["os_version"] = osRelease["VERSION_ID"]
+	}
+	if kernel, err := ioutil.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		facts["kernel"] = strings.TrimSpace(string(kernel))
+	}
+
+	// CPU and memory
+	if cpuinfo, err := ioutil.ReadFile("/proc/cpuinfo"); err == nil {
+		for _, line := range strings.Split(string(cpuinfo), "\n") {
+			parts := strings.SplitN(line, ":", 2)
+			if len(parts) == 2 && strings.TrimSpace(parts[0]) == "model name" {
+				facts["cpu_model"] = strings.TrimSpace(parts[1])
+				break
+			}
+		}
+	}
+	if meminfo, err := ioutil.ReadFile("/proc/meminfo"); err == nil {
+		mem := parseMeminfo(string(meminfo))
+		if v, ok := mem["MemTotal"]; ok {
+			facts["memory_total"] = strconv.FormatUint(v, 10)
+		}
+		if v, ok := mem["MemAvailable"]; ok {
+			facts["memory_available"] = strconv.FormatUint(v, 10)
+		}
+	}
+
+	// Uptime in seconds
+	if uptime, err := ioutil.ReadFile("/proc/uptime"); err == nil {
+		if fields := strings.Fields(string(uptime)); len(fields) > 0 {
+			if v, err := strconv.ParseFloat(fields[0], 64); err == nil {
+				facts["uptime"] = strconv.FormatInt(int64(v), 10)
+			}
+		}
+	}
+
+	// Disk of the root filesystem
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs("/", &stat); err == nil {
+		facts["disk_total"] = strconv.FormatUint(stat.Blocks*uint64(stat.Bsize), 10)
+		facts["disk_free"] = strconv.FormatUint(stat.Bavail*uint64(stat.Bsize), 10)
+	}
+
+	// Addresses, without loopback
+	ips := make([]string, 0)
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+				ips = append(ips, ipNet.IP.String())
+			}
+		}
+	}
+	sort.Strings(ips)
+	facts["ip_addresses"] = strings.Join(ips, ",")
+
+	return facts
+}
+
+// Parse KEY=value lines, quotes around values are removed
+func parseKeyValues(s string) map[string]string {
+	m := make(map[string]string)
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) < 1 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		m[strings.TrimSpace(parts[0])] = strings.Trim(strings.TrimSpace(parts[1]), "\"'")
+	}
+	return m
+}
+
+// Parse /proc/meminfo into bytes
+func parseMeminfo(s string) map[string]uint64 {
+	m := make(map[string]uint64)
+	for _, line := range strings.Split(s, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		fields := strings.Fields(parts[1])
+		if len(fields) < 1 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) > 1 && fields[1] == "kB" {
+			v *= 1024
+		}
+		m[strings.TrimSpace(parts[0])] = v
+	}
+	return m
+}
+
+// Facts of the executable scripts in the directory, each line of their output is a key=value pair
+func customFacts(dir string) map[string]string {
+	facts := make(map[string]string)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return facts
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Mode().Perm()&0111 == 0 {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(FACTS_SCRIPT_TIMEOUT)*time.Second)
+		out, err := exec.CommandContext(ctx, path.Join(dir, entry.Name())).Output()
+		cancel()
+		if err != nil {
+			log.Printf("Failed to gather facts from %s: %s", entry.Name(), err)
+			continue
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(out))
+		for scanner.Scan() {
+			parts := strings.SplitN(scanner.Text(), "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			key := strings.ToLower(strings.TrimSpace(parts[0]))
+			if !factKeyRegexp.MatchString(key) {
+				log.Printf("Ignoring fact %s from %s, keys may only contain a-z, 0-9, _ and .", key, entry.Name())
+				continue
+			}
+			facts[key] = strings.TrimSpace(parts[1])
+		}
+	}
+	return facts
+}
+
+// Condition on a fact, e.g. os_id=debian or memory_total>8589934592
+type FactFilter struct {
+	Key      string
+	Operator string // =, !=, > or <
+	Value    string
+}
+
+// Parse comma separated fact filters
+func parseFactFilters(s string) ([]*FactFilter, error) {
+	filters := make([]*FactFilter, 0)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) < 1 {
+			continue
+		}
+		var filter *FactFilter
+		for _, op := range []string{"!=", "=", ">", "<"} {
+			if i := strings.Index(part, op); i > 0 {
+				filter = &FactFilter{
+					Key:      strings.TrimSpace(part[:i]),
+					Operator: op,
+					Value:    strings.TrimSpace(part[i+len(op):]),
+				}
+				break
+			}
+		}
+		if filter == nil {
+			return nil, fmt.Errorf("Invalid fact filter %s, use key=value, key!=value, key>number or key<number", part)
+		}
+		if filter.Operator == ">" || filter.Operator == "<" {
+			if _, err := strconv.ParseFloat(filter.Value, 64); err != nil {
+				return nil, fmt.Errorf("Fact filter %s must compare with a number", part)
+			}
+		}
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
+
+// Do the facts match the filter?
+func (f *FactFilter) Match(facts map[string]string) bool {
+	value, ok := facts[f.Key]
+	switch f.Operator {
+	case "=":
+		return ok && value == f.Value
+	case "!=":
+		return !ok || value != f.Value
+	case ">", "<":
+		if !ok {
+			return false
+		}
+		a, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return false
+		}
+		b, _ := strconv.ParseFloat(f.Value, 64)
+		if f.Operator == ">" {
+			return a > b
+		}
+		return a < b
+	}
+	return false
+}
+
+// Do the facts of this client match all filters?
+func (c *RegisteredClient) MatchFacts(filters []*FactFilter) bool {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	for _, f := range filters {
+		if !f.Match(c.Facts) {
+			return false
+		}
+	}
+	return true
+}
+
+// Report facts to the server
+func (s *Client) ReportFacts() {
+	b, err := json.Marshal(gatherFacts())
+	if err != nil {
+		log.Printf("Failed to convert facts to JSON: %s", err)
+		return
+	}
+	if _, err := s._req("PUT", fmt.Sprintf("client/%s/facts", url.QueryEscape(s.Id)), b); err != nil {
+		log.Printf("Failed to report facts: %s", err)
+	}
+}
+
+// Facts of a client
+func PutClientFacts(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !auth(r) {
+		jr.Error("Client not authorized for PutClientFacts")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Get client
+	registeredClient := server.GetClient(ps.ByName("clientId"))
+	if registeredClient == nil {
+		jr.Error("Client not registered")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Read body
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1024*1024))
+	if err != nil {
+		jr.Error("Failed to read body")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	var facts map[string]string
+	if err := json.Unmarshal(body, &facts); err != nil {
+		jr.Error("Failed to parse json")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	registeredClient.mux.Lock()
+	registeredClient.Facts = facts
+	registeredClient.FactsUpdated = time.Now()
+	registeredClient.mux.Unlock()
+
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestParseFactFilters(t *testing.T) {
+	filters, err := parseFactFilters("os_id=debian, memory_total>1024,kernel!=4.4")
+	assert.NoError(t, err)
+	assert.Len(t, filters, 3)
+	assert.Equal(t, "os_id", filters[0].Key)
+	assert.Equal(t, "=", filters[0].Operator)
+	assert.Equal(t, "debian", filters[0].Value)
+	assert.Equal(t, ">", filters[1].Operator)
+	assert.Equal(t, "!=", filters[2].Operator)
+
+	filters, err = parseFactFilters("")
+	assert.NoError(t, err)
+	assert.Len(t, filters, 0)
+
+	_, err = parseFactFilters("debian")
+	assert.Error(t, err)
+	_, err = parseFactFilters("memory_total>lots")
+	assert.Error(t, err)
+}
+
+func TestFactFilterMatch(t *testing.T) {
+	facts := map[string]string{"os_id": "debian", "memory_total": "2048"}
+	match := func(s string) bool {
+		filters, err := parseFactFilters(s)
+		assert.NoError(t, err)
+		for _, f := range filters {
+			if !f.Match(facts) {
+				return false
+			}
+		}
+		return true
+	}
+	assert.True(t, match("os_id=debian"))
+	assert.False(t, match("os_id=centos"))
+	assert.True(t, match("os_id!=centos"))
+	assert.True(t, match("role!=db"))
+	assert.False(t, match("role=db"))
+	assert.True(t, match("memory_total>1024"))
+	assert.False(t, match("memory_total<1024"))
+	assert.False(t, match("os_id>1"))
+	assert.False(t, match("os_id=debian,memory_total>4096"))
+}
+
+func TestParseMeminfo(t *testing.T) {
+	m := parseMeminfo("MemTotal:        2048 kB\nMemAvailable:    1024 kB\nHugePages_Total:       0\n")
+	assert.Equal(t, uint64(2048*1024), m["MemTotal"])
+	assert.Equal(t, uint64(1024*1024), m["MemAvailable"])
+	assert.Equal(t, uint64(0), m["HugePages_Total"])
+}
+
+func TestParseKeyValues(t *testing.T) {
+	m := parseKeyValues("# comment\nNAME=\"Debian GNU/Linux\"\nID=debian\nVERSION_ID='8'\n")
+	assert.Equal(t, "Debian GNU/Linux", m["NAME"])
+	assert.Equal(t, "debian", m["ID"])
+	assert.Equal(t, "8", m["VERSION_ID"])
+}
+
+func TestCustomFacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "indispenso_facts_")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Executable scripts only, invalid keys are ignored
+	ioutil.WriteFile(path.Join(dir, "role"), []byte("#!/bin/sh\necho role=db\necho 'Rack Id=12'\necho datacenter = ams1\n"), 0755)
+	ioutil.WriteFile(path.Join(dir, "disabled"), []byte("#!/bin/sh\necho disabled=true\n"), 0644)
+
+	facts := customFacts(dir)
+	assert.Equal(t, "db", facts["role"])
+	assert.Equal(t, "ams1", facts["datacenter"])
+	assert.Len(t, facts, 2)
+}
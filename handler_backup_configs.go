@@ -14,21 +14,7 @@ import (
 
 // Backup data from the server in a ZIP file
 func GetBackupConfigs(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	// Logged in
 	jr := jresp.NewJsonResp()
-	if !authUser(r) {
-		jr.Error("Not authorized")
-		fmt.Fprint(w, jr.ToString(conf.Debug))
-		return
-	}
-
-	// Must be admin
-	usr := getUser(r)
-	if !usr.HasRole("admin") {
-		jr.Error("Not allowed")
-		fmt.Fprint(w, jr.ToString(conf.Debug))
-		return
-	}
 
 	// Create a buffer to write our archive to.
 	buf := new(bytes.Buffer)
@@ -44,6 +30,9 @@ func GetBackupConfigs(w http.ResponseWriter, r *http.Request, ps httprouter.Para
 		{conf.HomeFile("users.json")},
 		{conf.HomeFile("templates.conf")},
 		{conf.HomeFile("httpchecks.json")},
+		{conf.HomeFile("hostgroups.json")},
+		{conf.HomeFile("releases.json")},
+		{conf.GetUpdatePublicKeyFile()},
 		{conf.GetSslCertFile()},
 		{conf.GetSslPrivateKeyFile()},
 		{conf.ConfFile()},
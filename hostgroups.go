@@ -0,0 +1,268 @@
+package main
+
+// Host groups are managed on the server and assign tags to their clients, in addition to the tags the clients report themselves
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Host groups
+type HostGroupStore struct {
+	Groups   map[string]*HostGroup
+	ConfFile string
+	mux      sync.RWMutex
+}
+
+// A host group assigns tags to a set of clients
+type HostGroup struct {
+	Id        string
+	Name      string
+	Tags      []string // Assigned to the clients
+	ClientIds []string
+}
+
+// Validate a host group
+func (g *HostGroup) IsValid() error {
+	if len(strings.TrimSpace(g.Name)) < 1 {
+		return errors.New("Name can not be empty")
+	}
+	if len(g.Tags) < 1 {
+		return errors.New("A host group must assign at least one tag")
+	}
+	for _, tag := range g.Tags {
+		if cleanTag(tag) != tag {
+			return fmt.Errorf("Invalid tag %s, use a label or key=value", tag)
+		}
+	}
+	return nil
+}
+
+// Is the client member of this group?
+func (g *HostGroup) HasClient(clientId string) bool {
+	for _, id := range g.ClientIds {
+		if id == clientId {
+			return true
+		}
+	}
+	return false
+}
+
+// Get item
+func (s *HostGroupStore) Get(id string) *HostGroup {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.Groups[id]
+}
+
+// Add or replace item
+func (s *HostGroupStore) Add(g *HostGroup) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.Groups[g.Id] = g
+}
+
+// Remove item
+func (s *HostGroupStore) Remove(id string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	delete(s.Groups, id)
+}
+
+// Tags assigned to a client by all groups it is member of
+func (s *HostGroupStore) TagsOf(clientId string) []string {
+	tags := make([]string, 0)
+	s.mux.RLock()
+	for _, g := range s.Groups {
+		if g.HasClient(clientId) {
+			tags = append(tags, g.Tags...)
+		}
+	}
+	s.mux.RUnlock()
+	sort.Strings(tags)
+	return uniqueTags(tags)
+}
+
+// Save to disk
+func (s *HostGroupStore) save() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	bytes, je := json.Marshal(s.Groups)
+	if je != nil {
+		log.Printf("Failed to write host groups: %s", je)
+		return false
+	}
+	err := ioutil.WriteFile(s.ConfFile, bytes, 0644)
+	if err != nil {
+		log.Printf("Failed to write host groups: %s", err)
+		return false
+	}
+	return true
+}
+
+// Load from disk
+func (s *HostGroupStore) load() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	bytes, err := ioutil.ReadFile(s.ConfFile)
+	if err == nil {
+		var v map[string]*HostGroup
+		je := json.Unmarshal(bytes, &v)
+		if je != nil {
+			log.Printf("Invalid hostgroups.json: %s", je)
+			return
+		}
+		s.Groups = v
+	}
+}
+
+// New store
+func newHostGroupStore() *HostGroupStore {
+	s := &HostGroupStore{
+		ConfFile: conf.HomeFile("hostgroups.json"),
+		Groups:   make(map[string]*HostGroup),
+	}
+	s.load()
+	return s
+}
+
+// New host group
+func newHostGroup() *HostGroup {
+	return &HostGroup{
+		Id:        uuidStr(),
+		Tags:      make([]string, 0),
+		ClientIds: make([]string, 0),
+	}
+}
+
+// Tags reported by the client merged with the ones assigned by the server
+func mergeTags(reported []string, assigned []string) []string {
+	tags := make([]string, 0, len(reported)+len(assigned))
+	for _, tag := range append(append([]string{}, reported...), assigned...) {
+		if len(tag) > 0 {
+			tags = append(tags, tag)
+		}
+	}
+	return uniqueTags(tags)
+}
+
+// Tags assigned to a client by the server
+func (s *Server) assignedTags(clientId string) []string {
+	if s.hostGroupStore == nil {
+		return nil
+	}
+	return s.hostGroupStore.TagsOf(clientId)
+}
+
+// Apply the assigned tags to all clients and forget tags no client carries anymore
+func (s *Server) refreshTags() {
+	tags := make(map[string]bool)
+	s.clientsMux.RLock()
+	for _, client := range s.clients {
+		assigned := s.assignedTags(client.ClientId)
+		client.mux.Lock()
+		client.Tags = mergeTags(client.ReportedTags, assigned)
+		for _, tag := range client.Tags {
+			tags[tag] = true
+		}
+		client.mux.Unlock()
+	}
+	s.clientsMux.RUnlock()
+
+	s.tagsMux.Lock()
+	s.Tags = tags
+	s.tagsMux.Unlock()
+}
+
+// Split a comma separated form value
+func splitFormList(s string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) > 0 {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// List host groups
+func GetHostGroups(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+
+	server.hostGroupStore.mux.RLock()
+	jr.Set("hostgroups", server.hostGroupStore.Groups)
+	server.hostGroupStore.mux.RUnlock()
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Create or update host group
+func PostHostGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	user := getUser(r)
+
+	// Existing group or a new one
+	g := newHostGroup()
+	action := "Created"
+	if id := strings.TrimSpace(r.PostFormValue("id")); len(id) > 0 {
+		if server.hostGroupStore.Get(id) == nil {
+			jr.Error("Host group not found")
+			fmt.Fprint(w, jr.ToString(conf.Debug))
+			return
+		}
+		g.Id = id
+		action = "Updated"
+	}
+	g.Name = strings.TrimSpace(r.PostFormValue("name"))
+	for _, tag := range splitFormList(r.PostFormValue("tags")) {
+		g.Tags = append(g.Tags, strings.ToLower(tag))
+	}
+	g.ClientIds = splitFormList(r.PostFormValue("clients"))
+	if err := g.IsValid(); err != nil {
+		jr.Error(err.Error())
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Add and save
+	server.hostGroupStore.Add(g)
+	res := server.hostGroupStore.save()
+	server.refreshTags()
+	audit.Log(user, "Host group", fmt.Sprintf("%s %s (%s) with tags %s for clients %s", action, g.Name, g.Id, strings.Join(g.Tags, ","), strings.Join(g.ClientIds, ",")))
+
+	jr.Set("hostgroup", g)
+	jr.Set("saved", res)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Delete host group
+func DeleteHostGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	user := getUser(r)
+
+	// Remove
+	g := server.hostGroupStore.Get(ps.ByName("id"))
+	if g == nil {
+		jr.Error("Host group not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	server.hostGroupStore.Remove(g.Id)
+	res := server.hostGroupStore.save()
+	server.refreshTags()
+	audit.Log(user, "Host group", fmt.Sprintf("Deleted %s (%s)", g.Name, g.Id))
+
+	jr.Set("saved", res)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
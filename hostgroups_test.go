@@ -0,0 +1,67 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestHostGroupIsValid(t *testing.T) {
+	g := newHostGroup()
+	g.Name = "Webservers"
+	g.Tags = []string{"web", "dc=ams"}
+	assert.NoError(t, g.IsValid())
+
+	g.Tags = []string{"!web"}
+	assert.Error(t, g.IsValid())
+
+	g.Tags = []string{}
+	assert.Error(t, g.IsValid())
+
+	g.Tags = []string{"web"}
+	g.Name = " "
+	assert.Error(t, g.IsValid())
+}
+
+func TestHostGroupTagsOf(t *testing.T) {
+	s := &HostGroupStore{Groups: make(map[string]*HostGroup)}
+	web := newHostGroup()
+	web.Tags = []string{"web", "dc=ams"}
+	web.ClientIds = []string{"a", "b"}
+	s.Add(web)
+	db := newHostGroup()
+	db.Tags = []string{"db", "dc=ams"}
+	db.ClientIds = []string{"b"}
+	s.Add(db)
+
+	assert.Equal(t, []string{"dc=ams", "web"}, s.TagsOf("a"))
+	assert.Equal(t, []string{"db", "dc=ams", "web"}, s.TagsOf("b"))
+	assert.Empty(t, s.TagsOf("c"))
+
+	s.Remove(web.Id)
+	assert.Empty(t, s.TagsOf("a"))
+}
+
+func TestMergeTags(t *testing.T) {
+	assert.Equal(t, []string{"web", "test", "dc=ams"}, mergeTags([]string{"web", "", "test"}, []string{"dc=ams", "web"}))
+}
+
+func TestServerTagsGarbageCollected(t *testing.T) {
+	s := newServer()
+	s.hostGroupStore = &HostGroupStore{Groups: make(map[string]*HostGroup)}
+	g := newHostGroup()
+	g.Tags = []string{"dc=ams"}
+	g.ClientIds = []string{"a"}
+	s.hostGroupStore.Add(g)
+
+	s.RegisterClient("a", []string{"web"}, nil)
+	s.RegisterClient("b", []string{"db"}, nil)
+	assert.Equal(t, []string{"web", "dc=ams"}, s.GetClient("a").Tags)
+	assert.True(t, s.Tags["dc=ams"])
+
+	// Client no longer reports the tag and the group is removed
+	s.RegisterClient("b", []string{"cache"}, nil)
+	s.hostGroupStore.Remove(g.Id)
+	s.refreshTags()
+	assert.Equal(t, []string{"web"}, s.GetClient("a").Tags)
+	assert.Equal(t, map[string]bool{"web": true, "cache": true}, s.Tags)
+}
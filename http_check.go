@@ -150,25 +150,28 @@ func (s *HttpCheckStore) save() bool {
 	return true
 }
 
+// May the user manage the check? Scoped permissions apply to its template and clients
+func (hc *HttpCheckConfiguration) ManageableBy(u *User) bool {
+	return u.Can(PERM_HTTPCHECK_MANAGE, server.templateStore.Get(hc.TemplateId), registeredClients(hc.ClientIds))
+}
+
 // List HTTP Checks
 func GetHttpChecks(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	jr := jresp.NewJsonResp()
-	if !authUser(r) {
-		jr.Error("Not authorized")
-		fmt.Fprint(w, jr.ToString(conf.Debug))
-		return
-	}
-
-	// Must be admin
 	user := getUser(r)
-	if !user.HasRole("admin") {
-		jr.Error("Not authorized")
-		fmt.Fprint(w, jr.ToString(conf.Debug))
-		return
-	}
+
 	server.httpCheckStore.mux.RLock()
-	jr.Set("checks", server.httpCheckStore.Checks)
+	checks := make(map[string]*HttpCheckConfiguration)
+	for id, hc := range server.httpCheckStore.Checks {
+		checks[id] = hc
+	}
 	server.httpCheckStore.mux.RUnlock()
+	for id, hc := range checks {
+		if !hc.ManageableBy(user) {
+			delete(checks, id)
+		}
+	}
+	jr.Set("checks", checks)
 	jr.OK()
 	fmt.Fprint(w, jr.ToString(conf.Debug))
 }
@@ -176,22 +179,16 @@ func GetHttpChecks(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 // Delete HTTP check
 func DeleteHttpCheck(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	jr := jresp.NewJsonResp()
-	if !authUser(r) {
-		jr.Error("Not authorized")
-		fmt.Fprint(w, jr.ToString(conf.Debug))
-		return
-	}
-
-	// Must be admin
 	user := getUser(r)
-	if !user.HasRole("admin") {
-		jr.Error("Not authorized")
-		fmt.Fprint(w, jr.ToString(conf.Debug))
-		return
-	}
 
 	// Remove
 	id := strings.TrimSpace(r.URL.Query().Get("id"))
+	hc := server.httpCheckStore.Get(id)
+	if hc == nil || !hc.ManageableBy(user) {
+		jr.Error("HTTP check not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
 	audit.Log(user, "HTTP check", fmt.Sprintf("Deleted %s", id))
 	server.httpCheckStore.Remove(id)
 
@@ -205,22 +202,10 @@ func DeleteHttpCheck(w http.ResponseWriter, r *http.Request, ps httprouter.Param
 // Create HTTP Check
 func PostHttpCheck(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	jr := jresp.NewJsonResp()
-	if !authUser(r) {
-		jr.Error("Not authorized")
-		fmt.Fprint(w, jr.ToString(conf.Debug))
-		return
-	}
-
-	// Must be admin
 	user := getUser(r)
-	if !user.HasRole("admin") {
-		jr.Error("Not authorized")
-		fmt.Fprint(w, jr.ToString(conf.Debug))
-		return
-	}
 
 	// Verify two factor for, so that a hacked account can not request or execute anything without getting access to the 2fa device
-	if res, _ := user.ValidateTotp(r.PostFormValue("totp")); res == false {
+	if !validSecondFactor(user, r) {
 		jr.Error("Invalid two factor token")
 		fmt.Fprint(w, jr.ToString(conf.Debug))
 		return
@@ -237,6 +222,11 @@ func PostHttpCheck(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 
 	// Client IDs
 	clientIds := strings.Split(strings.TrimSpace(r.PostFormValue("clients")), ",")
+	if !user.Can(PERM_HTTPCHECK_MANAGE, template, registeredClients(clientIds)) {
+		jr.Error("User not allowed to create HTTP checks for this template on these clients")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
 
 	// Create
 	hc := newHttpCheckConfiguration()
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Interpreters that can run the command of a template
+
+const DEFAULT_INTERPRETER string = "bash"
+
+// Known interpreters with their shebang line
+var knownInterpreters = map[string]string{
+	"bash":    "#!/bin/bash",
+	"sh":      "#!/bin/sh",
+	"python3": "#!/usr/bin/env python3",
+}
+
+// Is this a custom shebang instead of a known interpreter?
+func isCustomShebang(interpreter string) bool {
+	return strings.HasPrefix(interpreter, "#!")
+}
+
+// Validate the interpreter of a template, empty means the default
+func validateInterpreter(interpreter string) error {
+	if len(interpreter) == 0 {
+		return nil
+	}
+	if isCustomShebang(interpreter) {
+		if strings.ContainsAny(interpreter, "\r\n") {
+			return errors.New("Shebang must be a single line")
+		}
+		if p, _ := shebangCommand(interpreter); !path.IsAbs(p) {
+			return errors.New("Shebang must use an absolute path, e.g. #!/usr/bin/env ruby")
+		}
+		return nil
+	}
+	if _, ok := knownInterpreters[interpreter]; !ok {
+		return errors.New("Interpreter must be bash, sh, python3 or a custom shebang")
+	}
+	return nil
+}
+
+// Normalize empty to the default
+func normalizeInterpreter(interpreter string) string {
+	if len(interpreter) == 0 {
+		return DEFAULT_INTERPRETER
+	}
+	return interpreter
+}
+
+// Shebang line of the script file
+func interpreterShebang(interpreter string) string {
+	interpreter = normalizeInterpreter(interpreter)
+	if isCustomShebang(interpreter) {
+		return interpreter
+	}
+	return knownInterpreters[interpreter]
+}
+
+// Command that runs the script file, custom shebangs are run through their interpreter
+// so the script also works from a temp dir that is mounted noexec
+func interpreterCommand(interpreter string, file string) *exec.Cmd {
+	interpreter = normalizeInterpreter(interpreter)
+	if isCustomShebang(interpreter) {
+		p, arg := shebangCommand(interpreter)
+		if len(arg) > 0 {
+			return exec.Command(p, arg, file)
+		}
+		return exec.Command(p, file)
+	}
+	return exec.Command(interpreter, file)
+}
+
+// Path and optional argument of a custom shebang, like the kernel: the rest of the line is a single argument
+func shebangCommand(interpreter string) (string, string) {
+	line := strings.TrimSpace(strings.TrimPrefix(interpreter, "#!"))
+	fields := strings.SplitN(line, " ", 2)
+	if len(fields) == 2 {
+		return fields[0], strings.TrimSpace(fields[1])
+	}
+	return fields[0], ""
+}
+
+// Known interpreters that are available on this host, advertised to the server
+func availableInterpreters() []string {
+	list := make([]string, 0)
+	for name := range knownInterpreters {
+		if _, err := exec.LookPath(name); err == nil {
+			list = append(list, name)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestValidateInterpreter(t *testing.T) {
+	assert.NoError(t, validateInterpreter(""))
+	assert.NoError(t, validateInterpreter("bash"))
+	assert.NoError(t, validateInterpreter("sh"))
+	assert.NoError(t, validateInterpreter("python3"))
+	assert.NoError(t, validateInterpreter("#!/usr/bin/env ruby"))
+	assert.NoError(t, validateInterpreter("#! /usr/bin/perl -w"))
+	assert.Error(t, validateInterpreter("perl"))
+	assert.Error(t, validateInterpreter("#!ruby"))
+	assert.Error(t, validateInterpreter("#! ruby"))
+	assert.Error(t, validateInterpreter("#!"))
+	assert.Error(t, validateInterpreter("#!/bin/sh\necho"))
+}
+
+func TestInterpreterShebang(t *testing.T) {
+	assert.Equal(t, "#!/bin/bash", interpreterShebang(""))
+	assert.Equal(t, "#!/bin/sh", interpreterShebang("sh"))
+	assert.Equal(t, "#!/usr/bin/env python3", interpreterShebang("python3"))
+	assert.Equal(t, "#!/usr/bin/env ruby", interpreterShebang("#!/usr/bin/env ruby"))
+}
+
+func TestInterpreterCommand(t *testing.T) {
+	assert.Equal(t, []string{"sh", "/tmp/script"}, interpreterCommand("sh", "/tmp/script").Args)
+	assert.Equal(t, []string{"/usr/bin/env", "ruby", "/tmp/script"}, interpreterCommand("#!/usr/bin/env ruby", "/tmp/script").Args)
+	assert.Equal(t, []string{"/usr/bin/perl", "-w", "/tmp/script"}, interpreterCommand("#! /usr/bin/perl -w", "/tmp/script").Args)
+	assert.Equal(t, []string{"/usr/local/bin/node", "/tmp/script"}, interpreterCommand("#!/usr/local/bin/node", "/tmp/script").Args)
+}
+
+func TestRegisteredClientHasInterpreter(t *testing.T) {
+	c := newRegisteredClient("test")
+	assert.True(t, c.HasInterpreter(""))
+	assert.True(t, c.HasInterpreter("bash"))
+	assert.False(t, c.HasInterpreter("python3"))
+
+	c.Interpreters = []string{"sh", "python3"}
+	assert.False(t, c.HasInterpreter(""))
+	assert.True(t, c.HasInterpreter("python3"))
+	assert.True(t, c.HasInterpreter("#!/usr/bin/env ruby"))
+}
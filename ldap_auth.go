@@ -5,8 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"gopkg.in/ldap.v2"
+	"net"
 	"regexp"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 type LocalUserStore interface {
@@ -15,14 +19,16 @@ type LocalUserStore interface {
 }
 
 type LdapAuthenticator struct {
-	conn      *ldap.Conn
+	pool      *LdapPool
 	config    *LdapConfig
 	userStore LocalUserStore
 }
 
-func newLdapAuthenticator(c *LdapConfig, userStore LocalUserStore) *LdapAuthenticator {
+// Authenticator for the LDAP servers. An invalid configuration is an error, servers that are down are not: logins
+// retry them and local users can log in meanwhile.
+func newLdapAuthenticator(c *LdapConfig, userStore LocalUserStore) (*LdapAuthenticator, error) {
 	if err := c.Init(); err != nil {
-		log.Fatal(fmt.Sprintf("Cannot initialize config %+v due to: %s", c, err))
+		return nil, fmt.Errorf("Cannot initialize LDAP config due to: %s", err)
 	}
 
 	a := new(LdapAuthenticator)
@@ -30,41 +36,44 @@ func newLdapAuthenticator(c *LdapConfig, userStore LocalUserStore) *LdapAuthenti
 	a.userStore = userStore
 
 	if err := a.Init(); err != nil {
-		log.Fatal(fmt.Sprintf("LDAP Init problem: %s", err))
+		log.Printf("LDAP not available, logins will retry: %s", err)
 	}
 
-	return a
+	return a, nil
 }
 
+// Create the pool and open its first connection
 func (a *LdapAuthenticator) Init() error {
-	conn, err := a.createConnection()
-	if err != nil {
-		return fmt.Errorf("Cannot connect to %s due to: %s", a.config.GetAddress(), err)
-	}
-
-	if err := conn.Bind(a.config.ManagerDN, a.config.ManagerPassword); err != nil {
-		return fmt.Errorf("Cannot bind as user %s due to: %s", a.config.ManagerDN, err)
-	}
-
-	a.conn = conn
-	return nil
+	a.pool = newLdapPool(a.config.GetPoolSize(), a.config.GetHealthCheckInterval(), a.dial, a.bind)
+	return a.pool.with(func(conn ldapConn) error {
+		return nil
+	})
 }
 
-func (c *LdapAuthenticator) createConnection() (conn *ldap.Conn, err error) {
-
-	if !c.config.isTLS {
-		conn, err = ldap.Dial("tcp", c.config.GetAddress())
+// Connection bound as the manager to the first server that is up
+func (a *LdapAuthenticator) dial() (ldapConn, error) {
+	return a.config.dialFailover(func(server *ldapServer) (ldapConn, error) {
+		conn, err := a.config.dialServer(server)
 		if err != nil {
-			return
+			return nil, fmt.Errorf("Cannot connect to %s due to: %s", server.address(), err)
 		}
-	} else {
-		return ldap.DialTLS("tcp", c.config.GetAddress(), c.config.tlsConfig)
+		if err := a.bind(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	})
+}
+
+func (a *LdapAuthenticator) bind(conn ldapConn) error {
+	if err := conn.Bind(a.config.ManagerDN, a.config.ManagerPassword); err != nil {
+		return fmt.Errorf("Cannot bind as user %s due to: %s", a.config.ManagerDN, err)
 	}
-	return conn, nil
+	return nil
 }
 
 func (a *LdapAuthenticator) auth(user *User, ar *AuthRequest) (*User, error) {
-	if a.conn == nil {
+	if a.pool == nil {
 		return nil, errors.New("Cannot authenticate, LdapAuthenticator missconfigured")
 	}
 
@@ -77,15 +86,18 @@ func (a *LdapAuthenticator) auth(user *User, ar *AuthRequest) (*User, error) {
 		return nil, fmt.Errorf("User not found in LDAP: %s", err)
 	}
 
-	// User found, create connection and try to Bind as it
-	userConn, err := a.createConnection()
-	if err != nil {
-		return nil, errors.New("Cannot create connection to authenticate user")
+	// User found, try to Bind as it
+	if err := a.pool.authenticate(userEntry.DN, ar.credential); err != nil {
+		return nil, fmt.Errorf("Authenticating user in LDAP faild due to: %s", err)
 	}
-	defer userConn.Close()
 
-	if err := userConn.Bind(userEntry.DN, ar.credential); err != nil {
-		return nil, fmt.Errorf("Authenticating user in LDAP faild due to: %s", err)
+	// Groups before the user is stored, so revoked memberships never log in with their old roles
+	var groups []string
+	if a.config.HasGroupSync() {
+		groups, err = a.UserGroups(userEntry)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read LDAP groups of user due to: %s", err)
+		}
 	}
 
 	//user not present in user store create new
@@ -94,13 +106,54 @@ func (a *LdapAuthenticator) auth(user *User, ar *AuthRequest) (*User, error) {
 		if err != nil {
 			return nil, fmt.Errorf("User authenticated by LDAP but cannot be stored in user store due to: %s", err)
 		}
-	} else {
-		//update user info form LDAP
-		a.userStore.UpdateUser(user, map[string]interface{}{"EmailAddress": userEntry.GetAttributeValue(a.config.EmailAttr)})
+	}
+
+	//update user info form LDAP, roles and teams are synced with the groups on every login
+	changes := map[string]interface{}{"EmailAddress": userEntry.GetAttributeValue(a.config.EmailAttr)}
+	if a.config.HasGroupSync() {
+		for k, v := range ldapGroupChanges(user, groups, a.config) {
+			changes[k] = v
+		}
+	}
+	if err := a.userStore.UpdateUser(user, changes); err != nil {
+		return nil, fmt.Errorf("User authenticated by LDAP but cannot be updated due to: %s", err)
 	}
 	return user, nil
 }
 
+// Groups of the user, from the group attribute of the user entry or a search for groups. Groups are listed by DN and
+// by name when searched.
+func (a *LdapAuthenticator) UserGroups(userEntry *ldap.Entry) ([]string, error) {
+	if len(a.config.GroupAttr) > 0 {
+		return userEntry.GetAttributeValues(a.config.GroupAttr), nil
+	}
+
+	searchRequest := ldap.NewSearchRequest(
+		a.config.GetGroupSearchBase(),
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		a.config.GetGroupSearchFilter(userEntry.DN),
+		[]string{a.config.GetGroupNameAttr()},
+		nil,
+	)
+	var sr *ldap.SearchResult
+	err := a.pool.with(func(conn ldapConn) (err error) {
+		sr, err = conn.Search(searchRequest)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make([]string, 0, len(sr.Entries)*2)
+	for _, entry := range sr.Entries {
+		groups = append(groups, entry.DN)
+		if name := entry.GetAttributeValue(a.config.GetGroupNameAttr()); len(name) > 0 {
+			groups = append(groups, name)
+		}
+	}
+	return groups, nil
+}
+
 func (a *LdapAuthenticator) UserSearch(login string) (*ldap.Entry, error) {
 	// Search for the given username
 	searchRequest := ldap.NewSearchRequest(
@@ -111,7 +164,11 @@ func (a *LdapAuthenticator) UserSearch(login string) (*ldap.Entry, error) {
 		nil,
 	)
 
-	sr, err := a.conn.Search(searchRequest)
+	var sr *ldap.SearchResult
+	err := a.pool.with(func(conn ldapConn) (err error) {
+		sr, err = conn.Search(searchRequest)
+		return
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -133,15 +190,30 @@ type LdapConfig struct {
 	host        string
 	port        string
 	tlsConfig   *tls.Config
-
-	ServerAddress    string
-	ManagerDN        string
-	ManagerPassword  string
-	RootDN           string
-	UserSearchBase   string
-	UserSearchFilter string
-	Attributes       []string
-	EmailAttr        string
+	servers     []*ldapServer // Server address and failover addresses
+	active      int           // Index of the server that accepted the last connection
+
+	ServerAddress       string
+	ServerAddresses     []string // Servers to fail over to, in order
+	StartTLS            bool     // Upgrade ldap:// connections with StartTLS
+	ConnectTimeout      int      // Seconds to connect to a server, 10 if 0
+	RequestTimeout      int      // Seconds to wait for a response, 30 if 0
+	PoolSize            int      // Idle connections kept open, 4 if 0
+	HealthCheckInterval int      // Seconds a connection can be idle before it is checked again, 60 if 0
+	ManagerDN           string
+	ManagerPassword     string
+	RootDN              string
+	UserSearchBase      string
+	UserSearchFilter    string
+	Attributes          []string
+	EmailAttr           string
+
+	GroupAttr         string              // Attribute of the user with the DNs of its groups, e.g. memberOf
+	GroupSearchBase   string              // Search groups below this DN when there is no group attribute, RootDN if empty
+	GroupSearchFilter string              // Filter for the groups of the user, %s is the DN of the user, e.g. member=%s
+	GroupNameAttr     string              // Attribute with the name of a searched group, cn if empty
+	GroupRoles        map[string][]string // Roles per group name or DN
+	GroupTeams        map[string][]string // Teams per group name or DN
 }
 
 func (c *LdapConfig) GetUserSearchFilter(login string) string {
@@ -157,32 +229,306 @@ func (c *LdapConfig) Init() error {
 	c.ldapConfMux.Lock()
 	defer c.ldapConfMux.Unlock()
 
+	c.servers = make([]*ldapServer, 0, len(c.ServerAddresses)+1)
+	for _, address := range append([]string{c.ServerAddress}, c.ServerAddresses...) {
+		server, err := parseLdapServer(address)
+		if err != nil {
+			return err
+		}
+		if server.isTLS && c.StartTLS {
+			return fmt.Errorf("StartTLS can not be used with %s, use ldap://", address)
+		}
+		c.servers = append(c.servers, server)
+	}
+
+	c.isTLS = c.servers[0].isTLS
+	c.host = c.servers[0].host
+	c.port = c.servers[0].port
+	c.tlsConfig = c.servers[0].tlsConfig
+
+	for group, roles := range c.GroupRoles {
+		for _, role := range roles {
+			if !isRole(role, configuredRoles()) {
+				return fmt.Errorf("Unknown role %s of group %s", role, group)
+			}
+		}
+	}
+	if (len(c.GroupRoles) > 0 || len(c.GroupTeams) > 0) && !c.HasGroupSync() {
+		return errors.New("Groups are mapped to roles or teams, but GroupAttr and GroupSearchFilter are empty")
+	}
+
+	c.initialized = true
+	return nil
+}
+
+type ldapServer struct {
+	isTLS     bool
+	host      string
+	port      string
+	tlsConfig *tls.Config
+}
+
+func parseLdapServer(address string) (*ldapServer, error) {
 	regExp, _ := regexp.Compile("(ldaps?)://([^/:]+):?([0-9]{0,})?")
 
-	if !regExp.MatchString(c.ServerAddress) {
-		return errors.New("Cannot parse server address")
+	if !regExp.MatchString(address) {
+		return nil, errors.New("Cannot parse server address")
 	}
 
-	matches := regExp.FindAllStringSubmatch(c.ServerAddress, -1)
-	c.isTLS = matches[0][1] == "ldaps"
-	c.host = matches[0][2]
-	c.port = matches[0][3]
+	matches := regExp.FindAllStringSubmatch(address, -1)
+	s := &ldapServer{
+		isTLS: matches[0][1] == "ldaps",
+		host:  matches[0][2],
+		port:  matches[0][3],
+	}
 
-	if c.port == "" {
-		if c.isTLS {
-			c.port = "636"
+	if s.port == "" {
+		if s.isTLS {
+			s.port = "636"
 		} else {
-			c.port = "389"
+			s.port = "389"
 		}
 	}
 
-	c.tlsConfig = &tls.Config{InsecureSkipVerify: false, ServerName: c.host}
-	c.initialized = true
-	return nil
+	s.tlsConfig = &tls.Config{InsecureSkipVerify: false, ServerName: s.host}
+	return s, nil
+}
+
+func (s *ldapServer) address() string {
+	return net.JoinHostPort(s.host, s.port)
+}
+
+// Connect to the server within the connect timeout, with TLS for ldaps:// or StartTLS
+func (c *LdapConfig) dialServer(s *ldapServer) (*ldap.Conn, error) {
+	dialer := &net.Dialer{Timeout: c.GetConnectTimeout()}
+	var conn *ldap.Conn
+	if s.isTLS {
+		tlsConn, err := tls.DialWithDialer(dialer, "tcp", s.address(), s.tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		conn = ldap.NewConn(tlsConn, true)
+	} else {
+		netConn, err := dialer.Dial("tcp", s.address())
+		if err != nil {
+			return nil, err
+		}
+		conn = ldap.NewConn(netConn, false)
+	}
+	conn.Start()
+	conn.SetTimeout(c.GetRequestTimeout())
+
+	if c.StartTLS {
+		if err := conn.StartTLS(s.tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Connection to the first server that is up, starting with the one that was up the last time
+func (c *LdapConfig) dialFailover(dial func(s *ldapServer) (ldapConn, error)) (ldapConn, error) {
+	c.ldapConfMux.RLock()
+	servers := c.servers
+	active := c.active
+	c.ldapConfMux.RUnlock()
+	if len(servers) < 1 {
+		return nil, errors.New("No LDAP servers configured")
+	}
+
+	var lastErr error
+	for _, i := range failoverOrder(len(servers), active) {
+		conn, err := dial(servers[i])
+		if err != nil {
+			log.Printf("LDAP server %s not available: %s", servers[i].address(), err)
+			lastErr = err
+			continue
+		}
+		if i != active {
+			log.Printf("LDAP failed over to %s", servers[i].address())
+			c.ldapConfMux.Lock()
+			c.active = i
+			c.ldapConfMux.Unlock()
+		}
+		return conn, nil
+	}
+	return nil, lastErr
+}
+
+func (c *LdapConfig) GetConnectTimeout() time.Duration {
+	if c.ConnectTimeout > 0 {
+		return time.Duration(c.ConnectTimeout) * time.Second
+	}
+	return 10 * time.Second
+}
+
+func (c *LdapConfig) GetRequestTimeout() time.Duration {
+	if c.RequestTimeout > 0 {
+		return time.Duration(c.RequestTimeout) * time.Second
+	}
+	return 30 * time.Second
+}
+
+func (c *LdapConfig) GetPoolSize() int {
+	if c.PoolSize > 0 {
+		return c.PoolSize
+	}
+	return 4
+}
+
+func (c *LdapConfig) GetHealthCheckInterval() time.Duration {
+	if c.HealthCheckInterval > 0 {
+		return time.Duration(c.HealthCheckInterval) * time.Second
+	}
+	return 60 * time.Second
 }
 
 func (c *LdapConfig) GetAttributes() []string {
-	return append(c.Attributes, c.EmailAttr, "dn")
+	attributes := append(c.Attributes, c.EmailAttr, "dn")
+	if len(c.GroupAttr) > 0 {
+		attributes = append(attributes, c.GroupAttr)
+	}
+	return attributes
+}
+
+// Are roles and teams synced with the LDAP groups of the user?
+func (c *LdapConfig) HasGroupSync() bool {
+	return len(c.GroupAttr) > 0 || len(c.GroupSearchFilter) > 0
+}
+
+func (c *LdapConfig) GetGroupSearchFilter(userDN string) string {
+	return fmt.Sprintf("(&(%s))", fmt.Sprintf(c.GroupSearchFilter, ldap.EscapeFilter(userDN)))
+}
+
+func (c *LdapConfig) GetGroupSearchBase() string {
+	if len(c.GroupSearchBase) > 0 {
+		return c.GroupSearchBase
+	}
+	return c.RootDN
+}
+
+func (c *LdapConfig) GetGroupNameAttr() string {
+	if len(c.GroupNameAttr) > 0 {
+		return c.GroupNameAttr
+	}
+	return "cn"
+}
+
+// Roles and teams of the groups, groups match the mapping by DN or, below the group search base, by the value of their
+// first RDN, case insensitive
+func (c *LdapConfig) GroupMapping(groups []string) (roles []string, teams []string) {
+	names := make(map[string]bool)
+	for _, group := range groups {
+		names[strings.ToLower(group)] = true
+		if name := ldapGroupName(group, c.GetGroupSearchBase()); len(name) > 0 {
+			names[strings.ToLower(name)] = true
+		}
+	}
+	roles = make([]string, 0)
+	for group, r := range c.GroupRoles {
+		if names[strings.ToLower(group)] {
+			roles = append(roles, r...)
+		}
+	}
+	teams = make([]string, 0)
+	for group, t := range c.GroupTeams {
+		if names[strings.ToLower(group)] {
+			teams = append(teams, t...)
+		}
+	}
+	roles = uniqueTags(roles)
+	teams = uniqueTags(teams)
+	sort.Strings(roles)
+	sort.Strings(teams)
+	return roles, teams
+}
+
+// Name of a group from its DN, e.g. admins of cn=admins,ou=groups,dc=example,dc=com. Only groups below the base have a
+// name, others could be made by anyone who may add entries elsewhere in the directory and only match by DN.
+func ldapGroupName(group string, base string) string {
+	dn, err := ldap.ParseDN(group)
+	if err != nil || len(dn.RDNs) < 1 || len(dn.RDNs[0].Attributes) < 1 {
+		return ""
+	}
+	baseDN, err := ldap.ParseDN(base)
+	if err != nil || len(baseDN.RDNs) < 1 || !ldapBelow(dn, baseDN) {
+		return ""
+	}
+	return dn.RDNs[0].Attributes[0].Value
+}
+
+// Is the DN below the base? Types and values compare case insensitive
+func ldapBelow(dn *ldap.DN, base *ldap.DN) bool {
+	offset := len(dn.RDNs) - len(base.RDNs)
+	if offset < 1 {
+		return false
+	}
+	for i, rdn := range base.RDNs {
+		other := dn.RDNs[offset+i]
+		if len(other.Attributes) != len(rdn.Attributes) {
+			return false
+		}
+		for j, attr := range rdn.Attributes {
+			if !strings.EqualFold(attr.Type, other.Attributes[j].Type) || !strings.EqualFold(attr.Value, other.Attributes[j].Value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Changes of the roles and teams of the user for the groups. Roles and teams granted by groups the user is no longer
+// a member of are revoked, the ones an admin granted are kept.
+func ldapGroupChanges(u *User, groups []string, c *LdapConfig) map[string]interface{} {
+	roles, teams := c.GroupMapping(groups)
+	u.mux.RLock()
+	previousRoles := u.LdapRoles
+	previousTeams := u.LdapTeams
+	u.mux.RUnlock()
+	userRoles, userTeams := u.syncGrants(previousRoles, previousTeams, roles, teams)
+	return map[string]interface{}{
+		"Roles":     userRoles,
+		"Teams":     userTeams,
+		"LdapRoles": roles,
+		"LdapTeams": teams,
+	}
+}
+
+// Roles and teams of the user with the previously granted ones replaced by the granted ones, see syncGranted
+func (u *User) syncGrants(previousRoles []string, previousTeams []string, roles []string, teams []string) (map[string]bool, []string) {
+	u.mux.RLock()
+	current := make([]string, 0, len(u.Roles))
+	for role, enabled := range u.Roles {
+		if enabled {
+			current = append(current, role)
+		}
+	}
+	userTeams := syncGranted(u.Teams, previousTeams, teams)
+	u.mux.RUnlock()
+
+	userRoles := make(map[string]bool)
+	for _, role := range syncGranted(current, previousRoles, roles) {
+		userRoles[role] = true
+	}
+	return userRoles, userTeams
+}
+
+// Current items without the previously granted ones, plus the granted ones
+func syncGranted(current []string, previous []string, granted []string) []string {
+	revoked := make(map[string]bool)
+	for _, item := range previous {
+		revoked[item] = true
+	}
+	list := make([]string, 0, len(current)+len(granted))
+	for _, item := range current {
+		if !revoked[item] {
+			list = append(list, item)
+		}
+	}
+	list = uniqueTags(append(list, granted...))
+	sort.Strings(list)
+	return list
 }
 
 func (c *LdapConfig) GetAddress() string {
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func TestInitialisingWithCorrectAddress(t *testing.T) {
@@ -70,3 +72,167 @@ func TestAllCustomAttributesShouldBeUsed(t *testing.T) {
 	assert.Contains(t, attributes, "test")
 	assert.Contains(t, attributes, "test2")
 }
+
+func TestGroupAttributeIsRequested(t *testing.T) {
+	config := &LdapConfig{EmailAttr: "email", Attributes: []string{}, GroupAttr: "memberOf"}
+	assert.Contains(t, config.GetAttributes(), "memberOf")
+}
+
+func TestGroupSearchFilterCreation(t *testing.T) {
+	config := &LdapConfig{GroupSearchFilter: "member=%s", RootDN: "dc=example,dc=com"}
+	assert.Equal(t, "(&(member=cn=John \\28Ops\\29,dc=example,dc=com))", config.GetGroupSearchFilter("cn=John (Ops),dc=example,dc=com"))
+	assert.Equal(t, "dc=example,dc=com", config.GetGroupSearchBase())
+	assert.Equal(t, "cn", config.GetGroupNameAttr())
+	assert.True(t, config.HasGroupSync())
+	assert.False(t, (&LdapConfig{}).HasGroupSync())
+}
+
+func TestGroupMappingValidation(t *testing.T) {
+	config := &LdapConfig{ServerAddress: "ldap://123.test.local", GroupAttr: "memberOf", GroupRoles: map[string][]string{"ops": []string{"root"}}}
+	assert.EqualError(t, config.Init(), "Unknown role root of group ops")
+
+	config = &LdapConfig{ServerAddress: "ldap://123.test.local", GroupTeams: map[string][]string{"ops": []string{"ops"}}}
+	assert.Error(t, config.Init())
+}
+
+func TestGroupName(t *testing.T) {
+	base := "ou=groups,dc=example,dc=com"
+	assert.Equal(t, "admins", ldapGroupName("cn=admins,ou=groups,dc=example,dc=com", base))
+	assert.Equal(t, "admins", ldapGroupName("CN=admins,OU=Groups,DC=example,DC=com", base))
+	assert.Equal(t, "ops, europe", ldapGroupName("cn=ops\\, europe,ou=groups,dc=example,dc=com", base))
+	assert.Equal(t, "", ldapGroupName("admins", base))
+
+	// Not below the base
+	assert.Equal(t, "", ldapGroupName("cn=admins,ou=people,dc=example,dc=com", base))
+	assert.Equal(t, "", ldapGroupName("cn=admins,ou=groups,dc=example,dc=org", base))
+	assert.Equal(t, "", ldapGroupName("ou=groups,dc=example,dc=com", base))
+	assert.Equal(t, "", ldapGroupName("cn=admins,ou=groups,dc=example,dc=com", ""))
+}
+
+func TestGroupMapping(t *testing.T) {
+	config := &LdapConfig{
+		GroupSearchBase: "ou=groups,dc=example,dc=com",
+		GroupRoles: map[string][]string{
+			"admins":                             []string{"admin", "requester"},
+			"CN=DBA,OU=Groups,DC=example,DC=com": []string{"requester", "approver"},
+			"unused":                             []string{"approver"},
+		},
+		GroupTeams: map[string][]string{"dba": []string{"db"}},
+	}
+	roles, teams := config.GroupMapping([]string{"cn=Admins,ou=groups,dc=example,dc=com", "cn=dba,ou=groups,dc=example,dc=com"})
+	assert.Equal(t, []string{"admin", "approver", "requester"}, roles)
+	assert.Equal(t, []string{"db"}, teams)
+
+	// Groups elsewhere only by DN
+	roles, teams = config.GroupMapping([]string{"cn=admins,ou=people,dc=example,dc=com"})
+	assert.Empty(t, roles)
+	assert.Empty(t, teams)
+
+	roles, teams = config.GroupMapping([]string{})
+	assert.Empty(t, roles)
+	assert.Empty(t, teams)
+}
+
+func TestGroupChangesRevokeGrantedRoles(t *testing.T) {
+	config := &LdapConfig{
+		GroupSearchBase: "ou=groups,dc=example,dc=com",
+		GroupRoles:      map[string][]string{"dba": []string{"approver"}, "ops": []string{"requester"}},
+		GroupTeams:      map[string][]string{"dba": []string{"db"}},
+	}
+	user := newUser()
+	user.AddRole("approver")
+	user.AddRole("requester")
+	user.Teams = []string{"web", "ops"}
+	user.LdapRoles = []string{"requester"}
+	user.LdapTeams = []string{"ops"}
+
+	// Left ops, joined dba: the role and team of ops are revoked, the ones an admin granted kept
+	changes := ldapGroupChanges(user, []string{"cn=dba,ou=groups,dc=example,dc=com"}, config)
+	assert.Equal(t, map[string]bool{"approver": true}, changes["Roles"])
+	assert.Equal(t, []string{"db", "web"}, changes["Teams"])
+	assert.Equal(t, []string{"approver"}, changes["LdapRoles"])
+	assert.Equal(t, []string{"db"}, changes["LdapTeams"])
+}
+
+func TestSyncGranted(t *testing.T) {
+	assert.Equal(t, []string{"a", "c", "d"}, syncGranted([]string{"a", "b", "c"}, []string{"b", "c"}, []string{"c", "d"}))
+	assert.Equal(t, []string{"a"}, syncGranted([]string{"a"}, nil, nil))
+}
+
+func TestFailoverAddresses(t *testing.T) {
+	config := &LdapConfig{ServerAddress: "ldaps://ldap1.test.local", ServerAddresses: []string{"ldap://ldap2.test.local:1389"}}
+	assert.NoError(t, config.Init())
+	assert.Len(t, config.servers, 2)
+	assert.Equal(t, "ldap1.test.local:636", config.servers[0].address())
+	assert.Equal(t, "ldap2.test.local:1389", config.servers[1].address())
+	assert.Equal(t, "ldap2.test.local", config.servers[1].tlsConfig.ServerName)
+	assert.Equal(t, "ldap1.test.local:636", config.GetAddress())
+
+	config = &LdapConfig{ServerAddress: "ldap://ldap1.test.local", ServerAddresses: []string{"ldap2.test.local"}}
+	assert.EqualError(t, config.Init(), "Cannot parse server address")
+}
+
+func TestStartTLSRequiresLdap(t *testing.T) {
+	config := &LdapConfig{ServerAddress: "ldap://ldap1.test.local", StartTLS: true}
+	assert.NoError(t, config.Init())
+
+	config = &LdapConfig{ServerAddress: "ldap://ldap1.test.local", ServerAddresses: []string{"ldaps://ldap2.test.local"}, StartTLS: true}
+	assert.EqualError(t, config.Init(), "StartTLS can not be used with ldaps://ldap2.test.local, use ldap://")
+}
+
+func TestConnectionDefaults(t *testing.T) {
+	config := &LdapConfig{}
+	assert.Equal(t, 10*time.Second, config.GetConnectTimeout())
+	assert.Equal(t, 30*time.Second, config.GetRequestTimeout())
+	assert.Equal(t, 4, config.GetPoolSize())
+	assert.Equal(t, time.Minute, config.GetHealthCheckInterval())
+
+	config = &LdapConfig{ConnectTimeout: 2, RequestTimeout: 5, PoolSize: 1, HealthCheckInterval: 10}
+	assert.Equal(t, 2*time.Second, config.GetConnectTimeout())
+	assert.Equal(t, 5*time.Second, config.GetRequestTimeout())
+	assert.Equal(t, 1, config.GetPoolSize())
+	assert.Equal(t, 10*time.Second, config.GetHealthCheckInterval())
+}
+
+func TestDialFailover(t *testing.T) {
+	config := &LdapConfig{ServerAddress: "ldap://ldap1.test.local", ServerAddresses: []string{"ldap://ldap2.test.local", "ldap://ldap3.test.local"}}
+	assert.NoError(t, config.Init())
+
+	down := map[string]bool{"ldap1.test.local": true}
+	tried := make([]string, 0)
+	dial := func(s *ldapServer) (ldapConn, error) {
+		tried = append(tried, s.host)
+		if down[s.host] {
+			return nil, errors.New("Connection refused")
+		}
+		return &fakeLdapConn{}, nil
+	}
+	_, err := config.dialFailover(dial)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ldap1.test.local", "ldap2.test.local"}, tried)
+
+	// Starts with the server that was up
+	tried = tried[:0]
+	down["ldap2.test.local"] = true
+	_, err = config.dialFailover(dial)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ldap2.test.local", "ldap3.test.local"}, tried)
+
+	// All down
+	down["ldap3.test.local"] = true
+	_, err = config.dialFailover(dial)
+	assert.EqualError(t, err, "Connection refused")
+}
+
+func TestLdapDownDoesNotStopStartup(t *testing.T) {
+	config := &LdapConfig{ServerAddress: "ldap://127.0.0.1:1", ConnectTimeout: 1, UserSearchFilter: "uid=%s"}
+	a, err := newLdapAuthenticator(config, nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, a)
+
+	_, err = a.auth(nil, &AuthRequest{login: "john", credential: "secret"})
+	assert.Error(t, err)
+
+	_, err = newLdapAuthenticator(&LdapConfig{ServerAddress: "http://127.0.0.1"}, nil)
+	assert.Error(t, err)
+}
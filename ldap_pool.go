@@ -0,0 +1,160 @@
+package main
+
+// Pool of connections to the LDAP servers, bound as the manager. Idle connections are checked with a rebind before
+// they are used again, connections with network errors are dropped and the request is retried once on a new
+// connection, to the next server if the current one is down.
+
+import (
+	"gopkg.in/ldap.v2"
+	"sync"
+	"time"
+)
+
+// The part of *ldap.Conn the authenticator uses
+type ldapConn interface {
+	Bind(username, password string) error
+	Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close()
+}
+
+type pooledLdapConn struct {
+	conn     ldapConn
+	lastUsed time.Time
+}
+
+type LdapPool struct {
+	mux            sync.Mutex
+	idle           []*pooledLdapConn
+	size           int                      // Idle connections kept open
+	healthInterval time.Duration            // Idle time after which a connection is checked before use
+	dial           func() (ldapConn, error) // New connection bound as the manager
+	bind           func(ldapConn) error     // Bind as the manager again
+}
+
+func newLdapPool(size int, healthInterval time.Duration, dial func() (ldapConn, error), bind func(ldapConn) error) *LdapPool {
+	return &LdapPool{
+		idle:           make([]*pooledLdapConn, 0, size),
+		size:           size,
+		healthInterval: healthInterval,
+		dial:           dial,
+		bind:           bind,
+	}
+}
+
+// Idle connection that passes its health check, or a new one
+func (p *LdapPool) get() (*pooledLdapConn, error) {
+	for {
+		p.mux.Lock()
+		if len(p.idle) < 1 {
+			p.mux.Unlock()
+			break
+		}
+		c := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mux.Unlock()
+
+		if time.Since(c.lastUsed) < p.healthInterval {
+			return c, nil
+		}
+		if err := p.bind(c.conn); err != nil {
+			log.Printf("Dropping LDAP connection that failed its health check: %s", err)
+			c.conn.Close()
+			continue
+		}
+		return c, nil
+	}
+
+	conn, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+	return &pooledLdapConn{conn: conn}, nil
+}
+
+// Return a connection to the pool, closed if the pool is full
+func (p *LdapPool) put(c *pooledLdapConn) {
+	c.lastUsed = time.Now()
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if len(p.idle) >= p.size {
+		c.conn.Close()
+		return
+	}
+	p.idle = append(p.idle, c)
+}
+
+// Run f on a connection. Connections with network errors are dropped and f is retried once on a new connection.
+func (p *LdapPool) with(f func(conn ldapConn) error) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var c *pooledLdapConn
+		c, err = p.get()
+		if err != nil {
+			return err
+		}
+		err = f(c.conn)
+		if isLdapNetworkError(err) {
+			c.conn.Close()
+			continue
+		}
+		p.put(c)
+		return err
+	}
+	return err
+}
+
+// Bind as the user to check the credential, the connection is bound as the manager again before it returns to the
+// pool
+func (p *LdapPool) authenticate(dn string, credential string) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var c *pooledLdapConn
+		c, err = p.get()
+		if err != nil {
+			return err
+		}
+		err = c.conn.Bind(dn, credential)
+		if isLdapNetworkError(err) {
+			c.conn.Close()
+			continue
+		}
+		if rebindErr := p.bind(c.conn); rebindErr != nil {
+			log.Printf("Dropping LDAP connection that failed to rebind: %s", rebindErr)
+			c.conn.Close()
+		} else {
+			p.put(c)
+		}
+		return err
+	}
+	return err
+}
+
+// Number of idle connections
+func (p *LdapPool) Len() int {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	return len(p.idle)
+}
+
+// Close all idle connections
+func (p *LdapPool) Close() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	for _, c := range p.idle {
+		c.conn.Close()
+	}
+	p.idle = make([]*pooledLdapConn, 0, p.size)
+}
+
+func isLdapNetworkError(err error) bool {
+	return err != nil && ldap.IsErrorWithCode(err, ldap.ErrorNetwork)
+}
+
+// Indexes of n servers in the order they are tried, starting with the active one
+func failoverOrder(n int, active int) []int {
+	order := make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		order = append(order, (active+i)%n)
+	}
+	return order
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/ldap.v2"
+	"testing"
+	"time"
+)
+
+type fakeLdapConn struct {
+	id        int
+	boundAs   string
+	bindErr   error
+	searchErr error
+	closed    bool
+}
+
+func (c *fakeLdapConn) Bind(username, password string) error {
+	if c.bindErr != nil {
+		return c.bindErr
+	}
+	if password != "secret" {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("Invalid credentials"))
+	}
+	c.boundAs = username
+	return nil
+}
+
+func (c *fakeLdapConn) Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if c.searchErr != nil {
+		return nil, c.searchErr
+	}
+	return &ldap.SearchResult{Entries: []*ldap.Entry{ldap.NewEntry("cn=test", nil)}}, nil
+}
+
+func (c *fakeLdapConn) Close() {
+	c.closed = true
+}
+
+func newFakeLdapPool(size int, healthInterval time.Duration) (*LdapPool, *[]*fakeLdapConn) {
+	conns := make([]*fakeLdapConn, 0)
+	bind := func(conn ldapConn) error {
+		return conn.Bind("manager", "secret")
+	}
+	dial := func() (ldapConn, error) {
+		conn := &fakeLdapConn{id: len(conns)}
+		conns = append(conns, conn)
+		return conn, bind(conn)
+	}
+	return newLdapPool(size, healthInterval, dial, bind), &conns
+}
+
+func search(conn ldapConn) error {
+	_, err := conn.Search(&ldap.SearchRequest{})
+	return err
+}
+
+func TestLdapPoolReusesConnections(t *testing.T) {
+	pool, conns := newFakeLdapPool(2, time.Minute)
+	assert.NoError(t, pool.with(search))
+	assert.NoError(t, pool.with(search))
+	assert.Len(t, *conns, 1)
+	assert.Equal(t, 1, pool.Len())
+
+	pool.Close()
+	assert.True(t, (*conns)[0].closed)
+	assert.Equal(t, 0, pool.Len())
+}
+
+func TestLdapPoolSize(t *testing.T) {
+	pool, conns := newFakeLdapPool(1, time.Minute)
+	c1, _ := pool.get()
+	c2, _ := pool.get()
+	pool.put(c1)
+	pool.put(c2)
+	assert.Len(t, *conns, 2)
+	assert.Equal(t, 1, pool.Len())
+	assert.False(t, (*conns)[0].closed)
+	assert.True(t, (*conns)[1].closed)
+}
+
+func TestLdapPoolRetriesNetworkErrors(t *testing.T) {
+	pool, conns := newFakeLdapPool(2, time.Minute)
+	assert.NoError(t, pool.with(search))
+
+	// The connection dropped, the search is retried on a new one
+	(*conns)[0].searchErr = ldap.NewError(ldap.ErrorNetwork, errors.New("ldap: connection closed"))
+	assert.NoError(t, pool.with(search))
+	assert.Len(t, *conns, 2)
+	assert.True(t, (*conns)[0].closed)
+	assert.Equal(t, 1, pool.Len())
+
+	// Other errors are returned as is, the connection stays
+	(*conns)[1].searchErr = ldap.NewError(ldap.LDAPResultNoSuchObject, errors.New("No such object"))
+	assert.Error(t, pool.with(search))
+	assert.Len(t, *conns, 2)
+	assert.Equal(t, 1, pool.Len())
+}
+
+func TestLdapPoolHealthCheck(t *testing.T) {
+	pool, conns := newFakeLdapPool(2, 0)
+	assert.NoError(t, pool.with(search))
+
+	// Idle connection fails its rebind, a new one is dialed
+	(*conns)[0].bindErr = ldap.NewError(ldap.ErrorNetwork, errors.New("ldap: connection closed"))
+	assert.NoError(t, pool.with(search))
+	assert.Len(t, *conns, 2)
+	assert.True(t, (*conns)[0].closed)
+}
+
+func TestLdapPoolDialError(t *testing.T) {
+	pool := newLdapPool(2, time.Minute, func() (ldapConn, error) {
+		return nil, errors.New("Connection refused")
+	}, func(conn ldapConn) error {
+		return nil
+	})
+	assert.EqualError(t, pool.with(search), "Connection refused")
+}
+
+func TestLdapPoolAuthenticateRebinds(t *testing.T) {
+	pool, conns := newFakeLdapPool(2, time.Minute)
+	assert.NoError(t, pool.authenticate("cn=john", "secret"))
+	assert.Equal(t, "manager", (*conns)[0].boundAs)
+	assert.Equal(t, 1, pool.Len())
+
+	assert.Error(t, pool.authenticate("cn=john", "wrong"))
+	assert.Equal(t, "manager", (*conns)[0].boundAs)
+	assert.Equal(t, 1, pool.Len())
+}
+
+func TestFailoverOrder(t *testing.T) {
+	assert.Equal(t, []int{0, 1, 2}, failoverOrder(3, 0))
+	assert.Equal(t, []int{2, 0, 1}, failoverOrder(3, 2))
+	assert.Empty(t, failoverOrder(0, 0))
+}
@@ -0,0 +1,334 @@
+package main
+
+// Local API of the agent, only reachable from the host itself. Shows what the agent is doing and lets engineers on
+// the host freeze automation during an incident: running commands are stopped and new ones are refused until resumed.
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const LOCAL_HISTORY_SIZE int = 100 // Commands kept in the local history
+
+// Freeze of the agent, persisted so it survives a restart
+type FreezeState struct {
+	Reason string
+	Since  int64 // Unix timestamp
+}
+
+// Command as shown by the local API, without the command itself as it may contain secrets
+type LocalCmdRecord struct {
+	Id         string
+	TemplateId string
+	Type       string
+	State      string
+	ExitCode   int
+	Started    int64 // Unix timestamp
+	Finished   int64 // Unix timestamp, 0 while running
+}
+
+// Load the freeze, nil if the agent is not frozen
+func loadFreezeState(file string) *FreezeState {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	var f FreezeState
+	if je := json.Unmarshal(b, &f); je != nil {
+		// Better safe than sorry, a corrupt file still means someone froze the agent
+		log.Printf("Invalid freeze state in %s: %s", file, je)
+		return &FreezeState{Reason: "unknown, freeze state is corrupt", Since: time.Now().Unix()}
+	}
+	return &f
+}
+
+// Persist the freeze, nil removes it
+func saveFreezeState(file string, f *FreezeState) error {
+	if f == nil {
+		err := os.Remove(file)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	b, je := json.Marshal(f)
+	if je != nil {
+		return je
+	}
+	return ioutil.WriteFile(file, b, 0600)
+}
+
+// Token of the local API, created on first start and only readable by the agent user
+func ensureLocalToken(file string) (string, error) {
+	if b, err := ioutil.ReadFile(file); err == nil && len(strings.TrimSpace(string(b))) > 0 {
+		return strings.TrimSpace(string(b)), nil
+	}
+	token, err := secureRandomString(32)
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(file, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Does the request carry the token? Either as bearer token or X-Auth header
+func validLocalToken(r *http.Request, token string) bool {
+	provided := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if len(provided) < 1 {
+		provided = r.Header.Get("X-Auth")
+	}
+	return len(token) > 0 && subtle.ConstantTimeCompare([]byte(provided), []byte(token)) == 1
+}
+
+// Record of a command
+func newLocalCmdRecord(c *Cmd) *LocalCmdRecord {
+	return &LocalCmdRecord{
+		Id:         c.Id,
+		TemplateId: c.TemplateId,
+		Type:       c.Type,
+		State:      c.GetState(),
+		ExitCode:   c.ExitCode,
+		Started:    time.Now().Unix(),
+	}
+}
+
+// Add to the history, the oldest records are dropped
+func appendLocalHistory(history []*LocalCmdRecord, record *LocalCmdRecord, max int) []*LocalCmdRecord {
+	history = append(history, record)
+	if len(history) > max {
+		history = history[len(history)-max:]
+	}
+	return history
+}
+
+// Is the agent frozen? Nil if not
+func (s *Client) Frozen() *FreezeState {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.freeze
+}
+
+// Stop all running commands and refuse new ones
+func (s *Client) Freeze(reason string) error {
+	f := &FreezeState{
+		Reason: reason,
+		Since:  time.Now().Unix(),
+	}
+	if err := saveFreezeState(conf.HomeFile("frozen.json"), f); err != nil {
+		return err
+	}
+	s.mux.Lock()
+	s.freeze = f
+	for _, c := range s.running {
+		select {
+		case c.stop <- reason:
+		default:
+			// Already stopping
+		}
+	}
+	s.mux.Unlock()
+	log.Printf("Agent frozen: %s", reason)
+	return nil
+}
+
+// Accept commands again
+func (s *Client) Resume() error {
+	if err := saveFreezeState(conf.HomeFile("frozen.json"), nil); err != nil {
+		return err
+	}
+	s.mux.Lock()
+	s.freeze = nil
+	s.mux.Unlock()
+	log.Printf("Agent resumed")
+	return nil
+}
+
+// Keep track of a command that starts executing
+func (s *Client) trackRunning(c *Cmd) *LocalCmdRecord {
+	record := newLocalCmdRecord(c)
+	s.mux.Lock()
+	s.running[c.Id] = c
+	s.history = appendLocalHistory(s.history, record, LOCAL_HISTORY_SIZE)
+	s.mux.Unlock()
+	return record
+}
+
+// Command done, its final state goes to the history
+func (s *Client) finishRunning(c *Cmd, record *LocalCmdRecord) {
+	state := c.GetState()
+	s.mux.Lock()
+	delete(s.running, c.Id)
+	record.State = state
+	record.ExitCode = c.ExitCode
+	record.Finished = time.Now().Unix()
+	s.mux.Unlock()
+}
+
+// Refuse a command while frozen, the server stops the rollout it is part of
+func (s *Client) refuseCmd(c *Cmd, f *FreezeState) {
+	log.Printf("Refusing %s, agent is frozen: %s", c.Id, f.Reason)
+	c.LogError(fmt.Sprintf("Agent was frozen on the host since %s: %s", time.Unix(f.Since, 0).Format(time.RFC3339), f.Reason))
+	c._flushLogs()
+	c.NotifyServer("refused")
+	record := newLocalCmdRecord(c)
+	record.Finished = record.Started
+	s.mux.Lock()
+	s.history = appendLocalHistory(s.history, record, LOCAL_HISTORY_SIZE)
+	s.mux.Unlock()
+}
+
+// Listen on the unix socket if configured, on localhost otherwise
+func localListener() (net.Listener, error) {
+	if len(conf.ClientSocket) > 0 {
+		// Left behind by a previous run
+		os.Remove(conf.ClientSocket)
+		l, err := net.Listen("unix", conf.ClientSocket)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(conf.ClientSocket, 0660); err != nil {
+			l.Close()
+			return nil, err
+		}
+		return l, nil
+	}
+	return net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", conf.ClientPort))
+}
+
+// Start the local API
+func (s *Client) StartLocalApi() error {
+	token, err := ensureLocalToken(conf.HomeFile("agent.token"))
+	if err != nil {
+		return err
+	}
+	s.mux.Lock()
+	s.localToken = token
+	s.mux.Unlock()
+
+	l, err := localListener()
+	if err != nil {
+		return err
+	}
+
+	router := httprouter.New()
+	router.GET("/ping", Ping)
+	router.GET("/status", GetLocalStatus)
+	router.GET("/history", GetLocalHistory)
+	router.POST("/stop", PostLocalStop)
+	router.POST("/resume", PostLocalResume)
+	log.Printf("Starting local API of %s on %s", s.Id, l.Addr())
+	go func() {
+		log.Printf("Local API of %s stopped: %v", s.Id, http.Serve(l, router))
+	}()
+	return nil
+}
+
+// Check the token of a request to the local API
+func authLocal(r *http.Request) bool {
+	client.mux.RLock()
+	token := client.localToken
+	client.mux.RUnlock()
+	return validLocalToken(r, token)
+}
+
+// What the agent is doing right now
+func GetLocalStatus(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+
+	// Not under the lock of the client, the executor reports to the server which takes that lock
+	queue := client.executor.Status()
+	client.mux.RLock()
+	running := make([]*LocalCmdRecord, 0, len(client.running))
+	for _, record := range client.history {
+		if record.Finished == 0 && client.running[record.Id] != nil {
+			current := *record
+			current.State = client.running[record.Id].GetState()
+			running = append(running, &current)
+		}
+	}
+	jr.Set("id", client.Id)
+	jr.Set("version", VERSION)
+	jr.Set("frozen", client.freeze != nil)
+	jr.Set("freeze", client.freeze)
+	jr.Set("running", running)
+	jr.Set("queue", queue)
+	jr.Set("stream_connected", client.stream != nil)
+	jr.Set("authenticated", len(client.AuthToken) > 0)
+	jr.Set("server_instance_id", client.ConnectedServerInstanceId)
+	jr.Set("last_ping", client.lastPing)
+	client.mux.RUnlock()
+
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Recently executed commands, newest first
+func GetLocalHistory(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+
+	client.mux.RLock()
+	history := make([]LocalCmdRecord, 0, len(client.history))
+	for i := len(client.history) - 1; i >= 0; i-- {
+		history = append(history, *client.history[i])
+	}
+	client.mux.RUnlock()
+
+	jr.Set("history", history)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Stop everything and refuse new commands
+func PostLocalStop(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authLocal(r) {
+		jr.Error("Not authorized, use the token from agent.token in the home directory")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	reason := strings.TrimSpace(r.PostFormValue("reason"))
+	if len(reason) < 1 {
+		reason = "no reason given"
+	}
+	if err := client.Freeze(reason); err != nil {
+		jr.Error(fmt.Sprintf("Failed to freeze: %s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	jr.Set("frozen", true)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Accept commands again
+func PostLocalResume(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authLocal(r) {
+		jr.Error("Not authorized, use the token from agent.token in the home directory")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	if err := client.Resume(); err != nil {
+		jr.Error(fmt.Sprintf("Failed to resume: %s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	jr.Set("frozen", false)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
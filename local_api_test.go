@@ -0,0 +1,76 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestFreezeStatePersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "indispenso_test_")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "frozen.json")
+
+	assert.Nil(t, loadFreezeState(file))
+	assert.NoError(t, saveFreezeState(file, &FreezeState{Reason: "incident", Since: 1}))
+	f := loadFreezeState(file)
+	assert.Equal(t, "incident", f.Reason)
+	assert.Equal(t, int64(1), f.Since)
+	info, _ := os.Stat(file)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// Resumed
+	assert.NoError(t, saveFreezeState(file, nil))
+	assert.Nil(t, loadFreezeState(file))
+	assert.NoError(t, saveFreezeState(file, nil))
+
+	// Corrupt state keeps the agent frozen
+	assert.NoError(t, ioutil.WriteFile(file, []byte("{"), 0600))
+	assert.NotNil(t, loadFreezeState(file))
+}
+
+func TestLocalToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "indispenso_test_")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "agent.token")
+
+	token, err := ensureLocalToken(file)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, token)
+	info, _ := os.Stat(file)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// Stable across restarts
+	again, err := ensureLocalToken(file)
+	assert.NoError(t, err)
+	assert.Equal(t, token, again)
+
+	r, _ := http.NewRequest("POST", "/stop", nil)
+	assert.False(t, validLocalToken(r, token))
+	r.Header.Set("Authorization", "Bearer "+token)
+	assert.True(t, validLocalToken(r, token))
+	r.Header.Set("Authorization", "Bearer other")
+	assert.False(t, validLocalToken(r, token))
+	r.Header.Del("Authorization")
+	r.Header.Set("X-Auth", token)
+	assert.True(t, validLocalToken(r, token))
+
+	// Never without a token
+	r.Header.Set("X-Auth", "")
+	assert.False(t, validLocalToken(r, ""))
+}
+
+func TestLocalHistorySize(t *testing.T) {
+	history := make([]*LocalCmdRecord, 0)
+	for _, id := range []string{"a", "b", "c"} {
+		history = appendLocalHistory(history, &LocalCmdRecord{Id: id}, 2)
+	}
+	assert.Len(t, history, 2)
+	assert.Equal(t, "b", history[0].Id)
+	assert.Equal(t, "c", history[1].Id)
+}
@@ -15,10 +15,15 @@ var server *Server
 var client *Client
 var log *Log
 var shutdown chan bool = make(chan bool)
+var VERSION string = "2.0.0" // Set at build time with -ldflags "-X main.VERSION=2.1.0", see build.sh
 
 const CLIENT_PING_INTERVAL int = 60                       // In seconds
+const CLIENT_FACTS_INTERVAL int = 900                     // In seconds
+const TAG_PROVIDER_TIMEOUT int = 10                       // In seconds
 const LONG_POLL_TIMEOUT time.Duration = time.Duration(30) // In seconds
 const DEFAULT_COMMAND_TIMEOUT int = 300                   // In seconds
+const DEFAULT_DELIVERY_TIMEOUT int = 3600                 // In seconds a command waits for an offline client
+const CMD_ACK_TIMEOUT int = 30                            // In seconds before an unacknowledged command is sent again
 
 func main() {
 	// Log
@@ -36,6 +41,14 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// Export or import templates instead of running
+	if conf.IsTemplateBundleCommand() {
+		if err := runTemplateBundleCommand(); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
 	// Handle signals
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
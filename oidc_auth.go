@@ -0,0 +1,688 @@
+package main
+
+// OpenID Connect single sign-on. The console sends the user to the identity provider with the authorization code
+// flow and PKCE, the callback verifies the ID token against the keys of the provider and creates or updates the user
+// from its claims. Users are linked to the issuer and subject of the token, the username claim only names new users.
+// The user then logs in through /auth with a single use ticket as credential, so the two factor token is still asked
+// for users that set it up.
+
+import (
+	"crypto"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const OIDC_LOGIN_TIMEOUT time.Duration = 10 * time.Minute // Time to log in at the identity provider
+const OIDC_TICKET_TIMEOUT time.Duration = 2 * time.Minute // Time to use the ticket of the callback in /auth
+const OIDC_CLOCK_SKEW time.Duration = time.Minute         // Leeway for the expiry of ID tokens
+const OIDC_STATE_COOKIE string = "indispenso_oidc_state"  // Binds the login to the browser that started it
+const OIDC_OPEN_LOGINS int = 1000                         // Logins that were started and not finished, a new one drops the oldest
+
+type OidcConfig struct {
+	Issuer        string              // URL of the identity provider, with discovery at /.well-known/openid-configuration
+	ClientId      string              // Client registered at the identity provider
+	ClientSecret  string              // Empty for public clients, PKCE protects the code either way
+	Scopes        []string            // openid, profile and email if empty
+	UsernameClaim string              // Claim with the username of new users, preferred_username if empty
+	EmailClaim    string              // Claim with the email address, email if empty
+	RolesClaim    string              // Claim with the groups or roles of the user, e.g. groups
+	ClaimRoles    map[string][]string // Roles per value of the roles claim
+	ClaimTeams    map[string][]string // Teams per value of the roles claim
+	DisplayName   string              // Name of the identity provider on the login page
+	Timeout       int                 // Seconds for requests to the identity provider, 10 if 0
+}
+
+func (c *OidcConfig) Validate() error {
+	if len(c.Issuer) < 1 || len(c.ClientId) < 1 {
+		return errors.New("Issuer and ClientId are required")
+	}
+	for value, roles := range c.ClaimRoles {
+		for _, role := range roles {
+			if !isRole(role, configuredRoles()) {
+				return fmt.Errorf("Unknown role %s of claim value %s", role, value)
+			}
+		}
+	}
+	if (len(c.ClaimRoles) > 0 || len(c.ClaimTeams) > 0) && len(c.RolesClaim) < 1 {
+		return errors.New("Claim values are mapped to roles or teams, but RolesClaim is empty")
+	}
+	return nil
+}
+
+func (c *OidcConfig) GetScopes() []string {
+	if len(c.Scopes) > 0 {
+		return c.Scopes
+	}
+	return []string{"openid", "profile", "email"}
+}
+
+func (c *OidcConfig) GetUsernameClaim() string {
+	if len(c.UsernameClaim) > 0 {
+		return c.UsernameClaim
+	}
+	return "preferred_username"
+}
+
+func (c *OidcConfig) GetEmailClaim() string {
+	if len(c.EmailClaim) > 0 {
+		return c.EmailClaim
+	}
+	return "email"
+}
+
+func (c *OidcConfig) GetDisplayName() string {
+	if len(c.DisplayName) > 0 {
+		return c.DisplayName
+	}
+	return "Single sign-on"
+}
+
+func (c *OidcConfig) GetTimeout() time.Duration {
+	if c.Timeout > 0 {
+		return time.Duration(c.Timeout) * time.Second
+	}
+	return 10 * time.Second
+}
+
+// Roles and teams of the values of the roles claim, case insensitive
+func (c *OidcConfig) ClaimMapping(values []string) (roles []string, teams []string) {
+	names := make(map[string]bool)
+	for _, value := range values {
+		names[strings.ToLower(value)] = true
+	}
+	roles = make([]string, 0)
+	for value, r := range c.ClaimRoles {
+		if names[strings.ToLower(value)] {
+			roles = append(roles, r...)
+		}
+	}
+	teams = make([]string, 0)
+	for value, t := range c.ClaimTeams {
+		if names[strings.ToLower(value)] {
+			teams = append(teams, t...)
+		}
+	}
+	roles = uniqueTags(roles)
+	teams = uniqueTags(teams)
+	sort.Strings(roles)
+	sort.Strings(teams)
+	return roles, teams
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+// Login started at the identity provider, by state
+type oidcLogin struct {
+	nonce    string
+	verifier string
+	created  time.Time
+}
+
+// Login finished at the identity provider, by ticket
+type oidcTicket struct {
+	login   string
+	created time.Time
+}
+
+type OidcUserStore interface {
+	LocalUserStore
+	ByName(username string) *User
+	ByOidcSubject(issuer string, subject string) *User
+}
+
+type OidcAuthenticator struct {
+	mux         sync.Mutex
+	config      *OidcConfig
+	userStore   OidcUserStore
+	client      *http.Client
+	redirectUri string
+	discovery   *oidcDiscovery
+	keys        map[string]*rsa.PublicKey // Signing keys of the identity provider by key id
+	logins      map[string]*oidcLogin
+	tickets     map[string]*oidcTicket
+}
+
+// Authenticator for the identity provider. Discovery happens on the first login, so the server starts while the
+// identity provider is down.
+func newOidcAuthenticator(c *OidcConfig, userStore OidcUserStore, redirectUri string) (*OidcAuthenticator, error) {
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("Cannot initialize OpenID Connect config due to: %s", err)
+	}
+	return &OidcAuthenticator{
+		config:      c,
+		userStore:   userStore,
+		client:      &http.Client{Timeout: c.GetTimeout()},
+		redirectUri: redirectUri,
+		keys:        make(map[string]*rsa.PublicKey),
+		logins:      make(map[string]*oidcLogin),
+		tickets:     make(map[string]*oidcTicket),
+	}, nil
+}
+
+// Log in with the ticket of the callback, only once
+func (a *OidcAuthenticator) auth(user *User, ar *AuthRequest) (*User, error) {
+	if user == nil {
+		return nil, errors.New("Cannot authenticate for unknown user.")
+	}
+	if !user.IsAuthType(AUTH_TYPE_OIDC) {
+		return nil, errors.New("User doesn't have OpenID Connect auth enabled")
+	}
+
+	a.mux.Lock()
+	ticket := a.tickets[ar.credential]
+	delete(a.tickets, ar.credential)
+	a.mux.Unlock()
+	if ticket == nil || time.Since(ticket.created) > OIDC_TICKET_TIMEOUT {
+		return nil, errors.New("Invalid or expired OpenID Connect ticket")
+	}
+	if ticket.login != user.Username {
+		return nil, errors.New("OpenID Connect ticket of another user")
+	}
+	return user, nil
+}
+
+// URL of the identity provider to log in at and the state of the login
+func (a *OidcAuthenticator) loginUrl() (string, string, error) {
+	d, err := a.discover()
+	if err != nil {
+		return "", "", err
+	}
+
+	login := &oidcLogin{nonce: oidcRandom(), verifier: oidcRandom(), created: time.Now()}
+	state := oidcRandom()
+	a.mux.Lock()
+	a.expire()
+	if len(a.logins) >= OIDC_OPEN_LOGINS {
+		// Anyone can start a login, so they must not pile up
+		a.dropOldestLogin()
+	}
+	a.logins[state] = login
+	a.mux.Unlock()
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", a.config.ClientId)
+	q.Set("redirect_uri", a.redirectUri)
+	q.Set("scope", strings.Join(a.config.GetScopes(), " "))
+	q.Set("state", state)
+	q.Set("nonce", login.nonce)
+	q.Set("code_challenge", pkceChallenge(login.verifier))
+	q.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + q.Encode(), state, nil
+}
+
+// Finish the login of the state with the code, returns the user and the ticket to log in with. The browser must send
+// the state it got when the login started, so a login started by someone else can not be finished in it.
+func (a *OidcAuthenticator) callback(code string, state string, browserState string) (*User, string, error) {
+	if len(state) < 1 || subtle.ConstantTimeCompare([]byte(state), []byte(browserState)) != 1 {
+		return nil, "", errors.New("Login was started in another browser, please try again")
+	}
+	a.mux.Lock()
+	login := a.logins[state]
+	delete(a.logins, state)
+	a.mux.Unlock()
+	if login == nil || time.Since(login.created) > OIDC_LOGIN_TIMEOUT {
+		return nil, "", errors.New("Unknown or expired login, please try again")
+	}
+
+	d, err := a.discover()
+	if err != nil {
+		return nil, "", err
+	}
+	idToken, err := a.exchange(d, code, login.verifier)
+	if err != nil {
+		return nil, "", err
+	}
+	claims, err := a.verifyIdToken(d, idToken, login.nonce)
+	if err != nil {
+		return nil, "", err
+	}
+
+	issuer := claimString(claims, "iss")
+	subject := claimString(claims, "sub")
+	if len(subject) < 1 {
+		return nil, "", errors.New("ID token has no sub claim")
+	}
+	email := claimString(claims, a.config.GetEmailClaim())
+
+	// The username claim can change or be given to someone else at the identity provider, so it only links a user once
+	user := a.userStore.ByOidcSubject(issuer, subject)
+	if user == nil {
+		username := claimString(claims, a.config.GetUsernameClaim())
+		if len(username) < 1 {
+			return nil, "", fmt.Errorf("ID token has no %s claim", a.config.GetUsernameClaim())
+		}
+		user = a.userStore.ByName(username)
+		if user == nil {
+			user, err = a.userStore.AddUser(username, email, AUTH_TYPE_OIDC)
+			if err != nil {
+				return nil, "", fmt.Errorf("User authenticated by OpenID Connect but cannot be stored in user store due to: %s", err)
+			}
+		} else if user.oidcLinked() {
+			return nil, "", fmt.Errorf("User %s is linked to another OpenID Connect account", username)
+		}
+	}
+
+	// Existing users must have OpenID Connect enabled, so the identity provider can not take over local users
+	if !user.IsAuthType(AUTH_TYPE_OIDC) {
+		return nil, "", errors.New("User doesn't have OpenID Connect auth enabled")
+	}
+
+	// Roles and teams follow the claim on every login
+	changes := map[string]interface{}{"EmailAddress": email, "OidcIssuer": issuer, "OidcSubject": subject}
+	if len(a.config.RolesClaim) > 0 {
+		for k, v := range oidcClaimChanges(user, claimStrings(claims, a.config.RolesClaim), a.config) {
+			changes[k] = v
+		}
+	}
+	if err := a.userStore.UpdateUser(user, changes); err != nil {
+		return nil, "", fmt.Errorf("User authenticated by OpenID Connect but cannot be updated due to: %s", err)
+	}
+
+	ticket := oidcRandom()
+	a.mux.Lock()
+	a.tickets[ticket] = &oidcTicket{login: user.Username, created: time.Now()}
+	a.mux.Unlock()
+	return user, ticket, nil
+}
+
+// Is the user linked to an OpenID Connect account?
+func (u *User) oidcLinked() bool {
+	u.mux.RLock()
+	defer u.mux.RUnlock()
+	return len(u.OidcSubject) > 0
+}
+
+// Drop logins and tickets that were not finished in time, must hold the lock
+func (a *OidcAuthenticator) expire() {
+	for state, login := range a.logins {
+		if time.Since(login.created) > OIDC_LOGIN_TIMEOUT {
+			delete(a.logins, state)
+		}
+	}
+	for ticket, t := range a.tickets {
+		if time.Since(t.created) > OIDC_TICKET_TIMEOUT {
+			delete(a.tickets, ticket)
+		}
+	}
+}
+
+// Drop the login that was started first, must hold the lock
+func (a *OidcAuthenticator) dropOldestLogin() {
+	var oldest string
+	for state, login := range a.logins {
+		if len(oldest) < 1 || login.created.Before(a.logins[oldest].created) {
+			oldest = state
+		}
+	}
+	delete(a.logins, oldest)
+}
+
+// Endpoints of the identity provider, cached once they are found
+func (a *OidcAuthenticator) discover() (*oidcDiscovery, error) {
+	a.mux.Lock()
+	d := a.discovery
+	a.mux.Unlock()
+	if d != nil {
+		return d, nil
+	}
+
+	d = &oidcDiscovery{}
+	if err := a.getJson(strings.TrimRight(a.config.Issuer, "/")+"/.well-known/openid-configuration", d); err != nil {
+		return nil, fmt.Errorf("OpenID Connect discovery failed due to: %s", err)
+	}
+	if strings.TrimRight(d.Issuer, "/") != strings.TrimRight(a.config.Issuer, "/") {
+		return nil, fmt.Errorf("OpenID Connect discovery returned issuer %s instead of %s", d.Issuer, a.config.Issuer)
+	}
+	if len(d.AuthorizationEndpoint) < 1 || len(d.TokenEndpoint) < 1 || len(d.JwksUri) < 1 {
+		return nil, errors.New("OpenID Connect discovery misses the authorization, token or JWKS endpoint")
+	}
+
+	a.mux.Lock()
+	a.discovery = d
+	a.mux.Unlock()
+	return d, nil
+}
+
+func (a *OidcAuthenticator) getJson(uri string, v interface{}) error {
+	resp, err := a.client.Get(uri)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", uri, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Exchange the code for the ID token, with the verifier of the PKCE challenge
+func (a *OidcAuthenticator) exchange(d *oidcDiscovery, code string, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", a.redirectUri)
+	form.Set("client_id", a.config.ClientId)
+	form.Set("code_verifier", verifier)
+	if len(a.config.ClientSecret) > 0 {
+		form.Set("client_secret", a.config.ClientSecret)
+	}
+	resp, err := a.client.PostForm(d.TokenEndpoint, form)
+	if err != nil {
+		return "", fmt.Errorf("Token request failed due to: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("Token request failed due to: %s", err)
+	}
+
+	var tokens struct {
+		IdToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return "", fmt.Errorf("Invalid token response with status %d", resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK || len(tokens.Error) > 0 {
+		return "", fmt.Errorf("Token request failed: %s %s", tokens.Error, tokens.ErrorDescription)
+	}
+	if len(tokens.IdToken) < 1 {
+		return "", errors.New("Token response has no ID token")
+	}
+	return tokens.IdToken, nil
+}
+
+// Claims of the ID token after checking its RS256 signature and its claims
+func (a *OidcAuthenticator) verifyIdToken(d *oidcDiscovery, token string, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("Invalid ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJwtPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("Invalid ID token header: %s", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("Unsupported ID token algorithm %s", header.Alg)
+	}
+	key, err := a.signingKey(d, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("Invalid ID token signature")
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature); err != nil {
+		return nil, errors.New("Invalid ID token signature")
+	}
+
+	claims := make(map[string]interface{})
+	if err := decodeJwtPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("Invalid ID token claims: %s", err)
+	}
+	if err := validateIdTokenClaims(claims, d.Issuer, a.config.ClientId, nonce, time.Now()); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// Key of the identity provider, the keys are fetched again for unknown key ids as keys rotate
+func (a *OidcAuthenticator) signingKey(d *oidcDiscovery, kid string) (*rsa.PublicKey, error) {
+	a.mux.Lock()
+	key := a.keys[kid]
+	a.mux.Unlock()
+	if key != nil {
+		return key, nil
+	}
+
+	var jwks struct {
+		Keys []*jsonWebKey `json:"keys"`
+	}
+	if err := a.getJson(d.JwksUri, &jwks); err != nil {
+		return nil, fmt.Errorf("Cannot fetch the keys of the identity provider due to: %s", err)
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range jwks.Keys {
+		k, err := jwk.rsaPublicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = k
+	}
+	a.mux.Lock()
+	a.keys = keys
+	a.mux.Unlock()
+
+	if key = keys[kid]; key == nil {
+		return nil, fmt.Errorf("Unknown ID token key %s", kid)
+	}
+	return key, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func (k *jsonWebKey) rsaPublicKey() (*rsa.PublicKey, error) {
+	if k.Kty != "RSA" || (len(k.Use) > 0 && k.Use != "sig") {
+		return nil, errors.New("Not an RSA signing key")
+	}
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	exponent := new(big.Int).SetBytes(e)
+	if len(n) < 1 || !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+		return nil, errors.New("Invalid RSA key")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+}
+
+func decodeJwtPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// Issuer, audience, expiry and nonce of the ID token
+func validateIdTokenClaims(claims map[string]interface{}, issuer string, clientId string, nonce string, now time.Time) error {
+	if claimString(claims, "iss") != issuer {
+		return fmt.Errorf("ID token of issuer %s instead of %s", claimString(claims, "iss"), issuer)
+	}
+	audience := claimStrings(claims, "aud")
+	found := false
+	for _, aud := range audience {
+		if aud == clientId {
+			found = true
+		}
+	}
+	if !found {
+		return errors.New("ID token is not meant for this client")
+	}
+	if azp := claimString(claims, "azp"); len(audience) > 1 && azp != clientId {
+		return errors.New("ID token is not meant for this client")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("ID token has no expiry")
+	}
+	if now.Add(-OIDC_CLOCK_SKEW).After(time.Unix(int64(exp), 0)) {
+		return errors.New("ID token expired")
+	}
+	if claimString(claims, "nonce") != nonce {
+		return errors.New("ID token of another login")
+	}
+	return nil
+}
+
+// String value of a claim, empty if it is missing or not a string
+func claimString(claims map[string]interface{}, name string) string {
+	s, _ := claims[name].(string)
+	return s
+}
+
+// Values of a claim that is a string or a list of strings
+func claimStrings(claims map[string]interface{}, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return []string{}
+}
+
+// Changes of the roles and teams of the user for the values of the roles claim, see ldapGroupChanges
+func oidcClaimChanges(u *User, values []string, c *OidcConfig) map[string]interface{} {
+	roles, teams := c.ClaimMapping(values)
+	u.mux.RLock()
+	previousRoles := u.OidcRoles
+	previousTeams := u.OidcTeams
+	u.mux.RUnlock()
+	userRoles, userTeams := u.syncGrants(previousRoles, previousTeams, roles, teams)
+	return map[string]interface{}{
+		"Roles":     userRoles,
+		"Teams":     userTeams,
+		"OidcRoles": roles,
+		"OidcTeams": teams,
+	}
+}
+
+// Code verifier of PKCE hashed for the code challenge
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Random string for states, nonces, verifiers and tickets, URL safe without padding as PKCE requires
+func oidcRandom() string {
+	b := make([]byte, 32)
+	if _, err := crand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Is single sign-on available? For the login page
+func GetOidcInfo(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	oidc := server.authService.oidc
+	jr.Set("enabled", oidc != nil)
+	if oidc != nil {
+		jr.Set("name", oidc.config.GetDisplayName())
+	}
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Send the user to the identity provider
+func GetOidcLogin(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	oidc := server.authService.oidc
+	if oidc == nil {
+		http.Redirect(w, r, oidcConsoleUrl(url.Values{"oidc_error": {"Single sign-on is not enabled"}}), http.StatusFound)
+		return
+	}
+	uri, state, err := oidc.loginUrl()
+	if err != nil {
+		log.Printf("%s", err)
+		http.Redirect(w, r, oidcConsoleUrl(url.Values{"oidc_error": {"Identity provider not available"}}), http.StatusFound)
+		return
+	}
+
+	// Lax as the identity provider sends the user back from another site
+	http.SetCookie(w, &http.Cookie{
+		Name:     OIDC_STATE_COOKIE,
+		Value:    state,
+		Path:     "/auth/oidc/",
+		MaxAge:   int(OIDC_LOGIN_TIMEOUT.Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, uri, http.StatusFound)
+}
+
+// The identity provider sends the user back, the console logs in with the ticket
+func GetOidcCallback(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	oidc := server.authService.oidc
+	if oidc == nil {
+		http.Redirect(w, r, oidcConsoleUrl(url.Values{"oidc_error": {"Single sign-on is not enabled"}}), http.StatusFound)
+		return
+	}
+	browserState := ""
+	if cookie, err := r.Cookie(OIDC_STATE_COOKIE); err == nil {
+		browserState = cookie.Value
+	}
+	http.SetCookie(w, &http.Cookie{Name: OIDC_STATE_COOKIE, Path: "/auth/oidc/", MaxAge: -1, Secure: true, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+	q := r.URL.Query()
+	if e := q.Get("error"); len(e) > 0 {
+		http.Redirect(w, r, oidcConsoleUrl(url.Values{"oidc_error": {strings.TrimSpace(e + " " + q.Get("error_description"))}}), http.StatusFound)
+		return
+	}
+	user, ticket, err := oidc.callback(q.Get("code"), q.Get("state"), browserState)
+	if err != nil {
+		log.Printf("%s", err)
+		http.Redirect(w, r, oidcConsoleUrl(url.Values{"oidc_error": {"Single sign-on failed"}}), http.StatusFound)
+		return
+	}
+
+	// Users with security keys are asked for them when the console logs in
+	totp := "0"
+	if user.HasTwoFactor() && !user.HasWebauthn() {
+		totp = "1"
+	}
+	http.Redirect(w, r, oidcConsoleUrl(url.Values{"oidc": {ticket}, "username": {user.Username}, "totp": {totp}}), http.StatusFound)
+}
+
+// Login page of the console with the parameters, spaces as %20 as the console decodes with decodeURIComponent
+func oidcConsoleUrl(params url.Values) string {
+	return "/console/#!login?" + strings.Replace(params.Encode(), "+", "%20", -1)
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Identity provider with discovery, keys and a token endpoint that checks PKCE
+type mockIdp struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	kid    string
+	claims map[string]interface{} // Claims of the next ID token
+	mux    sync.Mutex
+	codes  map[string]url.Values // Authorization requests by code
+}
+
+func newMockIdp(t *testing.T) *mockIdp {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	idp := &mockIdp{key: key, kid: "key-1", codes: make(map[string]url.Values)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": idp.kid,
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		idp.mux.Lock()
+		authorize := idp.codes[r.PostForm.Get("code")]
+		delete(idp.codes, r.PostForm.Get("code"))
+		idp.mux.Unlock()
+		if authorize == nil || r.PostForm.Get("grant_type") != "authorization_code" || r.PostForm.Get("client_id") != authorize.Get("client_id") || r.PostForm.Get("redirect_uri") != authorize.Get("redirect_uri") {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_grant"}`)
+			return
+		}
+		if pkceChallenge(r.PostForm.Get("code_verifier")) != authorize.Get("code_challenge") {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_grant","error_description":"PKCE verification failed"}`)
+			return
+		}
+		claims := map[string]interface{}{"iss": idp.server.URL, "aud": authorize.Get("client_id"), "exp": time.Now().Add(time.Minute).Unix(), "nonce": authorize.Get("nonce")}
+		for k, v := range idp.claims {
+			claims[k] = v
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(idp.key, "RS256", claims), "access_token": "access"})
+	})
+	idp.server = httptest.NewServer(mux)
+	return idp
+}
+
+// The user logs in at the identity provider, which redirects back with a code
+func (idp *mockIdp) authorize(t *testing.T, loginUrl string) (code string, state string) {
+	u, err := url.Parse(loginUrl)
+	assert.NoError(t, err)
+	assert.Equal(t, idp.server.URL+"/authorize", u.Scheme+"://"+u.Host+u.Path)
+	code = oidcRandom()
+	idp.mux.Lock()
+	idp.codes[code] = u.Query()
+	idp.mux.Unlock()
+	return code, u.Query().Get("state")
+}
+
+func (idp *mockIdp) sign(key *rsa.PrivateKey, alg string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": idp.kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signed))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func newTestOidcAuthenticator(t *testing.T, idp *mockIdp, userStore OidcUserStore) *OidcAuthenticator {
+	config := &OidcConfig{
+		Issuer:     idp.server.URL,
+		ClientId:   "indispenso",
+		RolesClaim: "groups",
+		ClaimRoles: map[string][]string{"ops": []string{"requester", "approver"}},
+		ClaimTeams: map[string][]string{"ops": []string{"ops"}},
+	}
+	a, err := newOidcAuthenticator(config, userStore, "https://indispenso.local/auth/oidc/callback")
+	assert.NoError(t, err)
+	return a
+}
+
+func TestOidcLogin(t *testing.T) {
+	idp := newMockIdp(t)
+	defer idp.server.Close()
+	idp.claims = map[string]interface{}{"sub": "u-1", "preferred_username": "john", "email": "john@example.com", "groups": []string{"ops", "dev"}}
+	userStore := &UserStore{}
+	a := newTestOidcAuthenticator(t, idp, userStore)
+
+	loginUrl, state, err := a.loginUrl()
+	assert.NoError(t, err)
+	q, _ := url.ParseQuery(loginUrl[strings.Index(loginUrl, "?")+1:])
+	assert.Equal(t, "code", q.Get("response_type"))
+	assert.Equal(t, "indispenso", q.Get("client_id"))
+	assert.Equal(t, "https://indispenso.local/auth/oidc/callback", q.Get("redirect_uri"))
+	assert.Equal(t, "openid profile email", q.Get("scope"))
+	assert.Equal(t, "S256", q.Get("code_challenge_method"))
+	assert.Len(t, q.Get("code_challenge"), 43)
+
+	assert.Equal(t, state, q.Get("state"))
+
+	// Just in time user with the roles of the claim
+	code, state := idp.authorize(t, loginUrl)
+	user, ticket, err := a.callback(code, state, state)
+	assert.NoError(t, err)
+	assert.Equal(t, "john", user.Username)
+	assert.Equal(t, "john@example.com", user.EmailAddress)
+	assert.True(t, user.IsAuthType(AUTH_TYPE_OIDC))
+	assert.Equal(t, map[string]bool{"approver": true, "requester": true}, user.Roles)
+	assert.Equal(t, []string{"ops"}, user.Teams)
+	assert.Equal(t, user, userStore.ByName("john"))
+
+	// The ticket logs in once
+	_, err = a.auth(user, &AuthRequest{login: "john", credential: "guess"})
+	assert.Error(t, err)
+	res, err := a.auth(user, &AuthRequest{login: "john", credential: ticket})
+	assert.NoError(t, err)
+	assert.Equal(t, user, res)
+	_, err = a.auth(user, &AuthRequest{login: "john", credential: ticket})
+	assert.Error(t, err)
+
+	// Next login without the group revokes its roles, the code and state can not be used again
+	idp.claims["groups"] = []string{"dev"}
+	code, state = idp.authorize(t, loginUrl)
+	_, _, err = a.callback(code, state, state)
+	assert.EqualError(t, err, "Unknown or expired login, please try again")
+	loginUrl, _, _ = a.loginUrl()
+	code, state = idp.authorize(t, loginUrl)
+	user, _, err = a.callback(code, state, state)
+	assert.NoError(t, err)
+	assert.Empty(t, user.Roles)
+	assert.Empty(t, user.Teams)
+}
+
+func TestOidcTwoFactorStillRequired(t *testing.T) {
+	idp := newMockIdp(t)
+	defer idp.server.Close()
+	idp.claims = map[string]interface{}{"sub": "u-1", "preferred_username": "john"}
+	userStore := &UserStore{}
+	a := newTestOidcAuthenticator(t, idp, userStore)
+	as := newAuthService(userStore, []Authenticator{a}, newGAuthAuthenticator())
+
+	loginUrl, _, _ := a.loginUrl()
+	code, state := idp.authorize(t, loginUrl)
+	user, ticket, err := a.callback(code, state, state)
+	assert.NoError(t, err)
+	user.TotpSecret = "JBSWY3DPEHPK3PXP"
+	user.TotpSecretValidated = true
+	user.AuthType |= AUTH_TYPE_TWO_FACTOR
+
+	// The ticket passes the first factor, the token fails the second
+	_, err = as.authUser(&AuthRequest{login: "john", credential: ticket, token: "abcdef"})
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), "User not authenticated")
+}
+
+func TestOidcLocalUserNotTakenOver(t *testing.T) {
+	idp := newMockIdp(t)
+	defer idp.server.Close()
+	idp.claims = map[string]interface{}{"sub": "u-1", "preferred_username": "admin"}
+	userStore := &UserStore{}
+	userStore.CreateUser("admin", "secret", "", []string{"admin"})
+	a := newTestOidcAuthenticator(t, idp, userStore)
+
+	loginUrl, _, _ := a.loginUrl()
+	code, state := idp.authorize(t, loginUrl)
+	_, _, err := a.callback(code, state, state)
+	assert.EqualError(t, err, "User doesn't have OpenID Connect auth enabled")
+}
+
+func TestOidcRequiresPkceVerifier(t *testing.T) {
+	idp := newMockIdp(t)
+	defer idp.server.Close()
+	idp.claims = map[string]interface{}{"sub": "u-1", "preferred_username": "john"}
+	a := newTestOidcAuthenticator(t, idp, &UserStore{})
+
+	loginUrl, _, _ := a.loginUrl()
+	code, state := idp.authorize(t, loginUrl)
+	a.logins[state].verifier = oidcRandom()
+	_, _, err := a.callback(code, state, state)
+	assert.EqualError(t, err, "Token request failed: invalid_grant PKCE verification failed")
+}
+
+func TestOidcLinksSubject(t *testing.T) {
+	idp := newMockIdp(t)
+	defer idp.server.Close()
+	idp.claims = map[string]interface{}{"sub": "u-1", "preferred_username": "john"}
+	userStore := &UserStore{}
+	a := newTestOidcAuthenticator(t, idp, userStore)
+	login := func() (*User, error) {
+		loginUrl, _, _ := a.loginUrl()
+		code, state := idp.authorize(t, loginUrl)
+		user, _, err := a.callback(code, state, state)
+		return user, err
+	}
+
+	john, err := login()
+	assert.NoError(t, err)
+	assert.Equal(t, idp.server.URL, john.OidcIssuer)
+	assert.Equal(t, "u-1", john.OidcSubject)
+
+	// A renamed account stays the same user
+	idp.claims["preferred_username"] = "johnny"
+	user, err := login()
+	assert.NoError(t, err)
+	assert.Equal(t, john, user)
+	assert.Nil(t, userStore.ByName("johnny"))
+
+	// Another account with the old name does not get the user
+	idp.claims = map[string]interface{}{"sub": "u-2", "preferred_username": "john"}
+	_, err = login()
+	assert.EqualError(t, err, "User john is linked to another OpenID Connect account")
+
+	// Tokens without subject are refused
+	idp.claims = map[string]interface{}{"preferred_username": "jane"}
+	_, err = login()
+	assert.EqualError(t, err, "ID token has no sub claim")
+}
+
+func TestOidcStateOfBrowser(t *testing.T) {
+	idp := newMockIdp(t)
+	defer idp.server.Close()
+	idp.claims = map[string]interface{}{"sub": "u-1", "preferred_username": "john"}
+	a := newTestOidcAuthenticator(t, idp, &UserStore{})
+
+	// A login started elsewhere can not be finished without its state cookie
+	loginUrl, _, _ := a.loginUrl()
+	code, state := idp.authorize(t, loginUrl)
+	_, _, err := a.callback(code, state, "")
+	assert.EqualError(t, err, "Login was started in another browser, please try again")
+	otherUrl, otherState, _ := a.loginUrl()
+	_, _, err = a.callback(code, state, otherState)
+	assert.Error(t, err)
+	code, state = idp.authorize(t, otherUrl)
+	_, _, err = a.callback(code, state, otherState)
+	assert.NoError(t, err)
+}
+
+func TestOidcOpenLoginLimit(t *testing.T) {
+	idp := newMockIdp(t)
+	defer idp.server.Close()
+	idp.claims = map[string]interface{}{"sub": "u-1", "preferred_username": "john"}
+	a := newTestOidcAuthenticator(t, idp, &UserStore{})
+
+	// Anyone can start logins, the oldest are dropped
+	firstUrl, firstState, _ := a.loginUrl()
+	for i := 0; i < OIDC_OPEN_LOGINS+10; i++ {
+		a.loginUrl()
+	}
+	assert.Len(t, a.logins, OIDC_OPEN_LOGINS)
+	code, state := idp.authorize(t, firstUrl)
+	_, _, err := a.callback(code, state, firstState)
+	assert.EqualError(t, err, "Unknown or expired login, please try again")
+
+	// The newest still work
+	loginUrl, loginState, _ := a.loginUrl()
+	code, state = idp.authorize(t, loginUrl)
+	_, _, err = a.callback(code, state, loginState)
+	assert.NoError(t, err)
+}
+
+func TestOidcVerifyIdToken(t *testing.T) {
+	idp := newMockIdp(t)
+	defer idp.server.Close()
+	a := newTestOidcAuthenticator(t, idp, &UserStore{})
+	d, err := a.discover()
+	assert.NoError(t, err)
+
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{"iss": idp.server.URL, "aud": "indispenso", "exp": time.Now().Add(time.Minute).Unix(), "nonce": "n1"}
+	}
+	claims, err := a.verifyIdToken(d, idp.sign(idp.key, "RS256", valid()), "n1")
+	assert.NoError(t, err)
+	assert.Equal(t, "indispenso", claims["aud"])
+
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, err = a.verifyIdToken(d, idp.sign(otherKey, "RS256", valid()), "n1")
+	assert.EqualError(t, err, "Invalid ID token signature")
+
+	_, err = a.verifyIdToken(d, idp.sign(idp.key, "HS256", valid()), "n1")
+	assert.EqualError(t, err, "Unsupported ID token algorithm HS256")
+
+	_, err = a.verifyIdToken(d, idp.sign(idp.key, "RS256", valid()), "n2")
+	assert.EqualError(t, err, "ID token of another login")
+
+	c := valid()
+	c["aud"] = []string{"other", "indispenso"}
+	_, err = a.verifyIdToken(d, idp.sign(idp.key, "RS256", c), "n1")
+	assert.EqualError(t, err, "ID token is not meant for this client")
+	c["azp"] = "indispenso"
+	_, err = a.verifyIdToken(d, idp.sign(idp.key, "RS256", c), "n1")
+	assert.NoError(t, err)
+
+	c = valid()
+	c["exp"] = time.Now().Add(-2 * time.Minute).Unix()
+	_, err = a.verifyIdToken(d, idp.sign(idp.key, "RS256", c), "n1")
+	assert.EqualError(t, err, "ID token expired")
+
+	c = valid()
+	c["iss"] = "https://evil.example.com"
+	_, err = a.verifyIdToken(d, idp.sign(idp.key, "RS256", c), "n1")
+	assert.Error(t, err)
+
+	// Rotated keys are fetched again
+	idp.kid = "key-2"
+	_, err = a.verifyIdToken(d, idp.sign(idp.key, "RS256", valid()), "n1")
+	assert.NoError(t, err)
+}
+
+func TestOidcIdentityProviderDown(t *testing.T) {
+	idp := newMockIdp(t)
+	a := newTestOidcAuthenticator(t, idp, &UserStore{})
+	idp.server.Close()
+	_, _, err := a.loginUrl()
+	assert.Error(t, err)
+
+	_, err = newOidcAuthenticator(&OidcConfig{Issuer: "https://idp.example.com"}, &UserStore{}, "")
+	assert.Error(t, err)
+}
+
+func TestOidcClaims(t *testing.T) {
+	claims := map[string]interface{}{"name": "John", "groups": []interface{}{"ops", 1, "dev"}}
+	assert.Equal(t, "John", claimString(claims, "name"))
+	assert.Equal(t, "", claimString(claims, "groups"))
+	assert.Equal(t, []string{"ops", "dev"}, claimStrings(claims, "groups"))
+	assert.Equal(t, []string{"John"}, claimStrings(claims, "name"))
+	assert.Empty(t, claimStrings(claims, "missing"))
+
+	// Base64 URL encoded SHA-256 without padding
+	assert.Equal(t, "jWhlpf21SXGxJTe9LDuVkWj1dkCMkzn2x-IfzngmW0w", pkceChallenge("dBjftJeZ4CVP-mJ92K9D1tYPnEu08ER0KWNzWUCJzBk"))
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// Commands run in their own process group, so the command and everything it spawned can be signalled at once
+
+const DEFAULT_KILL_GRACE_PERIOD int = 10 // In seconds
+
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGABRT: "SIGABRT",
+	syscall.SIGBUS:  "SIGBUS",
+	syscall.SIGFPE:  "SIGFPE",
+	syscall.SIGHUP:  "SIGHUP",
+	syscall.SIGILL:  "SIGILL",
+	syscall.SIGINT:  "SIGINT",
+	syscall.SIGKILL: "SIGKILL",
+	syscall.SIGPIPE: "SIGPIPE",
+	syscall.SIGQUIT: "SIGQUIT",
+	syscall.SIGSEGV: "SIGSEGV",
+	syscall.SIGTERM: "SIGTERM",
+	syscall.SIGUSR1: "SIGUSR1",
+	syscall.SIGUSR2: "SIGUSR2",
+	syscall.SIGXCPU: "SIGXCPU",
+	syscall.SIGXFSZ: "SIGXFSZ",
+}
+
+// Name of a signal, e.g. SIGTERM
+func signalName(sig syscall.Signal) string {
+	if name, ok := signalNames[sig]; ok {
+		return name
+	}
+	return fmt.Sprintf("SIG%d", int(sig))
+}
+
+// Start the process as leader of a new process group
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// Signal the whole process group of a started process
+func signalProcessGroup(process *os.Process, sig syscall.Signal) error {
+	// Negative pid addresses the group, the leader pid equals the group id
+	err := syscall.Kill(-process.Pid, sig)
+	if err == syscall.ESRCH {
+		// Already gone
+		return nil
+	}
+	return err
+}
+
+// Terminate the process group gracefully: SIGTERM, wait for the grace period and SIGKILL what is left.
+// Done receives the result of Wait on the process, which is returned once the process is gone.
+func terminateProcessGroup(process *os.Process, gracePeriod time.Duration, done <-chan error) error {
+	var waitErr error
+	exited := false
+	if err := signalProcessGroup(process, syscall.SIGTERM); err != nil {
+		log.Printf("Failed to send SIGTERM to process group %d: %s", process.Pid, err)
+	} else {
+		select {
+		case waitErr = <-done:
+			exited = true
+		case <-time.After(gracePeriod):
+		}
+	}
+
+	// Force whatever is left of the group, also when only the leader exited
+	if err := signalProcessGroup(process, syscall.SIGKILL); err != nil {
+		log.Printf("Failed to send SIGKILL to process group %d: %s", process.Pid, err)
+
+		// Last resort, at least the process itself
+		if !exited {
+			process.Kill()
+		}
+	}
+	if !exited {
+		waitErr = <-done
+	}
+	return waitErr
+}
+
+// Exit code and signal of a finished process, exit code is -1 if it was killed by a signal
+func processExitStatus(state *os.ProcessState) (int, string) {
+	if state == nil {
+		return -1, ""
+	}
+	ws, ok := state.Sys().(syscall.WaitStatus)
+	if !ok {
+		if state.Success() {
+			return 0, ""
+		}
+		return 1, ""
+	}
+	if ws.Signaled() {
+		return -1, signalName(ws.Signal())
+	}
+	return ws.ExitStatus(), ""
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSignalName(t *testing.T) {
+	assert.Equal(t, "SIGTERM", signalName(syscall.SIGTERM))
+	assert.Equal(t, "SIGKILL", signalName(syscall.SIGKILL))
+	assert.Equal(t, "SIG200", signalName(syscall.Signal(200)))
+}
+
+func TestTerminateProcessGroupGraceful(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", "sleep 30 & wait")
+	setProcessGroup(cmd)
+	assert.NoError(t, cmd.Start())
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	start := time.Now()
+	terminateProcessGroup(cmd.Process, 5*time.Second, done)
+	assert.True(t, time.Since(start) < 5*time.Second)
+
+	code, sig := processExitStatus(cmd.ProcessState)
+	assert.Equal(t, -1, code)
+	assert.Equal(t, "SIGTERM", sig)
+}
+
+func TestTerminateProcessGroupForced(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", "trap '' TERM; sleep 30 & wait; wait")
+	setProcessGroup(cmd)
+	assert.NoError(t, cmd.Start())
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	// Give the shell time to install the trap
+	time.Sleep(200 * time.Millisecond)
+	terminateProcessGroup(cmd.Process, 200*time.Millisecond, done)
+
+	code, sig := processExitStatus(cmd.ProcessState)
+	assert.Equal(t, -1, code)
+	assert.Equal(t, "SIGKILL", sig)
+}
+
+func TestProcessExitCode(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", "exit 3")
+	cmd.Run()
+	code, sig := processExitStatus(cmd.ProcessState)
+	assert.Equal(t, 3, code)
+	assert.Equal(t, "", sig)
+}
+
+func TestKillGracePeriodOfTemplate(t *testing.T) {
+	request := &ConsensusRequest{Id: "r1"}
+	template := &Template{Id: "t1", Command: "uptime", Timeout: 60}
+	client := newRegisteredClient("c1")
+	assert.Equal(t, DEFAULT_KILL_GRACE_PERIOD, request.newClientCmd(template, client).KillGracePeriod)
+
+	// Zero kills at once, it is signed like the rest of the command
+	template.KillGracePeriod = new(int)
+	cmd := request.newClientCmd(template, client)
+	assert.Equal(t, 0, cmd.KillGracePeriod)
+	signature := cmd.ComputeHmac("c2VjcmV0")
+	cmd.KillGracePeriod = 3600
+	assert.NotEqual(t, signature, cmd.ComputeHmac("c2VjcmV0"))
+}
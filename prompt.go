@@ -0,0 +1,367 @@
+package main
+
+// Interactive commands. The command of an interactive template can print a prompt line on its standard output, e.g.
+//   echo '##indispenso-prompt## {"question": "Found 3 stale replicas, delete?", "options": ["yes", "no"]}'
+// after which it waits in the awaiting_input state until a user answers from the console. The server signs the
+// answer with the token of the client, which writes it as a line to the standard input of the process.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const PROMPT_MARKER string = "##indispenso-prompt## " // Start of a prompt line, followed by the prompt as JSON
+const MAX_PROMPT_ANSWER_LENGTH int = 1024             // Bytes of an answer
+const MAX_OUTPUT_LINE_LENGTH int = 65536              // Bytes of output without a newline before it is logged as a line
+
+// Question of a command waiting for input
+type CmdPrompt struct {
+	Id       string   // Generated by the client, so an answer only applies to this prompt
+	Question string   `json:"question"`
+	Options  []string `json:"options"` // Allowed answers, any single line if empty
+	Asked    int64    // Unix timestamp
+}
+
+// Answer from the server to the client
+type CmdInput struct {
+	CmdId     string
+	PromptId  string
+	Answer    string
+	Signature string // HMAC with the token of the client
+}
+
+// Answer as kept with the command on the server
+type CmdAnswer struct {
+	PromptId string
+	Question string
+	Answer   string
+	UserId   string
+	Answered int64 // Unix timestamp
+}
+
+// Prompt of an output line, nil if it is regular output
+func parsePrompt(line string) *CmdPrompt {
+	if !strings.HasPrefix(line, PROMPT_MARKER) {
+		return nil
+	}
+	var p CmdPrompt
+	if je := json.Unmarshal([]byte(strings.TrimPrefix(line, PROMPT_MARKER)), &p); je != nil {
+		return nil
+	}
+	p.Question = strings.TrimSpace(p.Question)
+	if len(p.Question) < 1 {
+		return nil
+	}
+	options := make([]string, 0, len(p.Options))
+	for _, option := range p.Options {
+		option = strings.TrimSpace(option)
+		if len(option) < 1 || strings.ContainsAny(option, "\r\n") {
+			return nil
+		}
+		options = append(options, option)
+	}
+	p.Options = options
+	p.Id = uuidStr()
+	p.Asked = time.Now().Unix()
+	return &p
+}
+
+// Can this be written to the process as answer?
+func (p *CmdPrompt) validAnswer(answer string) error {
+	if len(answer) < 1 {
+		return errors.New("Answer can not be empty")
+	}
+	if len(answer) > MAX_PROMPT_ANSWER_LENGTH {
+		return fmt.Errorf("Answer can not be longer than %d characters", MAX_PROMPT_ANSWER_LENGTH)
+	}
+	if strings.ContainsAny(answer, "\r\n") {
+		return errors.New("Answer must be a single line")
+	}
+	if len(p.Options) == 0 {
+		return nil
+	}
+	for _, option := range p.Options {
+		if option == answer {
+			return nil
+		}
+	}
+	return fmt.Errorf("Answer must be one of %s", strings.Join(p.Options, ", "))
+}
+
+// Sign the input, bound to the command and the prompt so it can not be replayed for another question
+func (i *CmdInput) ComputeHmac(token string) string {
+	bytes, be := base64.URLEncoding.DecodeString(token)
+	if be != nil {
+		return ""
+	}
+	mac := hmac.New(sha256.New, bytes)
+	mac.Write([]byte(fmt.Sprintf("input:%s:%s:%s", i.CmdId, i.PromptId, i.Answer)))
+	sum := mac.Sum(nil)
+	return base64.URLEncoding.EncodeToString(sum)
+}
+
+// Splits the output of a process into lines
+type lineWriter struct {
+	buf  []byte
+	line func(string)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.line(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	if len(w.buf) > MAX_OUTPUT_LINE_LENGTH {
+		w.Flush()
+	}
+	return len(p), nil
+}
+
+// Output after the last newline
+func (w *lineWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.line(string(w.buf))
+		w.buf = nil
+	}
+}
+
+// Writes answers to the standard input of an interactive command, one prompt at a time
+type promptAnswerer struct {
+	cmd     *Cmd
+	stdin   io.WriteCloser
+	prompts chan *CmdPrompt
+	quit    chan bool
+	stopped chan bool
+}
+
+// Output line of the process, prompts are handed to the answerer
+func (a *promptAnswerer) outputLine(line string) {
+	p := parsePrompt(line)
+	if p == nil {
+		a.cmd.LogOutput(line)
+		return
+	}
+	a.cmd.LogOutput(fmt.Sprintf("Waiting for input: %s", p.Question))
+	a.cmd._flushLogs()
+	select {
+	case a.prompts <- p:
+	case <-a.quit:
+	}
+}
+
+// Answer prompts until stopped
+func (a *promptAnswerer) run() {
+	defer close(a.stopped)
+	defer a.stdin.Close()
+	var current *CmdPrompt
+	for {
+		select {
+		case p := <-a.prompts:
+			current = p
+			a.cmd.setPrompt(p)
+			a.cmd.NotifyServer("awaiting_input")
+		case in := <-a.cmd.input:
+			if current == nil || in.PromptId != current.Id {
+				log.Printf("Ignoring input for %s, prompt %s is not waiting for an answer", a.cmd.Id, in.PromptId)
+				continue
+			}
+			if err := current.validAnswer(in.Answer); err != nil {
+				log.Printf("Ignoring input for %s: %s", a.cmd.Id, err)
+				continue
+			}
+			if _, err := io.WriteString(a.stdin, in.Answer+"\n"); err != nil {
+				log.Printf("Failed to write input for %s: %s", a.cmd.Id, err)
+				continue
+			}
+			current = nil
+			a.cmd.setPrompt(nil)
+			a.cmd.NotifyServer("started_execution")
+		case <-a.quit:
+			return
+		}
+	}
+}
+
+// Stop answering, waits so the command can report its final state without racing the answerer
+func (a *promptAnswerer) stop() {
+	if a == nil {
+		return
+	}
+	close(a.quit)
+	<-a.stopped
+}
+
+func newPromptAnswerer(c *Cmd, stdin io.WriteCloser) *promptAnswerer {
+	return &promptAnswerer{
+		cmd:     c,
+		stdin:   stdin,
+		prompts: make(chan *CmdPrompt),
+		quit:    make(chan bool),
+		stopped: make(chan bool),
+	}
+}
+
+// Input received from the server, only accepted with a valid signature for a running command
+func (s *Client) receiveInput(in *CmdInput) {
+	if len(in.Signature) < 1 || in.ComputeHmac(s.AuthToken) != in.Signature {
+		log.Printf("ERROR! Invalid signature of input for %s, communication between server and client might be tampered with", in.CmdId)
+		return
+	}
+	s.mux.RLock()
+	c := s.running[in.CmdId]
+	s.mux.RUnlock()
+	if c == nil || c.input == nil {
+		log.Printf("Received input for %s which is not running interactively", in.CmdId)
+		return
+	}
+	select {
+	case c.input <- in:
+	default:
+		log.Printf("Dropped input for %s, the previous one is still being handled", in.CmdId)
+	}
+}
+
+// Queue input for the client, a newer answer for the same command replaces the one not yet delivered
+func (c *RegisteredClient) submitInput(in *CmdInput) {
+	c.mux.Lock()
+	c.Inputs[in.CmdId] = in
+	c.mux.Unlock()
+	c.signal()
+}
+
+// Input could not be delivered, unless it was replaced in the meantime
+func (c *RegisteredClient) returnInput(in *CmdInput) {
+	c.mux.Lock()
+	if _, ok := c.Inputs[in.CmdId]; !ok {
+		c.Inputs[in.CmdId] = in
+	}
+	c.mux.Unlock()
+	c.signal()
+}
+
+// Take the queued input for delivery, signed with the current token of the client
+func (c *RegisteredClient) takeInputs() []*CmdInput {
+	c.mux.Lock()
+	inputs := make([]*CmdInput, 0, len(c.Inputs))
+	for id, in := range c.Inputs {
+		in.Signature = in.ComputeHmac(c.AuthToken)
+		inputs = append(inputs, in)
+		delete(c.Inputs, id)
+	}
+	c.mux.Unlock()
+	return inputs
+}
+
+// Is input waiting for delivery?
+func (c *RegisteredClient) hasInputs() bool {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return len(c.Inputs) > 0
+}
+
+// Answer the prompt of an interactive command
+func PostClientCmdInput(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("User not authorized for PostClientCmdInput")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	user := getUser(r)
+
+	// Get client
+	registeredClient := server.GetClient(ps.ByName("clientId"))
+	if registeredClient == nil {
+		jr.Error("Client not registered")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	if len(registeredClient.AuthToken) < 1 {
+		jr.Error(fmt.Sprintf("Client %s auth token not available", registeredClient.ClientId))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Command
+	cmdId := ps.ByName("cmd")
+	registeredClient.mux.RLock()
+	cmd := registeredClient.DispatchedCmds[cmdId]
+	registeredClient.mux.RUnlock()
+	if cmd == nil {
+		jr.Error("Command not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// The requester decides on the command, managers of requests can take over
+	isManager := user.Can(PERM_REQUEST_MANAGE, server.templateStore.Get(cmd.TemplateId), []*RegisteredClient{registeredClient})
+	if !isManager && !(user.HasPermission(PERM_REQUEST_CREATE) && cmd.RequestUserId == user.Id) {
+		jr.Error("Only the requester of the command or a manager of requests can answer")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Verify two factor, the answer decides what the command does
+	if !validSecondFactor(user, r) {
+		jr.Error("Invalid two factor token")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Still waiting for this prompt?
+	prompt := cmd.awaitingInput()
+	if prompt == nil {
+		jr.Error("Command is not waiting for input")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	if r.PostFormValue("prompt") != prompt.Id {
+		jr.Error("Prompt was already answered")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	answer := strings.TrimSpace(r.PostFormValue("answer"))
+	if err := prompt.validAnswer(answer); err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Deliver, signed once it is taken for delivery
+	input := &CmdInput{
+		CmdId:    cmd.Id,
+		PromptId: prompt.Id,
+		Answer:   answer,
+	}
+	registeredClient.mux.Lock()
+	cmd.Answers = append(cmd.Answers, &CmdAnswer{
+		PromptId: prompt.Id,
+		Question: prompt.Question,
+		Answer:   answer,
+		UserId:   user.Id,
+		Answered: time.Now().Unix(),
+	})
+	registeredClient.mux.Unlock()
+	registeredClient.submitInput(input)
+	audit.Log(user, "Input", fmt.Sprintf("Answered '%s' to '%s' of command %s on %s", answer, prompt.Question, cmd.Id, registeredClient.ClientId))
+
+	jr.Set("submitted", true)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+func TestParsePrompt(t *testing.T) {
+	p := parsePrompt(`##indispenso-prompt## {"question": "Found 3 stale replicas, delete?", "options": ["yes", " no "]}`)
+	assert.NotNil(t, p)
+	assert.Equal(t, "Found 3 stale replicas, delete?", p.Question)
+	assert.Equal(t, []string{"yes", "no"}, p.Options)
+	assert.NotEmpty(t, p.Id)
+
+	// Every prompt is unique, so an answer can not be used for the next one
+	assert.NotEqual(t, p.Id, parsePrompt(`##indispenso-prompt## {"question": "Sure?"}`).Id)
+
+	// Regular output
+	assert.Nil(t, parsePrompt("Found 3 stale replicas"))
+	assert.Nil(t, parsePrompt(`##indispenso-prompt## not json`))
+	assert.Nil(t, parsePrompt(`##indispenso-prompt## {"question": " "}`))
+	assert.Nil(t, parsePrompt(`##indispenso-prompt## {"question": "Sure?", "options": ["yes\nrm -rf /"]}`))
+	assert.Nil(t, parsePrompt(` ##indispenso-prompt## {"question": "Sure?"}`))
+}
+
+func TestPromptValidAnswer(t *testing.T) {
+	p := &CmdPrompt{Question: "Delete?", Options: []string{"yes", "no"}}
+	assert.NoError(t, p.validAnswer("yes"))
+	assert.Error(t, p.validAnswer("maybe"))
+	assert.Error(t, p.validAnswer(""))
+
+	// Free text, but a single line
+	p.Options = []string{}
+	assert.NoError(t, p.validAnswer("replica-3"))
+	assert.Error(t, p.validAnswer("yes\nrm -rf /"))
+	assert.Error(t, p.validAnswer(string(make([]byte, MAX_PROMPT_ANSWER_LENGTH+1))))
+}
+
+func TestCmdInputSignature(t *testing.T) {
+	token := base64.URLEncoding.EncodeToString([]byte("01234567890123456789012345678901"))
+	in := &CmdInput{CmdId: "cmd", PromptId: "prompt", Answer: "no"}
+	signature := in.ComputeHmac(token)
+	assert.NotEmpty(t, signature)
+
+	// Changing the answer or reusing it for another prompt invalidates it
+	in.Answer = "yes"
+	assert.NotEqual(t, signature, in.ComputeHmac(token))
+	in.Answer = "no"
+	in.PromptId = "other"
+	assert.NotEqual(t, signature, in.ComputeHmac(token))
+
+	// Another client
+	in.PromptId = "prompt"
+	otherToken := base64.URLEncoding.EncodeToString([]byte("abcdefghijabcdefghijabcdefghijab"))
+	assert.NotEqual(t, signature, in.ComputeHmac(otherToken))
+}
+
+func TestLineWriter(t *testing.T) {
+	lines := make([]string, 0)
+	w := &lineWriter{line: func(line string) {
+		lines = append(lines, line)
+	}}
+	w.Write([]byte("first\nsec"))
+	w.Write([]byte("ond\n\nlast"))
+	assert.Equal(t, []string{"first", "second", ""}, lines)
+	w.Flush()
+	assert.Equal(t, []string{"first", "second", "", "last"}, lines)
+	w.Flush()
+	assert.Len(t, lines, 4)
+}
+
+func TestCmdAwaitingInput(t *testing.T) {
+	conf = &Conf{}
+	defer func() { conf = nil }()
+
+	c := newCmd("echo", 10)
+	p := parsePrompt(`##indispenso-prompt## {"question": "Delete?", "options": ["yes", "no"]}`)
+	c.ReportState("awaiting_input", 0, "", false, p)
+	assert.Equal(t, p, c.awaitingInput())
+
+	// Answered
+	c.ReportState("started_execution", 0, "", false, p)
+	assert.Nil(t, c.awaitingInput())
+	assert.Equal(t, "started_execution", c.GetState())
+}
+
+func TestPromptAnswerer(t *testing.T) {
+	// State changes read the configuration
+	conf = &Conf{}
+	defer func() { conf = nil }()
+
+	c := newCmd("echo", 10)
+	c.Interactive = true
+	c.input = make(chan *CmdInput, 1)
+	stdinReader, stdin := io.Pipe()
+	lines := bufio.NewReader(stdinReader)
+	a := newPromptAnswerer(c, stdin)
+	go a.run()
+
+	// Regular output is logged
+	a.outputLine("Checking replicas")
+	assert.Equal(t, []string{"Checking replicas"}, c.BufOutput)
+
+	// Only a valid answer to the current prompt is written to the process
+	p := parsePrompt(`##indispenso-prompt## {"question": "Delete?", "options": ["yes", "no"]}`)
+	a.prompts <- p
+	c.input <- &CmdInput{CmdId: c.Id, PromptId: "previous", Answer: "no"}
+	c.input <- &CmdInput{CmdId: c.Id, PromptId: p.Id, Answer: "maybe"}
+	c.input <- &CmdInput{CmdId: c.Id, PromptId: p.Id, Answer: "yes"}
+	line, err := lines.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "yes\n", line)
+
+	// Standard input is closed once stopped, prompts no longer wait
+	a.stop()
+	assert.Equal(t, "started_execution", c.State)
+	assert.Nil(t, c.Prompt)
+	_, err = lines.ReadString('\n')
+	assert.Equal(t, io.EOF, err)
+	a.outputLine(`##indispenso-prompt## {"question": "Really?"}`)
+	assert.Equal(t, "Waiting for input: Really?", c.BufOutput[1])
+}
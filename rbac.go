@@ -0,0 +1,353 @@
+package main
+
+// Role based access control. A role is a set of permissions, each optionally scoped to a tag (the clients a request
+// runs on must have it, or the template must include it) or to one template by id, as titles are not unique and can be
+// changed by anyone who creates templates. The built-in roles are admin with every permission, requester and approver.
+// Other roles, or other permissions for requester and approver, are configured in roles:
+//
+//	roles:
+//	  dba: [request.create:tag=db, request.approve:tag=db]
+//	  release: [template.create, "request.create:template=deploy-app"]
+//
+// Routes require a permission in any scope with requirePermission, handlers check the scope with User.Can.
+
+import (
+	"errors"
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const PERM_ALL string = "*"                             // Every permission, unscoped
+const PERM_TEMPLATE_CREATE string = "template.create"   // Create, edit, delete, import and export templates
+const PERM_TEMPLATE_APPROVE string = "template.approve" // Approve or reject changes of templates
+const PERM_REQUEST_CREATE string = "request.create"     // Request execution of templates and ad-hoc commands
+const PERM_REQUEST_APPROVE string = "request.approve"   // Approve requests of others
+const PERM_REQUEST_MANAGE string = "request.manage"     // Cancel requests and answer prompts of others
+const PERM_HTTPCHECK_MANAGE string = "httpcheck.manage" // Create, list and delete HTTP checks
+const PERM_BACKUP_DOWNLOAD string = "backup.download"   // Download the configuration backup
+const PERM_USER_MANAGE string = "user.manage"           // Create, change, list and delete users
+const PERM_CLIENT_MANAGE string = "client.manage"       // Host groups, agent releases and updates
+
+var permissions = []string{PERM_TEMPLATE_CREATE, PERM_TEMPLATE_APPROVE, PERM_REQUEST_CREATE, PERM_REQUEST_APPROVE, PERM_REQUEST_MANAGE, PERM_HTTPCHECK_MANAGE, PERM_BACKUP_DOWNLOAD, PERM_USER_MANAGE, PERM_CLIENT_MANAGE}
+
+// Roles that exist without configuration, requester and approver can be redefined
+var builtinRoles = map[string][]string{
+	"admin":     []string{PERM_ALL},
+	"requester": []string{PERM_REQUEST_CREATE},
+	"approver":  []string{PERM_REQUEST_APPROVE},
+}
+
+type Grant struct {
+	Permission string
+	Tag        string // Only for clients with this tag, or templates that include it when there are no clients
+	Template   string // Only for the template with this id
+}
+
+// Permission with an optional scope, e.g. request.create:tag=db
+func parseGrant(s string) (*Grant, error) {
+	s = strings.TrimSpace(s)
+	parts := strings.SplitN(s, ":", 2)
+	g := &Grant{Permission: parts[0]}
+	if g.Permission != PERM_ALL && !isPermission(g.Permission) {
+		return nil, fmt.Errorf("Unknown permission %s", g.Permission)
+	}
+	if len(parts) < 2 {
+		return g, nil
+	}
+	if g.Permission == PERM_ALL {
+		return nil, errors.New("All permissions can not be scoped")
+	}
+	scope := strings.SplitN(parts[1], "=", 2)
+	if len(scope) < 2 || len(strings.TrimSpace(scope[1])) < 1 {
+		return nil, fmt.Errorf("Invalid scope %s of %s, use tag=... or template=...", parts[1], g.Permission)
+	}
+	switch strings.TrimSpace(scope[0]) {
+	case "tag":
+		g.Tag = strings.TrimSpace(scope[1])
+	case "template":
+		g.Template = strings.TrimSpace(scope[1])
+	default:
+		return nil, fmt.Errorf("Unknown scope %s of %s, use tag or template", scope[0], g.Permission)
+	}
+	return g, nil
+}
+
+func isPermission(permission string) bool {
+	for _, p := range permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Is the grant for the permission valid for the template and the clients it runs on? Either can be nil.
+func (g *Grant) allows(permission string, template *Template, clients []*RegisteredClient) bool {
+	if g.Permission != PERM_ALL && g.Permission != permission {
+		return false
+	}
+	if len(g.Template) > 0 {
+		return template != nil && template.Id == g.Template
+	}
+	if len(g.Tag) > 0 {
+		if len(clients) > 0 {
+			for _, client := range clients {
+				if !client.HasTag(g.Tag) {
+					return false
+				}
+			}
+			return true
+		}
+		if template == nil || template.Acl == nil {
+			return false
+		}
+		for _, tag := range template.Acl.IncludedTags {
+			if tag == g.Tag {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Permissions of a role, configured roles take precedence over the built-in ones except for admin
+func rolePermissions(role string, configured map[string][]string) []string {
+	role = strings.ToLower(role)
+	if role != "admin" {
+		if p, ok := configured[role]; ok {
+			return p
+		}
+	}
+	return builtinRoles[role]
+}
+
+// Grants of the roles, invalid permissions are skipped as the configuration is validated on start
+func roleGrants(roles []string, configured map[string][]string) []*Grant {
+	grants := make([]*Grant, 0)
+	for _, role := range roles {
+		for _, p := range rolePermissions(role, configured) {
+			g, err := parseGrant(p)
+			if err != nil {
+				continue
+			}
+			grants = append(grants, g)
+		}
+	}
+	return grants
+}
+
+// Configured roles must only use known permissions and scopes
+func validateRoles(configured map[string][]string) error {
+	for role, perms := range configured {
+		if strings.ToLower(role) == "admin" {
+			return errors.New("Role admin can not be redefined")
+		}
+		for _, p := range perms {
+			if _, err := parseGrant(p); err != nil {
+				return fmt.Errorf("Role %s: %s", role, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Is the role built-in or configured?
+func isRole(role string, configured map[string][]string) bool {
+	return len(rolePermissions(role, configured)) > 0
+}
+
+// Roles from a comma separated list, all must exist
+func parseRoles(list string, configured map[string][]string) ([]string, error) {
+	roles := make([]string, 0)
+	for _, role := range splitFormList(strings.ToLower(list)) {
+		if !isRole(role, configured) {
+			return nil, fmt.Errorf("Unknown role %s", role)
+		}
+		roles = append(roles, role)
+	}
+	return roles, nil
+}
+
+// Names of the built-in and configured roles
+func roleNames(configured map[string][]string) []string {
+	names := make([]string, 0)
+	for role := range builtinRoles {
+		names = append(names, role)
+	}
+	for role := range configured {
+		if _, builtin := builtinRoles[strings.ToLower(role)]; !builtin {
+			names = append(names, strings.ToLower(role))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (u *User) grants() []*Grant {
+	u.mux.RLock()
+	roles := make([]string, 0, len(u.Roles))
+	for role, enabled := range u.Roles {
+		if enabled {
+			roles = append(roles, role)
+		}
+	}
+	u.mux.RUnlock()
+	return roleGrants(roles, configuredRoles())
+}
+
+// Roles from the configuration, none before it is loaded
+func configuredRoles() map[string][]string {
+	if conf == nil {
+		return nil
+	}
+	return conf.Roles
+}
+
+// Does the user have the permission in any scope?
+func (u *User) HasPermission(permission string) bool {
+	for _, g := range u.grants() {
+		if g.Permission == PERM_ALL || g.Permission == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Does the user have the permission for the template and the clients it runs on? Either can be nil, only unscoped
+// permissions apply to neither.
+func (u *User) Can(permission string, template *Template, clients []*RegisteredClient) bool {
+	for _, g := range u.grants() {
+		if g.allows(permission, template, clients) {
+			return true
+		}
+	}
+	return false
+}
+
+// Permissions of the user in any scope, for the console
+func (u *User) Permissions() []string {
+	list := make([]string, 0)
+	for _, p := range permissions {
+		if u.HasPermission(p) {
+			list = append(list, p)
+		}
+	}
+	return list
+}
+
+func (u *User) SetRoles(roles []string) {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	u.Roles = make(map[string]bool)
+	for _, role := range roles {
+		u.Roles[role] = true
+	}
+}
+
+// Is the grant part of the other one? An unscoped grant covers every scope of its permission, a scoped one only the
+// same scope
+func (g *Grant) coveredBy(other *Grant) bool {
+	if other.Permission != PERM_ALL && other.Permission != g.Permission {
+		return false
+	}
+	if len(other.Tag) < 1 && len(other.Template) < 1 {
+		return true
+	}
+	return other.Tag == g.Tag && other.Template == g.Template
+}
+
+// May the user assign the role? Only roles with grants the user has in the same or a broader scope, so user.manage
+// does not lead to admin and request.create:tag=web does not lead to request.create
+func (u *User) MayAssignRole(role string) bool {
+	grants := u.grants()
+	for _, g := range roleGrants([]string{role}, configuredRoles()) {
+		covered := false
+		for _, h := range grants {
+			if g.coveredBy(h) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			return false
+		}
+	}
+	return true
+}
+
+// May the user change or delete the other user? Only if the user may assign all roles of the other user
+func (u *User) MayManageUser(other *User) bool {
+	other.mux.RLock()
+	roles := make([]string, 0, len(other.Roles))
+	for role, enabled := range other.Roles {
+		if enabled {
+			roles = append(roles, role)
+		}
+	}
+	other.mux.RUnlock()
+	for _, role := range roles {
+		if !u.MayAssignRole(role) {
+			return false
+		}
+	}
+	return true
+}
+
+// Registered clients by id, unknown ones are left out
+func registeredClients(clientIds []string) []*RegisteredClient {
+	clients := make([]*RegisteredClient, 0, len(clientIds))
+	for _, clientId := range clientIds {
+		if client := server.GetClient(clientId); client != nil {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// Registered clients the request runs on, for scoped permissions
+func (c *ConsensusRequest) clients() []*RegisteredClient {
+	if c.Plan != nil {
+		return registeredClients(c.Plan.Clients)
+	}
+	return registeredClients(c.ClientIds)
+}
+
+// Route that requires an authenticated user with one of the permissions in any scope
+func requirePermission(handle httprouter.Handle, permissions ...string) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if !authUser(r) {
+			jr := jresp.NewJsonResp()
+			jr.Error("User not authorized")
+			fmt.Fprint(w, jr.ToString(conf.Debug))
+			return
+		}
+		user := getUser(r)
+		for _, permission := range permissions {
+			if user.HasPermission(permission) {
+				handle(w, r, ps)
+				return
+			}
+		}
+		jr := jresp.NewJsonResp()
+		jr.Error(fmt.Sprintf("User not allowed, requires %s", strings.Join(permissions, " or ")))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+	}
+}
+
+// Roles with their permissions, for assignment to users
+func GetRoles(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	roles := make(map[string][]string)
+	for _, role := range roleNames(conf.Roles) {
+		roles[role] = rolePermissions(role, conf.Roles)
+	}
+	jr.Set("roles", roles)
+	jr.Set("permissions", permissions)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseGrant(t *testing.T) {
+	g, err := parseGrant(" request.create ")
+	assert.Nil(t, err)
+	assert.Equal(t, &Grant{Permission: PERM_REQUEST_CREATE}, g)
+
+	g, err = parseGrant("request.approve:tag=db")
+	assert.Nil(t, err)
+	assert.Equal(t, &Grant{Permission: PERM_REQUEST_APPROVE, Tag: "db"}, g)
+
+	g, err = parseGrant("request.create:template=Deploy app")
+	assert.Nil(t, err)
+	assert.Equal(t, &Grant{Permission: PERM_REQUEST_CREATE, Template: "Deploy app"}, g)
+
+	g, err = parseGrant("*")
+	assert.Nil(t, err)
+	assert.Equal(t, PERM_ALL, g.Permission)
+
+	for _, invalid := range []string{"", "request.delete", "*:tag=db", "request.create:tag", "request.create:tag=", "request.create:host=web01"} {
+		_, err = parseGrant(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestGrantAllows(t *testing.T) {
+	db := newRegisteredClient("db01")
+	db.Tags = []string{"db"}
+	web := newRegisteredClient("web01")
+	web.Tags = []string{"web"}
+	template := &Template{Id: "t1", Title: "Restart", Acl: newTemplateAcl()}
+	template.Acl.IncludedTags = []string{"db"}
+
+	// Unscoped
+	g := &Grant{Permission: PERM_REQUEST_CREATE}
+	assert.True(t, g.allows(PERM_REQUEST_CREATE, nil, nil))
+	assert.True(t, g.allows(PERM_REQUEST_CREATE, template, []*RegisteredClient{web}))
+	assert.False(t, g.allows(PERM_REQUEST_APPROVE, nil, nil))
+	assert.True(t, (&Grant{Permission: PERM_ALL}).allows(PERM_USER_MANAGE, nil, nil))
+
+	// Tag, all clients must have it, without clients the template must include it
+	g = &Grant{Permission: PERM_REQUEST_APPROVE, Tag: "db"}
+	assert.True(t, g.allows(PERM_REQUEST_APPROVE, nil, []*RegisteredClient{db}))
+	assert.False(t, g.allows(PERM_REQUEST_APPROVE, nil, []*RegisteredClient{db, web}))
+	assert.True(t, g.allows(PERM_REQUEST_APPROVE, template, nil))
+	assert.False(t, g.allows(PERM_REQUEST_APPROVE, &Template{Acl: newTemplateAcl()}, nil))
+	assert.False(t, g.allows(PERM_REQUEST_APPROVE, nil, nil))
+
+	// Template by id, anyone who creates templates can use the title
+	assert.True(t, (&Grant{Permission: PERM_REQUEST_CREATE, Template: "t1"}).allows(PERM_REQUEST_CREATE, template, nil))
+	assert.False(t, (&Grant{Permission: PERM_REQUEST_CREATE, Template: "Restart"}).allows(PERM_REQUEST_CREATE, template, nil))
+	assert.False(t, (&Grant{Permission: PERM_REQUEST_CREATE, Template: "Deploy"}).allows(PERM_REQUEST_CREATE, template, nil))
+	assert.False(t, (&Grant{Permission: PERM_REQUEST_CREATE, Template: "t1"}).allows(PERM_REQUEST_CREATE, nil, nil))
+}
+
+func TestRoles(t *testing.T) {
+	configured := map[string][]string{
+		"dba":       []string{"request.create:tag=db", "request.approve:tag=db"},
+		"requester": []string{"request.create", "request.manage"},
+	}
+	assert.Nil(t, validateRoles(configured))
+
+	// Built-in, redefined and configured roles
+	assert.Equal(t, []string{PERM_ALL}, rolePermissions("admin", configured))
+	assert.Equal(t, []string{PERM_REQUEST_APPROVE}, rolePermissions("Approver", configured))
+	assert.Equal(t, []string{"request.create", "request.manage"}, rolePermissions("requester", configured))
+	assert.Empty(t, rolePermissions("unknown", configured))
+	assert.True(t, isRole("dba", configured))
+	assert.False(t, isRole("dba", nil))
+	assert.Equal(t, []string{"admin", "approver", "dba", "requester"}, roleNames(configured))
+
+	grants := roleGrants([]string{"dba", "unknown"}, configured)
+	assert.Equal(t, []*Grant{
+		&Grant{Permission: PERM_REQUEST_CREATE, Tag: "db"},
+		&Grant{Permission: PERM_REQUEST_APPROVE, Tag: "db"},
+	}, grants)
+
+	roles, err := parseRoles("dba, Requester,", configured)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"dba", "requester"}, roles)
+	_, err = parseRoles("dba,root", configured)
+	assert.Equal(t, "Unknown role root", err.Error())
+
+	// Invalid configuration
+	assert.NotNil(t, validateRoles(map[string][]string{"admin": []string{"request.create"}}))
+	assert.NotNil(t, validateRoles(map[string][]string{"dba": []string{"request.drop"}}))
+}
+
+func TestMayAssignRole(t *testing.T) {
+	conf = &Conf{Roles: map[string][]string{
+		"dba":        []string{"request.create:tag=db", "user.manage"},
+		"db-manager": []string{"request.create:tag=db", "request.approve:tag=db", "user.manage"},
+		"all-db":     []string{"request.create", "request.approve:tag=db"},
+	}}
+	defer func() { conf = nil }()
+
+	// The same or a narrower scope only
+	manager := newUser()
+	manager.AddRole("db-manager")
+	assert.True(t, manager.MayAssignRole("dba"))
+	assert.True(t, manager.MayAssignRole("db-manager"))
+	assert.False(t, manager.MayAssignRole("all-db"))
+	assert.False(t, manager.MayAssignRole("admin"))
+
+	// Unscoped covers every scope
+	assert.True(t, (&Grant{Permission: PERM_REQUEST_CREATE, Template: "Deploy"}).coveredBy(&Grant{Permission: PERM_REQUEST_CREATE}))
+	assert.False(t, (&Grant{Permission: PERM_REQUEST_CREATE, Template: "Deploy"}).coveredBy(&Grant{Permission: PERM_REQUEST_CREATE, Tag: "db"}))
+	admin := newUser()
+	admin.AddRole("admin")
+	assert.True(t, admin.MayAssignRole("all-db"))
+	assert.True(t, admin.MayAssignRole("admin"))
+}
@@ -9,6 +9,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"github.com/RobinUS2/golang-jresp"
 	"github.com/julienschmidt/httprouter"
@@ -40,6 +41,8 @@ type Server struct {
 	consensus            *Consensus
 	executionCoordinator *ExecutionCoordinator
 	httpCheckStore       *HttpCheckStore
+	hostGroupStore       *HostGroupStore
+	agentReleaseStore    *AgentReleaseStore
 	authService          *AuthService
 	notifications        *NotificationManager
 
@@ -47,7 +50,7 @@ type Server struct {
 }
 
 // Register client
-func (s *Server) RegisterClient(clientId string, tags []string) {
+func (s *Server) RegisterClient(clientId string, tags []string, interpreters []string) {
 	s.clientsMux.RLock()
 	if s.clients[clientId] == nil {
 		s.clientsMux.RUnlock()
@@ -61,15 +64,19 @@ func (s *Server) RegisterClient(clientId string, tags []string) {
 		s.clientsMux.RUnlock()
 	}
 
-	// Update client
+	// Update client, tags assigned by the server are merged with the reported ones
+	assigned := s.assignedTags(clientId)
 	s.clients[clientId].mux.Lock()
 	s.clients[clientId].LastPing = time.Now()
-	s.clients[clientId].Tags = tags
+	s.clients[clientId].ReportedTags = tags
+	s.clients[clientId].Tags = mergeTags(tags, assigned)
+	s.clients[clientId].Interpreters = interpreters
+	mergedTags := s.clients[clientId].Tags
 	s.clients[clientId].mux.Unlock()
 
-	// Update tags
+	// Update tags, tags that are no longer carried are removed by the cleanup
 	s.tagsMux.Lock()
-	for _, tag := range tags {
+	for _, tag := range mergedTags {
 		s.Tags[tag] = true
 	}
 	s.tagsMux.Unlock()
@@ -86,16 +93,31 @@ func (s *Server) CleanupClients() {
 	s.clientsMux.Lock()
 	for k, client := range s.clients {
 		if time.Now().Sub(client.LastPing).Seconds() > float64(CLIENT_PING_INTERVAL*5) {
+			// Keep the queue until the commands are delivered or expired
+			if client.hasQueuedCmds() {
+				continue
+			}
+
 			// Disconnect
 			log.Printf("Client %s disconnected", client.ClientId)
 			delete(s.clients, k)
 		}
 	}
 	s.clientsMux.Unlock()
+
+	// Forget tags of disconnected clients
+	s.refreshTags()
 }
 
 // Submit command to registered client using channel notify system
 func (client *RegisteredClient) Submit(cmd *Cmd) {
+	// Queued until the deadline, the client refuses it afterwards so it is part of the signature
+	timeout := cmd.DeliveryTimeout
+	if timeout < 1 {
+		timeout = DEFAULT_DELIVERY_TIMEOUT
+	}
+	cmd.DeliveryDeadline = time.Now().Unix() + int64(timeout)
+
 	client.mux.Lock()
 
 	// Command in pending list, this will be polled of within milliseconds
@@ -109,8 +131,8 @@ func (client *RegisteredClient) Submit(cmd *Cmd) {
 	// Log
 	audit.Log(nil, "Execute", fmt.Sprintf("Command '%s' on client %s with id %s", cmd.Command, client.ClientId, cmd.Id))
 
-	// Signal for work
-	client.CmdChan <- true
+	// Signal for work, does not wait for the client
+	client.signal()
 }
 
 // A client that is registered with the server
@@ -119,7 +141,27 @@ type RegisteredClient struct {
 	ClientId  string
 	AuthToken string `json:"-"` // Do not add to JSON
 	LastPing  time.Time
-	Tags      []string
+	Tags      []string // Reported by the client merged with the ones assigned by host groups
+
+	// Tags as reported by the client
+	ReportedTags []string
+
+	// Version and platform of the agent
+	Version string
+	Os      string
+	Arch    string
+
+	// Queue of the client
+	Workers     int
+	RunningCmds int
+	QueuedCmds  int
+
+	// Interpreters available on the client
+	Interpreters []string
+
+	// Facts about the host, e.g. os_id, memory_total and custom ones from facts.d
+	Facts        map[string]string
+	FactsUpdated time.Time
 
 	// Dispatched commands to the client
 	DispatchedCmds map[string]*Cmd
@@ -127,8 +169,17 @@ type RegisteredClient struct {
 	// Pending commands
 	Cmds map[string]*Cmd
 
-	// Channel used to trigger the long poll to fire a command to the client
+	// Answers to prompts of interactive commands waiting for delivery, by command id
+	Inputs map[string]*CmdInput `json:"-"`
+
+	// Channel used to trigger the long poll or control stream to fire a command to the client, holds at most one signal
 	CmdChan chan bool `json:"-"`
+
+	// Is the control stream connected?
+	Streaming bool
+
+	streams    int        // Number of connected control streams
+	deliverMux sync.Mutex // Only one stream or long poll delivers at a time
 }
 
 // Get list of dispatched commands
@@ -183,6 +234,26 @@ func (c *RegisteredClient) HasTag(s string) bool {
 	return false
 }
 
+// Can this registered client run commands with this interpreter?
+func (c *RegisteredClient) HasInterpreter(interpreter string) bool {
+	// Custom shebangs can not be verified upfront
+	if isCustomShebang(interpreter) {
+		return true
+	}
+
+	// Clients that do not advertise their interpreters only support the default
+	interpreter = normalizeInterpreter(interpreter)
+	if len(c.Interpreters) == 0 {
+		return interpreter == DEFAULT_INTERPRETER
+	}
+	for _, available := range c.Interpreters {
+		if available == interpreter {
+			return true
+		}
+	}
+	return false
+}
+
 // Generate keys
 func (s *Server) _prepareTlsKeys() error {
 	if _, err := os.Stat(conf.GetSslCertFile()); os.IsNotExist(err) {
@@ -305,9 +376,20 @@ func (s *Server) Start() bool {
 	// HTTP checks
 	s.httpCheckStore = newHttpCheckStore()
 
+	// Host groups
+	s.hostGroupStore = newHostGroupStore()
+
+	// Agent releases
+	s.agentReleaseStore = newAgentReleaseStore()
+
 	//Notifications
 	s.notifications = newNotificationManager()
 
+	// Templates managed in a directory
+	if len(conf.TemplateSyncDir) > 0 {
+		startTemplateSync(conf.HomeFile(conf.TemplateSyncDir))
+	}
+
 	// Print info
 	log.Printf("Starting server at https://localhost:%d/", conf.ServerPort)
 
@@ -327,19 +409,39 @@ func (s *Server) Start() bool {
 		// Client commands
 		router.GET("/client/:clientId/ping", ClientPing)
 		router.GET("/client/:clientId/cmds", ClientCmds)
+		router.POST("/client/:clientId/stream", ClientStream)
+		router.PUT("/client/:clientId/cmd/:cmd/ack", PutClientCmdAck)
+		router.PUT("/client/:clientId/facts", PutClientFacts)
 		router.PUT("/client/:clientId/cmd/:cmd/state", PutClientCmdState)
 		router.PUT("/client/:clientId/cmd/:cmd/logs", PutClientCmdLogs)
 		router.GET("/client/:clientId/cmd/:cmd/logs", GetClientCmdLogs)
+		router.POST("/client/:clientId/cmd/:cmd/input", PostClientCmdInput)
+		router.GET("/client/:clientId/cmd/:cmd/file/:id", GetClientCmdFile)
+		router.GET("/client/:clientId/cmd/:cmd/release", GetClientCmdRelease)
+		router.PUT("/client/:clientId/cmd/:cmd/artifact", PutClientCmdArtifact)
+		router.GET("/client/:clientId/cmd/:cmd/artifact/:id", GetClientCmdArtifact)
 		router.POST("/client/:clientId/auth", PostClientAuth)
 
 		// Auth endpoint
 		router.POST("/auth", PostAuth)
+		router.GET("/auth/oidc", GetOidcLogin)
+		router.GET("/auth/oidc/info", GetOidcInfo)
+		router.GET("/auth/oidc/callback", GetOidcCallback)
+		router.GET("/auth/webauthn", GetAuthWebauthn)
 
 		// Templates
 		router.GET("/templates", GetTemplate)
 		router.POST("/template/:templateid/validation", PostTemplateValidation)
 		router.DELETE("/template/:templateid/validation/:id", DeleteTemplateValidation)
-		router.POST("/template", PostTemplate)
+		router.POST("/template/:templateid/file", PostTemplateFile)
+		router.DELETE("/template/:templateid/file/:id", DeleteTemplateFile)
+		router.POST("/template", requirePermission(PostTemplate, PERM_TEMPLATE_CREATE))
+		router.PUT("/template/:templateid", PutTemplate)
+		router.GET("/templates/export", requirePermission(GetTemplatesExport, PERM_TEMPLATE_CREATE))
+		router.POST("/templates/import", requirePermission(PostTemplatesImport, PERM_TEMPLATE_CREATE))
+		router.GET("/template/:templateid/versions", GetTemplateVersions)
+		router.POST("/template/:templateid/change/approve", requirePermission(PostTemplateChangeApprove, PERM_TEMPLATE_APPROVE))
+		router.DELETE("/template/:templateid/change", requirePermission(DeleteTemplateChange, PERM_TEMPLATE_APPROVE))
 		router.DELETE("/template", DeleteTemplate)
 
 		// Update password
@@ -349,41 +451,64 @@ func (s *Server) Start() bool {
 		router.GET("/clients", GetClients)
 
 		// List users
-		router.GET("/users", GetUsers)
+		router.GET("/users", requirePermission(GetUsers, PERM_USER_MANAGE))
 
 		// List user names by ids
 		router.GET("/users/names", GetUsersNames)
 
+		// Teams and roles
+		router.GET("/teams", requirePermission(GetTeams, PERM_USER_MANAGE))
+		router.GET("/roles", requirePermission(GetRoles, PERM_USER_MANAGE))
+
 		// Create user
-		router.POST("/user", PostUser)
+		router.POST("/user", requirePermission(PostUser, PERM_USER_MANAGE))
 
 		// Remove user
-		router.DELETE("/user", DeleteUser)
+		router.DELETE("/user", requirePermission(DeleteUser, PERM_USER_MANAGE))
 
 		//Change user
-		router.PUT("/user", PutUser)
+		router.PUT("/user", requirePermission(PutUser, PERM_USER_MANAGE))
 
 		// Consensus requests
-		router.POST("/consensus/request", PostConsensusRequest)
-		router.DELETE("/consensus/request", DeleteConsensusRequest)
-		router.POST("/consensus/approve", PostConsensusApprove)
+		router.POST("/consensus/request", requirePermission(PostConsensusRequest, PERM_REQUEST_CREATE))
+		router.POST("/consensus/plan", requirePermission(PostConsensusPlan, PERM_REQUEST_CREATE))
+		router.POST("/consensus/check", requirePermission(PostConsensusCheck, PERM_REQUEST_CREATE, PERM_REQUEST_APPROVE, PERM_REQUEST_MANAGE))
+		router.POST("/consensus/adhoc", requirePermission(PostConsensusAdHoc, PERM_REQUEST_CREATE))
+		router.DELETE("/consensus/request", requirePermission(DeleteConsensusRequest, PERM_REQUEST_CREATE, PERM_REQUEST_MANAGE))
+		router.POST("/consensus/approve", requirePermission(PostConsensusApprove, PERM_REQUEST_APPROVE))
 		router.GET("/consensus/pending", GetConsensusPending)
 
 		// Dispatched commands list
-		router.POST("/dispatched", data_table.DefaultStoreHandler(DispatchedCmdQuery))
+		router.POST("/dispatched", PostDispatched)
 
 		// Http checks
 		router.GET("/http-check/:id", GetHttpCheck)
-		router.GET("/http-checks", GetHttpChecks)
-		router.POST("/http-check", PostHttpCheck)
-		router.DELETE("/http-check", DeleteHttpCheck)
+		router.GET("/http-checks", requirePermission(GetHttpChecks, PERM_HTTPCHECK_MANAGE))
+		router.POST("/http-check", requirePermission(PostHttpCheck, PERM_HTTPCHECK_MANAGE))
+		router.DELETE("/http-check", requirePermission(DeleteHttpCheck, PERM_HTTPCHECK_MANAGE))
+
+		// Host groups
+		router.GET("/hostgroups", requirePermission(GetHostGroups, PERM_CLIENT_MANAGE))
+		router.POST("/hostgroup", requirePermission(PostHostGroup, PERM_CLIENT_MANAGE))
+		router.DELETE("/hostgroup/:id", requirePermission(DeleteHostGroup, PERM_CLIENT_MANAGE))
+
+		// Agent updates
+		router.GET("/agent/releases", requirePermission(GetAgentReleases, PERM_CLIENT_MANAGE))
+		router.POST("/agent/release", requirePermission(PostAgentRelease, PERM_CLIENT_MANAGE))
+		router.POST("/agent/update", requirePermission(PostAgentUpdate, PERM_CLIENT_MANAGE))
 
 		// Two factor auth
 		router.GET("/user/2fa", GetUser2fa)
 		router.PUT("/user/2fa", PutUser2fa)
 
+		// Security keys
+		router.GET("/user/webauthn", GetUserWebauthn)
+		router.GET("/user/webauthn/register", GetUserWebauthnRegister)
+		router.POST("/user/webauthn/register", PostUserWebauthnRegister)
+		router.DELETE("/user/webauthn/:id", DeleteUserWebauthn)
+
 		// Backup
-		router.GET("/backup/configs.zip", GetBackupConfigs)
+		router.GET("/backup/configs.zip", requirePermission(GetBackupConfigs, PERM_BACKUP_DOWNLOAD))
 
 		// Console endpoint for interface
 		router.ServeFiles("/console/*filepath", http.Dir("console"))
@@ -402,7 +527,9 @@ func (s *Server) Start() bool {
 	go func() {
 		c := time.Tick(1 * time.Minute)
 		for _ = range c {
+			server.ExpireCmds()
 			server.CleanupClients()
+			cleanupArtifacts()
 		}
 	}()
 
@@ -429,8 +556,29 @@ func (s *Server) SetupNotifications(conf *Conf) {
 func createAuthService(us *UserStore) *AuthService {
 	as := newAuthService(us, DefaultFirstFactorAuth, newGAuthAuthenticator())
 
+	// Without LDAP only local users can log in, the server still starts
 	if conf.EnableLdap {
-		as.appendFirstFactor(newLdapAuthenticator(conf.ldapConfig, us))
+		ldapAuth, err := newLdapAuthenticator(conf.ldapConfig, us)
+		if err != nil {
+			log.Printf("LDAP authentication disabled: %s", err)
+		} else {
+			as.appendFirstFactor(ldapAuth)
+		}
+	}
+	webauthn, err := newWebauthn(conf.GetWebauthnOrigin(), us)
+	if err != nil {
+		log.Printf("Security keys disabled: %s", err)
+	} else {
+		as.webauthn = webauthn
+	}
+	if conf.EnableOidc {
+		oidcAuth, err := newOidcAuthenticator(conf.oidcConfig, us, conf.ServerRequest("/auth/oidc/callback"))
+		if err != nil {
+			log.Printf("OpenID Connect authentication disabled: %s", err)
+		} else {
+			as.appendFirstFactor(oidcAuth)
+			as.oidc = oidcAuth
+		}
 	}
 
 	return as
@@ -458,7 +606,7 @@ func GetClientCmdLogs(w http.ResponseWriter, r *http.Request, ps httprouter.Para
 	registeredClient.mux.RLock()
 	cmd := registeredClient.DispatchedCmds[cmdId]
 	registeredClient.mux.RUnlock()
-	if cmd == nil {
+	if cmd == nil || !cmd.VisibleTo(getUser(r)) {
 		jr.Error("Command not found")
 		fmt.Fprint(w, jr.ToString(conf.Debug))
 		return
@@ -466,6 +614,10 @@ func GetClientCmdLogs(w http.ResponseWriter, r *http.Request, ps httprouter.Para
 
 	jr.Set("log_output", cmd.BufOutput)
 	jr.Set("log_error", cmd.BufOutputErr)
+	jr.Set("artifacts", cmd.ArtifactFiles)
+	jr.Set("state", cmd.GetState())
+	jr.Set("prompt", cmd.awaitingInput())
+	jr.Set("answers", cmd.Answers)
 
 	jr.OK()
 	fmt.Fprint(w, jr.ToString(conf.Debug))
@@ -562,31 +714,66 @@ func GetUser2fa(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	fmt.Fprint(w, jr.ToString(conf.Debug))
 }
 
-func DispatchedCmdQuery(tableStore *data_table.DefaultStore) *data_table.DefaultStore {
+// History of commands, only those of templates of the teams of the user
+func PostDispatched(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("User not authorized for PostDispatched")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	user := getUser(r)
+	data_table.DefaultStoreHandler(func(tableStore *data_table.DefaultStore) *data_table.DefaultStore {
+		return DispatchedCmdQuery(tableStore, user)
+	})(w, r, ps)
+}
+
+func DispatchedCmdQuery(tableStore *data_table.DefaultStore, user *User) *data_table.DefaultStore {
 	// Fetch and create
 	server.clientsMux.RLock()
 	for _, client := range server.clients {
 		for _, d := range client.GetDispatchedCmds() {
+			if !d.VisibleTo(user) {
+				continue
+			}
 			commandTime := time.Unix(d.Created, 0)
 			row := make(map[string]interface{})
 			row["created"] = commandTime.Format("2006-01-02 15:04:05")
 
 			template := server.templateStore.Get(d.TemplateId)
-			if template != nil {
+			if template != nil && d.TemplateVersion > 0 {
+				row["template"] = fmt.Sprintf("%s (v%d)", template.Title, d.TemplateVersion)
+			} else if template != nil {
 				row["template"] = template.Title
+			} else if d.AdHoc {
+				row["template"] = adHocTitle(d.Command)
+			} else if d.Type == AGENT_UPDATE_CMD && d.Release != nil {
+				row["template"] = fmt.Sprintf("Agent update to %s", d.Release.Version)
 			} else {
 				row["template"] = "-"
 			}
+			if d.Type == CHECK_CMD {
+				row["template"] = fmt.Sprintf("Check of %s", row["template"])
+			}
 
-			user := server.userStore.ById(d.RequestUserId)
-			if user != nil {
-				row["user"] = user.Username
+			requestUser := server.userStore.ById(d.RequestUserId)
+			if requestUser != nil {
+				row["user"] = requestUser.Username
 			} else {
 				row["user"] = "-"
 			}
 
 			row["client"] = client.ClientId
 			row["state"] = d.State
+			if d.TimedOut {
+				row["state"] = fmt.Sprintf("%s (timeout, %s)", d.State, d.ExitSignal)
+			} else if len(d.ExitSignal) > 0 {
+				row["state"] = fmt.Sprintf("%s (%s)", d.State, d.ExitSignal)
+			} else if d.Pending && d.DeliveryDeadline > 0 {
+				row["state"] = fmt.Sprintf("%s (queued until %s)", d.State, time.Unix(d.DeliveryDeadline, 0).Format("2006-01-02 15:04:05"))
+			} else if d.State == "undeliverable" {
+				row["state"] = fmt.Sprintf("%s (not delivered before %s)", d.State, time.Unix(d.DeliveryDeadline, 0).Format("2006-01-02 15:04:05"))
+			}
 			row["link"] = fmt.Sprintf("logs?id=%s&client=%s", d.Id, client.ClientId)
 			rowObj := tableStore.CreateRow(row)
 			if time.Since(commandTime).Hours() > 24 {
@@ -619,6 +806,11 @@ func GetConsensusPending(w http.ResponseWriter, r *http.Request, ps httprouter.P
 			continue
 		}
 
+		// Only requests of templates of the teams of the user
+		if !req.VisibleTo(user) {
+			continue
+		}
+
 		// Ignore self
 		if req.RequestUserId == user.Id {
 			pending = append(pending, req)
@@ -631,11 +823,17 @@ func GetConsensusPending(w http.ResponseWriter, r *http.Request, ps httprouter.P
 			continue
 		}
 
+		// Only work the user may approve
+		if !user.Can(PERM_REQUEST_APPROVE, req.Template(), req.clients()) {
+			continue
+		}
+
 		work = append(work, req)
 	}
 	jr.Set("requests", pending)
 	jr.Set("server_instance_id", server.InstanceId)
 	jr.Set("work", work)
+	jr.Set("checks", checkStates(append(pending, work...)))
 	server.consensus.pendingMux.RUnlock()
 
 	jr.OK()
@@ -645,24 +843,30 @@ func GetConsensusPending(w http.ResponseWriter, r *http.Request, ps httprouter.P
 // Approve execution request
 func PostConsensusApprove(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	jr := jresp.NewJsonResp()
-	if !authUser(r) {
-		jr.Error("User not authorized for PostConsensusApprove")
+	user := getUser(r)
+
+	// Vote
+	id := strings.TrimSpace(r.PostFormValue("id"))
+	req := server.consensus.Get(id)
+	if req == nil || !req.VisibleTo(user) {
+		jr.Error("Request not found")
 		fmt.Fprint(w, jr.ToString(conf.Debug))
 		return
 	}
-
-	user := getUser(r)
-	if !user.HasRole("approver") {
-		jr.Error("User not allowed for PostConsensusApprove")
+	if !user.Can(PERM_REQUEST_APPROVE, req.Template(), req.clients()) {
+		jr.Error("User not allowed to approve this request")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	if req.awaitsCheck() {
+		jr.Error("The check of this request has not passed yet")
 		fmt.Fprint(w, jr.ToString(conf.Debug))
 		return
 	}
 
-	// Vote
-	id := strings.TrimSpace(r.PostFormValue("id"))
-	req := server.consensus.Get(id)
-	if req == nil {
-		jr.Error("Request not found")
+	// Users with a second factor confirm their vote with it
+	if user.HasSecondFactor() && !validSecondFactor(user, r) {
+		jr.Error("Invalid two factor token")
 		fmt.Fprint(w, jr.ToString(conf.Debug))
 		return
 	}
@@ -677,18 +881,7 @@ func PostConsensusApprove(w http.ResponseWriter, r *http.Request, ps httprouter.
 // Cancel execution request
 func DeleteConsensusRequest(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	jr := jresp.NewJsonResp()
-	if !authUser(r) {
-		jr.Error("User not authorized for  DeleteConsensusRequest")
-		fmt.Fprint(w, jr.ToString(conf.Debug))
-		return
-	}
-
 	user := getUser(r)
-	if !user.HasRole("requester") {
-		jr.Error("User not allowed to DeleteConsensusRequest")
-		fmt.Fprint(w, jr.ToString(conf.Debug))
-		return
-	}
 
 	// Get template
 	id := strings.TrimSpace(r.URL.Query().Get("id"))
@@ -699,11 +892,11 @@ func DeleteConsensusRequest(w http.ResponseWriter, r *http.Request, ps httproute
 		return
 	}
 
-	// Did we request this? Or are we admin
-	isAdmin := user.HasRole("admin")
+	// Did we request this? Or may we manage the requests of others
+	isManager := user.Can(PERM_REQUEST_MANAGE, req.Template(), req.clients())
 	isCreator := req.RequestUserId == user.Id
-	if !isAdmin && !isCreator {
-		jr.Error("Only the creator or admins can cancel a request")
+	if !isManager && !isCreator {
+		jr.Error("Only the creator or managers of requests can cancel a request")
 		fmt.Fprint(w, jr.ToString(conf.Debug))
 		return
 	}
@@ -721,22 +914,10 @@ func DeleteConsensusRequest(w http.ResponseWriter, r *http.Request, ps httproute
 // Create execution request
 func PostConsensusRequest(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	jr := jresp.NewJsonResp()
-	if !authUser(r) {
-		jr.Error("User not authorized for PostConsensusRequest")
-		fmt.Fprint(w, jr.ToString(conf.Debug))
-		return
-	}
-
-	// Are we allow to request execution?
 	user := getUser(r)
-	if !user.HasRole("requester") {
-		jr.Error("User not allowed to PostConsensusRequest")
-		fmt.Fprint(w, jr.ToString(conf.Debug))
-		return
-	}
 
 	// Verify two factor for, so that a hacked account can not request or execute anything without getting access to the 2fa device
-	if res, _ := user.ValidateTotp(r.PostFormValue("totp")); res == false {
+	if !validSecondFactor(user, r) {
 		jr.Error("Invalid two factor token")
 		fmt.Fprint(w, jr.ToString(conf.Debug))
 		return
@@ -753,6 +934,34 @@ func PostConsensusRequest(w http.ResponseWriter, r *http.Request, ps httprouter.
 	// Template
 	templateId := strings.TrimSpace(r.PostFormValue("template"))
 	clientIds := strings.Split(strings.TrimSpace(r.PostFormValue("clients")), ",")
+	template := server.templateStore.Get(templateId)
+	if template == nil || !template.VisibleTo(user) {
+		jr.Error("Template not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	if !user.Can(PERM_REQUEST_CREATE, template, registeredClients(clientIds)) {
+		jr.Error("User not allowed to request this template on these clients")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Clients must be able to run the interpreter
+	for _, clientId := range clientIds {
+		registeredClient := server.GetClient(clientId)
+		if registeredClient != nil && !registeredClient.HasInterpreter(template.Interpreter) {
+			jr.Error(fmt.Sprintf("Client %s does not support interpreter %s", clientId, normalizeInterpreter(template.Interpreter)))
+			fmt.Fprint(w, jr.ToString(conf.Debug))
+			return
+		}
+	}
+
+	// At least one client must be able to run it, the others are rejected in the plan
+	if plan := newConsensusPlan(template, clientIds, server.GetClient); len(plan.Clients) < 1 {
+		jr.Error("None of the clients can run this template, see the plan")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
 
 	// Create request
 	cr := server.consensus.AddRequest(templateId, clientIds, user, reason)
@@ -786,6 +995,11 @@ func PostTemplateValidation(w http.ResponseWriter, r *http.Request, ps httproute
 		fmt.Fprint(w, jr.ToString(conf.Debug))
 		return
 	}
+	if !template.EditableBy(getUser(r)) {
+		jr.Error("User not allowed to PostTemplateValidation")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
 
 	// Input
 	txt := r.PostFormValue("text")
@@ -832,6 +1046,11 @@ func DeleteTemplateValidation(w http.ResponseWriter, r *http.Request, ps httprou
 		fmt.Fprint(w, jr.ToString(conf.Debug))
 		return
 	}
+	if !template.EditableBy(getUser(r)) {
+		jr.Error("User not allowed to DeleteTemplateValidation")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
 
 	// Validaton rule id
 	id := ps.ByName("id")
@@ -856,30 +1075,23 @@ func GetTemplate(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		fmt.Fprint(w, jr.ToString(conf.Debug))
 		return
 	}
+	user := getUser(r)
 
-	server.templateStore.templateMux.RLock()
-	jr.Set("templates", server.templateStore.Templates)
-	server.templateStore.templateMux.RUnlock()
+	// Only the templates of the teams of the user
+	templates, categories := visibleTemplates(user, r.URL.Query().Get("category"))
+	editable := make(map[string]bool)
+	for id, template := range templates {
+		editable[id] = template.EditableBy(user)
+	}
+	jr.Set("templates", templates)
+	jr.Set("categories", categories)
+	jr.Set("editable", editable)
 	jr.OK()
 	fmt.Fprint(w, jr.ToString(conf.Debug))
 }
 
-// Create template
-func PostTemplate(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	jr := jresp.NewJsonResp()
-	if !authUser(r) {
-		jr.Error("User not authorized for PostTemplate")
-		fmt.Fprint(w, jr.ToString(conf.Debug))
-		return
-	}
-
-	user := getUser(r)
-	if !user.HasRole("admin") {
-		jr.Error("User not allowed to PostTemplate")
-		fmt.Fprint(w, jr.ToString(conf.Debug))
-		return
-	}
-
+// Template as submitted in the form, not validated against the other templates
+func templateFromForm(r *http.Request) (*Template, error) {
 	title := strings.TrimSpace(r.PostFormValue("title"))
 	description := strings.TrimSpace(r.PostFormValue("description"))
 	command := r.PostFormValue("command")
@@ -888,71 +1100,122 @@ func PostTemplate(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 	executionStrategyStr := r.PostFormValue("executionStrategy")
 
 	// Create strategy
-	var executionStrategy *ExecutionStrategy
-	switch executionStrategyStr {
-	case "simple":
-		executionStrategy = newExecutionStrategy(SimpleExecutionStrategy)
-		break
-	case "one-test":
-		executionStrategy = newExecutionStrategy(OneTestExecutionStrategy)
-		break
-	case "rolling":
-		executionStrategy = newExecutionStrategy(RollingExecutionStrategy)
-		break
-	case "exponential-rolling":
-		executionStrategy = newExecutionStrategy(ExponentialRollingExecutionStrategy)
-		break
-	default:
-		jr.Error("Strategy not found")
-		fmt.Fprint(w, jr.ToString(conf.Debug))
-		return
+	executionStrategy := parseExecutionStrategy(executionStrategyStr)
+	if executionStrategy == nil {
+		return nil, errors.New("Strategy not found")
 	}
 
 	// Minimum authorizations
 	minAuthStr := strings.TrimSpace(r.PostFormValue("minAuth"))
 	minAuth, minAuthE := strconv.ParseInt(minAuthStr, 10, 0)
 	if len(minAuthStr) < 1 {
-		jr.Error("Fill in min auth")
-		fmt.Fprint(w, jr.ToString(conf.Debug))
-		return
+		return nil, errors.New("Fill in min auth")
 	} else if minAuthE != nil {
-		jr.Error(fmt.Sprintf("%s", minAuthE))
-		fmt.Fprint(w, jr.ToString(conf.Debug))
-		return
+		return nil, minAuthE
 	} else if minAuth < 1 {
-		jr.Error("Min auth must be at least 1")
-		fmt.Fprint(w, jr.ToString(conf.Debug))
-		return
+		return nil, errors.New("Min auth must be at least 1")
 	}
 
 	// Timeout
 	timeoutStr := strings.TrimSpace(r.PostFormValue("timeout"))
 	timeout, timeoutE := strconv.ParseInt(timeoutStr, 10, 0)
 	if len(timeoutStr) < 1 {
-		jr.Error("Fill in timeout")
-		fmt.Fprint(w, jr.ToString(conf.Debug))
-		return
+		return nil, errors.New("Fill in timeout")
 	} else if timeoutE != nil {
-		jr.Error(fmt.Sprintf("%s", timeoutE))
-		fmt.Fprint(w, jr.ToString(conf.Debug))
-		return
+		return nil, timeoutE
 	} else if timeout < 1 {
-		jr.Error("Timeout must be at least 1 second")
-		fmt.Fprint(w, jr.ToString(conf.Debug))
-		return
+		return nil, errors.New("Timeout must be at least 1 second")
+	}
+
+	// Interpreter
+	interpreter := strings.TrimSpace(r.PostFormValue("interpreter"))
+	if interpreter == DEFAULT_INTERPRETER {
+		interpreter = ""
+	}
+
+	// Grace period between SIGTERM and SIGKILL, optional
+	killGracePeriodStr := strings.TrimSpace(r.PostFormValue("killGracePeriod"))
+	var killGracePeriod *int
+	if len(killGracePeriodStr) > 0 {
+		seconds, killGracePeriodE := strconv.ParseInt(killGracePeriodStr, 10, 0)
+		if killGracePeriodE != nil {
+			return nil, killGracePeriodE
+		} else if seconds < 0 {
+			return nil, errors.New("Grace period can not be negative")
+		}
+		killGracePeriod = new(int)
+		*killGracePeriod = int(seconds)
+	}
+
+	// How long a command waits for an offline client, optional
+	deliveryTimeoutStr := strings.TrimSpace(r.PostFormValue("deliveryTimeout"))
+	var deliveryTimeout int64
+	if len(deliveryTimeoutStr) > 0 {
+		var deliveryTimeoutE error
+		deliveryTimeout, deliveryTimeoutE = strconv.ParseInt(deliveryTimeoutStr, 10, 0)
+		if deliveryTimeoutE != nil {
+			return nil, deliveryTimeoutE
+		} else if deliveryTimeout < 0 {
+			return nil, errors.New("Delivery timeout can not be negative")
+		}
+	}
+
+	// Run as user, environment and limits
+	environment, environmentE := executionEnvironmentFromForm(r)
+	if environmentE != nil {
+		return nil, environmentE
+	}
+
+	// Files to collect after execution
+	artifacts, artifactsE := artifactsFromForm(r)
+	if artifactsE != nil {
+		return nil, artifactsE
 	}
 
-	// Validate template
 	template := newTemplate(title, description, command, true, strings.Split(includedTags, ","), strings.Split(excludedTags, ","), uint(minAuth), int(timeout), executionStrategy)
+	template.Environment = environment
+	template.Interpreter = interpreter
+	template.KillGracePeriod = killGracePeriod
+	template.Artifacts = artifacts
+	template.DeliveryTimeout = int(deliveryTimeout)
+	template.Interactive = r.PostFormValue("interactive") == "true"
+	template.CheckCommand = r.PostFormValue("checkCommand")
+	template.DryRun = r.PostFormValue("dryRun") == "true"
+	template.RequireCheck = r.PostFormValue("requireCheck") == "true"
+	template.Category = strings.TrimSpace(r.PostFormValue("category"))
+	template.OwnerTeam = strings.TrimSpace(r.PostFormValue("ownerTeam"))
+	template.Teams = splitFormList(r.PostFormValue("teams"))
+	return template, nil
+}
+
+// Create template
+func PostTemplate(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	user := getUser(r)
+
+	// Validate template
+	template, formE := templateFromForm(r)
+	if formE != nil {
+		jr.Error(fmt.Sprintf("%s", formE))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
 	valid, err := template.IsValid()
 	if !valid {
 		jr.Error(fmt.Sprintf("%s", err))
 		fmt.Fprint(w, jr.ToString(conf.Debug))
 		return
 	}
+	if !user.Can(PERM_TEMPLATE_CREATE, template, nil) {
+		jr.Error("User not allowed to create templates with these tags")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
 
+	template.initVersion(user.Id)
 	server.templateStore.Add(template)
 	server.templateStore.save()
+	audit.Log(user, "Template", fmt.Sprintf("Created template %s (%s)", template.Title, template.Id))
 	jr.Set("template", template)
 	jr.Set("saved", true)
 	jr.OK()
@@ -967,6 +1230,7 @@ func PostAuth(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		login:      strings.TrimSpace(r.PostFormValue("username")),
 		credential: strings.TrimSpace(r.PostFormValue("password")),
 		token:      strings.TrimSpace(r.PostFormValue("2fa")),
+		webauthn:   r.PostFormValue("webauthn"),
 	}
 
 	user, err := server.authService.authUser(authReq)
@@ -991,8 +1255,10 @@ func PostAuth(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		roles = append(roles, role)
 	}
 	jr.Set("user_roles", roles)
+	jr.Set("user_permissions", user.Permissions())
 	jr.Set("user_id", user.Id)
 	jr.Set("two_factor_enabled", user.HasTwoFactor())
+	jr.Set("webauthn_enabled", user.HasWebauthn())
 	jr.OK()
 	fmt.Fprint(w, jr.ToString(conf.Debug))
 }
@@ -1098,14 +1364,22 @@ func DeleteTemplate(w http.ResponseWriter, r *http.Request, ps httprouter.Params
 		return
 	}
 	usr := getUser(r)
-	if !usr.HasRole("admin") {
-		jr.Error("User not allowed to DeleteTemplate")
+
+	// Template
+	id := strings.TrimSpace(r.URL.Query().Get("id"))
+	template := server.templateStore.Get(id)
+	if template == nil {
+		jr.Error("Template not found")
 		fmt.Fprint(w, jr.ToString(conf.Debug))
 		return
 	}
 
-	// Username
-	id := strings.TrimSpace(r.URL.Query().Get("id"))
+	// Owners and admins only
+	if !template.EditableBy(usr) {
+		jr.Error("User not allowed to DeleteTemplate")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
 
 	// Make sure it's not used by an HTTP check
 	if len(server.httpCheckStore.FindByTemplate(id)) > 0 {
@@ -1117,6 +1391,7 @@ func DeleteTemplate(w http.ResponseWriter, r *http.Request, ps httprouter.Params
 	// Remove
 	server.templateStore.Remove(id)
 	server.templateStore.save()
+	audit.Log(usr, "Template", fmt.Sprintf("Deleted template %s (%s)", template.Title, id))
 
 	jr.Set("saved", true)
 	jr.OK()
@@ -1126,17 +1401,7 @@ func DeleteTemplate(w http.ResponseWriter, r *http.Request, ps httprouter.Params
 // Delete user
 func DeleteUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	jr := jresp.NewJsonResp()
-	if !authUser(r) {
-		jr.Error("User not authorized for DeleteUser")
-		fmt.Fprint(w, jr.ToString(conf.Debug))
-		return
-	}
 	usr := getUser(r)
-	if !usr.HasRole("admin") {
-		jr.Error("User not allowed to DeleteUser")
-		fmt.Fprint(w, jr.ToString(conf.Debug))
-		return
-	}
 
 	// Verify two factor for deletion of a user
 	if res, _ := usr.ValidateTotp(r.URL.Query().Get("admin_totp")); res == false {
@@ -1155,6 +1420,13 @@ func DeleteUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		return
 	}
 
+	// Only users with at most the same permissions
+	if user := server.userStore.ByName(username); user != nil && !usr.MayManageUser(user) {
+		jr.Error("User not allowed to remove a user with more permissions")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
 	// Get user
 	server.userStore.RemoveByName(username)
 	server.userStore.save()
@@ -1167,17 +1439,7 @@ func DeleteUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 // Create user
 func PostUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	jr := jresp.NewJsonResp()
-	if !authUser(r) {
-		jr.Error("User not authorized for PostUser")
-		fmt.Fprint(w, jr.ToString(conf.Debug))
-		return
-	}
 	usr := getUser(r)
-	if !usr.HasRole("admin") {
-		jr.Error("User not allowed to PostUser")
-		fmt.Fprint(w, jr.ToString(conf.Debug))
-		return
-	}
 
 	// Verify two factor for creation of new user, so that a hacked admin can not create a new user and use that to sign of for new commands
 	if res, _ := usr.ValidateTotp(r.PostFormValue("admin_totp")); res == false {
@@ -1207,10 +1469,25 @@ func PostUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	}
 
 	// Roles
-	roles := strings.Split(r.PostFormValue("roles"), ",")
+	roles, err := parseRoles(r.PostFormValue("roles"), conf.Roles)
+	if err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	for _, role := range roles {
+		if !usr.MayAssignRole(role) {
+			jr.Error(fmt.Sprintf("User not allowed to assign role %s", role))
+			fmt.Fprint(w, jr.ToString(conf.Debug))
+			return
+		}
+	}
 
 	// Create user
 	res := server.userStore.CreateUser(username, newPwd, email, roles)
+	if res {
+		server.userStore.ByName(username).SetTeams(splitFormList(r.PostFormValue("teams")))
+	}
 	server.userStore.save()
 
 	jr.Set("saved", res)
@@ -1221,17 +1498,7 @@ func PostUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 // Modify user
 func PutUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	jr := jresp.NewJsonResp()
-	if !authUser(r) {
-		jr.Error("User not authorized for Change User")
-		fmt.Fprint(w, jr.ToString(conf.Debug))
-		return
-	}
 	admin := getUser(r)
-	if !admin.HasRole("admin") {
-		jr.Error("User not allowed to Change User")
-		fmt.Fprint(w, jr.ToString(conf.Debug))
-		return
-	}
 
 	// Verify two factor for change user
 	if res, _ := admin.ValidateTotp(r.PostFormValue("token")); res == false {
@@ -1248,10 +1515,34 @@ func PutUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		fmt.Fprint(w, jr.ToString(conf.Debug))
 		return
 	}
+	if !admin.MayManageUser(user) {
+		jr.Error("User not allowed to modify a user with more permissions")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
 	for key, _ := range r.PostForm {
 		switch key {
 		case "enable":
 			user.Enabled = cast.ToBool(r.PostFormValue(key))
+		case "teams":
+			user.SetTeams(splitFormList(r.PostFormValue(key)))
+			audit.Log(admin, "User", fmt.Sprintf("Changed teams of %s to %s", user.Username, r.PostFormValue(key)))
+		case "roles":
+			roles, err := parseRoles(r.PostFormValue(key), conf.Roles)
+			if err != nil {
+				jr.Error(fmt.Sprintf("%s", err))
+				fmt.Fprint(w, jr.ToString(conf.Debug))
+				return
+			}
+			for _, role := range roles {
+				if !admin.MayAssignRole(role) {
+					jr.Error(fmt.Sprintf("User not allowed to assign role %s", role))
+					fmt.Fprint(w, jr.ToString(conf.Debug))
+					return
+				}
+			}
+			user.SetRoles(roles)
+			audit.Log(admin, "User", fmt.Sprintf("Changed roles of %s to %s", user.Username, r.PostFormValue(key)))
 		case "username", "token":
 			continue
 		default:
@@ -1293,17 +1584,7 @@ func GetUsersNames(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 // List users
 func GetUsers(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	jr := jresp.NewJsonResp()
-	if !authUser(r) {
-		jr.Error("User not authorized for GetUsers")
-		fmt.Fprint(w, jr.ToString(conf.Debug))
-		return
-	}
-	usr := getUser(r)
-	if !usr.HasRole("admin") {
-		jr.Error("User not allowed to GetUsers")
-		fmt.Fprint(w, jr.ToString(conf.Debug))
-		return
-	}
+
 	server.userStore.usersMux.RLock()
 	users := make([]User, 0)
 	for _, userPtr := range server.userStore.Users {
@@ -1339,6 +1620,13 @@ func GetClients(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	if len(tagsExclude) == 1 && tagsExclude[0] == "" {
 		tagsExclude = make([]string, 0)
 	}
+	interpreter := r.URL.Query().Get("filter_interpreter")
+	factFilters, factFiltersE := parseFactFilters(r.URL.Query().Get("filter_facts"))
+	if factFiltersE != nil {
+		jr.Error(fmt.Sprintf("%s", factFiltersE))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
 
 	clients := make([]RegisteredClient, 0)
 	server.clientsMux.RLock()
@@ -1365,6 +1653,16 @@ outer:
 			continue
 		}
 
+		// Able to run the interpreter?
+		if len(interpreter) > 0 && !clientPtr.HasInterpreter(interpreter) {
+			continue
+		}
+
+		// Facts must match
+		if !clientPtr.MatchFacts(factFilters) {
+			continue
+		}
+
 		// Deref, so we can modify the object without modifying the real one
 		client := *clientPtr
 
@@ -1476,18 +1774,7 @@ func PutClientCmdLogs(w http.ResponseWriter, r *http.Request, ps httprouter.Para
 	}
 
 	// Append buffers
-	if m.Output != nil {
-		for _, line := range m.Output {
-			cmd.BufOutput = append(cmd.BufOutput, line)
-		}
-	}
-
-	// Append buffers
-	if m.Error != nil {
-		for _, line := range m.Error {
-			cmd.BufOutputErr = append(cmd.BufOutputErr, line)
-		}
-	}
+	cmd.AppendLogs(m.Output, m.Error)
 
 	jr.OK()
 	fmt.Fprint(w, jr.ToString(conf.Debug))
@@ -1521,11 +1808,25 @@ func PutClientCmdState(w http.ResponseWriter, r *http.Request, ps httprouter.Par
 		return
 	}
 
-	// State
-	state := r.URL.Query().Get("state")
+	// Exit details, so a timeout can be told apart from a crash
+	exitCode := cmd.ExitCode
+	if exitCodeStr := r.URL.Query().Get("exit_code"); len(exitCodeStr) > 0 {
+		exitCode = cast.ToInt(exitCodeStr)
+	}
+
+	// Question of a command awaiting input
+	var prompt *CmdPrompt
+	if promptStr := r.URL.Query().Get("prompt"); len(promptStr) > 0 {
+		prompt = &CmdPrompt{}
+		if je := json.Unmarshal([]byte(promptStr), prompt); je != nil {
+			jr.Error(fmt.Sprintf("Invalid prompt: %s", je))
+			fmt.Fprint(w, jr.ToString(conf.Debug))
+			return
+		}
+	}
 
 	// Save state in local server
-	cmd.SetState(state)
+	cmd.ReportState(r.URL.Query().Get("state"), exitCode, r.URL.Query().Get("exit_signal"), r.URL.Query().Get("timed_out") == "true", prompt)
 
 	jr.OK()
 	fmt.Fprint(w, jr.ToString(conf.Debug))
@@ -1556,23 +1857,24 @@ func ClientCmds(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		return
 	}
 
-	// Read from channel and dispatch before timeout
-	select {
-	case <-registeredClient.CmdChan:
-		cmds := make([]*Cmd, 0)
-		registeredClient.mux.Lock()
-		for _, cmd := range registeredClient.Cmds {
-			if cmd.Pending {
-				cmds = append(cmds, cmd)
-				cmd.Pending = false
-			}
+	// Commands and input that are already pending are returned right away, otherwise wait for a signal before the timeout
+	if len(registeredClient.pendingCmds()) == 0 && !registeredClient.hasInputs() {
+		select {
+		case <-registeredClient.CmdChan:
+		case <-time.After(time.Second * LONG_POLL_TIMEOUT):
 		}
-		registeredClient.mux.Unlock()
-		jr.Set("cmds", cmds)
-	case <-time.After(time.Second * LONG_POLL_TIMEOUT):
-		// No commands
-		jr.Set("cmds", make([]string, 0))
 	}
+
+	// Dispatch all of them, also when they came in a burst
+	registeredClient.deliverMux.Lock()
+	cmds := registeredClient.signedCmds()
+	for _, cmd := range cmds {
+		registeredClient.sent(cmd)
+	}
+	inputs := registeredClient.takeInputs()
+	registeredClient.deliverMux.Unlock()
+	jr.Set("cmds", cmds)
+	jr.Set("inputs", inputs)
 	jr.OK()
 	fmt.Fprint(w, jr.ToString(conf.Debug))
 }
@@ -1586,7 +1888,17 @@ func ClientPing(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		return
 	}
 	tags := strings.Split(r.URL.Query().Get("tags"), ",")
-	server.RegisterClient(ps.ByName("clientId"), tags)
+	interpreters := make([]string, 0)
+	if str := r.URL.Query().Get("interpreters"); len(str) > 0 {
+		interpreters = strings.Split(str, ",")
+	}
+	server.RegisterClient(ps.ByName("clientId"), tags, interpreters)
+	registeredClient := server.GetClient(ps.ByName("clientId"))
+	registeredClient.SetAgent(r.URL.Query().Get("version"), r.URL.Query().Get("os"), r.URL.Query().Get("arch"))
+	workers, _ := strconv.Atoi(r.URL.Query().Get("workers"))
+	running, _ := strconv.Atoi(r.URL.Query().Get("running"))
+	queued, _ := strconv.Atoi(r.URL.Query().Get("queued"))
+	registeredClient.SetQueue(workers, running, queued)
 	jr.Set("ack", true)
 	jr.Set("server_instance_id", server.InstanceId)
 	jr.OK()
@@ -1655,7 +1967,8 @@ func newRegisteredClient(clientId string) *RegisteredClient {
 	return &RegisteredClient{
 		ClientId:       clientId,
 		Cmds:           make(map[string]*Cmd),
-		CmdChan:        make(chan bool),
+		CmdChan:        make(chan bool, 1),
 		DispatchedCmds: make(map[string]*Cmd),
+		Inputs:         make(map[string]*CmdInput),
 	}
 }
@@ -0,0 +1,374 @@
+package main
+
+// Persistent control stream between client and server. A single full duplex HTTP/2 request carries commands,
+// command states, logs and pings as newline delimited JSON frames. Clients fall back to long polling
+// when the stream can not be established.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+const STREAM_CONTENT_TYPE string = "application/x-ndjson"
+const STREAM_PING_INTERVAL int = 15   // In seconds
+const STREAM_RETRY_INTERVAL int = 300 // In seconds of long polling before the stream is attempted again
+const STREAM_QUEUE_SIZE int = 100     // Frames and commands that can be queued before the sender has to wait
+
+type StreamFrame struct {
+	Type       string     `json:"type"`                  // cmd, ack, state, logs, input or ping
+	Cmd        *Cmd       `json:"cmd,omitempty"`         // Command to execute, from server to client
+	CmdId      string     `json:"cmd_id,omitempty"`      // Command of an ack, state or logs frame, from client to server
+	State      string     `json:"state,omitempty"`       // State of the command
+	ExitCode   int        `json:"exit_code,omitempty"`   // Exit code of the process
+	ExitSignal string     `json:"exit_signal,omitempty"` // Signal that ended the process
+	TimedOut   bool       `json:"timed_out,omitempty"`   // Was the process terminated because of the timeout?
+	Output     []string   `json:"output,omitempty"`      // Standard output lines
+	Error      []string   `json:"error,omitempty"`       // Error output lines
+	Prompt     *CmdPrompt `json:"prompt,omitempty"`      // Question of a command awaiting input, from client to server
+	Input      *CmdInput  `json:"input,omitempty"`       // Answer to a prompt, from server to client
+}
+
+// Open control stream on the client
+type clientStream struct {
+	ctx context.Context
+	out chan *streamWrite
+}
+
+// Frame to write with the result of the write
+type streamWrite struct {
+	frame  *StreamFrame
+	result chan error
+}
+
+// Signal the client that commands are pending, never blocks as one signal covers all pending commands
+func (c *RegisteredClient) signal() {
+	select {
+	case c.CmdChan <- true:
+	default:
+		// Already signalled
+	}
+}
+
+// Commands to send in order of creation, those that were sent recently are still waiting for an acknowledgement
+func (c *RegisteredClient) pendingCmds() []*Cmd {
+	cmds := make([]*Cmd, 0)
+	resendBefore := time.Now().Unix() - int64(CMD_ACK_TIMEOUT)
+	c.mux.RLock()
+	for _, cmd := range c.Cmds {
+		if cmd.Pending && cmd.LastSent <= resendBefore {
+			cmds = append(cmds, cmd)
+		}
+	}
+	c.mux.RUnlock()
+	sort.Slice(cmds, func(i, j int) bool {
+		if cmds[i].Created == cmds[j].Created {
+			return cmds[i].Id < cmds[j].Id
+		}
+		return cmds[i].Created < cmds[j].Created
+	})
+	return cmds
+}
+
+// Keep track of connected streams
+func (c *RegisteredClient) trackStream(delta int) {
+	c.mux.Lock()
+	c.streams += delta
+	c.Streaming = c.streams > 0
+	c.mux.Unlock()
+}
+
+// Write the pending commands to the stream, a command is only marked as sent once it is written
+func (c *RegisteredClient) deliverStream(enc *json.Encoder, flusher http.Flusher) error {
+	c.deliverMux.Lock()
+	defer c.deliverMux.Unlock()
+	for _, cmd := range c.signedCmds() {
+		if err := enc.Encode(&StreamFrame{Type: "cmd", Cmd: cmd}); err != nil {
+			// Let another stream or long poll pick it up
+			c.signal()
+			return err
+		}
+		flusher.Flush()
+		c.sent(cmd)
+	}
+	for _, in := range c.takeInputs() {
+		if err := enc.Encode(&StreamFrame{Type: "input", Input: in}); err != nil {
+			c.returnInput(in)
+			return err
+		}
+		flusher.Flush()
+	}
+	return nil
+}
+
+// Handle a frame received from the client
+func (c *RegisteredClient) handleFrame(frame *StreamFrame) {
+	switch frame.Type {
+	case "ping":
+		c.mux.Lock()
+		c.LastPing = time.Now()
+		c.mux.Unlock()
+	case "ack":
+		c.acknowledge(frame.CmdId)
+	case "state", "logs":
+		c.mux.RLock()
+		cmd := c.DispatchedCmds[frame.CmdId]
+		c.mux.RUnlock()
+		if cmd == nil {
+			log.Printf("Received %s of unknown command %s from client %s", frame.Type, frame.CmdId, c.ClientId)
+			return
+		}
+		if frame.Type == "state" {
+			cmd.ReportState(frame.State, frame.ExitCode, frame.ExitSignal, frame.TimedOut, frame.Prompt)
+		} else {
+			cmd.AppendLogs(frame.Output, frame.Error)
+		}
+	default:
+		log.Printf("Received unknown frame %s from client %s", frame.Type, c.ClientId)
+	}
+}
+
+// Control stream of a client
+func ClientStream(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !auth(r) {
+		jr.Error("Client not authorized for ClientStream")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Get client
+	clientId := ps.ByName("clientId")
+	registeredClient := server.GetClient(clientId)
+	if registeredClient == nil {
+		jr.Error(fmt.Sprintf("Client %s not registered", clientId))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Do we have a token? If not, ignore as the client will discard the commands without hmac signatures
+	if len(registeredClient.AuthToken) < 1 {
+		jr.Error(fmt.Sprintf("Client %s auth token not available", registeredClient.ClientId))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Reading and writing at the same time requires HTTP/2, the client falls back to long polling
+	flusher, ok := w.(http.Flusher)
+	if r.ProtoMajor < 2 || !ok {
+		jr.Error("Control stream requires HTTP/2")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Open stream
+	w.Header().Set("Content-Type", STREAM_CONTENT_TYPE)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	registeredClient.trackStream(1)
+	defer registeredClient.trackStream(-1)
+	log.Printf("Client %s connected control stream", clientId)
+
+	// Reconnected, send what was not acknowledged again
+	registeredClient.resetSent()
+
+	// Frames from the client, the client pings so a silent stream is considered dead
+	pingInterval := time.Duration(STREAM_PING_INTERVAL) * time.Second
+	watchdog := time.NewTimer(3 * pingInterval)
+	defer watchdog.Stop()
+	closed := make(chan bool)
+	go func() {
+		defer close(closed)
+		dec := json.NewDecoder(r.Body)
+		for {
+			var frame StreamFrame
+			if err := dec.Decode(&frame); err != nil {
+				return
+			}
+			watchdog.Reset(3 * pingInterval)
+			registeredClient.handleFrame(&frame)
+		}
+	}()
+
+	// Frames to the client, starting with what was submitted while it was not connected
+	enc := json.NewEncoder(w)
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+	for {
+		if err := registeredClient.deliverStream(enc, flusher); err != nil {
+			log.Printf("Control stream of client %s failed: %s", clientId, err)
+			return
+		}
+		select {
+		case <-registeredClient.CmdChan:
+		case <-ping.C:
+			if err := enc.Encode(&StreamFrame{Type: "ping"}); err != nil {
+				log.Printf("Control stream of client %s failed: %s", clientId, err)
+				return
+			}
+			flusher.Flush()
+		case <-watchdog.C:
+			log.Printf("Control stream of client %s timed out", clientId)
+			return
+		case <-closed:
+			log.Printf("Client %s disconnected control stream", clientId)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Keep the control stream open, long poll while the server does not support it
+func (s *Client) RunControlChannel() {
+	for {
+		connected, err := s.Stream()
+		if connected {
+			// Reconnect right away, with a little delay to not hammer a restarting server
+			log.Printf("Control stream closed: %s", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		log.Printf("Control stream unavailable, falling back to long polling: %s", err)
+		until := time.Now().Add(time.Duration(STREAM_RETRY_INTERVAL) * time.Second)
+		for time.Now().Before(until) {
+			s.PollCmds()
+		}
+	}
+}
+
+// Run the control stream until it fails, returns whether it was connected
+func (s *Client) Stream() (bool, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Request body carries our frames
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	req, err := s._newRequest("POST", fmt.Sprintf("client/%s/stream", url.QueryEscape(s.Id)), pr)
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+
+	// Connect
+	tr := newClientTransport()
+	defer tr.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor < 2 || resp.Header.Get("Content-Type") != STREAM_CONTENT_TYPE {
+		// Old server, proxy without HTTP/2 or an error
+		return false, errors.New("Server did not open a control stream")
+	}
+	log.Printf("Control stream connected")
+
+	// Writer
+	stream := &clientStream{
+		ctx: ctx,
+		out: make(chan *streamWrite, STREAM_QUEUE_SIZE),
+	}
+	s.mux.Lock()
+	s.stream = stream
+	s.mux.Unlock()
+	defer func() {
+		s.mux.Lock()
+		if s.stream == stream {
+			s.stream = nil
+		}
+		s.mux.Unlock()
+	}()
+	go func() {
+		enc := json.NewEncoder(pw)
+		ping := time.NewTicker(time.Duration(STREAM_PING_INTERVAL) * time.Second)
+		defer ping.Stop()
+		for {
+			var err error
+			select {
+			case w := <-stream.out:
+				err = enc.Encode(w.frame)
+				w.result <- err
+			case <-ping.C:
+				err = enc.Encode(&StreamFrame{Type: "ping"})
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				cancel()
+				return
+			}
+		}
+	}()
+
+	// Reader, the server pings so a silent stream is considered dead
+	pingTimeout := 3 * time.Duration(STREAM_PING_INTERVAL) * time.Second
+	watchdog := time.AfterFunc(pingTimeout, cancel)
+	defer watchdog.Stop()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var frame StreamFrame
+		if err := dec.Decode(&frame); err != nil {
+			return true, err
+		}
+		watchdog.Reset(pingTimeout)
+		switch frame.Type {
+		case "cmd":
+			if frame.Cmd == nil {
+				continue
+			}
+			// Wait for room in the queue, the server will hold further commands in the meantime
+			watchdog.Stop()
+			s.receiveCmd(frame.Cmd)
+			watchdog.Reset(pingTimeout)
+		case "input":
+			if frame.Input != nil {
+				s.receiveInput(frame.Input)
+			}
+		case "ping":
+		default:
+			log.Printf("Received unknown frame %s from server", frame.Type)
+		}
+	}
+}
+
+// Send a frame over the control stream, fails if the stream is not connected
+func (s *Client) SendFrame(frame *StreamFrame) error {
+	s.mux.RLock()
+	stream := s.stream
+	s.mux.RUnlock()
+	if stream == nil {
+		return errors.New("Control stream not connected")
+	}
+
+	w := &streamWrite{
+		frame:  frame,
+		result: make(chan error, 1),
+	}
+	select {
+	case stream.out <- w:
+	case <-stream.ctx.Done():
+		return stream.ctx.Err()
+	}
+	select {
+	case err := <-w.result:
+		return err
+	case <-stream.ctx.Done():
+		// Written just before the stream closed?
+		select {
+		case err := <-w.result:
+			return err
+		default:
+			return stream.ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRegisteredClientSignal(t *testing.T) {
+	c := newRegisteredClient("test")
+
+	// Never blocks, multiple submits collapse into one signal
+	c.signal()
+	c.signal()
+	assert.Len(t, c.CmdChan, 1)
+	<-c.CmdChan
+	assert.Len(t, c.CmdChan, 0)
+}
+
+func TestRegisteredClientPendingCmds(t *testing.T) {
+	c := newRegisteredClient("test")
+	first := newCmd("echo 1", 10)
+	first.Created = 100
+	second := newCmd("echo 2", 10)
+	second.Created = 200
+	done := newCmd("echo 3", 10)
+	done.Pending = false
+	c.Cmds[second.Id] = second
+	c.Cmds[first.Id] = first
+	c.Cmds[done.Id] = done
+
+	// Oldest first, delivered ones are skipped
+	cmds := c.pendingCmds()
+	assert.Len(t, cmds, 2)
+	assert.Equal(t, first.Id, cmds[0].Id)
+	assert.Equal(t, second.Id, cmds[1].Id)
+
+	// Sent ones wait for an acknowledgement
+	c.sent(first)
+	cmds = c.pendingCmds()
+	assert.Len(t, cmds, 1)
+	assert.Equal(t, second.Id, cmds[0].Id)
+
+	// Reconnect sends them again
+	c.resetSent()
+	assert.Len(t, c.pendingCmds(), 2)
+}
@@ -0,0 +1,164 @@
+package main
+
+// Teams of users and the templates they may use. A template has a category to group it in the console, an owner team
+// whose members may edit and delete it next to the users with template.create for it, and the teams that may see and
+// request it. Templates without teams are visible to everyone, as they were before teams existed. Requests, the
+// history and the logs of commands follow the visibility of their template.
+
+import (
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"sort"
+)
+
+// Is the user a member of the team?
+func (u *User) InTeam(team string) bool {
+	u.mux.RLock()
+	defer u.mux.RUnlock()
+	for _, t := range u.Teams {
+		if t == team {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) SetTeams(teams []string) {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	u.Teams = uniqueTags(teams)
+}
+
+// May the user see and request the template?
+func (t *Template) VisibleTo(u *User) bool {
+	if u.Can(PERM_TEMPLATE_CREATE, t, nil) {
+		return true
+	}
+	t.mux.RLock()
+	ownerTeam := t.OwnerTeam
+	teams := t.Teams
+	t.mux.RUnlock()
+	if len(teams) == 0 {
+		return true
+	}
+	if len(ownerTeam) > 0 && u.InTeam(ownerTeam) {
+		return true
+	}
+	for _, team := range teams {
+		if u.InTeam(team) {
+			return true
+		}
+	}
+	return false
+}
+
+// May the user edit or delete the template? Members of the owner team only change what does not affect what runs, where
+// or by whom, see ownerTeamChanges
+func (t *Template) EditableBy(u *User) bool {
+	if u.Can(PERM_TEMPLATE_CREATE, t, nil) {
+		return true
+	}
+	t.mux.RLock()
+	ownerTeam := t.OwnerTeam
+	t.mux.RUnlock()
+	return len(ownerTeam) > 0 && u.InTeam(ownerTeam)
+}
+
+// Changes of a version that need template.create, the owner team may only change the description and category
+func ownerTeamChanges(previous *TemplateVersion, v *TemplateVersion) []string {
+	allowed := *previous
+	allowed.Description = v.Description
+	allowed.Category = v.Category
+	return templateChanges(&allowed, v)
+}
+
+// May the user see the command? Commands of deleted templates only to users that may create any template. Ad-hoc
+// commands and agent updates have no template, they are visible to the requester, the approvers of the request and
+// users that manage requests.
+func (c *Cmd) VisibleTo(u *User) bool {
+	if len(c.TemplateId) < 1 {
+		if c.RequestUserId == u.Id || u.Can(PERM_REQUEST_MANAGE, nil, nil) {
+			return true
+		}
+		req := server.consensus.Get(c.ConsensusRequestId)
+		return req != nil && req.ApproveUserIds[u.Id]
+	}
+	template := server.templateStore.Get(c.TemplateId)
+	if template == nil {
+		return u.Can(PERM_TEMPLATE_CREATE, nil, nil)
+	}
+	return template.VisibleTo(u)
+}
+
+// May the user see the request?
+func (c *ConsensusRequest) VisibleTo(u *User) bool {
+	template := c.Template()
+	if template == nil {
+		return u.Can(PERM_TEMPLATE_CREATE, nil, nil)
+	}
+	return template.VisibleTo(u)
+}
+
+// Templates the user may see, optionally of one category, and the categories of all of them
+func visibleTemplates(u *User, category string) (map[string]*Template, []string) {
+	server.templateStore.templateMux.RLock()
+	all := make([]*Template, 0, len(server.templateStore.Templates))
+	for _, template := range server.templateStore.Templates {
+		all = append(all, template)
+	}
+	server.templateStore.templateMux.RUnlock()
+
+	templates := make(map[string]*Template)
+	categories := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, template := range all {
+		if !template.VisibleTo(u) {
+			continue
+		}
+		template.mux.RLock()
+		templateCategory := template.Category
+		template.mux.RUnlock()
+		if len(templateCategory) > 0 && !seen[templateCategory] {
+			seen[templateCategory] = true
+			categories = append(categories, templateCategory)
+		}
+		if len(category) > 0 && templateCategory != category {
+			continue
+		}
+		templates[template.Id] = template
+	}
+	sort.Strings(categories)
+	return templates, categories
+}
+
+// Teams of the users and the templates, for selection in the console
+func GetTeams(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+
+	teams := make([]string, 0)
+	server.userStore.usersMux.RLock()
+	for _, u := range server.userStore.Users {
+		u.mux.RLock()
+		teams = append(teams, u.Teams...)
+		u.mux.RUnlock()
+	}
+	server.userStore.usersMux.RUnlock()
+	server.templateStore.templateMux.RLock()
+	for _, template := range server.templateStore.Templates {
+		template.mux.RLock()
+		if len(template.OwnerTeam) > 0 {
+			teams = append(teams, template.OwnerTeam)
+		}
+		teams = append(teams, template.Teams...)
+		template.mux.RUnlock()
+	}
+	server.templateStore.templateMux.RUnlock()
+	teams = uniqueTags(teams)
+	sort.Strings(teams)
+
+	jr.Set("teams", teams)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
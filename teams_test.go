@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestUserTeams(t *testing.T) {
+	u := newUser()
+	assert.False(t, u.InTeam("db"))
+	u.SetTeams([]string{"db", "web", "db"})
+	assert.Equal(t, []string{"db", "web"}, u.Teams)
+	assert.True(t, u.InTeam("db"))
+	assert.False(t, u.InTeam("ops"))
+}
+
+func TestTemplateVisibility(t *testing.T) {
+	dba := newUser()
+	dba.SetTeams([]string{"db"})
+	webDev := newUser()
+	webDev.SetTeams([]string{"web"})
+	admin := newUser()
+	admin.AddRole("admin")
+
+	// Without teams everyone sees it, only admins edit it
+	template := &Template{Title: "Uptime"}
+	assert.True(t, template.VisibleTo(dba))
+	assert.True(t, template.VisibleTo(webDev))
+	assert.False(t, template.EditableBy(dba))
+	assert.True(t, template.EditableBy(admin))
+
+	// Owner team edits and sees it, other teams only see it when listed
+	template = &Template{Title: "Vacuum", OwnerTeam: "db", Teams: []string{"ops"}}
+	assert.True(t, template.VisibleTo(dba))
+	assert.True(t, template.EditableBy(dba))
+	assert.False(t, template.VisibleTo(webDev))
+	assert.False(t, template.EditableBy(webDev))
+	assert.True(t, template.VisibleTo(admin))
+	assert.True(t, template.EditableBy(admin))
+	template.Teams = []string{"ops", "web"}
+	assert.True(t, template.VisibleTo(webDev))
+	assert.False(t, template.EditableBy(webDev))
+}
+
+func TestOwnerTeamChanges(t *testing.T) {
+	previous := &TemplateVersion{Title: "Vacuum", Command: "vacuumdb", MinAuth: 2, OwnerTeam: "db"}
+
+	// Description and category are up to the owner team
+	v := *previous
+	v.Description = "Reclaim space"
+	v.Category = "Database"
+	assert.Len(t, ownerTeamChanges(previous, &v), 0)
+
+	// What runs, where and by whom is not
+	v.Command = "dropdb app"
+	v.MinAuth = 1
+	assert.Equal(t, []string{"command: +1 -1 lines", "min auth: 2 -> 1"}, ownerTeamChanges(previous, &v))
+}
@@ -0,0 +1,912 @@
+package main
+
+// Templates as YAML or JSON bundles, so they can be managed in git. A bundle holds the templates with their validation
+// rules and HTTP checks, without the secrets of the checks and without attached files. Importing shows what changes
+// before anything is written, updates become new versions of the templates (see template_versions.go) and the server
+// can keep the templates in sync with the bundles in a directory under the home.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/fsnotify/fsnotify"
+	"github.com/julienschmidt/httprouter"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const TEMPLATE_BUNDLE_FORMAT int = 1                      // Version of the bundle layout
+const TEMPLATE_SYNC_DELAY time.Duration = 2 * time.Second // Quiet period after a change in the sync directory
+const TEMPLATE_SYNC_USER_ID string = "sync"               // Author of the versions created by the sync directory
+
+// Only one import at a time, so the plan still holds when it is applied
+var templateImportMux sync.Mutex
+
+type TemplateBundle struct {
+	Format    int               `json:"format" yaml:"format"`
+	Templates []*BundleTemplate `json:"templates" yaml:"templates"`
+}
+
+type BundleTemplate struct {
+	Id                string              `json:"id,omitempty" yaml:"id,omitempty"` // Optional, templates without id are matched by title
+	Title             string              `json:"title" yaml:"title"`
+	Description       string              `json:"description" yaml:"description"`
+	Category          string              `json:"category,omitempty" yaml:"category,omitempty"`
+	OwnerTeam         string              `json:"owner_team,omitempty" yaml:"owner_team,omitempty"`
+	Teams             []string            `json:"teams,omitempty" yaml:"teams,omitempty"`
+	Command           string              `json:"command" yaml:"command"`
+	Interpreter       string              `json:"interpreter,omitempty" yaml:"interpreter,omitempty"`
+	Timeout           int                 `json:"timeout" yaml:"timeout"`
+	KillGracePeriod   *int                `json:"kill_grace_period,omitempty" yaml:"kill_grace_period,omitempty"`
+	DeliveryTimeout   int                 `json:"delivery_timeout,omitempty" yaml:"delivery_timeout,omitempty"`
+	Interactive       bool                `json:"interactive,omitempty" yaml:"interactive,omitempty"`
+	CheckCommand      string              `json:"check_command,omitempty" yaml:"check_command,omitempty"`
+	DryRun            bool                `json:"dry_run,omitempty" yaml:"dry_run,omitempty"`
+	RequireCheck      bool                `json:"require_check,omitempty" yaml:"require_check,omitempty"`
+	MinAuth           uint                `json:"min_auth" yaml:"min_auth"`
+	IncludedTags      []string            `json:"included_tags,omitempty" yaml:"included_tags,omitempty"`
+	ExcludedTags      []string            `json:"excluded_tags,omitempty" yaml:"excluded_tags,omitempty"`
+	ExecutionStrategy string              `json:"execution_strategy,omitempty" yaml:"execution_strategy,omitempty"`
+	Environment       *BundleEnvironment  `json:"environment,omitempty" yaml:"environment,omitempty"`
+	Artifacts         []string            `json:"artifacts,omitempty" yaml:"artifacts,omitempty"`
+	Validation        []*BundleValidation `json:"validation,omitempty" yaml:"validation,omitempty"`
+	HttpChecks        []*BundleHttpCheck  `json:"http_checks,omitempty" yaml:"http_checks,omitempty"`
+}
+
+type BundleEnvironment struct {
+	User        string   `json:"user,omitempty" yaml:"user,omitempty"`
+	Group       string   `json:"group,omitempty" yaml:"group,omitempty"`
+	WorkingDir  string   `json:"working_dir,omitempty" yaml:"working_dir,omitempty"`
+	Env         []string `json:"env,omitempty" yaml:"env,omitempty"`
+	CpuSeconds  uint64   `json:"cpu_seconds,omitempty" yaml:"cpu_seconds,omitempty"`
+	MemoryBytes uint64   `json:"memory_bytes,omitempty" yaml:"memory_bytes,omitempty"`
+	OpenFiles   uint64   `json:"open_files,omitempty" yaml:"open_files,omitempty"`
+}
+
+type BundleValidation struct {
+	Text        string `json:"text" yaml:"text"`
+	Stream      string `json:"stream" yaml:"stream"` // stdout or stderr
+	MustContain bool   `json:"must_contain" yaml:"must_contain"`
+	Fatal       bool   `json:"fatal" yaml:"fatal"`
+}
+
+type BundleHttpCheck struct {
+	Id        string   `json:"id,omitempty" yaml:"id,omitempty"`
+	Enabled   bool     `json:"enabled" yaml:"enabled"`
+	Timeout   int      `json:"timeout" yaml:"timeout"`
+	ClientIds []string `json:"clients" yaml:"clients"`
+}
+
+// How an import treats existing templates
+type TemplateImportOptions struct {
+	Match      string // id (templates without id by title) or title
+	OnConflict string // overwrite, skip or fail when a matched template differs
+	DryRun     bool   // Only report the changes
+}
+
+// Outcome of the import of one template
+type TemplateImportChange struct {
+	Action   string   // create, update, unchanged or skip
+	Id       string   // Id of the template
+	Title    string   // Title in the bundle
+	Version  int      // Version of the template after the import
+	Pending  bool     // Change waits for approval of other admins
+	Changes  []string // What changes
+	Diff     []string // Command compared to the current version
+	template *Template
+	previous *TemplateVersion
+	version  *TemplateVersion
+	rules    []*ExecutionValidation
+	checks   []*HttpCheckConfiguration
+	// Clients of the HTTP checks the import adds, changes or removes, nil when the checks stay the same
+	checkClientIds []string
+}
+
+// Format of a bundle file by its extension, empty if it is not a bundle
+func bundleFormat(filename string) string {
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".json":
+		return "json"
+	}
+	return ""
+}
+
+func decodeTemplateBundle(b []byte, format string) (*TemplateBundle, error) {
+	var bundle TemplateBundle
+	var err error
+	switch format {
+	case "yaml":
+		err = yaml.Unmarshal(b, &bundle)
+	case "json":
+		err = json.Unmarshal(b, &bundle)
+	default:
+		return nil, fmt.Errorf("Unknown bundle format %s", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if bundle.Format > TEMPLATE_BUNDLE_FORMAT {
+		return nil, fmt.Errorf("Bundle format %d is newer than the supported %d", bundle.Format, TEMPLATE_BUNDLE_FORMAT)
+	}
+	return &bundle, nil
+}
+
+func (b *TemplateBundle) encode(format string) ([]byte, error) {
+	switch format {
+	case "yaml":
+		return yaml.Marshal(b)
+	case "json":
+		return json.MarshalIndent(b, "", "  ")
+	}
+	return nil, fmt.Errorf("Unknown bundle format %s", format)
+}
+
+// Bundle of templates, all of them the user may create if no ids are given. Without user all templates are exported.
+func exportTemplateBundle(templateIds []string, user *User) (*TemplateBundle, error) {
+	templates := make([]*Template, 0)
+	if len(templateIds) > 0 {
+		for _, id := range templateIds {
+			template := server.templateStore.Get(id)
+			if template == nil || (user != nil && !user.Can(PERM_TEMPLATE_CREATE, template, nil)) {
+				return nil, fmt.Errorf("Template %s not found", id)
+			}
+			templates = append(templates, template)
+		}
+	} else {
+		server.templateStore.templateMux.RLock()
+		for _, template := range server.templateStore.Templates {
+			if user != nil && !user.Can(PERM_TEMPLATE_CREATE, template, nil) {
+				continue
+			}
+			templates = append(templates, template)
+		}
+		server.templateStore.templateMux.RUnlock()
+	}
+
+	// Stable order, so exports can be compared in git
+	bundle := &TemplateBundle{Format: TEMPLATE_BUNDLE_FORMAT, Templates: make([]*BundleTemplate, 0, len(templates))}
+	for _, template := range templates {
+		bundle.Templates = append(bundle.Templates, newBundleTemplate(template, server.httpCheckStore.FindByTemplate(template.Id)))
+	}
+	sort.Sort(bundleTemplatesByTitle(bundle.Templates))
+	return bundle, nil
+}
+
+type bundleTemplatesByTitle []*BundleTemplate
+
+func (l bundleTemplatesByTitle) Len() int           { return len(l) }
+func (l bundleTemplatesByTitle) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l bundleTemplatesByTitle) Less(i, j int) bool { return l[i].Title < l[j].Title }
+
+func newBundleTemplate(t *Template, checks []*HttpCheckConfiguration) *BundleTemplate {
+	v := t.snapshot()
+	b := &BundleTemplate{
+		Id:                t.Id,
+		Title:             v.Title,
+		Description:       v.Description,
+		Category:          v.Category,
+		OwnerTeam:         v.OwnerTeam,
+		Teams:             v.Teams,
+		Command:           v.Command,
+		Interpreter:       v.Interpreter,
+		Timeout:           v.Timeout,
+		KillGracePeriod:   v.KillGracePeriod,
+		DeliveryTimeout:   v.DeliveryTimeout,
+		Interactive:       v.Interactive,
+		CheckCommand:      v.CheckCommand,
+		DryRun:            v.DryRun,
+		RequireCheck:      v.RequireCheck,
+		MinAuth:           v.MinAuth,
+		IncludedTags:      v.IncludedTags,
+		ExcludedTags:      v.ExcludedTags,
+		ExecutionStrategy: v.ExecutionStrategy.name(),
+		Artifacts:         v.Artifacts,
+		Validation:        make([]*BundleValidation, 0),
+		HttpChecks:        make([]*BundleHttpCheck, 0),
+	}
+	if e := v.Environment; e != nil {
+		b.Environment = &BundleEnvironment{
+			User:       e.User,
+			Group:      e.Group,
+			WorkingDir: e.WorkingDir,
+			Env:        e.Env,
+		}
+		if e.Limits != nil {
+			b.Environment.CpuSeconds = e.Limits.CpuSeconds
+			b.Environment.MemoryBytes = e.Limits.MemoryBytes
+			b.Environment.OpenFiles = e.Limits.OpenFiles
+		}
+	}
+	t.mux.RLock()
+	for _, rule := range t.ValidationRules {
+		b.Validation = append(b.Validation, newBundleValidation(rule))
+	}
+	t.mux.RUnlock()
+	for _, check := range checks {
+		b.HttpChecks = append(b.HttpChecks, &BundleHttpCheck{
+			Id:        check.Id,
+			Enabled:   check.Enabled,
+			Timeout:   check.Timeout,
+			ClientIds: check.ClientIds,
+		})
+	}
+	sort.Sort(bundleHttpChecksById(b.HttpChecks))
+	return b
+}
+
+type bundleHttpChecksById []*BundleHttpCheck
+
+func (l bundleHttpChecksById) Len() int           { return len(l) }
+func (l bundleHttpChecksById) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l bundleHttpChecksById) Less(i, j int) bool { return l[i].Id < l[j].Id }
+
+func newBundleValidation(rule *ExecutionValidation) *BundleValidation {
+	stream := "stdout"
+	if rule.OutputStream == 2 {
+		stream = "stderr"
+	}
+	return &BundleValidation{
+		Text:        rule.Text,
+		Stream:      stream,
+		MustContain: rule.MustContain,
+		Fatal:       rule.Fatal,
+	}
+}
+
+// Template as described in the bundle, not validated against the other templates
+func (b *BundleTemplate) template() (*Template, error) {
+	strategyName := b.ExecutionStrategy
+	if len(strategyName) < 1 {
+		strategyName = SimpleExecutionStrategy.name()
+	}
+	executionStrategy := parseExecutionStrategy(strategyName)
+	if executionStrategy == nil {
+		return nil, fmt.Errorf("Execution strategy %s of %s not found", b.ExecutionStrategy, b.Title)
+	}
+	if b.MinAuth < 1 {
+		return nil, fmt.Errorf("Min auth of %s must be at least 1", b.Title)
+	}
+	if b.Timeout < 1 {
+		return nil, fmt.Errorf("Timeout of %s must be at least 1 second", b.Title)
+	}
+	if (b.KillGracePeriod != nil && *b.KillGracePeriod < 0) || b.DeliveryTimeout < 0 {
+		return nil, fmt.Errorf("Grace period and delivery timeout of %s can not be negative", b.Title)
+	}
+	includedTags := b.IncludedTags
+	if includedTags == nil {
+		includedTags = make([]string, 0)
+	}
+	excludedTags := b.ExcludedTags
+	if excludedTags == nil {
+		excludedTags = make([]string, 0)
+	}
+	t := newTemplate(strings.TrimSpace(b.Title), strings.TrimSpace(b.Description), b.Command, true, includedTags, excludedTags, b.MinAuth, b.Timeout, executionStrategy)
+	t.Interpreter = strings.TrimSpace(b.Interpreter)
+	if t.Interpreter == DEFAULT_INTERPRETER {
+		t.Interpreter = ""
+	}
+	t.KillGracePeriod = b.KillGracePeriod
+	t.DeliveryTimeout = b.DeliveryTimeout
+	t.Interactive = b.Interactive
+	t.CheckCommand = b.CheckCommand
+	t.DryRun = b.DryRun
+	t.RequireCheck = b.RequireCheck
+	t.Category = strings.TrimSpace(b.Category)
+	t.OwnerTeam = strings.TrimSpace(b.OwnerTeam)
+	t.Teams = b.Teams
+	t.Artifacts = b.Artifacts
+	if t.Artifacts == nil {
+		t.Artifacts = make([]string, 0)
+	}
+	if e := b.Environment; e != nil {
+		t.Environment = &ExecutionEnvironment{
+			User:       e.User,
+			Group:      e.Group,
+			WorkingDir: e.WorkingDir,
+			Env:        e.Env,
+		}
+		limits := &ExecutionLimits{CpuSeconds: e.CpuSeconds, MemoryBytes: e.MemoryBytes, OpenFiles: e.OpenFiles}
+		if !limits.IsEmpty() {
+			t.Environment.Limits = limits
+		}
+	}
+	for _, v := range b.Validation {
+		outputStream := 1
+		switch v.Stream {
+		case "", "stdout":
+		case "stderr":
+			outputStream = 2
+		default:
+			return nil, fmt.Errorf("Validation stream of %s must be stdout or stderr", b.Title)
+		}
+		if len(v.Text) < 1 {
+			return nil, fmt.Errorf("Validation text of %s can not be empty", b.Title)
+		}
+		t.ValidationRules = append(t.ValidationRules, &ExecutionValidation{
+			Id:           uuidStr(),
+			Fatal:        v.Fatal,
+			MustContain:  v.MustContain,
+			OutputStream: outputStream,
+			Text:         v.Text,
+		})
+	}
+	return t, nil
+}
+
+// Validation rules in the bundle, keeping the ids of the existing ones that did not change
+func mergeValidationRules(existing []*ExecutionValidation, rules []*ExecutionValidation) ([]*ExecutionValidation, bool) {
+	key := func(r *ExecutionValidation) string {
+		return fmt.Sprintf("%d:%t:%t:%s", r.OutputStream, r.MustContain, r.Fatal, r.Text)
+	}
+	ids := make(map[string]string)
+	for _, r := range existing {
+		ids[key(r)] = r.Id
+	}
+	changed := len(existing) != len(rules)
+	merged := make([]*ExecutionValidation, 0, len(rules))
+	for i, r := range rules {
+		if id, ok := ids[key(r)]; ok {
+			r.Id = id
+		}
+		if !changed && key(existing[i]) != key(r) {
+			changed = true
+		}
+		merged = append(merged, r)
+	}
+	return merged, changed
+}
+
+// HTTP checks in the bundle, existing ones keep their secure token
+func mergeHttpChecks(templateId string, existing []*HttpCheckConfiguration, checks []*BundleHttpCheck) ([]*HttpCheckConfiguration, bool) {
+	byId := make(map[string]*HttpCheckConfiguration)
+	for _, c := range existing {
+		byId[c.Id] = c
+	}
+	changed := len(existing) != len(checks)
+	merged := make([]*HttpCheckConfiguration, 0, len(checks))
+	for _, b := range checks {
+		timeout := b.Timeout
+		if timeout < 1 {
+			timeout = 30
+		}
+		c := byId[b.Id]
+		if c == nil {
+			c = newHttpCheckConfiguration()
+			if len(b.Id) > 0 && server.httpCheckStore.Get(b.Id) == nil {
+				c.Id = b.Id
+			}
+			changed = true
+		} else {
+			// Copy, the current one stays in use until the import is applied
+			copied := *c
+			c = &copied
+			if c.Enabled != b.Enabled || c.Timeout != timeout || strings.Join(c.ClientIds, ",") != strings.Join(b.ClientIds, ",") {
+				changed = true
+			}
+		}
+		c.TemplateId = templateId
+		c.Enabled = b.Enabled
+		c.Timeout = timeout
+		c.ClientIds = b.ClientIds
+		merged = append(merged, c)
+	}
+	return merged, changed
+}
+
+// Template matched by the bundle, and the template it clashes with if any
+func matchTemplate(b *BundleTemplate, match string) (*Template, *Template) {
+	server.templateStore.templateMux.RLock()
+	defer server.templateStore.templateMux.RUnlock()
+	title := strings.TrimSpace(b.Title)
+	var byTitle *Template
+	for _, template := range server.templateStore.Templates {
+		if template.Title == title {
+			byTitle = template
+		}
+	}
+	if match == "title" || len(b.Id) < 1 {
+		return byTitle, nil
+	}
+	byId := server.templateStore.Templates[b.Id]
+	if byTitle != nil && byTitle != byId {
+		return byId, byTitle
+	}
+	return byId, nil
+}
+
+// What an import would change, nothing is written
+func planTemplateImport(bundle *TemplateBundle, opts *TemplateImportOptions) ([]*TemplateImportChange, error) {
+	if opts.Match != "id" && opts.Match != "title" {
+		return nil, fmt.Errorf("Match must be id or title, not %s", opts.Match)
+	}
+	if opts.OnConflict != "overwrite" && opts.OnConflict != "skip" && opts.OnConflict != "fail" {
+		return nil, fmt.Errorf("On conflict must be overwrite, skip or fail, not %s", opts.OnConflict)
+	}
+
+	changes := make([]*TemplateImportChange, 0, len(bundle.Templates))
+	titles := make(map[string]bool)
+	ids := make(map[string]bool)
+	for _, b := range bundle.Templates {
+		// Unique within the bundle
+		title := strings.TrimSpace(b.Title)
+		if titles[title] {
+			return nil, fmt.Errorf("Template %s is more than once in the bundle", title)
+		}
+		titles[title] = true
+		if len(b.Id) > 0 && opts.Match == "id" {
+			if ids[b.Id] {
+				return nil, fmt.Errorf("Template id %s is more than once in the bundle", b.Id)
+			}
+			ids[b.Id] = true
+		}
+
+		proposed, err := b.template()
+		if err != nil {
+			return nil, err
+		}
+		change := &TemplateImportChange{Title: title, Changes: make([]string, 0), Diff: make([]string, 0)}
+		existing, clash := matchTemplate(b, opts.Match)
+		if clash != nil {
+			if opts.OnConflict != "skip" {
+				return nil, fmt.Errorf("Title %s of template %s is already used by template %s", title, b.Id, clash.Id)
+			}
+			change.Action = "skip"
+			change.Id = b.Id
+			change.Changes = append(change.Changes, fmt.Sprintf("title is used by template %s", clash.Id))
+			changes = append(changes, change)
+			continue
+		}
+
+		// New template
+		if existing == nil {
+			if opts.Match == "id" && len(b.Id) > 0 {
+				proposed.Id = b.Id
+			}
+			if valid, err := proposed.IsValid(); !valid {
+				return nil, fmt.Errorf("Template %s: %s", title, err)
+			}
+			change.Action = "create"
+			change.Id = proposed.Id
+			change.Version = 1
+			change.template = proposed
+			change.rules = proposed.ValidationRules
+			change.checks, _ = mergeHttpChecks(proposed.Id, nil, b.HttpChecks)
+			if len(change.checks) > 0 {
+				change.checkClientIds = httpCheckClientIds(change.checks)
+			}
+			changes = append(changes, change)
+			continue
+		}
+
+		// Changes to the existing one
+		proposed.Id = existing.Id
+		if valid, err := proposed.IsValid(); !valid {
+			return nil, fmt.Errorf("Template %s: %s", title, err)
+		}
+		change.Id = existing.Id
+		change.template = existing
+		change.previous = existing.snapshot()
+		change.Version = change.previous.Version
+		next := proposed.snapshot()
+		next.Files = change.previous.Files // Bundles do not hold files
+		change.version = existing.proposeVersion(next, "")
+		change.Changes = append(change.Changes, change.version.Changes...)
+		change.Diff = change.version.Diff
+		existing.mux.RLock()
+		rules, rulesChanged := mergeValidationRules(existing.ValidationRules, proposed.ValidationRules)
+		pending := existing.PendingVersion
+		existing.mux.RUnlock()
+		if rulesChanged {
+			change.Changes = append(change.Changes, "validation rules")
+		}
+		existingChecks := server.httpCheckStore.FindByTemplate(existing.Id)
+		checks, checksChanged := mergeHttpChecks(existing.Id, existingChecks, b.HttpChecks)
+		if checksChanged {
+			change.Changes = append(change.Changes, "http checks")
+			change.checkClientIds = httpCheckClientIds(append(existingChecks, checks...))
+		}
+		change.rules = rules
+		change.checks = checks
+		if len(change.Changes) == 0 {
+			change.Action = "unchanged"
+			changes = append(changes, change)
+			continue
+		}
+		if pending != nil {
+			change.Action = "skip"
+			change.Changes = append(change.Changes, "a change is waiting for approval")
+			changes = append(changes, change)
+			continue
+		}
+		switch opts.OnConflict {
+		case "skip":
+			change.Action = "skip"
+			changes = append(changes, change)
+			continue
+		case "fail":
+			return nil, fmt.Errorf("Template %s differs: %s", title, strings.Join(change.Changes, ", "))
+		}
+		if len(change.version.Changes) > 0 {
+			if conf.TemplateChangeMinAuth > 1 && change.version.changesExecution(change.previous) {
+				// Rules and checks take effect with the approved version
+				change.Pending = true
+				change.version.Import = &TemplateVersionImport{ValidationRules: rules, HttpChecks: b.HttpChecks}
+				if rulesChanged {
+					change.version.Changes = append(change.version.Changes, "validation rules")
+				}
+				if checksChanged {
+					change.version.Changes = append(change.version.Changes, "http checks")
+				}
+			} else {
+				change.Version = change.version.Version
+			}
+		}
+		change.Action = "update"
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// Write the planned changes
+func applyTemplateImport(changes []*TemplateImportChange, user *User) error {
+	userId := TEMPLATE_SYNC_USER_ID
+	if user != nil {
+		userId = user.Id
+	}
+	for _, change := range changes {
+		switch change.Action {
+		case "create":
+			change.template.initVersion(userId)
+			server.templateStore.Add(change.template)
+			audit.Log(user, "Template", fmt.Sprintf("Imported template %s (%s)", change.Title, change.Id))
+		case "update":
+			if len(change.version.Changes) > 0 {
+				change.version.UserId = userId
+				if change.Pending {
+					if err := change.template.setPendingVersion(change.version); err != nil {
+						return fmt.Errorf("Template %s: %s", change.Title, err)
+					}
+					message := fmt.Sprintf("Proposed version %d of template %s by import: %s", change.version.Version, change.previous.Title, strings.Join(change.version.Changes, ", "))
+					audit.Log(user, "Template", message)
+					server.notifications.Notify(&Message{Type: NEW_CONSENSUS, Content: message, Url: conf.ServerRequest("/console/#!templates")})
+				} else if err := change.template.applyVersion(change.version); err != nil {
+					return fmt.Errorf("Template %s: %s", change.Title, err)
+				}
+			}
+			audit.Log(user, "Template", fmt.Sprintf("Imported template %s (%s): %s", change.Title, change.Id, strings.Join(change.Changes, ", ")))
+			if change.Pending {
+				continue
+			}
+			change.template.mux.Lock()
+			change.template.ValidationRules = change.rules
+			change.template.mux.Unlock()
+		default:
+			continue
+		}
+		replaceHttpChecks(change.Id, change.checks)
+	}
+	server.templateStore.save()
+	server.httpCheckStore.save()
+	return nil
+}
+
+// The bundle holds all checks of the template, the others are removed
+func replaceHttpChecks(templateId string, checks []*HttpCheckConfiguration) {
+	keep := make(map[string]bool)
+	for _, check := range checks {
+		keep[check.Id] = true
+		server.httpCheckStore.Add(check)
+	}
+	for _, check := range server.httpCheckStore.FindByTemplate(templateId) {
+		if !keep[check.Id] {
+			server.httpCheckStore.Remove(check.Id)
+		}
+	}
+}
+
+// Clients of the checks, once each
+func httpCheckClientIds(checks []*HttpCheckConfiguration) []string {
+	ids := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, check := range checks {
+		for _, id := range check.ClientIds {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// HTTP checks start executions from outside, changing them by import requires what creating them does: httpcheck.manage
+// for the template on the clients of the checks and a second factor
+func authorizeTemplateImportChecks(changes []*TemplateImportChange, user *User, secondFactor func() bool) error {
+	verified := false
+	for _, change := range changes {
+		if change.checkClientIds == nil || (change.Action != "create" && change.Action != "update") {
+			continue
+		}
+		if !user.Can(PERM_HTTPCHECK_MANAGE, change.template, registeredClients(change.checkClientIds)) {
+			return fmt.Errorf("User not allowed to change the HTTP checks of template %s on these clients", change.Title)
+		}
+		if !verified && !secondFactor() {
+			return errors.New("Invalid two factor token, it is required to change HTTP checks")
+		}
+		verified = true
+	}
+	return nil
+}
+
+// Plan and, unless it is a dry run, apply an import. Authorize may refuse the planned changes, nil accepts them.
+func importTemplateBundle(bundle *TemplateBundle, opts *TemplateImportOptions, user *User, authorize func([]*TemplateImportChange) error) ([]*TemplateImportChange, error) {
+	templateImportMux.Lock()
+	defer templateImportMux.Unlock()
+	changes, err := planTemplateImport(bundle, opts)
+	if err != nil || opts.DryRun {
+		return changes, err
+	}
+	if authorize != nil {
+		if err := authorize(changes); err != nil {
+			return nil, err
+		}
+	}
+	return changes, applyTemplateImport(changes, user)
+}
+
+// All bundles in a directory as one, files in alphabetical order
+func readTemplateDir(dir string) (*TemplateBundle, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	bundle := &TemplateBundle{Format: TEMPLATE_BUNDLE_FORMAT, Templates: make([]*BundleTemplate, 0)}
+	for _, file := range files {
+		format := bundleFormat(file.Name())
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") || len(format) < 1 {
+			continue
+		}
+		b, err := ioutil.ReadFile(path.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		fileBundle, err := decodeTemplateBundle(b, format)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file.Name(), err)
+		}
+		bundle.Templates = append(bundle.Templates, fileBundle.Templates...)
+	}
+	return bundle, nil
+}
+
+// Import the bundles of the sync directory
+func syncTemplateDir(dir string) {
+	bundle, err := readTemplateDir(dir)
+	if err != nil {
+		log.Printf("Failed to read templates from %s: %s", dir, err)
+		return
+	}
+	changes, err := importTemplateBundle(bundle, &TemplateImportOptions{Match: "id", OnConflict: "overwrite"}, nil, nil)
+	if err != nil {
+		log.Printf("Failed to sync templates from %s: %s", dir, err)
+		return
+	}
+	for _, change := range changes {
+		switch change.Action {
+		case "unchanged":
+		case "skip":
+			log.Printf("Skipped template %s from %s: %s", change.Title, dir, strings.Join(change.Changes, ", "))
+		default:
+			log.Printf("Synced template %s from %s: %s", change.Title, dir, change.Action)
+		}
+	}
+}
+
+// Keep the templates in sync with the bundles in a directory, on startup and whenever a bundle changes
+func startTemplateSync(dir string) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Printf("Failed to create template sync directory %s: %s", dir, err)
+		return
+	}
+	syncTemplateDir(dir)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Failed to watch %s: %s", dir, err)
+		return
+	}
+	if err := watcher.Add(dir); err != nil {
+		log.Printf("Failed to watch %s: %s", dir, err)
+		watcher.Close()
+		return
+	}
+	go func() {
+		var changed <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if len(bundleFormat(event.Name)) < 1 {
+					continue
+				}
+				// Editors and git write in several steps, wait until it is quiet
+				changed = time.After(TEMPLATE_SYNC_DELAY)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Error while watching %s: %s", dir, err)
+			case <-changed:
+				changed = nil
+				syncTemplateDir(dir)
+			}
+		}
+	}()
+}
+
+// Import options from a form, overwrite by id unless asked otherwise
+func templateImportOptionsFromForm(r *http.Request) *TemplateImportOptions {
+	opts := &TemplateImportOptions{
+		Match:      strings.TrimSpace(r.PostFormValue("match")),
+		OnConflict: strings.TrimSpace(r.PostFormValue("onConflict")),
+		DryRun:     r.PostFormValue("dryRun") == "true",
+	}
+	if len(opts.Match) < 1 {
+		opts.Match = "id"
+	}
+	if len(opts.OnConflict) < 1 {
+		opts.OnConflict = "overwrite"
+	}
+	return opts
+}
+
+// Download templates as bundle
+func GetTemplatesExport(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	user := getUser(r)
+
+	format := r.URL.Query().Get("format")
+	if len(format) < 1 {
+		format = "yaml"
+	}
+	bundle, err := exportTemplateBundle(splitFormList(r.URL.Query().Get("ids")), user)
+	if err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	b, err := bundle.encode(format)
+	if err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	audit.Log(user, "Template", fmt.Sprintf("Exported %d templates", len(bundle.Templates)))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"templates.%s\"", format))
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(b)))
+	w.Write(b)
+}
+
+// Import a bundle, or with dryRun only show what would change
+func PostTemplatesImport(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	user := getUser(r)
+
+	// Imports can overwrite any template
+	if !user.Can(PERM_TEMPLATE_CREATE, nil, nil) {
+		jr.Error("User not allowed to import templates, requires template.create without scope")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	format := r.PostFormValue("format")
+	if len(format) < 1 {
+		format = "yaml"
+	}
+	bundle, err := decodeTemplateBundle([]byte(r.PostFormValue("bundle")), format)
+	if err != nil {
+		jr.Error(fmt.Sprintf("Invalid bundle: %s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	opts := templateImportOptionsFromForm(r)
+	changes, err := importTemplateBundle(bundle, opts, user, func(changes []*TemplateImportChange) error {
+		return authorizeTemplateImportChecks(changes, user, func() bool {
+			return validSecondFactor(user, r)
+		})
+	})
+	if err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	jr.Set("changes", changes)
+	jr.Set("dry_run", opts.DryRun)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Is indispenso started to export or import templates instead of running?
+func (c *Conf) IsTemplateBundleCommand() bool {
+	return len(viper.GetString("exportTemplates")) > 0 || len(viper.GetString("importTemplates")) > 0
+}
+
+// Export or import templates in the home directory, the server must not be running as it would overwrite them
+func runTemplateBundleCommand() error {
+	server = newServer()
+	server.templateStore = newTemplateStore()
+	server.httpCheckStore = newHttpCheckStore()
+	server.notifications = newNotificationManager()
+
+	if filename := viper.GetString("exportTemplates"); len(filename) > 0 {
+		format := bundleFormat(filename)
+		if len(format) < 1 {
+			return errors.New("Export file must end with .yaml, .yml or .json")
+		}
+		bundle, err := exportTemplateBundle(nil, nil)
+		if err != nil {
+			return err
+		}
+		b, err := bundle.encode(format)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+			return err
+		}
+		fmt.Printf("Exported %d templates to %s\n", len(bundle.Templates), filename)
+		return nil
+	}
+
+	filename := viper.GetString("importTemplates")
+	format := bundleFormat(filename)
+	if len(format) < 1 {
+		return errors.New("Import file must end with .yaml, .yml or .json")
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	bundle, err := decodeTemplateBundle(b, format)
+	if err != nil {
+		return err
+	}
+	opts := &TemplateImportOptions{
+		Match:      viper.GetString("importMatch"),
+		OnConflict: viper.GetString("importOnConflict"),
+		DryRun:     viper.GetBool("importDryRun"),
+	}
+	changes, err := importTemplateBundle(bundle, opts, nil, nil)
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		fmt.Printf("%s %s (%s)\n", change.Action, change.Title, change.Id)
+		for _, line := range change.Changes {
+			fmt.Printf("    %s\n", line)
+		}
+		for _, line := range change.Diff {
+			fmt.Printf("    %s\n", line)
+		}
+	}
+	if opts.DryRun {
+		fmt.Println("Dry run, nothing was imported")
+	}
+	return nil
+}
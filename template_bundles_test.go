@@ -0,0 +1,136 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBundleFormat(t *testing.T) {
+	assert.Equal(t, "yaml", bundleFormat("templates.d/restart.yaml"))
+	assert.Equal(t, "yaml", bundleFormat("restart.YML"))
+	assert.Equal(t, "json", bundleFormat("/tmp/templates.json"))
+	assert.Equal(t, "", bundleFormat(".restart.yaml.swp"))
+	assert.Equal(t, "", bundleFormat("README"))
+}
+
+func TestDecodeTemplateBundle(t *testing.T) {
+	bundle, err := decodeTemplateBundle([]byte(`format: 1
+templates:
+  - title: Restart app
+    description: Restarts the app after a deploy
+    command: |
+      service app stop
+      service app start
+    timeout: 300
+    min_auth: 2
+    included_tags: [app]
+    execution_strategy: rolling
+    environment:
+      user: app
+      memory_bytes: 1073741824
+    validation:
+      - text: started
+        stream: stdout
+        must_contain: true
+        fatal: true
+    http_checks:
+      - enabled: true
+        clients: [app01, app02]
+`), "yaml")
+	assert.NoError(t, err)
+	assert.Len(t, bundle.Templates, 1)
+	b := bundle.Templates[0]
+	assert.Equal(t, "", b.Id)
+	assert.Equal(t, "Restart app", b.Title)
+	assert.Equal(t, "service app stop\nservice app start\n", b.Command)
+	assert.Equal(t, uint(2), b.MinAuth)
+	assert.Equal(t, []string{"app"}, b.IncludedTags)
+	assert.Equal(t, "app", b.Environment.User)
+	assert.Equal(t, uint64(1073741824), b.Environment.MemoryBytes)
+	assert.Equal(t, &BundleValidation{Text: "started", Stream: "stdout", MustContain: true, Fatal: true}, b.Validation[0])
+	assert.Equal(t, []string{"app01", "app02"}, b.HttpChecks[0].ClientIds)
+
+	// Same bundle after a round trip through either format
+	for _, format := range []string{"yaml", "json"} {
+		encoded, err := bundle.encode(format)
+		assert.NoError(t, err)
+		decoded, err := decodeTemplateBundle(encoded, format)
+		assert.NoError(t, err)
+		assert.Equal(t, bundle, decoded)
+	}
+
+	// Unknown formats
+	_, err = decodeTemplateBundle([]byte(`{"format": 2, "templates": []}`), "json")
+	assert.Error(t, err)
+	_, err = decodeTemplateBundle([]byte(`format = 1`), "toml")
+	assert.Error(t, err)
+}
+
+func TestMergeValidationRules(t *testing.T) {
+	existing := []*ExecutionValidation{
+		&ExecutionValidation{Id: "a", Text: "started", OutputStream: 1, MustContain: true, Fatal: true},
+		&ExecutionValidation{Id: "b", Text: "error", OutputStream: 2, Fatal: true},
+	}
+
+	// Unchanged rules keep their ids
+	rules, changed := mergeValidationRules(existing, []*ExecutionValidation{
+		&ExecutionValidation{Id: "new1", Text: "started", OutputStream: 1, MustContain: true, Fatal: true},
+		&ExecutionValidation{Id: "new2", Text: "error", OutputStream: 2, Fatal: true},
+	})
+	assert.False(t, changed)
+	assert.Equal(t, "a", rules[0].Id)
+	assert.Equal(t, "b", rules[1].Id)
+
+	// Another order, a changed rule or one less is a change
+	_, changed = mergeValidationRules(existing, []*ExecutionValidation{
+		&ExecutionValidation{Id: "new1", Text: "error", OutputStream: 2, Fatal: true},
+		&ExecutionValidation{Id: "new2", Text: "started", OutputStream: 1, MustContain: true, Fatal: true},
+	})
+	assert.True(t, changed)
+	rules, changed = mergeValidationRules(existing, []*ExecutionValidation{
+		&ExecutionValidation{Id: "new1", Text: "started", OutputStream: 1, MustContain: true, Fatal: false},
+		&ExecutionValidation{Id: "new2", Text: "error", OutputStream: 2, Fatal: true},
+	})
+	assert.True(t, changed)
+	assert.Equal(t, "new1", rules[0].Id)
+	_, changed = mergeValidationRules(existing, existing[:1])
+	assert.True(t, changed)
+}
+
+func TestNewBundleValidation(t *testing.T) {
+	assert.Equal(t, &BundleValidation{Text: "error", Stream: "stderr", Fatal: true}, newBundleValidation(&ExecutionValidation{Id: "b", Text: "error", OutputStream: 2, Fatal: true}))
+	assert.Equal(t, "stdout", newBundleValidation(&ExecutionValidation{Text: "ok", OutputStream: 1}).Stream)
+}
+
+func TestAuthorizeTemplateImportChecks(t *testing.T) {
+	conf = &Conf{Roles: map[string][]string{"web": {"template.create", "httpcheck.manage:tag=web"}}}
+	defer func() { conf = nil }()
+	server = newServer()
+	defer func() { server = nil }()
+	web := newRegisteredClient("web01")
+	web.Tags = []string{"web"}
+	db := newRegisteredClient("db01")
+	db.Tags = []string{"db"}
+	server.clients["web01"] = web
+	server.clients["db01"] = db
+	user := newUser()
+	user.SetRoles([]string{"web"})
+	template := &Template{Id: "t1", Title: "Restart", Acl: newTemplateAcl()}
+	verified := func() bool { return true }
+	unverified := func() bool { return false }
+
+	// Checks stay the same
+	unchanged := []*TemplateImportChange{{Action: "update", Title: "Restart", template: template}}
+	assert.NoError(t, authorizeTemplateImportChecks(unchanged, user, unverified))
+
+	// Checks on clients of the scope, with a second factor
+	changes := []*TemplateImportChange{{Action: "update", Title: "Restart", template: template, checkClientIds: []string{"web01"}}}
+	assert.NoError(t, authorizeTemplateImportChecks(changes, user, verified))
+	assert.Error(t, authorizeTemplateImportChecks(changes, user, unverified))
+
+	// Other clients, also when a check on them is removed
+	changes[0].checkClientIds = []string{"web01", "db01"}
+	assert.Error(t, authorizeTemplateImportChecks(changes, user, verified))
+	changes[0].Action = "skip"
+	assert.NoError(t, authorizeTemplateImportChecks(changes, user, unverified))
+}
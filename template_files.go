@@ -0,0 +1,372 @@
+package main
+
+// Files attached to a template, pushed to the client before the command is executed
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const MAX_TEMPLATE_FILE_SIZE int64 = 64 * 1024 * 1024 // In bytes
+
+type TemplateFile struct {
+	Id     string // Unique id
+	Name   string // Original file name
+	Path   string // Absolute destination path on the client
+	Mode   uint32 // Permissions of the file on the client, e.g. 0644
+	Size   int64  // In bytes
+	Sha256 string // Hex encoded checksum of the contents
+}
+
+var sha256Regexp = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// Hex encoded SHA-256 of the contents
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Location of the contents on the server, files are stored by checksum
+func templateFileStorePath(checksum string) string {
+	return conf.HomeFile(path.Join("files", checksum))
+}
+
+// Store the contents on the server and return the checksum
+func storeTemplateFileContents(b []byte) (string, error) {
+	checksum := sha256Hex(b)
+	if err := os.MkdirAll(conf.HomeFile("files"), 0700); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(templateFileStorePath(checksum), b, 0600); err != nil {
+		return "", err
+	}
+	return checksum, nil
+}
+
+// Read the contents from the server storage
+func readTemplateFileContents(checksum string) ([]byte, error) {
+	if !sha256Regexp.MatchString(checksum) {
+		return nil, errors.New("Invalid checksum")
+	}
+	return ioutil.ReadFile(templateFileStorePath(checksum))
+}
+
+// Validate the declaration of a file
+func (f *TemplateFile) IsValid() error {
+	if !path.IsAbs(f.Path) || path.Clean(f.Path) != f.Path {
+		return errors.New("Destination must be a clean absolute path")
+	}
+	if f.Mode > 0777 {
+		return errors.New("Mode must be between 0000 and 0777")
+	}
+	if !sha256Regexp.MatchString(f.Sha256) {
+		return errors.New("Invalid checksum")
+	}
+	return nil
+}
+
+// Install the file on the client, the contents must match the signed checksum
+func (f *TemplateFile) Install(contents []byte, owner *ExecutionEnvironment) error {
+	if sha256Hex(contents) != f.Sha256 {
+		return fmt.Errorf("Checksum mismatch for %s", f.Path)
+	}
+
+	// Write next to the destination and swap, so the file is never half written
+	dir := path.Dir(f.Path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, ".indispenso_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), os.FileMode(f.Mode)); err != nil {
+		return err
+	}
+
+	// Owned by the user that runs the command
+	if owner != nil {
+		cred, _, err := owner.credential()
+		if err != nil {
+			return err
+		}
+		if cred != nil {
+			if err := os.Chown(tmp.Name(), int(cred.Uid), int(cred.Gid)); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Rename(tmp.Name(), f.Path)
+}
+
+// Download and install the files of a command on the client
+func (c *Cmd) installFiles(client *Client) error {
+	for _, f := range c.Files {
+		contents := make([]byte, 0)
+		if f.Size > 0 {
+			var err error
+			contents, err = client._get(fmt.Sprintf("client/%s/cmd/%s/file/%s", url.QueryEscape(client.Id), url.QueryEscape(c.Id), url.QueryEscape(f.Id)))
+			if err != nil {
+				return fmt.Errorf("Failed to download %s: %s", f.Path, err)
+			}
+		}
+		if err := f.Install(contents, c.Environment); err != nil {
+			return err
+		}
+		log.Printf("Installed %s for %s", f.Path, c.Id)
+	}
+	return nil
+}
+
+// Next version with a file added
+func (s *Template) proposeAddFile(f *TemplateFile, userId string) *TemplateVersion {
+	proposed := s.snapshot()
+	files := make([]*TemplateFile, 0, len(proposed.Files)+1)
+	proposed.Files = append(append(files, proposed.Files...), f)
+	return s.proposeVersion(proposed, userId)
+}
+
+// Next version without a file, nil if the template does not have it
+func (s *Template) proposeDeleteFile(id string, userId string) *TemplateVersion {
+	proposed := s.snapshot()
+	files := make([]*TemplateFile, 0, len(proposed.Files))
+	for _, f := range proposed.Files {
+		if f.Id == id {
+			continue
+		}
+		files = append(files, f)
+	}
+	if len(files) == len(proposed.Files) {
+		return nil
+	}
+	proposed.Files = files
+	return s.proposeVersion(proposed, userId)
+}
+
+// Attach file to template
+func PostTemplateFile(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("User not authorized for PostTemplateFile")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	user := getUser(r)
+
+	// Get template
+	template := server.templateStore.Get(ps.ByName("templateid"))
+	if template == nil {
+		jr.Error("Template not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Files are installed as the agent, not by the owner team
+	if !user.Can(PERM_TEMPLATE_CREATE, template, nil) {
+		jr.Error("User not allowed to PostTemplateFile")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Contents
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_TEMPLATE_FILE_SIZE+1024*1024)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		jr.Error(fmt.Sprintf("Failed to read file: %s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	defer file.Close()
+	contents, err := ioutil.ReadAll(file)
+	if err != nil {
+		jr.Error(fmt.Sprintf("Failed to read file: %s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	if int64(len(contents)) > MAX_TEMPLATE_FILE_SIZE {
+		jr.Error(fmt.Sprintf("File can not be larger than %d bytes", MAX_TEMPLATE_FILE_SIZE))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Mode, octal
+	modeStr := strings.TrimSpace(r.PostFormValue("mode"))
+	if len(modeStr) < 1 {
+		modeStr = "0644"
+	}
+	mode, modeE := strconv.ParseUint(modeStr, 8, 32)
+	if modeE != nil {
+		jr.Error("Mode must be octal, e.g. 0644")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Declaration
+	f := &TemplateFile{
+		Id:     uuidStr(),
+		Name:   path.Base(header.Filename),
+		Path:   strings.TrimSpace(r.PostFormValue("path")),
+		Mode:   uint32(mode),
+		Size:   int64(len(contents)),
+		Sha256: sha256Hex(contents),
+	}
+	if err := f.IsValid(); err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Store contents
+	if _, err := storeTemplateFileContents(contents); err != nil {
+		jr.Error(fmt.Sprintf("Failed to store file: %s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// New version of the template, which needs approval like a changed command
+	previous := template.snapshot()
+	v := template.proposeAddFile(f, user.Id)
+	pending, err := template.submitVersion(v, previous, user)
+	if err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	audit.Log(user, "Template", fmt.Sprintf("Attached file %s (sha256 %s) to %s as %s", f.Name, f.Sha256, template.Id, f.Path))
+	res := server.templateStore.save()
+
+	jr.Set("file", f)
+	jr.Set("version", v)
+	jr.Set("pending", pending)
+	jr.Set("saved", res)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Remove file from template
+func DeleteTemplateFile(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("User not authorized for DeleteTemplateFile")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	user := getUser(r)
+
+	// Get template
+	template := server.templateStore.Get(ps.ByName("templateid"))
+	if template == nil {
+		jr.Error("Template not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Files are installed as the agent, not by the owner team
+	if !user.Can(PERM_TEMPLATE_CREATE, template, nil) {
+		jr.Error("User not allowed to DeleteTemplateFile")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// New version of the template without the file
+	id := ps.ByName("id")
+	previous := template.snapshot()
+	v := template.proposeDeleteFile(id, user.Id)
+	if v == nil {
+		jr.Error("File not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	pending, err := template.submitVersion(v, previous, user)
+	if err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	audit.Log(user, "Template", fmt.Sprintf("Removed file %s from %s", id, template.Id))
+
+	// Save
+	res := server.templateStore.save()
+
+	jr.Set("version", v)
+	jr.Set("pending", pending)
+	jr.Set("saved", res)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Download of a file by the client that executes the command
+func GetClientCmdFile(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !auth(r) {
+		jr.Error("Client not authorized for GetClientCmdFile")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Get client
+	registeredClient := server.GetClient(ps.ByName("clientId"))
+	if registeredClient == nil {
+		jr.Error("Client not registered")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Command, must be dispatched to this client
+	cmdId := ps.ByName("cmd")
+	registeredClient.mux.RLock()
+	cmd := registeredClient.DispatchedCmds[cmdId]
+	registeredClient.mux.RUnlock()
+	if cmd == nil {
+		jr.Error("Command not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// File, must be part of the command
+	var file *TemplateFile
+	for _, f := range cmd.Files {
+		if f.Id == ps.ByName("id") {
+			file = f
+			break
+		}
+	}
+	if file == nil {
+		jr.Error("File not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	contents, err := readTemplateFileContents(file.Sha256)
+	if err != nil {
+		jr.Error("Failed to read file")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(contents)))
+	w.Write(contents)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestTemplateFileIsValid(t *testing.T) {
+	f := &TemplateFile{Path: "/etc/app.conf", Mode: 0644, Sha256: sha256Hex([]byte("test"))}
+	assert.NoError(t, f.IsValid())
+
+	f.Path = "etc/app.conf"
+	assert.Error(t, f.IsValid())
+	f.Path = "/etc/../app.conf"
+	assert.Error(t, f.IsValid())
+	f.Path = "/etc/app.conf"
+
+	f.Mode = 04755
+	assert.Error(t, f.IsValid())
+	f.Mode = 0600
+
+	f.Sha256 = "abc"
+	assert.Error(t, f.IsValid())
+}
+
+func TestTemplateFileInstall(t *testing.T) {
+	dir, err := ioutil.TempDir("", "indispenso_test_")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	contents := []byte("key=value\n")
+	f := &TemplateFile{Path: path.Join(dir, "sub", "app.conf"), Mode: 0600, Sha256: sha256Hex(contents)}
+
+	// Tampered contents are refused
+	assert.Error(t, f.Install([]byte("key=other\n"), nil))
+	_, statErr := os.Stat(f.Path)
+	assert.True(t, os.IsNotExist(statErr))
+
+	// Installed with declared mode
+	assert.NoError(t, f.Install(contents, nil))
+	b, _ := ioutil.ReadFile(f.Path)
+	assert.Equal(t, contents, b)
+	info, _ := os.Stat(f.Path)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// No temporary files left behind
+	entries, _ := ioutil.ReadDir(path.Dir(f.Path))
+	assert.Len(t, entries, 1)
+}
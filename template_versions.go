@@ -0,0 +1,549 @@
+package main
+
+// Versions of templates. Every change is kept as an immutable version with the diff of the command and commands record
+// the version they ran. Changes to what runs and as whom (command, interpreter, environment, files, artifacts) can
+// require approval by other admins before they take effect.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type TemplateVersion struct {
+	Version           int
+	Title             string
+	Description       string
+	Command           string
+	Timeout           int
+	Interpreter       string
+	KillGracePeriod   *int
+	DeliveryTimeout   int
+	Interactive       bool
+	CheckCommand      string
+	DryRun            bool
+	RequireCheck      bool
+	Environment       *ExecutionEnvironment
+	Artifacts         []string
+	Files             []*TemplateFile
+	IncludedTags      []string
+	ExcludedTags      []string
+	MinAuth           uint
+	ExecutionStrategy ExecutionStrategyType
+	Category          string
+	OwnerTeam         string
+	Teams             []string
+	Changes           []string               // What changed compared to the previous version
+	Diff              []string               // Command compared to the previous version, lines prefixed with "+ ", "- " or "  "
+	UserId            string                 // User that made the change
+	Created           int64                  // Unix timestamp
+	ApproveUserIds    map[string]bool        // Approvals while the change is pending
+	Import            *TemplateVersionImport `json:",omitempty"` // Set when an import proposed the version
+}
+
+// Validation rules and HTTP checks of an import, applied together with the version once it is approved
+type TemplateVersionImport struct {
+	ValidationRules []*ExecutionValidation
+	HttpChecks      []*BundleHttpCheck
+}
+
+// Current state of the template
+func (t *Template) snapshot() *TemplateVersion {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	return t._snapshot()
+}
+
+func (t *Template) _snapshot() *TemplateVersion {
+	v := &TemplateVersion{
+		Version:         t.Version,
+		Title:           t.Title,
+		Description:     t.Description,
+		Command:         t.Command,
+		Timeout:         t.Timeout,
+		Interpreter:     t.Interpreter,
+		KillGracePeriod: t.KillGracePeriod,
+		DeliveryTimeout: t.DeliveryTimeout,
+		Interactive:     t.Interactive,
+		CheckCommand:    t.CheckCommand,
+		DryRun:          t.DryRun,
+		RequireCheck:    t.RequireCheck,
+		Environment:     t.Environment,
+		Artifacts:       t.Artifacts,
+		Files:           t.Files,
+		Category:        t.Category,
+		OwnerTeam:       t.OwnerTeam,
+		Teams:           t.Teams,
+		Changes:         make([]string, 0),
+		Diff:            make([]string, 0),
+	}
+	if t.Acl != nil {
+		v.IncludedTags = t.Acl.IncludedTags
+		v.ExcludedTags = t.Acl.ExcludedTags
+		v.MinAuth = t.Acl.MinAuth
+	}
+	if t.ExecutionStrategy != nil {
+		v.ExecutionStrategy = t.ExecutionStrategy.Strategy
+	}
+	return v
+}
+
+// First version of a new template, or of one created before templates had versions
+func (t *Template) initVersion(userId string) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.Version > 0 {
+		return
+	}
+	t.Version = 1
+	v := t._snapshot()
+	v.UserId = userId
+	v.Created = time.Now().Unix()
+	t.Versions = []*TemplateVersion{v}
+}
+
+// Next version of the template with the changes to the current one
+func (t *Template) proposeVersion(proposed *TemplateVersion, userId string) *TemplateVersion {
+	current := t.snapshot()
+	proposed.Version = current.Version + 1
+	proposed.Changes = templateChanges(current, proposed)
+	proposed.Diff = make([]string, 0)
+	if proposed.Command != current.Command {
+		proposed.Diff = diffLines(current.Command, proposed.Command)
+	}
+	proposed.UserId = userId
+	proposed.Created = time.Now().Unix()
+	proposed.ApproveUserIds = make(map[string]bool)
+	return proposed
+}
+
+// Make a version the current one
+func (t *Template) applyVersion(v *TemplateVersion) error {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.PendingVersion != nil {
+		return errors.New("A change of this template is waiting for approval")
+	}
+	return t._applyVersion(v)
+}
+
+func (t *Template) _applyVersion(v *TemplateVersion) error {
+	if v.Version != t.Version+1 {
+		return fmt.Errorf("Version %d does not follow version %d", v.Version, t.Version)
+	}
+	t.Version = v.Version
+	t.Title = v.Title
+	t.Description = v.Description
+	t.Command = v.Command
+	t.Timeout = v.Timeout
+	t.Interpreter = v.Interpreter
+	t.KillGracePeriod = v.KillGracePeriod
+	t.DeliveryTimeout = v.DeliveryTimeout
+	t.Interactive = v.Interactive
+	t.CheckCommand = v.CheckCommand
+	t.DryRun = v.DryRun
+	t.RequireCheck = v.RequireCheck
+	t.Environment = v.Environment
+	t.Artifacts = v.Artifacts
+	t.Files = v.Files
+	if t.Acl == nil {
+		t.Acl = newTemplateAcl()
+	}
+	t.Acl.IncludedTags = v.IncludedTags
+	t.Acl.ExcludedTags = v.ExcludedTags
+	t.Acl.MinAuth = v.MinAuth
+	t.ExecutionStrategy = newExecutionStrategy(v.ExecutionStrategy)
+	t.Category = v.Category
+	t.OwnerTeam = v.OwnerTeam
+	t.Teams = v.Teams
+	if v.Import != nil {
+		t.ValidationRules, _ = mergeValidationRules(t.ValidationRules, v.Import.ValidationRules)
+	}
+	t.Versions = append(t.Versions, v)
+	t.PendingVersion = nil
+	return nil
+}
+
+// Wait for approval of a change
+func (t *Template) setPendingVersion(v *TemplateVersion) error {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.PendingVersion != nil {
+		return errors.New("Another change of this template is waiting for approval")
+	}
+	t.PendingVersion = v
+	return nil
+}
+
+// Approve the pending change, applied once it has the approvals. Returns the version if it was applied.
+func (t *Template) approvePendingVersion(userId string, minAuth uint) (*TemplateVersion, error) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	v := t.PendingVersion
+	if v == nil {
+		return nil, errors.New("No change is waiting for approval")
+	}
+	if v.UserId == userId {
+		return nil, errors.New("Changes can not be approved by the user that made them")
+	}
+	if v.ApproveUserIds[userId] {
+		return nil, errors.New("Already approved")
+	}
+	v.ApproveUserIds[userId] = true
+	if uint(1+len(v.ApproveUserIds)) < minAuth {
+		return nil, nil
+	}
+	if err := t._applyVersion(v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Drop the pending change
+func (t *Template) rejectPendingVersion() *TemplateVersion {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	v := t.PendingVersion
+	t.PendingVersion = nil
+	return v
+}
+
+// Does the change affect what runs or as whom? Checks run without approval of the request, so their command as well.
+// Files are installed and artifacts are read as the agent, so they count too.
+func (v *TemplateVersion) changesExecution(previous *TemplateVersion) bool {
+	return v.Command != previous.Command || v.Interpreter != previous.Interpreter || !sameJson(v.Environment, previous.Environment) ||
+		v.CheckCommand != previous.CheckCommand || v.DryRun != previous.DryRun ||
+		!sameTemplateFiles(v.Files, previous.Files) || strings.Join(v.Artifacts, "\n") != strings.Join(previous.Artifacts, "\n") ||
+		v.MinAuth != previous.MinAuth || v.ExecutionStrategy != previous.ExecutionStrategy ||
+		strings.Join(v.IncludedTags, ",") != strings.Join(previous.IncludedTags, ",") || strings.Join(v.ExcludedTags, ",") != strings.Join(previous.ExcludedTags, ",")
+}
+
+// Same files with the same contents at the same paths
+func sameTemplateFiles(a []*TemplateFile, b []*TemplateFile) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Path != b[i].Path || a[i].Mode != b[i].Mode || a[i].Sha256 != b[i].Sha256 {
+			return false
+		}
+	}
+	return true
+}
+
+// Files of a version as they are installed, e.g. /etc/app.conf 0644 (3a7bd3e2)
+func templateFileList(files []*TemplateFile) string {
+	list := make([]string, 0, len(files))
+	for _, f := range files {
+		list = append(list, fmt.Sprintf("%s %04o (%.8s)", f.Path, f.Mode, f.Sha256))
+	}
+	return strings.Join(list, ", ")
+}
+
+// Apply a version, or keep it pending when it changes what runs and changes need approval by other admins. Returns
+// whether it is pending.
+func (t *Template) submitVersion(v *TemplateVersion, previous *TemplateVersion, user *User) (bool, error) {
+	if conf.TemplateChangeMinAuth > 1 && v.changesExecution(previous) {
+		if err := t.setPendingVersion(v); err != nil {
+			return false, err
+		}
+		message := fmt.Sprintf("Proposed version %d of template %s: %s", v.Version, previous.Title, strings.Join(v.Changes, ", "))
+		audit.Log(user, "Template", message)
+		server.notifications.Notify(&Message{Type: NEW_CONSENSUS, Content: message, Url: conf.ServerRequest("/console/#!templates")})
+		return true, nil
+	}
+	if err := t.applyVersion(v); err != nil {
+		return false, err
+	}
+	audit.Log(user, "Template", fmt.Sprintf("Changed template %s to version %d: %s", previous.Title, v.Version, strings.Join(v.Changes, ", ")))
+	return false, nil
+}
+
+// Grace period of a version, "default" when not set
+func gracePeriodString(seconds *int) string {
+	if seconds == nil {
+		return "default"
+	}
+	return fmt.Sprintf("%d", *seconds)
+}
+
+// Human readable changes between two versions
+func templateChanges(previous *TemplateVersion, v *TemplateVersion) []string {
+	changes := make([]string, 0)
+	changed := func(field string, from interface{}, to interface{}) {
+		if fmt.Sprintf("%v", from) != fmt.Sprintf("%v", to) {
+			changes = append(changes, fmt.Sprintf("%s: %v -> %v", field, from, to))
+		}
+	}
+	changed("title", previous.Title, v.Title)
+	changed("description", previous.Description, v.Description)
+	if previous.Command != v.Command {
+		added, removed := 0, 0
+		for _, line := range diffLines(previous.Command, v.Command) {
+			if strings.HasPrefix(line, "+ ") {
+				added++
+			} else if strings.HasPrefix(line, "- ") {
+				removed++
+			}
+		}
+		changes = append(changes, fmt.Sprintf("command: +%d -%d lines", added, removed))
+	}
+	changed("timeout", previous.Timeout, v.Timeout)
+	changed("interpreter", previous.Interpreter, v.Interpreter)
+	changed("kill grace period", gracePeriodString(previous.KillGracePeriod), gracePeriodString(v.KillGracePeriod))
+	changed("delivery timeout", previous.DeliveryTimeout, v.DeliveryTimeout)
+	changed("interactive", previous.Interactive, v.Interactive)
+	if previous.CheckCommand != v.CheckCommand {
+		changes = append(changes, "check command")
+	}
+	changed("dry run", previous.DryRun, v.DryRun)
+	changed("require check", previous.RequireCheck, v.RequireCheck)
+	if !sameJson(previous.Environment, v.Environment) {
+		changes = append(changes, "environment")
+	}
+	changed("artifacts", strings.Join(previous.Artifacts, ", "), strings.Join(v.Artifacts, ", "))
+	changed("files", templateFileList(previous.Files), templateFileList(v.Files))
+	changed("included tags", strings.Join(previous.IncludedTags, ", "), strings.Join(v.IncludedTags, ", "))
+	changed("excluded tags", strings.Join(previous.ExcludedTags, ", "), strings.Join(v.ExcludedTags, ", "))
+	changed("min auth", previous.MinAuth, v.MinAuth)
+	changed("execution strategy", previous.ExecutionStrategy, v.ExecutionStrategy)
+	changed("category", previous.Category, v.Category)
+	changed("owner team", previous.OwnerTeam, v.OwnerTeam)
+	changed("teams", strings.Join(previous.Teams, ", "), strings.Join(v.Teams, ", "))
+	return changes
+}
+
+// Same when encoded, for nested structures
+func sameJson(a interface{}, b interface{}) bool {
+	aBytes, _ := json.Marshal(a)
+	bBytes, _ := json.Marshal(b)
+	return string(aBytes) == string(bBytes)
+}
+
+// Line based diff, unchanged lines are prefixed with "  ", removed ones with "- " and added ones with "+ "
+func diffLines(a string, b string) []string {
+	from := strings.Split(a, "\n")
+	to := strings.Split(b, "\n")
+
+	// Longest common subsequence from the end
+	lcs := make([][]int, len(from)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(to)+1)
+	}
+	for i := len(from) - 1; i >= 0; i-- {
+		for j := len(to) - 1; j >= 0; j-- {
+			if from[i] == to[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	diff := make([]string, 0, len(from)+len(to))
+	i, j := 0, 0
+	for i < len(from) && j < len(to) {
+		if from[i] == to[j] {
+			diff = append(diff, "  "+from[i])
+			i++
+			j++
+		} else if lcs[i+1][j] >= lcs[i][j+1] {
+			diff = append(diff, "- "+from[i])
+			i++
+		} else {
+			diff = append(diff, "+ "+to[j])
+			j++
+		}
+	}
+	for ; i < len(from); i++ {
+		diff = append(diff, "- "+from[i])
+	}
+	for ; j < len(to); j++ {
+		diff = append(diff, "+ "+to[j])
+	}
+	return diff
+}
+
+// Edit a template
+func PutTemplate(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("User not authorized for PutTemplate")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	user := getUser(r)
+
+	// Get template
+	template := server.templateStore.Get(ps.ByName("templateid"))
+	if template == nil {
+		jr.Error("Template not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Owners and admins only
+	if !template.EditableBy(user) {
+		jr.Error("User not allowed to PutTemplate")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Validate the template as it would become
+	proposed, formE := templateFromForm(r)
+	if formE != nil {
+		jr.Error(fmt.Sprintf("%s", formE))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	proposed.Id = template.Id
+	if valid, err := proposed.IsValid(); !valid {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	admin := user.Can(PERM_TEMPLATE_CREATE, template, nil)
+	if admin && !user.Can(PERM_TEMPLATE_CREATE, proposed, nil) {
+		jr.Error("User not allowed to create templates with these tags")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	previous := template.snapshot()
+	next := proposed.snapshot()
+	next.Files = previous.Files // Files are changed on their own, see template_files.go
+	v := template.proposeVersion(next, user.Id)
+	if len(v.Changes) == 0 {
+		jr.Error("Nothing changed")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	if denied := ownerTeamChanges(previous, v); !admin && len(denied) > 0 {
+		jr.Error(fmt.Sprintf("Members of the owner team may only change the description and category, not: %s", strings.Join(denied, ", ")))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Changes to what runs need approval of other admins if configured
+	pending, err := template.submitVersion(v, previous, user)
+	if err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	server.templateStore.save()
+
+	jr.Set("pending", pending)
+
+	jr.Set("version", v)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Versions of a template, newest first
+func GetTemplateVersions(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("User not authorized for GetTemplateVersions")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	// Get template
+	template := server.templateStore.Get(ps.ByName("templateid"))
+	if template == nil || !template.VisibleTo(getUser(r)) {
+		jr.Error("Template not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	template.mux.RLock()
+	versions := make([]*TemplateVersion, 0, len(template.Versions))
+	for i := len(template.Versions) - 1; i >= 0; i-- {
+		versions = append(versions, template.Versions[i])
+	}
+	jr.Set("versions", versions)
+	jr.Set("pending", template.PendingVersion)
+	template.mux.RUnlock()
+
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Approve the pending change of a template
+func PostTemplateChangeApprove(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	user := getUser(r)
+
+	// Get template
+	template := server.templateStore.Get(ps.ByName("templateid"))
+	if template == nil {
+		jr.Error("Template not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	if !user.Can(PERM_TEMPLATE_APPROVE, template, nil) {
+		jr.Error("User not allowed to approve changes of this template")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	applied, err := template.approvePendingVersion(user.Id, conf.TemplateChangeMinAuth)
+	if err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	if applied != nil {
+		if applied.Import != nil {
+			checks, _ := mergeHttpChecks(template.Id, server.httpCheckStore.FindByTemplate(template.Id), applied.Import.HttpChecks)
+			replaceHttpChecks(template.Id, checks)
+			server.httpCheckStore.save()
+		}
+		audit.Log(user, "Template", fmt.Sprintf("Approved and applied version %d of template %s: %s", applied.Version, template.Id, strings.Join(applied.Changes, ", ")))
+	} else {
+		audit.Log(user, "Template", fmt.Sprintf("Approved the pending change of template %s", template.Id))
+	}
+	server.templateStore.save()
+
+	jr.Set("applied", applied != nil)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Reject the pending change of a template
+func DeleteTemplateChange(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	user := getUser(r)
+
+	// Get template
+	template := server.templateStore.Get(ps.ByName("templateid"))
+	if template == nil {
+		jr.Error("Template not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	if !user.Can(PERM_TEMPLATE_APPROVE, template, nil) {
+		jr.Error("User not allowed to approve changes of this template")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	v := template.rejectPendingVersion()
+	if v == nil {
+		jr.Error("No change is waiting for approval")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	audit.Log(user, "Template", fmt.Sprintf("Rejected version %d of template %s", v.Version, template.Id))
+	server.templateStore.save()
+
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
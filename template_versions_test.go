@@ -0,0 +1,158 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	assert.Equal(t, []string{"  echo start", "- rm -rf /tmp/cache", "+ rm -rf /tmp/cache/*", "  echo done"}, diffLines("echo start\nrm -rf /tmp/cache\necho done", "echo start\nrm -rf /tmp/cache/*\necho done"))
+	assert.Equal(t, []string{"  uptime", "+ df -h"}, diffLines("uptime", "uptime\ndf -h"))
+	assert.Equal(t, []string{"- uptime", "  df -h"}, diffLines("uptime\ndf -h", "df -h"))
+	assert.Equal(t, []string{"  uptime"}, diffLines("uptime", "uptime"))
+}
+
+func TestTemplateChanges(t *testing.T) {
+	previous := &TemplateVersion{Title: "Restart", Command: "service app restart", Timeout: 300, IncludedTags: []string{"app"}}
+	v := &TemplateVersion{Title: "Restart", Command: "service app stop\nservice app start", Timeout: 600, IncludedTags: []string{"app"}}
+	assert.Equal(t, []string{"command: +2 -1 lines", "timeout: 300 -> 600"}, templateChanges(previous, v))
+
+	v = &TemplateVersion{Title: "Restart", Command: "service app restart", Timeout: 300, IncludedTags: []string{"app"}}
+	assert.Empty(t, templateChanges(previous, v))
+	v.IncludedTags = []string{"app", "web"}
+	assert.Equal(t, []string{"included tags: app -> app, web"}, templateChanges(previous, v))
+}
+
+func TestTemplateVersionChangesExecution(t *testing.T) {
+	previous := &TemplateVersion{Title: "Restart", Command: "service app restart", Environment: &ExecutionEnvironment{User: "app"}, MinAuth: 3}
+	v := &TemplateVersion{Title: "Restart app", Description: "Restarts the app", Command: "service app restart", Environment: &ExecutionEnvironment{User: "app"}, MinAuth: 3}
+	assert.False(t, v.changesExecution(previous))
+
+	v.Interpreter = "sh"
+	assert.True(t, v.changesExecution(previous))
+	v.Interpreter = ""
+	v.Environment = &ExecutionEnvironment{User: "root"}
+	assert.True(t, v.changesExecution(previous))
+	v.Environment = previous.Environment
+	v.Command = "service app reload"
+	assert.True(t, v.changesExecution(previous))
+}
+
+func TestTemplateVersionChangesApprovalsAndHosts(t *testing.T) {
+	previous := &TemplateVersion{Command: "service app restart", MinAuth: 3, IncludedTags: []string{"app"}, ExcludedTags: []string{"db"}, ExecutionStrategy: RollingExecutionStrategy}
+	same := func() *TemplateVersion {
+		v := *previous
+		return &v
+	}
+	assert.False(t, same().changesExecution(previous))
+
+	// Fewer approvals
+	v := same()
+	v.MinAuth = 1
+	assert.True(t, v.changesExecution(previous))
+
+	// Other hosts
+	v = same()
+	v.IncludedTags = []string{"app", "web"}
+	assert.True(t, v.changesExecution(previous))
+	v.IncludedTags = []string{}
+	assert.True(t, v.changesExecution(previous))
+	v = same()
+	v.ExcludedTags = nil
+	assert.True(t, v.changesExecution(previous))
+
+	// All at once instead of one at a time
+	v = same()
+	v.ExecutionStrategy = SimpleExecutionStrategy
+	assert.True(t, v.changesExecution(previous))
+}
+
+func TestTemplatePendingVersion(t *testing.T) {
+	template := &Template{Title: "Restart", Command: "service app restart", Acl: newTemplateAcl()}
+	template.initVersion("alice")
+	assert.Equal(t, 1, template.Version)
+	assert.Len(t, template.Versions, 1)
+
+	proposed := template.snapshot()
+	proposed.Command = "service app reload"
+	v := template.proposeVersion(proposed, "alice")
+	assert.Equal(t, 2, v.Version)
+	assert.Equal(t, []string{"- service app restart", "+ service app reload"}, v.Diff)
+	assert.NoError(t, template.setPendingVersion(v))
+	assert.Error(t, template.setPendingVersion(v))
+
+	// Other edits wait for the pending one
+	assert.Error(t, template.applyVersion(v))
+
+	// Approved by others, not by the author
+	_, err := template.approvePendingVersion("alice", 3)
+	assert.Error(t, err)
+	applied, err := template.approvePendingVersion("bob", 3)
+	assert.NoError(t, err)
+	assert.Nil(t, applied)
+	_, err = template.approvePendingVersion("bob", 3)
+	assert.Error(t, err)
+	assert.Equal(t, "service app restart", template.Command)
+	applied, err = template.approvePendingVersion("carol", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, v, applied)
+	assert.Equal(t, 2, template.Version)
+	assert.Equal(t, "service app reload", template.Command)
+	assert.Nil(t, template.PendingVersion)
+	assert.Len(t, template.Versions, 2)
+}
+
+func TestTemplateFileVersions(t *testing.T) {
+	template := &Template{Title: "Deploy", Command: "deploy.sh", Acl: newTemplateAcl()}
+	template.initVersion("alice")
+	previous := template.snapshot()
+
+	// A file is a new version that changes what runs
+	f := &TemplateFile{Id: "f1", Name: "app.conf", Path: "/etc/app.conf", Mode: 0644, Sha256: sha256Hex([]byte("a=1"))}
+	v := template.proposeAddFile(f, "alice")
+	assert.Equal(t, 2, v.Version)
+	assert.Equal(t, []string{"files:  -> /etc/app.conf 0644 (" + f.Sha256[:8] + ")"}, v.Changes)
+	assert.True(t, v.changesExecution(previous))
+	assert.NoError(t, template.applyVersion(v))
+	assert.Len(t, template.Files, 1)
+
+	// Other contents at the same path
+	previous = template.snapshot()
+	replaced := *f
+	replaced.Sha256 = sha256Hex([]byte("a=2"))
+	next := template.snapshot()
+	next.Files = []*TemplateFile{&replaced}
+	assert.True(t, template.proposeVersion(next, "alice").changesExecution(previous))
+
+	// Removing it as well, unknown files are not a change
+	assert.Nil(t, template.proposeDeleteFile("unknown", "alice"))
+	v = template.proposeDeleteFile("f1", "alice")
+	assert.True(t, v.changesExecution(previous))
+	assert.NoError(t, template.applyVersion(v))
+	assert.Len(t, template.Files, 0)
+	assert.Equal(t, 3, template.Version)
+
+	// Artifacts are read as the agent
+	previous = template.snapshot()
+	next = template.snapshot()
+	next.Artifacts = []string{"/etc/shadow"}
+	assert.True(t, template.proposeVersion(next, "alice").changesExecution(previous))
+}
+
+func TestTemplateImportVersion(t *testing.T) {
+	template := &Template{Title: "Restart", Command: "service app restart", Acl: newTemplateAcl()}
+	template.initVersion("alice")
+
+	// Rules of a pending import wait for the approval
+	proposed := template.snapshot()
+	proposed.Command = "service app reload"
+	v := template.proposeVersion(proposed, "")
+	v.Import = &TemplateVersionImport{ValidationRules: []*ExecutionValidation{newExecutionValidation("reloaded", true, true, 1)}}
+	assert.NoError(t, template.setPendingVersion(v))
+	assert.Len(t, template.ValidationRules, 0)
+	applied, err := template.approvePendingVersion("bob", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, v, applied)
+	assert.Len(t, template.ValidationRules, 1)
+	assert.Equal(t, "reloaded", template.ValidationRules[0].Text)
+}
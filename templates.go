@@ -20,6 +20,22 @@ type Template struct {
 	Acl               *TemplateACL
 	ExecutionStrategy *ExecutionStrategy
 	ValidationRules   []*ExecutionValidation // Validation rules
+	Environment       *ExecutionEnvironment  // Run as user, working directory, environment variables and resource limits
+	Interpreter       string                 // bash (default when empty), sh, python3 or a custom shebang line
+	KillGracePeriod   *int                   // Seconds between SIGTERM and SIGKILL after the timeout, nil for the default, 0 kills at once
+	Files             []*TemplateFile        // Files installed on the client before execution
+	Artifacts         []string               // Paths or patterns of files collected from the client after execution
+	DeliveryTimeout   int                    // Seconds a command may wait for an offline client, 0 for the default
+	Interactive       bool                   // Can ask for input while running, see prompt.go
+	CheckCommand      string                 // Runs instead of the command in check mode, see consensus_check.go
+	DryRun            bool                   // The command itself supports check mode with INDISPENSO_DRY_RUN=1
+	RequireCheck      bool                   // Requests are only approved once a check passed on all clients
+	Version           int                    // Current version, see template_versions.go
+	Versions          []*TemplateVersion     // All versions, oldest first
+	PendingVersion    *TemplateVersion       // Change waiting for approval
+	Category          string                 // Group of templates in the console
+	OwnerTeam         string                 // Team that may edit and delete the template next to the admins, see teams.go
+	Teams             []string               // Teams that may see and request the template, everyone if empty
 	mux               sync.RWMutex
 }
 
@@ -64,7 +80,7 @@ func (s *Template) IsValid() (bool, error) {
 	server.templateStore.templateMux.RLock()
 	defer server.templateStore.templateMux.RUnlock()
 	for _, template := range server.templateStore.Templates {
-		if template.Title == s.Title {
+		if template.Title == s.Title && template.Id != s.Id {
 			return false, errors.New("Title is not unique")
 		}
 	}
@@ -75,6 +91,22 @@ func (s *Template) IsValid() (bool, error) {
 	if len(s.Command) < 1 {
 		return false, errors.New("Fill in a command")
 	}
+	if err := validateInterpreter(s.Interpreter); err != nil {
+		return false, err
+	}
+	if s.Environment != nil {
+		if err := s.Environment.IsValid(); err != nil {
+			return false, err
+		}
+	}
+	for _, a := range s.Artifacts {
+		if err := validateArtifactPath(a); err != nil {
+			return false, err
+		}
+	}
+	if s.RequireCheck && !s.HasCheck() {
+		return false, errors.New("Requiring a check needs a check command or dry run support")
+	}
 	return true, nil
 }
 
@@ -126,6 +158,10 @@ func (s *TemplateStore) load() {
 		}
 		s.Templates = v
 	}
+	for _, template := range s.Templates {
+		// Created before templates had versions
+		template.initVersion("")
+	}
 }
 
 // Execution strategy of the template
@@ -185,6 +221,8 @@ func newTemplate(title string, description string, command string, enabled bool,
 		Timeout:           timeout,
 		ExecutionStrategy: executionStrategy,
 		ValidationRules:   make([]*ExecutionValidation, 0),
+		Files:             make([]*TemplateFile, 0),
+		Artifacts:         make([]string, 0),
 	}
 
 	return t
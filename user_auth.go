@@ -13,6 +13,7 @@ type AuthRequest struct {
 	login      string
 	credential string
 	token      string
+	webauthn   string // Assertion of a security key, instead of the token
 }
 
 func (ar *AuthRequest) Validate() error {
@@ -30,6 +31,8 @@ type AuthService struct {
 	userStore        *UserStore
 	secondFactorAuth Authenticator
 	firstFactorAuth  []Authenticator
+	oidc             *OidcAuthenticator // Single sign-on, nil if not enabled
+	webauthn         *Webauthn          // Security keys, nil without a valid origin
 }
 
 func newAuthService(us *UserStore, ffAuth []Authenticator, sfAuth Authenticator) (as *AuthService) {
@@ -59,7 +62,10 @@ func (as *AuthService) authUser(ar *AuthRequest) (user *User, err error) {
 		return nil, fmt.Errorf("User not authenticated, last authenticator error: %s", err)
 	}
 
-	if as.secondFactorAuth != nil && user.HasTwoFactor() {
+	if as.webauthn != nil && len(ar.webauthn) > 0 && user.HasWebauthn() {
+		return as.webauthn.auth(user, ar)
+	}
+	if as.secondFactorAuth != nil && user.HasSecondFactor() {
 		return as.secondFactorAuth.auth(user, ar)
 	}
 
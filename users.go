@@ -28,6 +28,7 @@ const (
 	AUTH_TYPE_LOCAL AuthType = 1 << iota
 	AUTH_TYPE_LDAP
 	AUTH_TYPE_TWO_FACTOR
+	AUTH_TYPE_OIDC
 )
 
 // Users
@@ -50,6 +51,22 @@ func (s *UserStore) ByName(username string) *User {
 	return nil
 }
 
+// User linked to the OpenID Connect account
+func (s *UserStore) ByOidcSubject(issuer string, subject string) *User {
+	s.usersMux.Lock()
+	defer s.usersMux.Unlock()
+
+	for _, user := range s.Users {
+		user.mux.RLock()
+		linked := user.OidcIssuer == issuer && user.OidcSubject == subject
+		user.mux.RUnlock()
+		if linked {
+			return user
+		}
+	}
+	return nil
+}
+
 func (s *UserStore) ById(userId string) *User {
 	s.usersMux.Lock()
 	defer s.usersMux.Unlock()
@@ -179,9 +196,10 @@ func (s *UserStore) MigrateUsers(users []*User) {
 
 func (s *UserStore) AuthTypes() map[string]int {
 	return map[string]int{
-		"Local":      int(AUTH_TYPE_LOCAL),
-		"LDAP":       int(AUTH_TYPE_LDAP),
-		"Two factor": int(AUTH_TYPE_TWO_FACTOR),
+		"Local":          int(AUTH_TYPE_LOCAL),
+		"LDAP":           int(AUTH_TYPE_LDAP),
+		"Two factor":     int(AUTH_TYPE_TWO_FACTOR),
+		"OpenID Connect": int(AUTH_TYPE_OIDC),
 	}
 }
 
@@ -241,6 +259,14 @@ type User struct {
 	SessionIpAddress     string // Current session IP
 	SessionLastTimestamp time.Time
 	Roles                map[string]bool
+	Teams                []string              // Teams the user is a member of, see teams.go
+	LdapRoles            []string              // Roles granted by LDAP groups, see ldap_auth.go
+	LdapTeams            []string              // Teams granted by LDAP groups
+	OidcRoles            []string              // Roles granted by the roles claim of OpenID Connect, see oidc_auth.go
+	OidcTeams            []string              // Teams granted by the roles claim of OpenID Connect
+	OidcIssuer           string                // Identity provider of the linked OpenID Connect account
+	OidcSubject          string                // Subject of the linked OpenID Connect account at the issuer
+	WebauthnCredentials  []*WebauthnCredential // Security keys, see webauthn.go
 	mux                  sync.RWMutex
 }
 
@@ -251,6 +277,43 @@ func (u *User) HasTwoFactor() bool {
 	return u.IsAuthType(AUTH_TYPE_TWO_FACTOR) && u.LegacyHasTwoFactors()
 }
 
+// Registered security keys?
+func (u *User) HasWebauthn() bool {
+	u.mux.RLock()
+	defer u.mux.RUnlock()
+	return len(u.WebauthnCredentials) > 0
+}
+
+// TOTP or security keys?
+func (u *User) HasSecondFactor() bool {
+	return u.HasTwoFactor() || u.HasWebauthn()
+}
+
+// Security key by id, nil if the user did not register it
+func (u *User) WebauthnCredential(id string) *WebauthnCredential {
+	u.mux.RLock()
+	defer u.mux.RUnlock()
+	for _, c := range u.WebauthnCredentials {
+		if c.Id == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// Remove a security key, returns the removed key
+func (u *User) RemoveWebauthnCredential(id string) *WebauthnCredential {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	for i, c := range u.WebauthnCredentials {
+		if c.Id == id {
+			u.WebauthnCredentials = append(u.WebauthnCredentials[:i], u.WebauthnCredentials[i+1:]...)
+			return c
+		}
+	}
+	return nil
+}
+
 func (u *User) LegacyHasTwoFactors() bool {
 	return len(u.TotpSecret) > 0 && u.TotpSecretValidated == true
 }
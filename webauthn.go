@@ -0,0 +1,399 @@
+package main
+
+// WebAuthn security keys (FIDO2) as second factor, for login and for the step-up confirmation of requests and
+// approvals. Users register any number of keys. The ceremonies are verified by the go-webauthn library, attestation is
+// not requested, the key is trusted because the logged in user registered it with their other factor.
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const WEBAUTHN_CHALLENGE_TIMEOUT time.Duration = 2 * time.Minute // Time to touch the key
+const WEBAUTHN_RP_NAME string = "Indispenso"                     // Name of the relying party shown by browsers
+const WEBAUTHN_USER_CHALLENGES int = 5                           // Open challenges per user, a new one drops the oldest
+
+type WebauthnCredential struct {
+	Id       string              // Credential id, base64 URL encoded without padding
+	Name     string              // Given by the user
+	Key      webauthn.Credential // Public key, flags and signature counter as the library verifies them
+	Created  int64               // Unix TS
+	LastUsed int64               // Unix TS
+}
+
+type webauthnChallenge struct {
+	username string
+	create   bool // Registration, otherwise assertion
+	session  *webauthn.SessionData
+	created  time.Time
+}
+
+type Webauthn struct {
+	mux        sync.Mutex
+	lib        *webauthn.WebAuthn
+	userStore  *UserStore
+	challenges map[string]*webauthnChallenge // By challenge, only for users with keys or registering one
+}
+
+func newWebauthn(origin string, userStore *UserStore) (*Webauthn, error) {
+	u, err := url.Parse(strings.TrimSpace(origin))
+	if err != nil || len(u.Scheme) < 1 || len(u.Hostname()) < 1 {
+		return nil, fmt.Errorf("Invalid origin for security keys: %s", origin)
+	}
+	timeout := webauthn.TimeoutConfig{Enforce: true, Timeout: WEBAUTHN_CHALLENGE_TIMEOUT, TimeoutUVD: WEBAUTHN_CHALLENGE_TIMEOUT}
+	lib, err := webauthn.New(&webauthn.Config{
+		RPID:                   u.Hostname(),
+		RPDisplayName:          WEBAUTHN_RP_NAME,
+		RPOrigins:              []string{u.Scheme + "://" + u.Host},
+		AttestationPreference:  protocol.PreferNoAttestation,
+		AuthenticatorSelection: protocol.AuthenticatorSelection{UserVerification: protocol.VerificationDiscouraged},
+		Timeouts:               webauthn.TimeoutsConfig{Login: timeout, Registration: timeout},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Invalid configuration for security keys: %s", err)
+	}
+	return &Webauthn{
+		lib:        lib,
+		userStore:  userStore,
+		challenges: make(map[string]*webauthnChallenge),
+	}, nil
+}
+
+// The user as the library sees it, the id is the user id
+func (u *User) WebAuthnID() []byte {
+	return []byte(u.Id)
+}
+
+func (u *User) WebAuthnName() string {
+	return u.Username
+}
+
+func (u *User) WebAuthnDisplayName() string {
+	return u.Username
+}
+
+func (u *User) WebAuthnCredentials() []webauthn.Credential {
+	u.mux.RLock()
+	defer u.mux.RUnlock()
+	list := make([]webauthn.Credential, 0, len(u.WebauthnCredentials))
+	for _, c := range u.WebauthnCredentials {
+		list = append(list, c.Key)
+	}
+	return list
+}
+
+// Keep the session of a challenge until the key answers it. Users have a few open challenges at most, so asking for
+// challenges does not fill the memory of the server.
+func (w *Webauthn) keep(username string, create bool, session *webauthn.SessionData) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	var oldest string
+	open := 0
+	for k, v := range w.challenges {
+		if time.Since(v.created) > WEBAUTHN_CHALLENGE_TIMEOUT {
+			delete(w.challenges, k)
+			continue
+		}
+		if v.username != username {
+			continue
+		}
+		open++
+		if len(oldest) < 1 || v.created.Before(w.challenges[oldest].created) {
+			oldest = k
+		}
+	}
+	if open >= WEBAUTHN_USER_CHALLENGES {
+		delete(w.challenges, oldest)
+	}
+	w.challenges[session.Challenge] = &webauthnChallenge{username: username, create: create, session: session, created: time.Now()}
+}
+
+// Session of a challenge of the user, used up
+func (w *Webauthn) take(challenge string, username string, create bool) (*webauthn.SessionData, error) {
+	w.mux.Lock()
+	c := w.challenges[challenge]
+	delete(w.challenges, challenge)
+	w.mux.Unlock()
+	if c == nil || time.Since(c.created) > WEBAUTHN_CHALLENGE_TIMEOUT || c.username != username || c.create != create {
+		return nil, errors.New("Unknown or expired security key challenge")
+	}
+	return c.session, nil
+}
+
+// Options for navigator.credentials.create
+func (w *Webauthn) registrationOptions(user *User) (*protocol.PublicKeyCredentialCreationOptions, error) {
+	creation, session, err := w.lib.BeginRegistration(user, webauthn.WithExclusions(webauthn.Credentials(user.WebAuthnCredentials()).CredentialDescriptors()))
+	if err != nil {
+		return nil, err
+	}
+	w.keep(user.Username, true, session)
+	return &creation.Response, nil
+}
+
+// Options for navigator.credentials.get. Unknown users and users without keys get a challenge that is not kept, it
+// looks the same but no key can answer it.
+func (w *Webauthn) assertionOptions(user *User) (*protocol.PublicKeyCredentialRequestOptions, error) {
+	if user == nil || !user.HasWebauthn() {
+		assertion, _, err := w.lib.BeginDiscoverableLogin()
+		if err != nil {
+			return nil, err
+		}
+		return &assertion.Response, nil
+	}
+	assertion, session, err := w.lib.BeginLogin(user)
+	if err != nil {
+		return nil, err
+	}
+	w.keep(user.Username, false, session)
+	return &assertion.Response, nil
+}
+
+// Add the key of a navigator.credentials.create response, the credential as JSON, to the user
+func (w *Webauthn) register(user *User, name string, credential []byte) (*WebauthnCredential, error) {
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(credential)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid security key response: %s", err)
+	}
+	session, err := w.take(parsed.Response.CollectedClientData.Challenge, user.Username, true)
+	if err != nil {
+		return nil, err
+	}
+	key, err := w.lib.CreateCredential(user, *session, parsed)
+	if err != nil {
+		return nil, fmt.Errorf("Security key not accepted: %s", err)
+	}
+
+	cred := &WebauthnCredential{
+		Id:      base64.RawURLEncoding.EncodeToString(key.ID),
+		Name:    strings.TrimSpace(name),
+		Key:     *key,
+		Created: time.Now().Unix(),
+	}
+	if len(cred.Name) < 1 {
+		cred.Name = "Security key"
+	}
+	user.mux.Lock()
+	defer user.mux.Unlock()
+	for _, c := range user.WebauthnCredentials {
+		if c.Id == cred.Id {
+			return nil, errors.New("Security key already registered")
+		}
+	}
+	user.WebauthnCredentials = append(user.WebauthnCredentials, cred)
+	return cred, nil
+}
+
+// Verify the assertion of one of the keys of the user, the signature counter of the key is updated
+func (w *Webauthn) verifyAssertion(user *User, assertion string) error {
+	parsed, err := protocol.ParseCredentialRequestResponseBytes([]byte(assertion))
+	if err != nil {
+		return fmt.Errorf("Invalid security key assertion: %s", err)
+	}
+	cred := user.WebauthnCredential(base64.RawURLEncoding.EncodeToString(parsed.RawID))
+	if cred == nil {
+		return errors.New("Unknown security key")
+	}
+	session, err := w.take(parsed.Response.CollectedClientData.Challenge, user.Username, false)
+	if err != nil {
+		return err
+	}
+	key, err := w.lib.ValidateLogin(user, *session, parsed)
+	if err != nil {
+		return fmt.Errorf("Security key not accepted: %s", err)
+	}
+	if key.Authenticator.CloneWarning {
+		return errors.New("Signature counter of the security key did not increase, the key may be cloned")
+	}
+
+	user.mux.Lock()
+	defer user.mux.Unlock()
+	cred.Key = *key
+	cred.LastUsed = time.Now().Unix()
+	return nil
+}
+
+// Second factor with a security key
+func (w *Webauthn) auth(user *User, ar *AuthRequest) (*User, error) {
+	if user == nil {
+		return nil, errors.New("User not found")
+	}
+	if err := w.verifyAssertion(user, ar.webauthn); err != nil {
+		return nil, err
+	}
+	w.userStore.save()
+	return user, nil
+}
+
+// Second factor for step-up confirmations: an assertion of a security key or a TOTP token
+func verifySecondFactor(w *Webauthn, user *User, totp string, assertion string) bool {
+	if len(assertion) > 0 {
+		if w == nil {
+			return false
+		}
+		if err := w.verifyAssertion(user, assertion); err != nil {
+			log.Printf("Security key of %s not accepted: %s", user.Username, err)
+			return false
+		}
+		w.userStore.save()
+		return true
+	}
+	res, _ := user.ValidateTotp(totp)
+	return res
+}
+
+// Second factor of the form, fields totp or webauthn
+func validSecondFactor(user *User, r *http.Request) bool {
+	return verifySecondFactor(server.authService.webauthn, user, r.PostFormValue("totp"), r.PostFormValue("webauthn"))
+}
+
+// Challenge to log in with a security key
+func GetAuthWebauthn(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	wa := server.authService.webauthn
+	if wa == nil {
+		jr.Error("Security keys are not available")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	options, err := wa.assertionOptions(server.userStore.ByName(strings.TrimSpace(r.URL.Query().Get("username"))))
+	if err != nil {
+		jr.Error(err.Error())
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	jr.Set("options", options)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Security keys of the user and a challenge for step-up confirmations
+func GetUserWebauthn(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("User not authorized for GetUserWebauthn")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	wa := server.authService.webauthn
+	if wa == nil {
+		jr.Error("Security keys are not available")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	user := getUser(r)
+	keys := make([]map[string]interface{}, 0)
+	user.mux.RLock()
+	for _, c := range user.WebauthnCredentials {
+		keys = append(keys, map[string]interface{}{"Id": c.Id, "Name": c.Name, "Created": c.Created, "LastUsed": c.LastUsed})
+	}
+	user.mux.RUnlock()
+	options, err := wa.assertionOptions(user)
+	if err != nil {
+		jr.Error(err.Error())
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	jr.Set("keys", keys)
+	jr.Set("options", options)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Options to register a security key
+func GetUserWebauthnRegister(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("User not authorized for GetUserWebauthnRegister")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	wa := server.authService.webauthn
+	if wa == nil {
+		jr.Error("Security keys are not available")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	options, err := wa.registrationOptions(getUser(r))
+	if err != nil {
+		jr.Error(err.Error())
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	jr.Set("options", options)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Register a security key, users with a second factor confirm with it
+func PostUserWebauthnRegister(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("User not authorized for PostUserWebauthnRegister")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	wa := server.authService.webauthn
+	if wa == nil {
+		jr.Error("Security keys are not available")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	user := getUser(r)
+	if user.HasSecondFactor() && !validSecondFactor(user, r) {
+		jr.Error("Invalid two factor token")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	cred, err := wa.register(user, r.PostFormValue("name"), []byte(r.PostFormValue("credential")))
+	if err != nil {
+		jr.Error(err.Error())
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	server.userStore.save()
+	audit.Log(user, "Security key", fmt.Sprintf("Registered %s", cred.Name))
+
+	jr.Set("id", cred.Id)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
+
+// Remove a security key, confirmed with a second factor
+func DeleteUserWebauthn(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jr := jresp.NewJsonResp()
+	if !authUser(r) {
+		jr.Error("User not authorized for DeleteUserWebauthn")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	user := getUser(r)
+	q := r.URL.Query()
+	if !verifySecondFactor(server.authService.webauthn, user, q.Get("totp"), q.Get("webauthn")) {
+		jr.Error("Invalid two factor token")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+
+	cred := user.RemoveWebauthnCredential(ps.ByName("id"))
+	if cred == nil {
+		jr.Error("Security key not found")
+		fmt.Fprint(w, jr.ToString(conf.Debug))
+		return
+	}
+	server.userStore.save()
+	audit.Log(user, "Security key", fmt.Sprintf("Removed %s", cred.Name))
+
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(conf.Debug))
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// CBOR of the types attestation objects and COSE keys use, map keys in the given order
+func cborEncode(v interface{}) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 1<<8:
+			return []byte{major<<5 | 24, byte(n)}
+		case n < 1<<16:
+			b := []byte{major<<5 | 25, 0, 0}
+			binary.BigEndian.PutUint16(b[1:], uint16(n))
+			return b
+		default:
+			b := []byte{major<<5 | 26, 0, 0, 0, 0}
+			binary.BigEndian.PutUint32(b[1:], uint32(n))
+			return b
+		}
+	}
+	switch t := v.(type) {
+	case int:
+		if t < 0 {
+			return head(1, uint64(-1-t))
+		}
+		return head(0, uint64(t))
+	case []byte:
+		return append(head(2, uint64(len(t))), t...)
+	case string:
+		return append(head(3, uint64(len(t))), t...)
+	case [][2]interface{}:
+		b := head(5, uint64(len(t)))
+		for _, kv := range t {
+			b = append(b, cborEncode(kv[0])...)
+			b = append(b, cborEncode(kv[1])...)
+		}
+		return b
+	}
+	panic("unsupported")
+}
+
+// Security key in software
+type testSecurityKey struct {
+	id        []byte
+	key       *ecdsa.PrivateKey
+	signCount uint32
+}
+
+func newTestSecurityKey(t *testing.T) *testSecurityKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &testSecurityKey{id: id, key: key}
+}
+
+// Flags of the authenticator data: user present and attested credential data
+const testFlagUserPresent byte = 0x01
+const testFlagAttested byte = 0x40
+
+func (k *testSecurityKey) authData(rpId string, flags byte, attested []byte) []byte {
+	hash := sha256.Sum256([]byte(rpId))
+	b := append(hash[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[33:], k.signCount)
+	return append(b, attested...)
+}
+
+func clientData(typ string, challenge string, origin string) []byte {
+	b, _ := json.Marshal(map[string]string{"type": typ, "challenge": challenge, "origin": origin})
+	return b
+}
+
+// Credential as the console posts it
+func (k *testSecurityKey) credential(response map[string]string) []byte {
+	id := base64.RawURLEncoding.EncodeToString(k.id)
+	b, _ := json.Marshal(map[string]interface{}{"id": id, "rawId": id, "type": "public-key", "response": response})
+	return b
+}
+
+// Response of navigator.credentials.create
+func (k *testSecurityKey) create(rpId string, challenge string, origin string) []byte {
+	x := k.key.PublicKey.X.Bytes()
+	y := k.key.PublicKey.Y.Bytes()
+	x = append(make([]byte, 32-len(x)), x...)
+	y = append(make([]byte, 32-len(y)), y...)
+	coseKey := cborEncode([][2]interface{}{{1, 2}, {3, -7}, {-1, 1}, {-2, x}, {-3, y}})
+
+	attested := make([]byte, 18)
+	binary.BigEndian.PutUint16(attested[16:], uint16(len(k.id)))
+	attested = append(append(attested, k.id...), coseKey...)
+	attestationObject := cborEncode([][2]interface{}{
+		{"fmt", "none"},
+		{"attStmt", [][2]interface{}{}},
+		{"authData", k.authData(rpId, testFlagUserPresent|testFlagAttested, attested)},
+	})
+	return k.credential(map[string]string{
+		"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData("webauthn.create", challenge, origin)),
+		"attestationObject": base64.RawURLEncoding.EncodeToString(attestationObject),
+	})
+}
+
+// Response of navigator.credentials.get
+func (k *testSecurityKey) get(rpId string, challenge string, origin string) string {
+	k.signCount++
+	cd := clientData("webauthn.get", challenge, origin)
+	authData := k.authData(rpId, testFlagUserPresent, nil)
+	hash := sha256.Sum256(cd)
+	signed := sha256.Sum256(append(append([]byte{}, authData...), hash[:]...))
+	signature, _ := ecdsa.SignASN1(rand.Reader, k.key, signed[:])
+	return string(k.credential(map[string]string{
+		"clientDataJSON":    base64.RawURLEncoding.EncodeToString(cd),
+		"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+		"signature":         base64.RawURLEncoding.EncodeToString(signature),
+	}))
+}
+
+const testWebauthnOrigin = "https://indispenso.example.com:897"
+
+func newTestWebauthn(t *testing.T) (*Webauthn, *UserStore, *User) {
+	userStore := &UserStore{}
+	userStore.CreateUser("test", "test", "test@test.pl", []string{})
+	w, err := newWebauthn(testWebauthnOrigin+"/", userStore)
+	assert.NoError(t, err)
+	return w, userStore, userStore.ByName("test")
+}
+
+func registrationChallenge(t *testing.T, w *Webauthn, user *User) string {
+	options, err := w.registrationOptions(user)
+	assert.NoError(t, err)
+	return options.Challenge.String()
+}
+
+func assertionChallenge(t *testing.T, w *Webauthn, user *User) string {
+	options, err := w.assertionOptions(user)
+	assert.NoError(t, err)
+	return options.Challenge.String()
+}
+
+func registerTestSecurityKey(t *testing.T, w *Webauthn, user *User, name string) *testSecurityKey {
+	k := newTestSecurityKey(t)
+	cred, err := w.register(user, name, k.create("indispenso.example.com", registrationChallenge(t, w, user), testWebauthnOrigin))
+	assert.NoError(t, err)
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(k.id), cred.Id)
+	return k
+}
+
+func TestWebauthnRegister(t *testing.T) {
+	w, _, user := newTestWebauthn(t)
+	assert.Equal(t, "indispenso.example.com", w.lib.Config.RPID)
+	assert.Equal(t, []string{testWebauthnOrigin}, w.lib.Config.RPOrigins)
+
+	// Multiple keys
+	registerTestSecurityKey(t, w, user, "Yubikey")
+	registerTestSecurityKey(t, w, user, "")
+	assert.True(t, user.HasWebauthn())
+	assert.True(t, user.HasSecondFactor())
+	assert.Len(t, user.WebauthnCredentials, 2)
+	assert.Equal(t, "Yubikey", user.WebauthnCredentials[0].Name)
+	assert.Equal(t, "Security key", user.WebauthnCredentials[1].Name)
+	options, err := w.registrationOptions(user)
+	assert.NoError(t, err)
+	assert.Len(t, options.CredentialExcludeList, 2)
+
+	k := newTestSecurityKey(t)
+	challenge := registrationChallenge(t, w, user)
+
+	// Other origin or relying party, the challenge is used up either way
+	_, err = w.register(user, "", k.create("indispenso.example.com", challenge, "https://evil.example.com"))
+	assert.Error(t, err)
+	challenge = registrationChallenge(t, w, user)
+	_, err = w.register(user, "", k.create("evil.example.com", challenge, testWebauthnOrigin))
+	assert.Error(t, err)
+
+	// The challenge is used once, by the user it was made for, for the ceremony it was made for
+	_, err = w.register(user, "", k.create("indispenso.example.com", challenge, testWebauthnOrigin))
+	assert.EqualError(t, err, "Unknown or expired security key challenge")
+	other := newUser()
+	other.Username = "other"
+	_, err = w.register(user, "", k.create("indispenso.example.com", registrationChallenge(t, w, other), testWebauthnOrigin))
+	assert.EqualError(t, err, "Unknown or expired security key challenge")
+	_, err = w.register(user, "", k.create("indispenso.example.com", assertionChallenge(t, w, user), testWebauthnOrigin))
+	assert.EqualError(t, err, "Unknown or expired security key challenge")
+	_, err = w.register(user, "", []byte("{"))
+	assert.Error(t, err)
+
+	// Same key twice
+	_, err = w.register(user, "", k.create("indispenso.example.com", registrationChallenge(t, w, user), testWebauthnOrigin))
+	assert.NoError(t, err)
+	_, err = w.register(user, "", k.create("indispenso.example.com", registrationChallenge(t, w, user), testWebauthnOrigin))
+	assert.EqualError(t, err, "Security key already registered")
+
+	// Removal
+	assert.NotNil(t, user.RemoveWebauthnCredential(base64.RawURLEncoding.EncodeToString(k.id)))
+	assert.Nil(t, user.RemoveWebauthnCredential(base64.RawURLEncoding.EncodeToString(k.id)))
+	assert.Len(t, user.WebauthnCredentials, 2)
+
+	_, err = newWebauthn("", nil)
+	assert.Error(t, err)
+}
+
+func TestWebauthnAssertion(t *testing.T) {
+	w, _, user := newTestWebauthn(t)
+	k1 := registerTestSecurityKey(t, w, user, "Yubikey")
+	k2 := registerTestSecurityKey(t, w, user, "Backup")
+	challenge := func() string {
+		return assertionChallenge(t, w, user)
+	}
+
+	// Either key
+	assert.NoError(t, w.verifyAssertion(user, k1.get("indispenso.example.com", challenge(), testWebauthnOrigin)))
+	assert.NoError(t, w.verifyAssertion(user, k2.get("indispenso.example.com", challenge(), testWebauthnOrigin)))
+	assert.Equal(t, uint32(1), user.WebauthnCredentials[0].Key.Authenticator.SignCount)
+	assert.True(t, user.WebauthnCredentials[0].LastUsed > 0)
+
+	// Replayed assertion
+	c := challenge()
+	assertion := k1.get("indispenso.example.com", c, testWebauthnOrigin)
+	assert.NoError(t, w.verifyAssertion(user, assertion))
+	assert.EqualError(t, w.verifyAssertion(user, assertion), "Unknown or expired security key challenge")
+
+	// Cloned key with a lower counter
+	k1.signCount = 1
+	assert.EqualError(t, w.verifyAssertion(user, k1.get("indispenso.example.com", challenge(), testWebauthnOrigin)), "Signature counter of the security key did not increase, the key may be cloned")
+	k1.signCount = 10
+
+	// Signature of another key
+	var a map[string]interface{}
+	json.Unmarshal([]byte(k2.get("indispenso.example.com", challenge(), testWebauthnOrigin)), &a)
+	a["id"] = base64.RawURLEncoding.EncodeToString(k1.id)
+	a["rawId"] = a["id"]
+	b, _ := json.Marshal(a)
+	assert.Error(t, w.verifyAssertion(user, string(b)))
+
+	// Unknown key, other user, other origin, not a challenge for login
+	assert.EqualError(t, w.verifyAssertion(user, newTestSecurityKey(t).get("indispenso.example.com", challenge(), testWebauthnOrigin)), "Unknown security key")
+	assert.Error(t, w.verifyAssertion(user, k1.get("indispenso.example.com", challenge(), "https://evil.example.com")))
+	assert.EqualError(t, w.verifyAssertion(user, k1.get("indispenso.example.com", registrationChallenge(t, w, user), testWebauthnOrigin)), "Unknown or expired security key challenge")
+	assert.Error(t, w.verifyAssertion(user, "{"))
+
+	// Unknown users get a challenge without keys that no key can answer
+	options, err := w.assertionOptions(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, options.AllowedCredentials)
+	assert.EqualError(t, w.verifyAssertion(user, k1.get("indispenso.example.com", options.Challenge.String(), testWebauthnOrigin)), "Unknown or expired security key challenge")
+	options, err = w.assertionOptions(user)
+	assert.NoError(t, err)
+	assert.Len(t, options.AllowedCredentials, 2)
+}
+
+func TestWebauthnChallengeLimit(t *testing.T) {
+	w, _, user := newTestWebauthn(t)
+	k := registerTestSecurityKey(t, w, user, "Yubikey")
+
+	// Challenges for unknown users are not kept, users have a few at most
+	for i := 0; i < 100; i++ {
+		w.assertionOptions(nil)
+	}
+	assert.Len(t, w.challenges, 0)
+	first := assertionChallenge(t, w, user)
+	for i := 0; i < 2*WEBAUTHN_USER_CHALLENGES; i++ {
+		assertionChallenge(t, w, user)
+	}
+	assert.Len(t, w.challenges, WEBAUTHN_USER_CHALLENGES)
+
+	// The oldest ones were dropped, the newest work
+	assert.EqualError(t, w.verifyAssertion(user, k.get("indispenso.example.com", first, testWebauthnOrigin)), "Unknown or expired security key challenge")
+	assert.NoError(t, w.verifyAssertion(user, k.get("indispenso.example.com", assertionChallenge(t, w, user), testWebauthnOrigin)))
+}
+
+func TestWebauthnLogin(t *testing.T) {
+	w, userStore, user := newTestWebauthn(t)
+	k := registerTestSecurityKey(t, w, user, "Yubikey")
+	as := newAuthService(userStore, DefaultFirstFactorAuth, newGAuthAuthenticator())
+	as.webauthn = w
+
+	// Key instead of a token
+	_, err := as.authUser(&AuthRequest{login: "test", credential: "test"})
+	assert.Error(t, err)
+	res, err := as.authUser(&AuthRequest{login: "test", credential: "test", webauthn: k.get("indispenso.example.com", assertionChallenge(t, w, user), testWebauthnOrigin)})
+	assert.NoError(t, err)
+	assert.Equal(t, user, res)
+
+	// The password is still required
+	_, err = as.authUser(&AuthRequest{login: "test", credential: "wrong", webauthn: k.get("indispenso.example.com", assertionChallenge(t, w, user), testWebauthnOrigin)})
+	assert.Error(t, err)
+
+	// Step-up confirmation with the key or the token
+	assert.True(t, verifySecondFactor(w, user, "", k.get("indispenso.example.com", assertionChallenge(t, w, user), testWebauthnOrigin)))
+	assert.False(t, verifySecondFactor(w, user, "", k.get("indispenso.example.com", "guess", testWebauthnOrigin)))
+	assert.False(t, verifySecondFactor(nil, user, "", k.get("indispenso.example.com", "guess", testWebauthnOrigin)))
+	assert.False(t, verifySecondFactor(w, user, "123456", ""))
+}